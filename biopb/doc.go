@@ -0,0 +1,13 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package biopb defines the protocol buffers stored in PAM and sortshard
+// files.
+//
+// The *.pb.go files are generated by protoc-gen-gogo from the .proto files in
+// proto/bio. To regenerate them, run from the root of the repository, with the
+// repository and github.com/gogo/protobuf under $GOPATH/src:
+//
+//	protoc -I. -I$GOPATH/src --gogo_out=$GOPATH/src proto/bio/*.proto
+package biopb
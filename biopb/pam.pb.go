@@ -32,7 +32,7 @@ func (m *PAMBlockHeader) Reset()         { *m = PAMBlockHeader{} }
 func (m *PAMBlockHeader) String() string { return proto.CompactTextString(m) }
 func (*PAMBlockHeader) ProtoMessage()    {}
 func (*PAMBlockHeader) Descriptor() ([]byte, []int) {
-	return fileDescriptor_pam_41ccb9a3d2807762, []int{0}
+	return fileDescriptor_pam_3ce5b7b36b795e71, []int{0}
 }
 func (m *PAMBlockHeader) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -86,7 +86,7 @@ func (m *PAMBlockIndexEntry) Reset()         { *m = PAMBlockIndexEntry{} }
 func (m *PAMBlockIndexEntry) String() string { return proto.CompactTextString(m) }
 func (*PAMBlockIndexEntry) ProtoMessage()    {}
 func (*PAMBlockIndexEntry) Descriptor() ([]byte, []int) {
-	return fileDescriptor_pam_41ccb9a3d2807762, []int{1}
+	return fileDescriptor_pam_3ce5b7b36b795e71, []int{1}
 }
 func (m *PAMBlockIndexEntry) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -144,17 +144,20 @@ func (m *PAMBlockIndexEntry) GetEndAddr() Coord {
 }
 
 type PAMShardIndex struct {
-	Magic            uint64     `protobuf:"fixed64,1,opt,name=magic,proto3" json:"magic,omitempty"`
-	Version          string     `protobuf:"bytes,3,opt,name=version,proto3" json:"version,omitempty"`
-	Range            CoordRange `protobuf:"bytes,4,opt,name=range,proto3" json:"range"`
-	EncodedBamHeader []byte     `protobuf:"bytes,15,opt,name=encoded_bam_header,json=encodedBamHeader,proto3" json:"encoded_bam_header,omitempty"`
+	Magic              uint64     `protobuf:"fixed64,1,opt,name=magic,proto3" json:"magic,omitempty"`
+	Version            string     `protobuf:"bytes,3,opt,name=version,proto3" json:"version,omitempty"`
+	Range              CoordRange `protobuf:"bytes,4,opt,name=range,proto3" json:"range"`
+	AuxTags            []string   `protobuf:"bytes,5,rep,name=aux_tags,json=auxTags,proto3" json:"aux_tags,omitempty"`
+	QualBins           []byte     `protobuf:"bytes,6,opt,name=qual_bins,json=qualBins,proto3" json:"qual_bins,omitempty"`
+	ReferenceChecksums []string   `protobuf:"bytes,7,rep,name=reference_checksums,json=referenceChecksums,proto3" json:"reference_checksums,omitempty"`
+	EncodedBamHeader   []byte     `protobuf:"bytes,15,opt,name=encoded_bam_header,json=encodedBamHeader,proto3" json:"encoded_bam_header,omitempty"`
 }
 
 func (m *PAMShardIndex) Reset()         { *m = PAMShardIndex{} }
 func (m *PAMShardIndex) String() string { return proto.CompactTextString(m) }
 func (*PAMShardIndex) ProtoMessage()    {}
 func (*PAMShardIndex) Descriptor() ([]byte, []int) {
-	return fileDescriptor_pam_41ccb9a3d2807762, []int{2}
+	return fileDescriptor_pam_3ce5b7b36b795e71, []int{2}
 }
 func (m *PAMShardIndex) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -204,6 +207,27 @@ func (m *PAMShardIndex) GetRange() CoordRange {
 	return CoordRange{}
 }
 
+func (m *PAMShardIndex) GetAuxTags() []string {
+	if m != nil {
+		return m.AuxTags
+	}
+	return nil
+}
+
+func (m *PAMShardIndex) GetQualBins() []byte {
+	if m != nil {
+		return m.QualBins
+	}
+	return nil
+}
+
+func (m *PAMShardIndex) GetReferenceChecksums() []string {
+	if m != nil {
+		return m.ReferenceChecksums
+	}
+	return nil
+}
+
 func (m *PAMShardIndex) GetEncodedBamHeader() []byte {
 	if m != nil {
 		return m.EncodedBamHeader
@@ -222,7 +246,7 @@ func (m *PAMFieldIndex) Reset()         { *m = PAMFieldIndex{} }
 func (m *PAMFieldIndex) String() string { return proto.CompactTextString(m) }
 func (*PAMFieldIndex) ProtoMessage()    {}
 func (*PAMFieldIndex) Descriptor() ([]byte, []int) {
-	return fileDescriptor_pam_41ccb9a3d2807762, []int{3}
+	return fileDescriptor_pam_3ce5b7b36b795e71, []int{3}
 }
 func (m *PAMFieldIndex) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -392,6 +416,42 @@ func (m *PAMShardIndex) MarshalTo(dAtA []byte) (int, error) {
 		return 0, err
 	}
 	i += n3
+	if len(m.AuxTags) > 0 {
+		for _, s := range m.AuxTags {
+			dAtA[i] = 0x2a
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				dAtA[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			dAtA[i] = uint8(l)
+			i++
+			i += copy(dAtA[i:], s)
+		}
+	}
+	if len(m.QualBins) > 0 {
+		dAtA[i] = 0x32
+		i++
+		i = encodeVarintPam(dAtA, i, uint64(len(m.QualBins)))
+		i += copy(dAtA[i:], m.QualBins)
+	}
+	if len(m.ReferenceChecksums) > 0 {
+		for _, s := range m.ReferenceChecksums {
+			dAtA[i] = 0x3a
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				dAtA[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			dAtA[i] = uint8(l)
+			i++
+			i += copy(dAtA[i:], s)
+		}
+	}
 	if len(m.EncodedBamHeader) > 0 {
 		dAtA[i] = 0x7a
 		i++
@@ -508,6 +568,22 @@ func (m *PAMShardIndex) Size() (n int) {
 	}
 	l = m.Range.Size()
 	n += 1 + l + sovPam(uint64(l))
+	if len(m.AuxTags) > 0 {
+		for _, s := range m.AuxTags {
+			l = len(s)
+			n += 1 + l + sovPam(uint64(l))
+		}
+	}
+	l = len(m.QualBins)
+	if l > 0 {
+		n += 1 + l + sovPam(uint64(l))
+	}
+	if len(m.ReferenceChecksums) > 0 {
+		for _, s := range m.ReferenceChecksums {
+			l = len(s)
+			n += 1 + l + sovPam(uint64(l))
+		}
+	}
 	l = len(m.EncodedBamHeader)
 	if l > 0 {
 		n += 1 + l + sovPam(uint64(l))
@@ -887,6 +963,95 @@ func (m *PAMShardIndex) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field AuxTags", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPam
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.AuxTags = append(m.AuxTags, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field QualBins", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPam
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.QualBins = append(m.QualBins[:0], dAtA[iNdEx:postIndex]...)
+			if m.QualBins == nil {
+				m.QualBins = []byte{}
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ReferenceChecksums", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPam
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ReferenceChecksums = append(m.ReferenceChecksums, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
 		case 15:
 			if wireType != 2 {
 				return fmt.Errorf("proto: wrong wireType = %d for field EncodedBamHeader", wireType)
@@ -1183,37 +1348,40 @@ var (
 	ErrIntOverflowPam   = fmt.Errorf("proto: integer overflow")
 )
 
-func init() { proto.RegisterFile("proto/bio/pam.proto", fileDescriptor_pam_41ccb9a3d2807762) }
+func init() { proto.RegisterFile("proto/bio/pam.proto", fileDescriptor_pam_3ce5b7b36b795e71) }
 
-var fileDescriptor_pam_41ccb9a3d2807762 = []byte{
-	// 450 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x52, 0x4d, 0x6f, 0xd3, 0x40,
-	0x10, 0xcd, 0xd2, 0x38, 0xa5, 0x13, 0x4a, 0xab, 0xa5, 0x54, 0x56, 0x11, 0xae, 0x15, 0x2e, 0x3e,
-	0x80, 0x23, 0x95, 0x43, 0x0e, 0x9c, 0x12, 0x04, 0xa2, 0x87, 0xaa, 0xd5, 0x72, 0xe3, 0x62, 0xed,
-	0x7a, 0xd7, 0x8e, 0x85, 0xbd, 0x1b, 0xad, 0x1d, 0x04, 0xff, 0x82, 0x23, 0xbf, 0x80, 0xdf, 0xd2,
-	0x03, 0x87, 0x1e, 0x39, 0x21, 0x94, 0xfc, 0x11, 0xb4, 0x1f, 0x01, 0x44, 0x38, 0x20, 0x0e, 0x91,
-	0xf2, 0xde, 0xcc, 0x7b, 0xf3, 0xc6, 0xb3, 0x70, 0x6f, 0xa1, 0x55, 0xa7, 0xc6, 0xac, 0x52, 0xe3,
-	0x05, 0x6d, 0x52, 0x8b, 0xf0, 0x41, 0xa9, 0x69, 0x55, 0x3b, 0x90, 0xb2, 0x4a, 0x9d, 0x3c, 0x29,
-	0xab, 0x6e, 0xbe, 0x64, 0x69, 0xae, 0x9a, 0x71, 0xa9, 0x4a, 0x35, 0xb6, 0x25, 0xb6, 0x2c, 0x2c,
-	0x72, 0x16, 0xe6, 0x9f, 0x93, 0x9c, 0xdc, 0xff, 0x65, 0x9a, 0x2b, 0xa5, 0xb9, 0xa3, 0x47, 0xe7,
-	0x70, 0xf7, 0x6a, 0x7a, 0x31, 0xab, 0x55, 0xfe, 0xf6, 0x95, 0xa0, 0x5c, 0x68, 0x7c, 0x0c, 0x03,
-	0x55, 0x14, 0xad, 0xe8, 0xc2, 0x5b, 0x31, 0x4a, 0xf6, 0x89, 0x47, 0xf8, 0x14, 0x86, 0xac, 0x56,
-	0x2c, 0xf3, 0xc5, 0x1d, 0x5b, 0x04, 0x43, 0x5d, 0x5a, 0x66, 0xf4, 0x05, 0x01, 0xde, 0x78, 0x9d,
-	0x4b, 0x2e, 0xde, 0xbf, 0x90, 0x9d, 0xfe, 0x60, 0x74, 0x45, 0x55, 0x8b, 0x8d, 0x0e, 0xc5, 0x28,
-	0xe9, 0x13, 0x30, 0xd4, 0xe5, 0x4f, 0x63, 0xb9, 0x6c, 0x32, 0x2d, 0x72, 0xa5, 0x79, 0xbb, 0x31,
-	0x96, 0xcb, 0x86, 0x38, 0x06, 0x3f, 0x03, 0x68, 0x3b, 0xaa, 0xbb, 0x8c, 0x72, 0xae, 0xc3, 0x7e,
-	0x8c, 0x92, 0xe1, 0xd9, 0x71, 0xfa, 0xc7, 0xf7, 0x48, 0x9f, 0x9b, 0xad, 0x66, 0xfd, 0xeb, 0x6f,
-	0xa7, 0x3d, 0xb2, 0x67, 0xfb, 0xa7, 0x9c, 0x6b, 0x3c, 0x81, 0xdb, 0x42, 0x72, 0x27, 0x0d, 0xfe,
-	0x41, 0xba, 0x2b, 0x24, 0x37, 0xc2, 0xd1, 0x67, 0x04, 0xfb, 0x57, 0xd3, 0x8b, 0xd7, 0x73, 0xaa,
-	0xb9, 0x5d, 0x07, 0x1f, 0x41, 0xd0, 0xd0, 0xb2, 0xca, 0xed, 0x0e, 0x03, 0xe2, 0x00, 0x0e, 0x61,
-	0xf7, 0x9d, 0xd0, 0x6d, 0xa5, 0xa4, 0x8d, 0xbe, 0x47, 0x36, 0x10, 0x4f, 0x20, 0xd0, 0x54, 0x96,
-	0xc2, 0x47, 0x7e, 0xf0, 0xf7, 0xb9, 0xc4, 0xb4, 0xf8, 0xe1, 0xae, 0x1f, 0x3f, 0x06, 0x2c, 0x64,
-	0xae, 0xb8, 0xe0, 0x19, 0xa3, 0x4d, 0x36, 0xb7, 0x87, 0x09, 0x0f, 0x62, 0x94, 0xdc, 0x21, 0x87,
-	0xbe, 0x32, 0xa3, 0x8d, 0x3b, 0xd8, 0xe8, 0x93, 0x0b, 0xfa, 0xb2, 0x12, 0xf5, 0x7f, 0x06, 0x3d,
-	0x82, 0xa0, 0x30, 0x6a, 0x1b, 0x34, 0x20, 0x0e, 0xe0, 0x29, 0x0c, 0x98, 0xb9, 0x65, 0x1b, 0x1e,
-	0xc6, 0x3b, 0xc9, 0xf0, 0xec, 0xd1, 0x56, 0xfe, 0xed, 0x6b, 0xfb, 0x3d, 0xbc, 0x70, 0x36, 0xb9,
-	0x5e, 0x45, 0xe8, 0x66, 0x15, 0xa1, 0xef, 0xab, 0x08, 0x7d, 0x5c, 0x47, 0xbd, 0x9b, 0x75, 0xd4,
-	0xfb, 0xba, 0x8e, 0x7a, 0x6f, 0x1e, 0xfe, 0xfe, 0x7a, 0x8d, 0xad, 0x79, 0x98, 0xfe, 0xb7, 0x60,
-	0x6c, 0x60, 0x87, 0x3c, 0xfd, 0x11, 0x00, 0x00, 0xff, 0xff, 0xa3, 0x10, 0x55, 0x55, 0x0b, 0x03,
-	0x00, 0x00,
+var fileDescriptor_pam_3ce5b7b36b795e71 = []byte{
+	// 512 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x53, 0x4f, 0x6f, 0xd3, 0x30,
+	0x1c, 0x6d, 0xd6, 0xa6, 0x7f, 0x7e, 0x65, 0x6c, 0xf2, 0xc6, 0x14, 0x36, 0x91, 0x45, 0xe5, 0xd2,
+	0x03, 0xb4, 0xd2, 0x38, 0xf4, 0xc0, 0xa9, 0x9d, 0x40, 0xec, 0x30, 0x6d, 0x0a, 0x9c, 0xb8, 0x44,
+	0x76, 0xec, 0xa4, 0xd1, 0x12, 0xbb, 0xd8, 0x09, 0x2a, 0x9f, 0x02, 0x8e, 0x7c, 0xa4, 0x1d, 0x38,
+	0xec, 0xc8, 0x09, 0xa1, 0xf6, 0x8b, 0x20, 0xdb, 0xe9, 0x40, 0x8c, 0x03, 0xda, 0x21, 0x52, 0xde,
+	0x7b, 0x7e, 0xcf, 0xf6, 0xd3, 0xcf, 0xb0, 0xb7, 0x90, 0xa2, 0x14, 0x63, 0x92, 0x89, 0xf1, 0x02,
+	0x17, 0x23, 0x83, 0xd0, 0x4e, 0x2a, 0x71, 0x96, 0x5b, 0x30, 0x22, 0x99, 0x38, 0x7c, 0x9e, 0x66,
+	0xe5, 0xbc, 0x22, 0xa3, 0x58, 0x14, 0xe3, 0x54, 0xa4, 0x62, 0x6c, 0x24, 0x52, 0x25, 0x06, 0xd9,
+	0x08, 0xfd, 0x67, 0x2d, 0x87, 0x8f, 0x7e, 0x87, 0xc6, 0x42, 0x48, 0x6a, 0xe9, 0xc1, 0x19, 0x3c,
+	0xbc, 0x9c, 0x9e, 0xcf, 0x72, 0x11, 0x5f, 0xbd, 0x61, 0x98, 0x32, 0x89, 0x0e, 0xa0, 0x2d, 0x92,
+	0x44, 0xb1, 0xd2, 0xdb, 0x0a, 0x9c, 0xe1, 0x76, 0x58, 0x23, 0x74, 0x0c, 0x7d, 0x92, 0x0b, 0x12,
+	0xd5, 0x62, 0xd3, 0x88, 0xa0, 0xa9, 0x0b, 0xc3, 0x0c, 0xbe, 0x39, 0x80, 0x36, 0x59, 0x67, 0x9c,
+	0xb2, 0xe5, 0x2b, 0x5e, 0xca, 0x4f, 0xda, 0x97, 0x64, 0x39, 0xdb, 0xf8, 0x9c, 0xc0, 0x19, 0xb6,
+	0x42, 0xd0, 0xd4, 0xc5, 0x6d, 0x30, 0xaf, 0x8a, 0x48, 0xb2, 0x58, 0x48, 0xaa, 0x36, 0xc1, 0xbc,
+	0x2a, 0x42, 0xcb, 0xa0, 0x97, 0x00, 0xaa, 0xc4, 0xb2, 0x8c, 0x30, 0xa5, 0xd2, 0x6b, 0x05, 0xce,
+	0xb0, 0x7f, 0x72, 0x30, 0xfa, 0xab, 0x8f, 0xd1, 0xa9, 0xbe, 0xd5, 0xac, 0x75, 0xfd, 0xe3, 0xb8,
+	0x11, 0xf6, 0xcc, 0xfa, 0x29, 0xa5, 0x12, 0x4d, 0xa0, 0xcb, 0x38, 0xb5, 0x56, 0xf7, 0x3f, 0xac,
+	0x1d, 0xc6, 0xa9, 0x36, 0x0e, 0x3e, 0x6f, 0xc1, 0xf6, 0xe5, 0xf4, 0xfc, 0xed, 0x1c, 0x4b, 0x6a,
+	0xae, 0x83, 0xf6, 0xc1, 0x2d, 0x70, 0x9a, 0xc5, 0xe6, 0x0e, 0xed, 0xd0, 0x02, 0xe4, 0x41, 0xe7,
+	0x23, 0x93, 0x2a, 0x13, 0xdc, 0x1c, 0xbd, 0x17, 0x6e, 0x20, 0x9a, 0x80, 0x2b, 0x31, 0x4f, 0x59,
+	0x7d, 0xe4, 0xa3, 0x7f, 0xef, 0x1b, 0xea, 0x25, 0xf5, 0xe6, 0x76, 0x3d, 0x7a, 0x0c, 0x5d, 0x5c,
+	0x2d, 0xa3, 0x12, 0xa7, 0xca, 0x73, 0x83, 0xa6, 0xce, 0xc4, 0xd5, 0xf2, 0x1d, 0x4e, 0x15, 0x3a,
+	0x82, 0xde, 0x87, 0x0a, 0xe7, 0x11, 0xc9, 0xb8, 0xf2, 0xda, 0x81, 0x33, 0x7c, 0x10, 0x76, 0x35,
+	0x31, 0xcb, 0xb8, 0x42, 0x63, 0xd8, 0x93, 0x2c, 0x61, 0x92, 0xf1, 0x98, 0x45, 0xf1, 0x9c, 0xc5,
+	0x57, 0xaa, 0x2a, 0x94, 0xd7, 0x31, 0x11, 0xe8, 0x56, 0x3a, 0xdd, 0x28, 0xe8, 0x19, 0x20, 0xc6,
+	0x63, 0x41, 0x19, 0x8d, 0x08, 0x2e, 0xa2, 0xb9, 0x99, 0x00, 0x6f, 0xc7, 0xc4, 0xee, 0xd6, 0xca,
+	0x0c, 0x17, 0x76, 0x32, 0x06, 0x5f, 0x1d, 0xd3, 0xc8, 0xeb, 0x8c, 0xe5, 0xf7, 0x6c, 0x64, 0x1f,
+	0xdc, 0x44, 0xbb, 0x4d, 0x23, 0x6e, 0x68, 0x01, 0x9a, 0x42, 0x9b, 0xe8, 0xa1, 0x51, 0xde, 0x6e,
+	0xd0, 0x1c, 0xf6, 0x4f, 0x9e, 0xde, 0x29, 0xea, 0xee, 0x58, 0xd5, 0x85, 0xd5, 0xc6, 0xd9, 0xe4,
+	0x7a, 0xe5, 0x3b, 0x37, 0x2b, 0xdf, 0xf9, 0xb9, 0xf2, 0x9d, 0x2f, 0x6b, 0xbf, 0x71, 0xb3, 0xf6,
+	0x1b, 0xdf, 0xd7, 0x7e, 0xe3, 0xfd, 0x93, 0x3f, 0x9f, 0x89, 0x8e, 0xd5, 0x2f, 0xa0, 0xfe, 0x16,
+	0x84, 0xb4, 0xcd, 0x26, 0x2f, 0x7e, 0x0d, 0x00, 0x16, 0x45, 0xbd, 0xce, 0x74, 0x03, 0x00, 0x00,
 }
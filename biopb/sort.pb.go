@@ -32,7 +32,7 @@ func (m *SortShardBlockIndex) Reset()         { *m = SortShardBlockIndex{} }
 func (m *SortShardBlockIndex) String() string { return proto.CompactTextString(m) }
 func (*SortShardBlockIndex) ProtoMessage()    {}
 func (*SortShardBlockIndex) Descriptor() ([]byte, []int) {
-	return fileDescriptor_sort_7f232c7936230cd7, []int{0}
+	return fileDescriptor_sort_32fef1958725ef70, []int{0}
 }
 func (m *SortShardBlockIndex) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -92,6 +92,7 @@ func (m *SortShardBlockIndex) GetNumRecords() uint32 {
 type SortShardIndex struct {
 	NumRecords       int64                 `protobuf:"varint,1,opt,name=num_records,json=numRecords,proto3" json:"num_records,omitempty"`
 	Snappy           bool                  `protobuf:"varint,2,opt,name=snappy,proto3" json:"snappy,omitempty"`
+	QueryName        bool                  `protobuf:"varint,3,opt,name=query_name,json=queryName,proto3" json:"query_name,omitempty"`
 	EncodedBamHeader []byte                `protobuf:"bytes,15,opt,name=encoded_bam_header,json=encodedBamHeader,proto3" json:"encoded_bam_header,omitempty"`
 	Blocks           []SortShardBlockIndex `protobuf:"bytes,16,rep,name=blocks,proto3" json:"blocks"`
 }
@@ -100,7 +101,7 @@ func (m *SortShardIndex) Reset()         { *m = SortShardIndex{} }
 func (m *SortShardIndex) String() string { return proto.CompactTextString(m) }
 func (*SortShardIndex) ProtoMessage()    {}
 func (*SortShardIndex) Descriptor() ([]byte, []int) {
-	return fileDescriptor_sort_7f232c7936230cd7, []int{1}
+	return fileDescriptor_sort_32fef1958725ef70, []int{1}
 }
 func (m *SortShardIndex) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -143,6 +144,13 @@ func (m *SortShardIndex) GetSnappy() bool {
 	return false
 }
 
+func (m *SortShardIndex) GetQueryName() bool {
+	if m != nil {
+		return m.QueryName
+	}
+	return false
+}
+
 func (m *SortShardIndex) GetEncodedBamHeader() []byte {
 	if m != nil {
 		return m.EncodedBamHeader
@@ -229,6 +237,16 @@ func (m *SortShardIndex) MarshalTo(dAtA []byte) (int, error) {
 		}
 		i++
 	}
+	if m.QueryName {
+		dAtA[i] = 0x18
+		i++
+		if m.QueryName {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
 	if len(m.EncodedBamHeader) > 0 {
 		dAtA[i] = 0x7a
 		i++
@@ -294,6 +312,9 @@ func (m *SortShardIndex) Size() (n int) {
 	if m.Snappy {
 		n += 2
 	}
+	if m.QueryName {
+		n += 2
+	}
 	l = len(m.EncodedBamHeader)
 	if l > 0 {
 		n += 1 + l + sovSort(uint64(l))
@@ -514,6 +535,26 @@ func (m *SortShardIndex) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.Snappy = bool(v != 0)
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field QueryName", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowSort
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.QueryName = bool(v != 0)
 		case 15:
 			if wireType != 2 {
 				return fmt.Errorf("proto: wrong wireType = %d for field EncodedBamHeader", wireType)
@@ -702,29 +743,30 @@ var (
 	ErrIntOverflowSort   = fmt.Errorf("proto: integer overflow")
 )
 
-func init() { proto.RegisterFile("proto/bio/sort.proto", fileDescriptor_sort_7f232c7936230cd7) }
-
-var fileDescriptor_sort_7f232c7936230cd7 = []byte{
-	// 334 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x51, 0x4f, 0x4b, 0xc3, 0x30,
-	0x1c, 0x6d, 0xdc, 0x28, 0x33, 0xf3, 0xcf, 0x88, 0x22, 0xc5, 0x61, 0x57, 0x76, 0xea, 0x41, 0x5b,
-	0xd0, 0x83, 0x78, 0xed, 0x49, 0xf1, 0x20, 0x74, 0x37, 0x2f, 0x25, 0x69, 0xd3, 0xad, 0x6c, 0x6d,
-	0xba, 0x24, 0x05, 0xf7, 0x2d, 0xf4, 0xab, 0xf8, 0x29, 0x76, 0xdc, 0xd1, 0x93, 0xc8, 0xf6, 0x45,
-	0x24, 0x69, 0xd1, 0x22, 0x1e, 0x02, 0xbf, 0xf7, 0x5e, 0x1e, 0x3c, 0xde, 0x83, 0xa7, 0x25, 0x67,
-	0x92, 0xf9, 0x24, 0x63, 0xbe, 0x60, 0x5c, 0x7a, 0x1a, 0x22, 0x53, 0xdd, 0x94, 0x9f, 0x5f, 0x4d,
-	0x33, 0x39, 0xab, 0x88, 0x17, 0xb3, 0xdc, 0x9f, 0xb2, 0x29, 0xf3, 0xb5, 0x4c, 0xaa, 0x54, 0xa3,
-	0xda, 0xaa, 0xae, 0xda, 0x36, 0x7e, 0x03, 0xf0, 0x64, 0xc2, 0xb8, 0x9c, 0xcc, 0x30, 0x4f, 0x82,
-	0x05, 0x8b, 0xe7, 0x0f, 0x45, 0x42, 0x5f, 0xd0, 0x10, 0xee, 0x0b, 0x89, 0xb9, 0x8c, 0xe6, 0x74,
-	0x65, 0x01, 0x07, 0xb8, 0xdd, 0xb0, 0xa7, 0x89, 0x47, 0xba, 0xfa, 0x15, 0x05, 0x5d, 0x5a, 0x7b,
-	0x2d, 0x71, 0x42, 0x97, 0x68, 0x04, 0xfb, 0x69, 0xb6, 0xa0, 0x11, 0x4b, 0x53, 0x41, 0xa5, 0xd5,
-	0xd1, 0x32, 0x54, 0xd4, 0x93, 0x66, 0xd4, 0x87, 0xa2, 0xca, 0x23, 0x4e, 0x63, 0xc6, 0x13, 0x61,
-	0x75, 0x1d, 0xe0, 0x1e, 0x86, 0xb0, 0xa8, 0xf2, 0xb0, 0x66, 0xc6, 0xef, 0x00, 0x1e, 0xfd, 0x64,
-	0xaa, 0xe3, 0xfc, 0xf1, 0xa8, 0x40, 0x9d, 0xb6, 0x07, 0x9d, 0x41, 0x53, 0x14, 0xb8, 0x2c, 0x57,
-	0x3a, 0x4f, 0x2f, 0x6c, 0x10, 0xba, 0x84, 0x88, 0x16, 0x31, 0x4b, 0x68, 0x12, 0x11, 0x9c, 0x47,
-	0x33, 0x8a, 0x13, 0xca, 0xad, 0x63, 0x07, 0xb8, 0x07, 0xe1, 0xa0, 0x51, 0x02, 0x9c, 0xdf, 0x6b,
-	0x1e, 0xdd, 0x41, 0x93, 0xa8, 0x0e, 0x84, 0x35, 0x70, 0x3a, 0x6e, 0xff, 0x7a, 0xe8, 0xd5, 0xad,
-	0x7a, 0xff, 0x54, 0x14, 0x74, 0xd7, 0x9f, 0x23, 0x23, 0x6c, 0x0c, 0xc1, 0xed, 0x7a, 0x6b, 0x83,
-	0xcd, 0xd6, 0x06, 0x5f, 0x5b, 0x1b, 0xbc, 0xee, 0x6c, 0x63, 0xb3, 0xb3, 0x8d, 0x8f, 0x9d, 0x6d,
-	0x3c, 0x5f, 0xb4, 0x17, 0xe1, 0x38, 0x5b, 0xa8, 0xe5, 0x9a, 0x57, 0x12, 0x62, 0xea, 0x21, 0x6e,
-	0xbe, 0x03, 0x00, 0x00, 0xff, 0xff, 0xa5, 0xdb, 0xe0, 0x6d, 0xd7, 0x01, 0x00, 0x00,
+func init() { proto.RegisterFile("proto/bio/sort.proto", fileDescriptor_sort_32fef1958725ef70) }
+
+var fileDescriptor_sort_32fef1958725ef70 = []byte{
+	// 352 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x91, 0xcf, 0x4a, 0xf3, 0x40,
+	0x14, 0xc5, 0x33, 0x5f, 0x4b, 0x68, 0xa7, 0xdf, 0x9f, 0x32, 0x9f, 0x48, 0xb0, 0x34, 0x0d, 0x5d,
+	0x65, 0xa1, 0x09, 0xe8, 0x42, 0xdc, 0x66, 0xa5, 0x08, 0x0a, 0xe9, 0xce, 0x4d, 0x98, 0x24, 0x37,
+	0x6d, 0x68, 0x93, 0x49, 0x27, 0x13, 0x30, 0x6f, 0xa1, 0x6f, 0xd5, 0x65, 0xdd, 0xb9, 0x12, 0x69,
+	0x5f, 0x44, 0x66, 0x12, 0xb4, 0x88, 0x8b, 0x81, 0x7b, 0x7f, 0x67, 0x0e, 0x1c, 0xee, 0xc1, 0x47,
+	0x05, 0x67, 0x82, 0xb9, 0x61, 0xca, 0xdc, 0x92, 0x71, 0xe1, 0xa8, 0x95, 0xe8, 0x72, 0x06, 0x7e,
+	0x72, 0x36, 0x4f, 0xc5, 0xa2, 0x0a, 0x9d, 0x88, 0x65, 0xee, 0x9c, 0xcd, 0x99, 0xab, 0xe4, 0xb0,
+	0x4a, 0xd4, 0xd6, 0x58, 0xe5, 0xd4, 0xd8, 0xa6, 0xcf, 0x08, 0xff, 0x9f, 0x31, 0x2e, 0x66, 0x0b,
+	0xca, 0x63, 0x6f, 0xc5, 0xa2, 0xe5, 0x4d, 0x1e, 0xc3, 0x23, 0x19, 0xe1, 0x7e, 0x29, 0x28, 0x17,
+	0xc1, 0x12, 0x6a, 0x03, 0x59, 0xc8, 0xee, 0xfa, 0x3d, 0x05, 0x6e, 0xa1, 0xfe, 0x12, 0x4b, 0x58,
+	0x1b, 0xbf, 0x0e, 0xc4, 0x19, 0xac, 0xc9, 0x04, 0x0f, 0x92, 0x74, 0x05, 0x01, 0x4b, 0x92, 0x12,
+	0x84, 0xd1, 0x51, 0x32, 0x96, 0xe8, 0x5e, 0x11, 0xf9, 0x21, 0xaf, 0xb2, 0x80, 0x43, 0xc4, 0x78,
+	0x5c, 0x1a, 0x5d, 0x0b, 0xd9, 0x7f, 0x7c, 0x9c, 0x57, 0x99, 0xdf, 0x90, 0xe9, 0x0b, 0xc2, 0x7f,
+	0x3f, 0x33, 0x35, 0x71, 0xbe, 0x79, 0x64, 0xa0, 0xce, 0xa1, 0x87, 0x1c, 0x63, 0xbd, 0xcc, 0x69,
+	0x51, 0xd4, 0x2a, 0x4f, 0xcf, 0x6f, 0x37, 0x32, 0xc6, 0x78, 0x5d, 0x01, 0xaf, 0x83, 0x9c, 0x66,
+	0xa0, 0xc2, 0xf4, 0xfc, 0xbe, 0x22, 0x77, 0x34, 0x03, 0x72, 0x8a, 0x09, 0xe4, 0x11, 0x8b, 0x21,
+	0x0e, 0x42, 0x9a, 0x05, 0x0b, 0xa0, 0x31, 0x70, 0xe3, 0x9f, 0x85, 0xec, 0xdf, 0xfe, 0xb0, 0x55,
+	0x3c, 0x9a, 0x5d, 0x2b, 0x4e, 0xae, 0xb0, 0x1e, 0xca, 0x13, 0x95, 0xc6, 0xd0, 0xea, 0xd8, 0x83,
+	0xf3, 0x91, 0xd3, 0x1c, 0xdd, 0xf9, 0xe1, 0x82, 0x5e, 0x77, 0xf3, 0x36, 0xd1, 0xfc, 0xd6, 0xe0,
+	0x5d, 0x6e, 0x76, 0x26, 0xda, 0xee, 0x4c, 0xf4, 0xbe, 0x33, 0xd1, 0xd3, 0xde, 0xd4, 0xb6, 0x7b,
+	0x53, 0x7b, 0xdd, 0x9b, 0xda, 0xc3, 0xf8, 0xb0, 0x30, 0x4e, 0xd3, 0x95, 0x2c, 0xb6, 0x7d, 0x45,
+	0x18, 0xea, 0xaa, 0xa7, 0x8b, 0x8f, 0x01, 0x00, 0x98, 0xec, 0x3b, 0x29, 0xf6, 0x01, 0x00, 0x00,
 }
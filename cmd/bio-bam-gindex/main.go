@@ -12,7 +12,7 @@ import (
 )
 
 var (
-	shardSize = flag.Int("shard-size", 64*1024, "Approximate bytes per interval in index")
+	shardSize = flag.Int("shard-size", bam.DefaultGIndexByteInterval, "Approximate bytes per interval in index")
 )
 
 func main() {
@@ -0,0 +1,11 @@
+// Command bio-bam-index reads a coordinate-sorted .bam file and writes a
+// standard .bai index file, or a .csi index file with --csi.  bio-bam-index
+// expects the bam file to arrive on stdin, and writes to stdout.  A .bai
+// index cannot describe references longer than 2^29-1 bases; use --csi for
+// such files.
+//
+// Usage:
+//
+//	cat foo.bam | bio-bam-index > foo.bam.bai
+//	cat foo.bam | bio-bam-index --csi > foo.bam.csi
+package main
@@ -0,0 +1,32 @@
+package main
+
+// See doc.go for documentation
+import (
+	"flag"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/grailbio/base/grail"
+	"github.com/grailbio/bio/encoding/bam"
+)
+
+var (
+	csi = flag.Bool("csi", false, "Write a .csi index instead of a .bai index")
+)
+
+func main() {
+	shutdown := grail.Init()
+	defer shutdown()
+
+	r := io.Reader(os.Stdin)
+	w := io.Writer(os.Stdout)
+
+	format := bam.BAIFormat
+	if *csi {
+		format = bam.CSIFormat
+	}
+	if err := bam.WriteIndex(w, r, format, runtime.NumCPU()); err != nil {
+		panic(err.Error())
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/base/vcontext"
 	"github.com/grailbio/bio/cmd/bio-bam-sort/sorter"
+	gsam "github.com/grailbio/bio/encoding/sam"
 	"github.com/grailbio/hts/bam"
 	"github.com/grailbio/hts/sam"
 )
@@ -22,14 +23,16 @@ import (
 var (
 	samInputFlag           = flag.Bool("sam", true, "Specify that the inputs are in SAM format")
 	shardIndexFlag         = flag.Int("shard-index", 0, "Value of bam.SorterOptions.ShardIndex")
+	sortOrderFlag          = flag.String("sort-order", "coordinate", "Sort order of the sortshard, either coordinate or queryname")
 	bamFlag                = flag.String("bam", "", "Merge multiple sortshard files into one BAM file specified by this flag")
 	pamFlag                = flag.String("pam", "", "Merge multiple sortshard files into one PAM file specified by this flag")
-	parallelismFlag        = flag.Int("parallelism", 64, "Parallelism during PAM generation.")
+	sortedInputsFlag       = flag.Bool("sorted-inputs", false, "With -bam or -pam, the inputs are coordinate-sorted BAM or PAM files, not sortshard files")
+	parallelismFlag        = flag.Int("parallelism", 64, "Parallelism during PAM generation, or during merging of sorted inputs.")
 	recordsPerPAMShardFlag = flag.Int64("records-per-pam-shard", 128<<20,
 		"Approx. size of each PAM shard, in number of reads.")
 )
 
-// recordReader is implemented by both biogo sam.Reader and biogo bam.Reader.
+// recordReader is implemented by both gsam.Reader and biogo bam.Reader.
 type recordReader interface {
 	Header() *sam.Header
 	Read() (*sam.Record, error)
@@ -52,7 +55,7 @@ func openInput(inPath string) recordReader {
 	var err error
 	var reader recordReader
 	if *samInputFlag {
-		reader, err = sam.NewReader(in)
+		reader, err = gsam.NewReader(in, gsam.ReaderOpts{Parallelism: runtime.NumCPU()})
 		if err != nil {
 			log.Panicf("open %v: failed to open SAM: %v", inPath, err)
 		}
@@ -65,10 +68,25 @@ func openInput(inPath string) recordReader {
 	return reader
 }
 
+// parseSortOrder parses the value of -sort-order.
+func parseSortOrder(order string) sam.SortOrder {
+	switch order {
+	case "coordinate":
+		return sam.Coordinate
+	case "queryname":
+		return sam.QueryName
+	}
+	log.Panicf("invalid -sort-order '%v': it must be either coordinate or queryname", order)
+	return sam.UnknownOrder
+}
+
 // sort sorts a sequence of sam.Records in inPath to a sortshard file outPath.
 func sort(inPath, outPath string) {
 	in := openInput(inPath)
-	sorter := sorter.NewSorter(outPath, in.Header(), sorter.SortOptions{ShardIndex: uint32(*shardIndexFlag)})
+	sorter := sorter.NewSorter(outPath, in.Header(), sorter.SortOptions{
+		ShardIndex: uint32(*shardIndexFlag),
+		SortOrder:  parseSortOrder(*sortOrderFlag),
+	})
 	for nRecs := 0; ; nRecs++ {
 		rec, err := in.Read()
 		if rec == nil {
@@ -97,17 +115,25 @@ following three ways.
    The command reads a sequence of bam or sam records from input, sorts them,
    and produces file <sortshard>. If <input> is '-', records are read from
    stdin.  With -sam flag, the records are assumed to be in SAM format. Else, it
-   is assumed to be in BAM format.
+   is assumed to be in BAM format. With -sort-order=queryname, the records are
+   sorted by read name, in the same order as "samtools sort -n".
 
 2. bio-bam-sort -bam <foo.bam> <sortshard...>
 
    The command reads a list of sortshard files and merges them into foo.bam.
-   Existing contents of foo.bam, if any, are destroyed.
+   Existing contents of foo.bam, if any, are destroyed. If the records are
+   sorted by coordinate, the command also writes the indexes foo.bam.bai (or
+   foo.bam.csi, for references longer than 2^29-1) and foo.bam.gbai.
 
 3. bio-bam-sort -pam <foo.pam> <sortshard...>
 
    The command reads a list of sortshard files and merges them into foo.pam.
    Existing contents of foo.pam, if any, are destroyed.
+
+With -sorted-inputs, the second and the third forms merge coordinate-sorted BAM
+or PAM files instead of sortshard files. BAM inputs must be indexed. The
+headers of the inputs are merged, so the inputs may have different sets of
+reference sequences, as long as the shared ones are listed in the same order.
 `)
 		flag.PrintDefaults()
 	}
@@ -120,7 +146,12 @@ following three ways.
 			flag.Usage()
 			os.Exit(1)
 		}
-		err := sorter.BAMFromSortShards(args, *bamFlag)
+		var err error
+		if *sortedInputsFlag {
+			err = sorter.BAMFromSortedFiles(args, *bamFlag, sorter.MergeOpts{Parallelism: *parallelismFlag})
+		} else {
+			err = sorter.BAMFromSortShards(args, *bamFlag)
+		}
 		if err != nil {
 			log.Panicf("merge %v to %v: %v", args, *bamFlag, err)
 		}
@@ -129,7 +160,12 @@ following three ways.
 			flag.Usage()
 			os.Exit(1)
 		}
-		err := sorter.PAMFromSortShards(args, *pamFlag, *recordsPerPAMShardFlag, *parallelismFlag)
+		var err error
+		if *sortedInputsFlag {
+			err = sorter.PAMFromSortedFiles(args, *pamFlag, sorter.MergeOpts{Parallelism: *parallelismFlag})
+		} else {
+			err = sorter.PAMFromSortShards(args, *pamFlag, *recordsPerPAMShardFlag, *parallelismFlag)
+		}
 		if err != nil {
 			log.Panicf("merge %v to %v: %v", args, *pamFlag, err)
 		}
@@ -0,0 +1,355 @@
+package sorter
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+// DefaultMergeBasesPerShard is the default value for MergeOpts.BasesPerShard.
+const DefaultMergeBasesPerShard = 64 << 20
+
+// MergeOpts controls the behavior of BAMFromSortedFiles and PAMFromSortedFiles.
+type MergeOpts struct {
+	// ProviderOpts is passed to bamprovider.NewProvider when opening each
+	// input.
+	ProviderOpts bamprovider.ProviderOpts
+
+	// BasesPerShard is the width of a genomic range merged by one task.  For PAM
+	// output, it is also the width of a rowshard. All the unmapped reads are
+	// merged by one task. If <= 0, DefaultMergeBasesPerShard is used.
+	BasesPerShard int
+
+	// Parallelism is the number of tasks run concurrently. If <= 0,
+	// runtime.NumCPU() is used.
+	Parallelism int
+
+	// WriteOpts is passed to pam.NewWriter when creating each PAM rowshard. It
+	// is used only by PAMFromSortedFiles. WriteOpts.Range is ignored.
+	WriteOpts pam.WriteOpts
+}
+
+// sortedFileReader reads a shard of a coordinate-sorted BAM or PAM file
+// through bamprovider. It implements mergeSource.
+type sortedFileReader struct {
+	path   string
+	iter   bamprovider.Iterator
+	refMap []*sam.Reference // maps the reference IDs of the file to the merged header.
+	err    *errors.Once
+
+	curKey  sortKey
+	curBody bytes.Buffer
+	n       uint64 // # of records read so far.
+}
+
+func (r *sortedFileReader) scan() bool {
+	if !r.iter.Scan() {
+		r.err.Set(r.iter.Err())
+		return false
+	}
+	rec := r.iter.Record()
+	if rec.Ref != nil {
+		rec.Ref = r.refMap[rec.Ref.ID()]
+	}
+	if rec.MateRef != nil {
+		rec.MateRef = r.refMap[rec.MateRef.ID()]
+	}
+	key := makeSortKey(rec, r.n)
+	// The lowest bit of the coord is the strand, which is not part of the
+	// coordinate sort order, so only the refid and the position are compared.
+	if key.coord>>1 < r.curKey.coord>>1 {
+		r.err.Set(fmt.Errorf("%v: records are not sorted by coordinate: %v appears after %v", r.path, key, r.curKey))
+		return false
+	}
+	r.curKey = key
+	r.n++
+	r.curBody.Reset()
+	if err := bam.Marshal(rec, &r.curBody); err != nil {
+		r.err.Set(err)
+		return false
+	}
+	// Note: don't call sam.PutInFreePool since rec may be produced by the
+	// native biogo code.
+	return true
+}
+
+func (r *sortedFileReader) key() sortKey { return r.curKey }
+
+func (r *sortedFileReader) body() []byte { return r.curBody.Bytes() }
+
+func (r *sortedFileReader) drain() {}
+
+func (r *sortedFileReader) name() string { return r.path }
+
+// sortedFileMerger merges shards of coordinate-sorted BAM or PAM files.
+type sortedFileMerger struct {
+	paths     []string
+	opts      MergeOpts
+	providers []bamprovider.Provider
+	headers   []*sam.Header
+	refMaps   [][]*sam.Reference // refMaps[i] maps reference IDs of paths[i] to header.
+	header    *sam.Header        // merged header.
+	shards    []gbam.Shard       // in the merged header's reference space.
+	pool      *sortShardBlockPool
+	err       errors.Once
+}
+
+// newSortedFileMerger opens the files and merges their headers.  The reference
+// sequences must be ordered consistently across the files, so that the merged
+// header can list them in an order compatible with all the files.
+func newSortedFileMerger(paths []string, opts MergeOpts) (*sortedFileMerger, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No files to merge")
+	}
+	if opts.BasesPerShard <= 0 {
+		opts.BasesPerShard = DefaultMergeBasesPerShard
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = runtime.NumCPU()
+	}
+	m := &sortedFileMerger{paths: paths, opts: opts, pool: newSortShardBlockPool()}
+	for _, path := range paths {
+		provider := bamprovider.NewProvider(path, opts.ProviderOpts)
+		m.providers = append(m.providers, provider)
+		header, err := provider.GetHeader()
+		if err != nil {
+			m.close() // nolint: errcheck
+			return nil, err
+		}
+		if header.SortOrder != sam.Coordinate && header.SortOrder != sam.UnknownOrder && header.SortOrder != sam.Unsorted {
+			m.close() // nolint: errcheck
+			return nil, fmt.Errorf("%v: file must be sorted by coordinate, but its sort order is %v", path, header.SortOrder)
+		}
+		m.headers = append(m.headers, header)
+	}
+	var err error
+	if m.header, m.refMaps, err = sam.MergeHeaders(m.headers); err != nil {
+		m.close() // nolint: errcheck
+		return nil, err
+	}
+	// The records in each file are sorted by the file's reference IDs. They
+	// remain sorted after translation only if the translation is monotonic.
+	for i, refMap := range m.refMaps {
+		for j := 1; j < len(refMap); j++ {
+			if refMap[j].ID() <= refMap[j-1].ID() {
+				m.close() // nolint: errcheck
+				return nil, fmt.Errorf("%v: reference %v is ordered differently from the other files",
+					paths[i], refMap[j].Name())
+			}
+		}
+	}
+	m.header.SortOrder = sam.Coordinate
+	if m.shards, err = gbam.GetPositionBasedShards(m.header, opts.BasesPerShard, 0, true); err != nil {
+		m.close() // nolint: errcheck
+		return nil, err
+	}
+	return m, nil
+}
+
+// close closes the providers.
+func (m *sortedFileMerger) close() error {
+	for _, p := range m.providers {
+		m.err.Set(p.Close())
+	}
+	return m.err.Err()
+}
+
+// fileShard translates shard "shardIdx" into the reference space of file
+// "fileIdx". It returns false if the file has no record in the shard.
+func (m *sortedFileMerger) fileShard(fileIdx, shardIdx int) (gbam.Shard, bool) {
+	shard := m.shards[shardIdx]
+	if shard.StartRef == nil {
+		return shard, true // unmapped reads.
+	}
+	for _, ref := range m.headers[fileIdx].Refs() {
+		if ref.Name() == shard.StartRef.Name() {
+			shard.StartRef, shard.EndRef = ref, ref
+			return shard, true
+		}
+	}
+	return shard, false
+}
+
+// mergeShard merges the records in shard "shardIdx" of all the files.
+// readCallback is called for each record, in order.
+func (m *sortedFileMerger) mergeShard(shardIdx int, readCallback func(key sortKey, body []byte) bool) {
+	var (
+		sources []mergeSource
+		iters   []bamprovider.Iterator
+	)
+	for i, provider := range m.providers {
+		shard, ok := m.fileShard(i, shardIdx)
+		if !ok {
+			continue
+		}
+		iter := provider.NewIterator(shard)
+		iters = append(iters, iter)
+		sources = append(sources, &sortedFileReader{
+			path:   m.paths[i],
+			iter:   iter,
+			refMap: m.refMaps[i],
+			err:    &m.err,
+		})
+	}
+	internalMergeShards(sources, readCallback, m.pool, &m.err)
+	for _, iter := range iters {
+		m.err.Set(iter.Close())
+	}
+}
+
+// run calls mergeShard for every shard, using opts.Parallelism threads. The
+// shards are started in order.
+func (m *sortedFileMerger) run(mergeShard func(shardIdx int)) {
+	reqCh := make(chan int, len(m.shards))
+	for i := range m.shards {
+		reqCh <- i
+	}
+	close(reqCh)
+	wg := sync.WaitGroup{}
+	for i := 0; i < m.opts.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shardIdx := range reqCh {
+				mergeShard(shardIdx)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// The size of a chunk of BAM records passed from a merge task to the BAM
+// writer.
+const mergeChunkSize = 1 << 20
+
+// BAMFromSortedFiles merges coordinate-sorted BAM or PAM files into a single
+// BAM file. The files are read through bamprovider, so BAM files must be
+// indexed. The headers of the files are merged; the files may have different
+// sets of reference sequences, as long as the shared ones are in the same
+// order.
+//
+// The genome is split into shards, which are merged in parallel. The merged
+// records are written in order, so the memory usage is bounded by
+// opts.Parallelism.
+func BAMFromSortedFiles(paths []string, bamPath string, opts MergeOpts) error {
+	m, err := newSortedFileMerger(paths, opts)
+	if err != nil {
+		return err
+	}
+	ctx := vcontext.Background()
+	out, err := file.Create(ctx, bamPath)
+	if err != nil {
+		m.close() // nolint: errcheck
+		return err
+	}
+	gzip := bgzf.NewWriter(out.Writer(ctx), runtime.NumCPU()*4)
+	var buf bytes.Buffer
+	if err := m.header.EncodeBinary(&buf); err != nil {
+		m.close() // nolint: errcheck
+		return err
+	}
+	_, err = gzip.Write(buf.Bytes())
+	m.err.Set(err)
+
+	// Each merge task sends chunks of serialized records to its channel. The
+	// channels are drained in shard order, so a task blocks when it runs too far
+	// ahead of the writer.
+	chunkChs := make([]chan []byte, len(m.shards))
+	for i := range chunkChs {
+		chunkChs[i] = make(chan []byte, 4)
+	}
+	go m.run(func(shardIdx int) {
+		ch := chunkChs[shardIdx]
+		var chunk []byte
+		m.mergeShard(shardIdx, func(key sortKey, body []byte) bool {
+			chunk = append(chunk, body...)
+			if len(chunk) >= mergeChunkSize {
+				ch <- chunk
+				chunk = nil
+			}
+			return true
+		})
+		if len(chunk) > 0 {
+			ch <- chunk
+		}
+		close(ch)
+	})
+	for _, ch := range chunkChs {
+		for chunk := range ch {
+			_, err := gzip.Write(chunk)
+			m.err.Set(err)
+		}
+	}
+	m.err.Set(gzip.Close())
+	m.err.Set(out.Close(ctx))
+	return m.close()
+}
+
+// PAMFromSortedFiles merges coordinate-sorted BAM or PAM files into a single
+// PAM file. It is the same as BAMFromSortedFiles, except that each shard is
+// written to a separate PAM rowshard. Existing contents of pamPath, if any, are
+// destroyed.
+func PAMFromSortedFiles(paths []string, pamPath string, opts MergeOpts) error {
+	m, err := newSortedFileMerger(paths, opts)
+	if err != nil {
+		return err
+	}
+	if err := pamutil.Remove(pamPath); err != nil {
+		m.close() // nolint: errcheck
+		return err
+	}
+	// The rowshards must cover the whole coordinate space, so each rowshard
+	// extends to the start of the next one.
+	ranges := make([]biopb.CoordRange, len(m.shards))
+	for i, shard := range m.shards {
+		start := biopb.Coord{RefId: biopb.UnmappedRefID}
+		if shard.StartRef != nil {
+			start = biopb.Coord{RefId: int32(shard.StartRef.ID()), Pos: int32(shard.Start)}
+		}
+		if i == 0 {
+			start = gbam.UniversalRange.Start
+		} else {
+			ranges[i-1].Limit = start
+		}
+		ranges[i].Start = start
+	}
+	ranges[len(ranges)-1].Limit = gbam.UniversalRange.Limit
+
+	m.run(func(shardIdx int) {
+		wopts := m.opts.WriteOpts
+		wopts.Range = ranges[shardIdx]
+		vlog.VI(1).Infof("%v: generating PAM shard %+v", pamPath, wopts.Range)
+		w := pam.NewWriter(wopts, m.header, pamPath)
+		m.mergeShard(shardIdx, func(key sortKey, body []byte) bool {
+			// The first 4 bytes of body is the length field. Remove it.
+			rec, err := gbam.Unmarshal(body[4:], m.header)
+			if err != nil {
+				m.err.Set(err)
+				return false
+			}
+			w.Write(rec)
+			sam.PutInFreePool(rec)
+			if err := w.Err(); err != nil {
+				m.err.Set(err)
+				return false
+			}
+			return true
+		})
+		m.err.Set(w.Close())
+	})
+	return m.close()
+}
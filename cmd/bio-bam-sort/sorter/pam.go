@@ -36,7 +36,7 @@ func computePAMShardBounds(
 	// Sort the starting keys for all the blocks in increasing order.
 	for _, shard := range shards {
 		for _, block := range shard {
-			allKeys = append(allKeys, sortKey{recCoord(block.StartKey), block.StartSeq})
+			allKeys = append(allKeys, sortKey{coord: recCoord(block.StartKey), seq: block.StartSeq})
 			totalRecords += int64(block.NumRecords)
 		}
 		totalBlocks += int64(len(shard))
@@ -73,7 +73,7 @@ func computePAMShardBounds(
 func startFileOffset(blocks []biopb.SortShardBlockIndex, coord recCoord) int64 {
 	key := sortKey{coord: coord, seq: 0}
 	n := sort.Search(len(blocks), func(i int) bool {
-		b := sortKey{recCoord(blocks[i].StartKey), blocks[i].StartSeq}
+		b := sortKey{coord: recCoord(blocks[i].StartKey), seq: blocks[i].StartSeq}
 		return b.compare(key) >= 0
 	})
 	// blocks[n] is the first block >= "coord"
@@ -81,7 +81,7 @@ func startFileOffset(blocks []biopb.SortShardBlockIndex, coord recCoord) int64 {
 		return int64(blocks[len(blocks)-1].FileOffset)
 	}
 	// If block[n] starts exactly at "key", then block[n] is the starting point.
-	b := sortKey{recCoord(blocks[n].StartKey), blocks[n].StartSeq}
+	b := sortKey{coord: recCoord(blocks[n].StartKey), seq: blocks[n].StartSeq}
 	if comp := b.compare(key); comp == 0 {
 		return int64(blocks[n].FileOffset)
 	} else if comp < 0 {
@@ -99,7 +99,7 @@ func startFileOffset(blocks []biopb.SortShardBlockIndex, coord recCoord) int64 {
 func limitFileOffset(blocks []biopb.SortShardBlockIndex, coord recCoord) int64 {
 	key := sortKey{coord: coord, seq: 0}
 	n := sort.Search(len(blocks), func(i int) bool {
-		b := sortKey{recCoord(blocks[i].StartKey), blocks[i].StartSeq}
+		b := sortKey{coord: recCoord(blocks[i].StartKey), seq: blocks[i].StartSeq}
 		return b.compare(key) >= 0
 	})
 	// blocks[n:] are the blocks that we can exclude.
@@ -137,16 +137,17 @@ func recCoordToRecAddr(coord recCoord) (r biopb.Coord) {
 	}
 }
 
-// Generate one PAM rowshard that stores reads in range [start, limit).
+// Generate one PAM rowshard that stores reads in range [start, limit). The
+// range in baseOpts is ignored.
 func generatePAMShard(readers []*sortShardReader,
 	path string,
 	header *sam.Header,
 	start, limit recCoord,
+	baseOpts pam.WriteOpts,
 	pool *sortShardBlockPool,
 	errReporter *errors.Once) {
-	opts := pam.WriteOpts{
-		Range: biopb.CoordRange{recCoordToRecAddr(start), recCoordToRecAddr(limit)},
-	}
+	opts := baseOpts
+	opts.Range = biopb.CoordRange{recCoordToRecAddr(start), recCoordToRecAddr(limit)}
 	vlog.VI(1).Infof("%v: Generating PAM shard %+v", path, opts)
 	pamWriter := pam.NewWriter(opts, header, path)
 	readCallback := func(key sortKey, data []byte) bool {
@@ -162,14 +163,15 @@ func generatePAMShard(readers []*sortShardReader,
 				return false
 			}
 			pamWriter.Write(rec)
-			if pamWriter.Err() != nil {
-				vlog.Fatalf("ERR: %+v, opts %+v key %+v, limit %+v", pamWriter.Err(), opts, key, limit)
-			}
 			sam.PutInFreePool(rec)
+			if err := pamWriter.Err(); err != nil {
+				vlog.Errorf("%v: key %+v, opts %+v: %v", path, key, opts, err)
+				return false
+			}
 		}
 		return true
 	}
-	internalMergeShards(readers, readCallback, pool, errReporter)
+	internalMergeShards(sortShardSources(readers), readCallback, pool, errReporter)
 	errReporter.Set(pamWriter.Close())
 }
 
@@ -178,8 +180,15 @@ type generatePAMShardRequest struct {
 }
 
 // PAMFromSortShards merges a set of sortshard files into a single PAM file.
-// recordsPerShard is the goal # of reads to store in each rowshard.
+// recordsPerShard is the goal # of reads to store in each rowshard. The
+// sortshards must be in the coordinate order.
 func PAMFromSortShards(paths []string, pamPath string, recordsPerShard int64, parallelism int) error {
+	return pamFromSortShards(paths, pamPath, recordsPerShard, parallelism, pam.WriteOpts{})
+}
+
+// pamFromSortShards is the same as PAMFromSortShards, but it passes opts to
+// pam.NewWriter when creating each rowshard. opts.Range is ignored.
+func pamFromSortShards(paths []string, pamPath string, recordsPerShard int64, parallelism int, opts pam.WriteOpts) error {
 	if len(paths) == 0 {
 		return fmt.Errorf("No shards to merge")
 	}
@@ -201,6 +210,11 @@ func PAMFromSortShards(paths []string, pamPath string, recordsPerShard int64, pa
 	if err := errReporter.Err(); err != nil {
 		return err
 	}
+	for _, r := range baseReaders {
+		if r.index.QueryName {
+			return fmt.Errorf("%v: sortshard %v is sorted by queryname, but PAM requires the coordinate order", pamPath, r.path)
+		}
+	}
 	mergedHeader, err := mergeHeader(baseReaders)
 	if err != nil {
 		return err
@@ -224,7 +238,7 @@ func PAMFromSortShards(paths []string, pamPath string, recordsPerShard int64, pa
 					}
 					subReaders[i] = newSortShardReader(path, pool, &errReporter, opts)
 				}
-				generatePAMShard(subReaders, pamPath, mergedHeader, req.start, req.limit, pool, &errReporter)
+				generatePAMShard(subReaders, pamPath, mergedHeader, req.start, req.limit, opts, pool, &errReporter)
 				vlog.Infof("%s: finished generating PAM shard %+v", pamPath, req)
 			}
 		}()
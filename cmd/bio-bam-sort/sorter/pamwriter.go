@@ -0,0 +1,118 @@
+package sorter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+// DefaultRecordsPerPAMShard is the default value for
+// PAMWriterOpts.RecordsPerShard.
+const DefaultRecordsPerPAMShard = 128 << 20
+
+// PAMWriterOpts controls the behavior of PAMWriter.
+type PAMWriterOpts struct {
+	// SortOptions is passed to the sorter that buffers the records. Its TmpDir
+	// is also used to store the intermediate sortshard file. SortOrder must be
+	// unset or sam.Coordinate, since PAM requires the coordinate order.
+	SortOptions SortOptions
+
+	// WriteOpts is passed to pam.NewWriter when creating each PAM rowshard.
+	// WriteOpts.Range is ignored; the rowshard ranges are computed from the
+	// records.
+	WriteOpts pam.WriteOpts
+
+	// RecordsPerShard is the goal # of reads to store in each rowshard. If <=
+	// 0, DefaultRecordsPerPAMShard is used.
+	RecordsPerShard int64
+
+	// Parallelism is the number of rowshards generated concurrently in Close.
+	// If <= 0, DefaultParallelism is used.
+	Parallelism int
+}
+
+// PAMWriter creates a PAM file from records added in an arbitrary order. Unlike
+// pam.Writer, which requires the records to be sorted by coordinate, PAMWriter
+// sorts the records using a Sorter, spilling them to a temporary sortshard
+// file, then merges the sortshard into PAM rowshards on Close.
+//
+// Example:
+//   w := sorter.NewPAMWriter("foo.pam", header, sorter.PAMWriterOpts{})
+//   for _, rec := range recordsInAnyOrder {
+//     w.Write(rec)
+//   }
+//   err := w.Close()
+type PAMWriter struct {
+	path      string
+	opts      PAMWriterOpts
+	shardPath string // the temporary sortshard file
+	sorter    *Sorter
+	err       error
+}
+
+// NewPAMWriter creates a PAMWriter that produces a PAM file in "path". Existing
+// contents of "path", if any, are destroyed on Close. "header" must contain all
+// the references used by the records to be written.
+func NewPAMWriter(path string, header *sam.Header, opts PAMWriterOpts) *PAMWriter {
+	if opts.RecordsPerShard <= 0 {
+		opts.RecordsPerShard = DefaultRecordsPerPAMShard
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = DefaultParallelism
+	}
+	w := &PAMWriter{path: path, opts: opts}
+	if order := opts.SortOptions.SortOrder; order != sam.UnknownOrder && order != sam.Coordinate {
+		w.err = fmt.Errorf("%v: PAM requires the coordinate order, but sort order '%v' is specified", path, order)
+		return w
+	}
+	temp, err := ioutil.TempFile(opts.SortOptions.TmpDir, "pamwriter")
+	if err != nil {
+		w.err = err
+		return w
+	}
+	w.shardPath = temp.Name()
+	if err := temp.Close(); err != nil {
+		w.err = err
+		return w
+	}
+	if opts.SortOptions.ShardIndex == 0 {
+		// Records are merged from only one sortshard, so any value will do.
+		opts.SortOptions.ShardIndex = 1
+	}
+	w.sorter = NewSorter(w.shardPath, header, opts.SortOptions)
+	return w
+}
+
+// Write adds a record. The writer takes ownership of "rec". The caller shall
+// not read or write "rec" after the call.
+func (w *PAMWriter) Write(rec *sam.Record) {
+	if w.err != nil {
+		return
+	}
+	w.sorter.AddRecord(rec)
+}
+
+// Close sorts the records and writes the PAM file. It must be called exactly
+// once after adding all the records. It blocks the caller until the PAM file is
+// generated.
+func (w *PAMWriter) Close() error {
+	if w.shardPath == "" {
+		return w.err
+	}
+	defer func() {
+		if err := os.Remove(w.shardPath); err != nil {
+			vlog.Errorf("%v: failed to remove sortshard %v: %v", w.path, w.shardPath, err)
+		}
+	}()
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.sorter.Close(); err != nil {
+		return err
+	}
+	return pamFromSortShards([]string{w.shardPath}, w.path, w.opts.RecordsPerShard, w.opts.Parallelism, w.opts.WriteOpts)
+}
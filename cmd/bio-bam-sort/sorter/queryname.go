@@ -0,0 +1,109 @@
+package sorter
+
+import (
+	"github.com/grailbio/hts/sam"
+)
+
+// In the queryname order, sortKey.name stores the read name, and sortKey.coord
+// stores the Read1 and Read2 flag bits, so that records with the same name are
+// sorted Read1 first.
+const queryNameFlagMask = sam.Read1 | sam.Read2
+
+// makeQueryNameSortKey creates a sortKey for the queryname order.
+func makeQueryNameSortKey(rec *sam.Record, seq uint64) sortKey {
+	return sortKey{
+		coord: recCoord(rec.Flags & queryNameFlagMask),
+		seq:   seq,
+		name:  []byte(rec.Name),
+	}
+}
+
+// Offsets of fields in a BAM-serialized record, including the leading 4-byte
+// length field. Cf. the SAM specification, section 4.2.
+const (
+	bamReadNameLenOffset = 12
+	bamReadNameOffset    = 36
+)
+
+// nameFromBAMRecord extracts the read name from a BAM-serialized record.  The
+// result is a subslice of body. It returns an empty, non-nil slice if body is
+// too short.
+func nameFromBAMRecord(body []byte) []byte {
+	if len(body) < bamReadNameOffset {
+		return body[:0]
+	}
+	n := int(body[bamReadNameLenOffset]) - 1 // exclude the trailing NUL.
+	if n <= 0 || bamReadNameOffset+n > len(body) {
+		return body[:0]
+	}
+	return body[bamReadNameOffset : bamReadNameOffset+n]
+}
+
+func isDigit(ch byte) bool { return ch >= '0' && ch <= '9' }
+
+// strnumCompare compares two read names in the "natural" order, where runs of
+// digits are compared numerically, e.g., "r2" < "r10". It returns a negative
+// value, 0, or a positive value if a < b, a == b, a > b, respectively. It is a
+// port of strnum_cmp in samtools bam_sort.c, so the resulting order is the same
+// as "samtools sort -n".
+func strnumCompare(a, b []byte) int {
+	// at returns s[i], or 0 at the end of s, mimicking a NUL-terminated string.
+	at := func(s []byte, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+	pa, pb := 0, 0
+	for pa < len(a) && pb < len(b) {
+		if isDigit(a[pa]) && isDigit(b[pb]) {
+			for at(a, pa) == '0' {
+				pa++
+			}
+			for at(b, pb) == '0' {
+				pb++
+			}
+			for isDigit(at(a, pa)) && isDigit(at(b, pb)) && a[pa] == b[pb] {
+				pa++
+				pb++
+			}
+			ca, cb := at(a, pa), at(b, pb)
+			switch {
+			case isDigit(ca) && isDigit(cb):
+				i := 0
+				for isDigit(at(a, pa+i)) && isDigit(at(b, pb+i)) {
+					i++
+				}
+				if isDigit(at(a, pa+i)) {
+					return 1
+				}
+				if isDigit(at(b, pb+i)) {
+					return -1
+				}
+				return int(ca) - int(cb)
+			case isDigit(ca):
+				return 1
+			case isDigit(cb):
+				return -1
+			case pa != pb:
+				if pa < pb {
+					return 1
+				}
+				return -1
+			}
+		} else {
+			if a[pa] != b[pb] {
+				return int(a[pa]) - int(b[pb])
+			}
+			pa++
+			pb++
+		}
+	}
+	if pa < len(a) {
+		return 1
+	}
+	if pb < len(b) {
+		return -1
+	}
+	return 0
+}
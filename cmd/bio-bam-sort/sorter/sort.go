@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"runtime"
@@ -17,8 +18,8 @@ import (
 	"github.com/grailbio/base/vcontext"
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/hts/bam"
-	"github.com/grailbio/hts/bgzf"
 	"github.com/grailbio/hts/sam"
+	"github.com/klauspost/compress/gzip"
 	"v.io/x/lib/vlog"
 ) // DefaultSortBatchSize is the default number of records to keep in memory
 // before resorting to external sorting.
@@ -54,6 +55,15 @@ type SortOptions struct {
 	// TmpDir defines the directory to store temp files created during merge.  ""
 	// means the system default, usually /tmp.
 	TmpDir string
+
+	// SortOrder is either sam.Coordinate or sam.QueryName. sam.UnknownOrder
+	// (default) means sam.Coordinate. In the queryname order, records are
+	// sorted by read name, comparing runs of digits numerically, in the same way
+	// as "samtools sort -n". Records with the same name are sorted Read1 first,
+	// so the records of a template are grouped together. All the sortshards merged into one file
+	// must use the same order. A queryname-sorted sortshard cannot be converted
+	// into PAM.
+	SortOrder sam.SortOrder
 }
 
 // recCoord encodes reference id, alignment position, and the reverse flag.  Sort
@@ -72,15 +82,30 @@ type sortKey struct {
 	// Seq breaks ties between reads with the same key.  In practice, it is
 	// (SortOptions.ShardIndex<<32 | position of the read in the file)
 	seq uint64
+
+	// Name is the read name in the queryname order. It is nil in the coordinate
+	// order. Cf. makeQueryNameSortKey.
+	name []byte
 }
 
 func (k sortKey) String() string {
+	if k.name != nil {
+		return fmt.Sprintf("(%s,%x,%d)", k.name, uint64(k.coord), k.seq)
+	}
 	refid, pos, reverse := parseCoord(k.coord)
 	return fmt.Sprintf("(%d,%d,%v,%d)", refid, pos, reverse, k.seq)
 }
 
 // Return -1, 0, 1 if k0 < k1, k0==k1, k0 > k1, respectively.
 func (k0 sortKey) compare(k1 sortKey) int {
+	if k0.name != nil || k1.name != nil {
+		if c := strnumCompare(k0.name, k1.name); c != 0 {
+			if c < 0 {
+				return -1
+			}
+			return 1
+		}
+	}
 	if k0.coord < k1.coord {
 		return -1
 	}
@@ -97,7 +122,7 @@ func (k0 sortKey) compare(k1 sortKey) int {
 }
 
 func makeSortKey(rec *sam.Record, seq uint64) sortKey {
-	return sortKey{coordFromRecord(rec), seq}
+	return sortKey{coord: coordFromRecord(rec), seq: seq}
 }
 
 func coordFromRecord(rec *sam.Record) (key recCoord) {
@@ -157,14 +182,15 @@ const unmappedCoord recCoord = 0x7ffffffffffffffe
 // files into a BAM file. "header" must contain all the references used by
 // records to be added later.
 //
-// Sorter orders records in the following way:
+// By default, Sorter orders records in the following way:
 //
 // - Increasing reference sequence IDs, then
 // - increasing alignment positions, then
 // - sorts a forward read before a reverse read.
 // - All else equal, sorts records the order of appearance in the input (i.e., stable sort)
 //
-// These criteria are the same as "samtool sort" and "sambamba sort".
+// These criteria are the same as "samtool sort" and "sambamba sort". Cf.
+// SortOptions.SortOrder for the queryname order.
 //
 // Example:
 //   sorter := NewSorter("tmp0.sort", header)
@@ -194,23 +220,39 @@ type Sorter struct {
 	shards []string // pathnames of temp sortshard files.
 }
 
-// A thin wrapper around sortShardReader to read a shard file and do
+// mergeSource is a sequence of BAM-serialized records sorted by sortKey. It is
+// implemented by sortShardReader and sortedFileReader.
+type mergeSource interface {
+	// scan advances to the next record. It returns false on EOD or error.
+	scan() bool
+	// key returns the key of the current record.
+	key() sortKey
+	// body returns the current BAM-serialized record, including the leading
+	// 4-byte length field.
+	body() []byte
+	// drain should be called when quitting reads before reaching the end.
+	drain()
+	// name returns the path of the source, for logging only.
+	name() string
+}
+
+// A thin wrapper around mergeSource to read a shard file and do
 // reference-ID translations.
 type mergeLeaf struct {
 	// Index is a number (0,1,2..) arbitrarily assigned to distinguish mergeLeafs
 	// that are merged into one destination.
 	seq    int
 	name   string // the path of shard file; for logging only.
-	reader *sortShardReader
+	reader mergeSource
 	done   bool // reader.scan() returned false?
 	err    *errors.Once
 }
 
-func newMergeLeaf(seq int, reader *sortShardReader,
+func newMergeLeaf(seq int, reader mergeSource,
 	pool *sortShardBlockPool, errorReporter *errors.Once) *mergeLeaf {
 	leaf := mergeLeaf{
 		seq:    seq,
-		name:   reader.path,
+		name:   reader.name(),
 		reader: reader,
 		err:    errorReporter,
 	}
@@ -242,13 +284,13 @@ func (s *Sorter) mergeShards(paths []string, header *sam.Header, outPath string)
 	for i, path := range paths {
 		shardReaders[i] = newSortShardReader(path, s.sortBlockPool, &s.err)
 	}
-	writer := newSortShardWriter(out.Writer(ctx), !s.options.NoCompressTmpFiles, true, header,
+	writer := newSortShardWriter(out.Writer(ctx), !s.options.NoCompressTmpFiles, true, s.queryName(), header,
 		s.sortBlockPool, &s.err)
 	callback := func(key sortKey, data []byte) bool {
 		writer.add(key, data)
 		return true
 	}
-	internalMergeShards(shardReaders, callback, s.sortBlockPool, &s.err)
+	internalMergeShards(sortShardSources(shardReaders), callback, s.sortBlockPool, &s.err)
 	writer.finish()
 	s.err.Set(out.Close(ctx))
 }
@@ -257,7 +299,7 @@ func (s *Sorter) mergeShards(paths []string, header *sam.Header, outPath string)
 // then readCallback is called sequentially for each record in sort order.  If
 // readCallback returns false, this function exits immediately.
 func internalMergeShards(
-	shards []*sortShardReader,
+	shards []mergeSource,
 	readCallback func(key sortKey, body []byte) bool,
 	pool *sortShardBlockPool,
 	errReporter *errors.Once) {
@@ -346,6 +388,9 @@ func NewSorter(outPath string, header *sam.Header, optList ...SortOptions) *Sort
 	if options.Parallelism <= 0 {
 		options.Parallelism = DefaultParallelism
 	}
+	if options.SortOrder == sam.UnknownOrder {
+		options.SortOrder = sam.Coordinate
+	}
 	vlog.VI(1).Infof("New Sorter: %v, %+v", outPath, options)
 	sorter := &Sorter{
 		options:       options,
@@ -355,6 +400,10 @@ func NewSorter(outPath string, header *sam.Header, optList ...SortOptions) *Sort
 		sortBlockPool: newSortShardBlockPool(),
 		bgSorterCh:    make(chan sortBatch, options.Parallelism),
 	}
+	if options.SortOrder != sam.Coordinate && options.SortOrder != sam.QueryName {
+		sorter.err.Set(fmt.Errorf("sort %v: unsupported sort order '%v'; it must be either %v or %v",
+			outPath, options.SortOrder, sam.Coordinate, sam.QueryName))
+	}
 	for i := 0; i < options.Parallelism; i++ {
 		sorter.wg.Add(1)
 		go func() {
@@ -380,6 +429,32 @@ func (s *Sorter) AddRecord(rec *sam.Record) {
 	}
 }
 
+// queryName returns true if the records are sorted in the queryname order.
+func (s *Sorter) queryName() bool {
+	return s.options.SortOrder == sam.QueryName
+}
+
+// makeSortKey creates a sortKey for the sort order of the sorter.
+func (s *Sorter) makeSortKey(rec *sam.Record, seq uint64) sortKey {
+	if s.queryName() {
+		return makeQueryNameSortKey(rec, seq)
+	}
+	return makeSortKey(rec, seq)
+}
+
+// keyedRecords is for sorting records with precomputed sortKeys.
+type keyedRecords struct {
+	keys []sortKey
+	recs []*sam.Record
+}
+
+func (r keyedRecords) Len() int           { return len(r.recs) }
+func (r keyedRecords) Less(i, j int) bool { return r.keys[i].compare(r.keys[j]) < 0 }
+func (r keyedRecords) Swap(i, j int) {
+	r.keys[i], r.keys[j] = r.keys[j], r.keys[i]
+	r.recs[i], r.recs[j] = r.recs[j], r.recs[i]
+}
+
 func (s *Sorter) startGenerateSortShard() {
 	s.bgSorterCh <- sortBatch{
 		recs:           s.recs,
@@ -396,21 +471,20 @@ func (s *Sorter) sortRecords(records []*sam.Record, sortTieBreaker uint64) strin
 		s.err.Set(err)
 		return ""
 	}
-	sort.SliceStable(records, func(i, j int) bool {
-		ki := makeSortKey(records[i], 0)
-		kj := makeSortKey(records[j], 0)
-		return ki.compare(kj) < 0
-	})
-	writer := newSortShardWriter(temp, !s.options.NoCompressTmpFiles, false, nil, s.sortBlockPool, &s.err)
-	for _, rec := range records {
+	keys := make([]sortKey, len(records))
+	for i, rec := range records {
+		keys[i] = s.makeSortKey(rec, sortTieBreaker)
+	}
+	sort.Stable(keyedRecords{keys, records})
+	writer := newSortShardWriter(temp, !s.options.NoCompressTmpFiles, false, s.queryName(), nil, s.sortBlockPool, &s.err)
+	for i, rec := range records {
 		smallBuf.Reset()
 		if err := bam.Marshal(rec, &smallBuf); err != nil {
 			s.err.Set(err)
 			continue
 		}
 		marshalled := smallBuf.Bytes()
-		key := makeSortKey(rec, sortTieBreaker)
-		writer.add(key, marshalled)
+		writer.add(keys[i], marshalled)
 		// Note: don't call sam.PutInFreePool since rec may be produced by the
 		// native biogo code.
 	}
@@ -469,11 +543,21 @@ func mergeHeader(shards []*sortShardReader) (*sam.Header, error) {
 		}
 	}
 	header.SortOrder = sam.Coordinate
+	for _, shard := range shards {
+		if shard.index.QueryName != shards[0].index.QueryName {
+			return nil, fmt.Errorf("%s, %s: cannot merge sortshards with different sort orders", shards[0].path, shard.path)
+		}
+	}
+	if shards[0].index.QueryName {
+		header.SortOrder = sam.QueryName
+	}
 	header.GroupOrder = shardHeaders[0].GroupOrder
 	return header, nil
 }
 
 // BAMFromSortShards merges a set of sortshard files into a single BAM file.
+// If the BAM file is sorted by coordinate, it also writes its .bai (or .csi)
+// index, and its .gbai index, next to the BAM file.
 func BAMFromSortShards(paths []string, bamPath string) error {
 	if len(paths) == 0 {
 		return fmt.Errorf("No shards to merge")
@@ -498,31 +582,96 @@ func BAMFromSortShards(paths []string, bamPath string) error {
 	}
 
 	ctx := vcontext.Background()
-	out, err := file.Create(ctx, bamPath)
+	var outs []file.File
+	create := func(path string) (io.Writer, error) {
+		f, err := file.Create(ctx, path)
+		if err != nil {
+			for _, out := range outs {
+				out.Close(ctx) // nolint: errcheck
+			}
+			return nil, err
+		}
+		outs = append(outs, f)
+		return f.Writer(ctx), nil
+	}
+	out, err := create(bamPath)
 	if err != nil {
 		// TODO(saito) Close all shard readers.
 		return err
 	}
-	gzip := bgzf.NewWriter(out.Writer(ctx), runtime.NumCPU()*4)
-	writeBytes := func(bytes []byte) {
-		_, e := gzip.Write(bytes)
-		errReporter.Set(e)
+	var indexOpts gbam.ShardedBAMIndexOpts
+	if mergedHeader.SortOrder == sam.Coordinate {
+		indexOpts.IndexFormat = gbam.IndexFormatFor(mergedHeader)
+		if indexOpts.Index, err = create(bamPath + indexOpts.IndexFormat.Ext()); err != nil {
+			return err
+		}
+		if indexOpts.GIndex, err = create(bamPath + ".gbai"); err != nil {
+			return err
+		}
 	}
-
-	// Write the BAM header.
-	var buf bytes.Buffer
-	if err := mergedHeader.EncodeBinary(&buf); err != nil {
+	parallelism := runtime.NumCPU()
+	w, err := gbam.NewShardedBAMWriterWithIndex(out, gzip.DefaultCompression, parallelism*4, mergedHeader, indexOpts)
+	if err != nil {
+		for _, out := range outs {
+			out.Close(ctx) // nolint: errcheck
+		}
 		return err
 	}
-	writeBytes(buf.Bytes())
 
-	// Write the BAM records.
-	readCallback := func(key sortKey, data []byte) bool {
-		writeBytes(data)
+	// Write the BAM records. The merged records are compressed in parallel,
+	// in shards of about mergeChunkSize bytes.
+	type chunk struct {
+		shardIdx int
+		data     []byte
+	}
+	chunkCh := make(chan chunk, parallelism)
+	wg := sync.WaitGroup{}
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := w.GetCompressor()
+			failed := false
+			for ch := range chunkCh {
+				if failed {
+					// The writer has failed. Drain the remaining chunks, so
+					// that the merger does not block.
+					continue
+				}
+				if err := c.StartShard(ch.shardIdx); err != nil {
+					errReporter.Set(err)
+					failed = true
+					continue
+				}
+				errReporter.Set(c.AddSerializedRecords(ch.data))
+				errReporter.Set(c.CloseShard())
+			}
+		}()
+	}
+	var data []byte
+	shardIdx := 0
+	readCallback := func(key sortKey, body []byte) bool {
+		if errReporter.Err() != nil {
+			// Stop merging on the first error.
+			return false
+		}
+		data = append(data, body...)
+		if len(data) >= mergeChunkSize {
+			chunkCh <- chunk{shardIdx, data}
+			data = nil
+			shardIdx++
+		}
 		return true
 	}
-	internalMergeShards(shardReaders, readCallback, pool, &errReporter)
-	errReporter.Set(gzip.Close())
-	errReporter.Set(out.Close(ctx))
+	internalMergeShards(sortShardSources(shardReaders), readCallback, pool, &errReporter)
+	if len(data) > 0 && errReporter.Err() == nil {
+		chunkCh <- chunk{shardIdx, data}
+	}
+	close(chunkCh)
+	wg.Wait()
+	errReporter.Set(w.Close())
+	for _, out := range outs {
+		errReporter.Set(out.Close(ctx))
+	}
 	return errReporter.Err()
 }
@@ -22,6 +22,7 @@ import (
 	"github.com/grailbio/base/grail"
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/pam"
 	"github.com/grailbio/hts/bam"
 	"github.com/grailbio/hts/bgzf"
 	"github.com/grailbio/hts/sam"
@@ -229,6 +230,27 @@ func TestSortPAMEndToEnd(t *testing.T) {
 	}
 }
 
+func TestPAMWriter(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup)
+
+	for _, bamPath := range testBAMFiles {
+		newPAMPath := filepath.Join(tempDir, "test.pam")
+		log.Printf("Writing %v to %v", bamPath, newPAMPath)
+		header, recs := shuffleRecords(t, bamPath, "")
+		w := NewPAMWriter(newPAMPath, header, PAMWriterOpts{
+			SortOptions:     SortOptions{SortBatchSize: 1000, TmpDir: tempDir},
+			WriteOpts:       pam.WriteOpts{Transformers: []string{"zstd 1"}},
+			RecordsPerShard: 3000,
+		})
+		for _, rec := range recs {
+			w.Write(rec)
+		}
+		require.NoError(t, w.Close())
+		compareFiles(t, bamPath, newPAMPath)
+	}
+}
+
 func TestEmpty(t *testing.T) {
 	tempDir, cleanup := testutil.TempDir(t, "", "")
 	defer testutil.NoCleanupOnError(t, cleanup)
@@ -278,7 +300,7 @@ read11	12	*	0	0	10M	*	0	0	ACGTACGTAC	ABCDEFGHIJ	RG:Z:NA12879
 	require.NoError(t, err)
 	pamPath := filepath.Join(tempDir, "test.pam")
 	generatePAMShard([]*sortShardReader{shardReader},
-		pamPath, header, unmappedCoord, infinityCoord, pool, &errReporter)
+		pamPath, header, unmappedCoord, infinityCoord, pam.WriteOpts{}, pool, &errReporter)
 	require.NoError(t, errReporter.Err())
 	_, recs := readRecords(t, pamPath)
 	log.Printf("Read recs: %v", recs)
@@ -326,6 +348,122 @@ read3	0	chr2	123	60	10M	=	456	20	GGGGGGGGGG	ABCDEFGHIJ	NM:i:1
 		n++
 	}
 	assert.Equal(t, n, len(expected))
+
+	// The BAM file can be read through either of the indexes written with it.
+	for _, indexPath := range []string{bamPath + ".bai", bamPath + ".gbai"} {
+		provider := bamprovider.NewProvider(bamPath, bamprovider.ProviderOpts{Index: indexPath})
+		shards, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{IncludeUnmapped: true})
+		require.NoError(t, err)
+		var names []string
+		for _, shard := range shards {
+			iter := provider.NewIterator(shard)
+			for iter.Scan() {
+				names = append(names, iter.Record().Name)
+			}
+			require.NoError(t, iter.Close())
+		}
+		require.NoError(t, provider.Close())
+		assert.Equal(t, expected, names, "index=%s", indexPath)
+	}
+}
+
+// pamFromSAM sorts the SAM records into a PAM file.
+func pamFromSAM(t *testing.T, pamPath, samText string) {
+	shardPath := pamPath + ".shard"
+	sortSAM(t, SortOptions{ShardIndex: 1}, shardPath, samText)
+	require.NoError(t, PAMFromSortShards([]string{shardPath}, pamPath, 1024, 2))
+}
+
+func TestMergeSortedFiles(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup)
+
+	pam0 := filepath.Join(tempDir, "in0.pam")
+	pam1 := filepath.Join(tempDir, "in1.pam")
+	pamFromSAM(t, pam0, `@HD	VN:1.3	SO:coordinate
+@SQ	SN:chr1	LN:10000
+read1	0	chr1	123	60	10M	=	456	20	AAAAAAAAAA	ABCDEFGHIJ	NM:i:1
+read4	0	chr1	5000	60	10M	=	456	20	TTTTTTTTTT	ABCDEFGHIJ	NM:i:1
+`)
+	pamFromSAM(t, pam1, `@HD	VN:1.3	SO:coordinate
+@SQ	SN:chr1	LN:10000
+@SQ	SN:chr2	LN:9999
+read2	0	chr1	100	60	10M	=	456	20	CCCCCCCCCC	ABCDEFGHIJ	NM:i:1
+read3	0	chr1	4000	60	10M	=	456	20	GGGGGGGGGG	ABCDEFGHIJ	NM:i:1
+read5	0	chr2	123	60	10M	=	456	20	ACACACACAC	ABCDEFGHIJ	NM:i:1
+read6	4	*	0	0	10M	*	0	0	ACGTACGTAC	ABCDEFGHIJ
+`)
+	expected := []string{"read2", "read1", "read3", "read4", "read5", "read6"}
+	// Use small shards so that the records are spread across multiple shards.
+	opts := MergeOpts{BasesPerShard: 1000, Parallelism: 3}
+
+	checkRecords := func(path string) {
+		header, recs := readRecords(t, path)
+		require.Contains(t, headerString(t, header), "@SQ	SN:chr1	LN:10000")
+		require.Contains(t, headerString(t, header), "@SQ	SN:chr2	LN:9999")
+		assert.Equal(t, sam.Coordinate, header.SortOrder)
+		require.Equalf(t, len(expected), len(recs), "recs=%v", recs)
+		for i, rec := range recs {
+			assert.Equalf(t, expected[i], rec.Name, "rec=%+v", rec)
+		}
+	}
+	bamPath := filepath.Join(tempDir, "test.bam")
+	require.NoError(t, BAMFromSortedFiles([]string{pam0, pam1}, bamPath, opts))
+	checkRecords(bamPath)
+
+	pamPath := filepath.Join(tempDir, "test.pam")
+	require.NoError(t, PAMFromSortedFiles([]string{pam0, pam1}, pamPath, opts))
+	checkRecords(pamPath)
+
+	// The references must be ordered consistently across the inputs.
+	pam2 := filepath.Join(tempDir, "in2.pam")
+	pamFromSAM(t, pam2, `@HD	VN:1.3	SO:coordinate
+@SQ	SN:chr2	LN:9999
+@SQ	SN:chr1	LN:10000
+read7	0	chr1	123	60	10M	=	456	20	AAAAAAAAAA	ABCDEFGHIJ	NM:i:1
+`)
+	err := BAMFromSortedFiles([]string{pam1, pam2}, bamPath, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ordered differently")
+
+	// The strand is not part of the coordinate sort order, so a reverse read
+	// may precede a forward read at the same position. The input is written
+	// as is, without going through the sorter.
+	bam3 := filepath.Join(tempDir, "in3.bam")
+	sr, err := sam.NewReader(strings.NewReader(`@HD	VN:1.3	SO:coordinate
+@SQ	SN:chr1	LN:10000
+read8	16	chr1	200	60	10M	*	0	0	AAAAAAAAAA	ABCDEFGHIJ
+read9	0	chr1	200	60	10M	*	0	0	CCCCCCCCCC	ABCDEFGHIJ
+`))
+	require.NoError(t, err)
+	out, err := os.Create(bam3)
+	require.NoError(t, err)
+	bw, err := bam.NewWriter(out, sr.Header(), 1)
+	require.NoError(t, err)
+	for {
+		rec, err := sr.Read()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, bw.Write(rec))
+	}
+	require.NoError(t, bw.Close())
+	require.NoError(t, out.Close())
+	in, err := os.Open(bam3)
+	require.NoError(t, err)
+	indexOut, err := os.Create(bam3 + ".bai")
+	require.NoError(t, err)
+	require.NoError(t, gbam.WriteIndex(indexOut, in, gbam.BAIFormat, 1))
+	require.NoError(t, indexOut.Close())
+	require.NoError(t, in.Close())
+	require.NoError(t, BAMFromSortedFiles([]string{pam0, bam3}, bamPath, opts))
+	_, recs := readRecords(t, bamPath)
+	var names []string
+	for _, rec := range recs {
+		names = append(names, rec.Name)
+	}
+	assert.Equal(t, []string{"read1", "read8", "read9", "read4"}, names)
 }
 
 // Merge two shards with the same shard index.  The resulting BAM should contain
@@ -360,6 +498,63 @@ read1	0	chr1	123	60	10M	=	456	20	AAAAAAAAAA	ABCDEFGHIJ	NM:i:1
 	assert.Equal(t, n, len(expected))
 }
 
+func TestStrnumCompare(t *testing.T) {
+	names := []string{"r10", "r2", "a", "r1", "r1a", "b1:10", "b1:9", "", "r"}
+	sort.SliceStable(names, func(i, j int) bool {
+		return strnumCompare([]byte(names[i]), []byte(names[j])) < 0
+	})
+	assert.Equal(t, []string{"", "a", "b1:9", "b1:10", "r", "r1", "r1a", "r2", "r10"}, names)
+}
+
+func TestQueryName(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup)
+
+	shard0 := fmt.Sprintf("%s/shard0", tempDir)
+	shard1 := fmt.Sprintf("%s/shard1", tempDir)
+	opts := SortOptions{SortOrder: sam.QueryName}
+	opts.ShardIndex = 1
+	sortSAM(t, opts, shard0, `@HD	VN:1.3	SO:coordinate
+@SQ	SN:chr1	LN:10000
+read10	129	chr1	100	60	10M	=	456	20	AAAAAAAAAA	ABCDEFGHIJ
+read2	129	chr1	200	60	10M	=	456	20	CCCCCCCCCC	ABCDEFGHIJ
+read1	65	chr1	300	60	10M	=	456	20	GGGGGGGGGG	ABCDEFGHIJ
+`)
+	opts.ShardIndex = 2
+	sortSAM(t, opts, shard1, `@HD	VN:1.3	SO:coordinate
+@SQ	SN:chr1	LN:10000
+read10	65	chr1	400	60	10M	=	456	20	TTTTTTTTTT	ABCDEFGHIJ
+read2	65	chr1	500	60	10M	=	456	20	ACACACACAC	ABCDEFGHIJ
+`)
+	bamPath := filepath.Join(tempDir, "test.bam")
+	require.NoError(t, BAMFromSortShards([]string{shard0, shard1}, bamPath))
+	header, recs := readRecords(t, bamPath)
+	require.Equal(t, sam.QueryName, header.SortOrder)
+	expected := []string{"read1/65", "read2/65", "read2/129", "read10/65", "read10/129"}
+	require.Equal(t, len(expected), len(recs))
+	for i, rec := range recs {
+		assert.Equalf(t, expected[i], fmt.Sprintf("%s/%d", rec.Name, rec.Flags), "rec=%+v", rec)
+	}
+
+	// PAM requires the coordinate order.
+	pamPath := filepath.Join(tempDir, "test.pam")
+	err := PAMFromSortShards([]string{shard0, shard1}, pamPath, 1024, 2)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "PAM requires the coordinate order")
+	w := NewPAMWriter(pamPath, header, PAMWriterOpts{SortOptions: opts})
+	assert.Error(t, w.Close())
+
+	// Sortshards with different orders cannot be merged.
+	shard2 := fmt.Sprintf("%s/shard2", tempDir)
+	sortSAM(t, SortOptions{ShardIndex: 3}, shard2, `@HD	VN:1.3	SO:coordinate
+@SQ	SN:chr1	LN:10000
+read3	0	chr1	123	60	10M	=	456	20	AAAAAAAAAA	ABCDEFGHIJ
+`)
+	err = BAMFromSortShards([]string{shard0, shard2}, bamPath)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "different sort orders")
+}
+
 func runCmd(t *testing.T, sh *gosh.Shell, arg0 string, args ...string) {
 	cmd := sh.Cmd(arg0, args...)
 	cmd.Run()
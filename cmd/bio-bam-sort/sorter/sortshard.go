@@ -34,6 +34,10 @@ import (
 // Each recordio block is approx. sortShardBlockSize bytes long,
 // pre-compression.
 //
+// In the queryname order (SortShardIndex.QueryName), the key.coord field stores
+// the Read1 and Read2 flag bits instead of the coordinate. The read name part
+// of the key is not stored separately; it is extracted from the record data.
+//
 // The record trailer stores a serialized SortShardIndex.  This proto tells
 // whether the preceding data blocks are compressed or not, and it also stores
 // the file offset of each block, in case one wants to seek to it directly.
@@ -90,9 +94,10 @@ func (w *sortShardWriter) newBuf() sortShardBuf {
 
 // Create a new sortShardWriter. Any error is reported through errReporter.  If
 // parameters writeBlockIndex and header are set, the index block will contain
-// the full block offset and bam header information.
+// the full block offset and bam header information. queryName should be set iff
+// the keys are in the queryname order.
 func newSortShardWriter(out io.Writer,
-	snappy, writeBlockIndex bool,
+	snappy, writeBlockIndex, queryName bool,
 	header *sam.Header, //may be null.
 	pool *sortShardBlockPool, errReporter *errors.Once) *sortShardWriter {
 	w := &sortShardWriter{
@@ -100,7 +105,7 @@ func newSortShardWriter(out io.Writer,
 		writeBlockIndex: writeBlockIndex,
 		err:             errReporter,
 		pool:            pool,
-		index:           biopb.SortShardIndex{Snappy: snappy},
+		index:           biopb.SortShardIndex{Snappy: snappy, QueryName: queryName},
 	}
 	w.curBlock = w.newBuf()
 	if header != nil {
@@ -148,7 +153,7 @@ func (w *sortShardWriter) add(key sortKey, body []byte) {
 		vlog.Errorf("Key %v decreased, last %v", key, w.curBlock.lastKey)
 		panic("key")
 	}
-	w.curBlock.lastKey = key
+	w.curBlock.lastKey = copyKey(w.curBlock.lastKey, key)
 	if w.tryAdd(key, body) {
 		return // Common case.
 	}
@@ -234,9 +239,10 @@ func (w *sortShardWriter) tryAdd(key sortKey, body []byte) bool {
 //      vlog.Infof("Key %v, body %v", r.key(), r.body())
 //   }
 type sortShardBlockParser struct {
-	curKey  sortKey // The currennt key. EOD iff curKey.key==invalidKey.
-	curBody []byte  // The current serialized record.
-	buf     []byte  // Records that remain to be read.
+	curKey    sortKey // The currennt key. EOD iff curKey.key==invalidKey.
+	curBody   []byte  // The current serialized record.
+	buf       []byte  // Records that remain to be read.
+	queryName bool    // Keys are in the queryname order.
 }
 
 func (r *sortShardBlockParser) reset(buf sortShardBlock) {
@@ -250,7 +256,7 @@ func (r *sortShardBlockParser) reset(buf sortShardBlock) {
 func (r *sortShardBlockParser) next() {
 	if len(r.buf) <= sortShardRecordHeaderSize {
 		// The header is chopped at the end.
-		r.curKey = sortKey{invalidCoord, 0}
+		r.curKey = sortKey{coord: invalidCoord}
 		return
 	}
 	r.curKey.coord = recCoord(binary.LittleEndian.Uint64(r.buf[:8]))
@@ -265,6 +271,9 @@ func (r *sortShardBlockParser) next() {
 	}
 	r.curBody = r.buf[sortShardRecordHeaderSize : sortShardRecordHeaderSize+recLen]
 	r.buf = r.buf[sortShardRecordHeaderSize+recLen:]
+	if r.queryName {
+		r.curKey.name = nameFromBAMRecord(r.curBody)
+	}
 }
 
 func (r *sortShardBlockParser) done() bool {
@@ -353,7 +362,7 @@ func newSortShardReader(path string,
 		pool: pool,
 		err:  errReporter,
 		// The parser is initially at done() state.
-		parser: sortShardBlockParser{curKey: sortKey{invalidCoord, 0}},
+		parser: sortShardBlockParser{curKey: sortKey{coord: invalidCoord}},
 		ch:     make(chan sortShardBlock),
 	}
 
@@ -380,6 +389,7 @@ func newSortShardReader(path string,
 	} else {
 		r.index = *opts.index
 	}
+	r.parser.queryName = r.index.QueryName
 	vlog.VI(0).Infof("%v: created shard reader, range=[%v,%v)", path, opts.startOffset, opts.limitOffset)
 	if opts.startOffset > 0 {
 		r.rio.Seek(recordio.ItemLocation{uint64(opts.startOffset), 0})
@@ -413,10 +423,34 @@ func (r *sortShardReader) scan() bool {
 	if r.parser.key().compare(r.lastKey) < 0 {
 		vlog.Fatalf("Key %v decreased, last %v", r.parser.key(), r.lastKey)
 	}
-	r.lastKey = r.parser.key()
+	r.lastKey = copyKey(r.lastKey, r.parser.key())
 	return true
 }
 
+// copyKey returns a copy of key. The name of the key is copied into the buffer
+// of dst, so that the result stays valid after the block that stores the
+// original name is recycled.
+func copyKey(dst, key sortKey) sortKey {
+	if key.name != nil {
+		key.name = append(dst.name[:0], key.name...)
+	}
+	return key
+}
+
+// Return the path of the shard file.
+func (r *sortShardReader) name() string {
+	return r.path
+}
+
+// sortShardSources converts sortShardReaders to mergeSources.
+func sortShardSources(readers []*sortShardReader) []mergeSource {
+	sources := make([]mergeSource, len(readers))
+	for i, r := range readers {
+		sources[i] = r
+	}
+	return sources
+}
+
 // Drain should be called when quitting reads before reaching the end of
 // shard. It cleans up the reader state.  It's ok to call drain() after
 // successful end of reads.
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"hash"
+	"io"
+	"os"
 	"runtime"
 
 	"blainsmith.com/go/seahash"
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/log"
 	"github.com/grailbio/base/unsafe"
+	"github.com/grailbio/base/vcontext"
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/bio/encoding/pam"
 	"github.com/grailbio/hts/sam"
 )
 
@@ -40,6 +46,18 @@ type checksumOpts struct {
 	qual bool
 	// aux causes the aux tag values to be added to the checksum.
 	aux bool
+
+	// qualBins, if nonempty, causes the quality scores to be binned (Cf.
+	// pam.ParseQualBins) before being added to the checksum. It allows
+	// comparing a file against a PAM file written with the same binning.
+	qualBins []byte
+
+	// reference is needed to read a CRAM file, or a PAM file whose seq field
+	// is encoded relative to a reference.
+	reference fasta.Fasta
+
+	// format is the output format, either "json" or "tsv".
+	format string
 }
 
 // RefChecksum is the checksum of reads for one chromosome.
@@ -112,6 +130,7 @@ func (c *refChecksum) add(r *sam.Record, h hash.Hash64, opts checksumOpts) {
 		c.SumName += hashField(h, pos, unsafe.StringToBytes(r.Name))
 	}
 	if opts.all || opts.qual {
+		pam.BinQual(opts.qualBins, r.Qual)
 		c.SumQual += hashField(h, pos, r.Qual)
 	}
 	if opts.all || opts.seq {
@@ -156,6 +175,11 @@ func (c *refChecksum) merge(other refChecksum) {
 type fileChecksum struct {
 	Refs     []refChecksum // One for each ref. Index is refid.
 	Unmapped refChecksum   // For unmapped reads.
+	// QualBins describes the binning applied to the quality scores, either when
+	// the PAM file was written or by checksumOpts.qualBins, in the format of
+	// pam.FormatQualBins. It is empty if the scores are lossless, or if they are
+	// not checksummed.
+	QualBins string `json:",omitempty"`
 	err      errors.Once
 }
 
@@ -202,32 +226,52 @@ func checksumBAMShard(opts checksumOpts, ch chan gbam.Shard, provider bamprovide
 	return csum
 }
 
-func checksumFile(bamPath string, opts checksumOpts) fileChecksum {
-	var csum fileChecksum
-	bopts := bamprovider.ProviderOpts{Index: opts.baiPath}
+// dropFields returns the fields that are not needed to checksum the fields
+// selected by opts.
+func (opts checksumOpts) dropFields() []gbam.FieldType {
+	var drop []gbam.FieldType
 	if !opts.all && !opts.name {
-		bopts.DropFields = append(bopts.DropFields, gbam.FieldName)
+		drop = append(drop, gbam.FieldName)
 	}
 	if !opts.all && !opts.mapQ {
-		bopts.DropFields = append(bopts.DropFields, gbam.FieldMapq)
+		drop = append(drop, gbam.FieldMapq)
 	}
 	if !opts.all && !opts.tempLen {
-		bopts.DropFields = append(bopts.DropFields, gbam.FieldTempLen)
+		drop = append(drop, gbam.FieldTempLen)
 	}
 	if !opts.all && !opts.matePos {
-		bopts.DropFields = append(bopts.DropFields, gbam.FieldMateRefID, gbam.FieldMatePos)
+		drop = append(drop, gbam.FieldMateRefID, gbam.FieldMatePos)
 	}
 	if !opts.all && !opts.seq {
-		bopts.DropFields = append(bopts.DropFields, gbam.FieldSeq)
+		drop = append(drop, gbam.FieldSeq)
 	}
 	if !opts.all && !opts.cigar {
-		bopts.DropFields = append(bopts.DropFields, gbam.FieldCigar)
+		drop = append(drop, gbam.FieldCigar)
 	}
 	if !opts.all && !opts.qual {
-		bopts.DropFields = append(bopts.DropFields, gbam.FieldQual)
+		drop = append(drop, gbam.FieldQual)
 	}
 	if !opts.all && !opts.aux {
-		bopts.DropFields = append(bopts.DropFields, gbam.FieldAux)
+		drop = append(drop, gbam.FieldAux)
+	}
+	return drop
+}
+
+func checksumFile(bamPath string, opts checksumOpts) fileChecksum {
+	var csum fileChecksum
+	bopts := bamprovider.ProviderOpts{Index: opts.baiPath, Reference: opts.reference}
+	bopts.DropFields = opts.dropFields()
+	if opts.all || opts.qual {
+		qualBins := opts.qualBins
+		if bamprovider.GuessFileType(bamPath) == bamprovider.PAM {
+			fileBins, err := pam.ReadQualBins(vcontext.Background(), bamPath)
+			if err != nil {
+				csum.err.Set(err)
+				return csum
+			}
+			qualBins = composeQualBins(fileBins, opts.qualBins)
+		}
+		csum.QualBins = pam.FormatQualBins(qualBins)
 	}
 	provider := bamprovider.NewProvider(bamPath, bopts)
 	shardList, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{
@@ -255,11 +299,52 @@ func checksumFile(bamPath string, opts checksumOpts) fileChecksum {
 	return csum
 }
 
+// composeQualBins returns the binning table that applies "first", then
+// "second". Either table may be empty.
+func composeQualBins(first, second []byte) []byte {
+	if len(first) == 0 {
+		return second
+	}
+	if len(second) == 0 {
+		return first
+	}
+	bins := make([]byte, len(first))
+	for q, b := range first {
+		bins[q] = second[b]
+	}
+	return bins
+}
+
+// writeChecksumTSV writes one line for each reference that has records,
+// followed by a line named "*" for the unmapped reads. The first line lists
+// the column names.
+func writeChecksumTSV(out io.Writer, csum *fileChecksum) error {
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, "name\tnrecs\tsum_pos\tsum_flags\tsum_templen\tsum_mapq\tsum_matepos\tsum_name\tsum_seq\tsum_cigar\tsum_qual\tsum_aux")
+	writeRow := func(name string, c refChecksum) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", name, c.NRecs,
+			c.SumPos, c.SumFlags, c.SumTempLen, c.SumMapQ, c.SumMatePos, c.SumName, c.SumSeq, c.SumCigar, c.SumQual, c.SumAux)
+	}
+	for _, c := range csum.Refs {
+		if c.NRecs > 0 {
+			writeRow(c.Name, c)
+		}
+	}
+	writeRow("*", csum.Unmapped)
+	return w.Flush()
+}
+
 func checksum(path string, opts checksumOpts) error {
+	if opts.format != "json" && opts.format != "tsv" {
+		return fmt.Errorf("checksum: unknown format '%s'", opts.format)
+	}
 	csum := checksumFile(path, opts)
 	if csum.err.Err() != nil {
 		return csum.err.Err()
 	}
+	if opts.format == "tsv" {
+		return writeChecksumTSV(os.Stdout, &csum)
+	}
 	js, err := json.MarshalIndent(csum, "", "  ")
 	if err != nil {
 		log.Panic(err)
@@ -2,6 +2,7 @@ package main_test
 
 import (
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/grailbio/testutil"
@@ -26,8 +27,36 @@ func TestVerify(t *testing.T) {
 	pamCsum := sh.Cmd(pamtoolPath, "checksum", "-all", pamPath).Stdout()
 	assert.Equal(t, bamCsum, pamCsum)
 
+	bamTSV := sh.Cmd(pamtoolPath, "checksum", "-all", "-format=tsv", bamPath).Stdout()
+	pamTSV := sh.Cmd(pamtoolPath, "checksum", "-all", "-format=tsv", pamPath).Stdout()
+	assert.Equal(t, bamTSV, pamTSV)
+	lines := strings.Split(strings.TrimSuffix(pamTSV, "\n"), "\n")
+	assert.True(t, strings.HasPrefix(lines[0], "name\tnrecs\t"), lines[0])
+	assert.True(t, strings.HasPrefix(lines[len(lines)-1], "*\t"), lines[len(lines)-1])
+
 	// Test error generation.
 	bam2Path := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam")
 	bam2Csum := sh.Cmd(pamtoolPath, "checksum", bam2Path).Stdout()
 	assert.NotEqual(t, pamCsum, bam2Csum)
 }
+
+func TestChecksumQualBins(t *testing.T) {
+	if !testutil.IsBazel() {
+		t.Skip("not bazel")
+	}
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+	pamtoolPath := testutil.GoExecutable(t, "//go/src/github.com/grailbio/bio/cmd/bio-pamtool/bio-pamtool")
+	dir := sh.MakeTempDir()
+	pamPath := filepath.Join(dir, "test.pam")
+	sh.Cmd(pamtoolPath, "convert", "-qual-bins=illumina8", bamPath, pamPath).Run()
+	assert.NoError(t, sh.Err)
+
+	pamCsum := sh.Cmd(pamtoolPath, "checksum", "-all", pamPath).Stdout()
+	assert.Contains(t, pamCsum, `"QualBins": "2-9:6,`)
+	bamCsum := sh.Cmd(pamtoolPath, "checksum", "-all", bamPath).Stdout()
+	assert.NotEqual(t, bamCsum, pamCsum)
+	bamCsum = sh.Cmd(pamtoolPath, "checksum", "-all", "-qual-bins=illumina8", bamPath).Stdout()
+	assert.Equal(t, bamCsum, pamCsum)
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/syncqueue"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamfilter"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/hts/sam"
+)
+
+type depthOpts struct {
+	// index sets the name of the BAM index file. If empty, bampath+".bai" is used.
+	index string
+	// regions is a comma-separated list of regions, in the same format as
+	// "view -regions". If empty, the whole genome is scanned.
+	regions string
+	// filter is a filter expression. Only records matching the expression are
+	// counted.
+	filter string
+	// bedPath, if nonempty, restricts the output to the intervals in the BED file.
+	bedPath string
+	// format is the output format, either "bedgraph" or "tsv".
+	format string
+	// window, if >0, causes the mean depth of each window-sized bin to be
+	// reported instead of per-base depth.
+	window int
+	// padding is the maximum reference span of a record. Records that start
+	// more than padding bases before a shard are not counted in that shard.
+	padding int
+	// excludeFlags causes records with any of these flag bits to be ignored.
+	excludeFlags int
+}
+
+// depthRun is a run of bases [start, end) on reference refID that share the
+// same nonzero depth.
+type depthRun struct {
+	refID      int
+	start, end int
+	depth      int
+}
+
+// depthSummary accumulates depth statistics for one reference.
+type depthSummary struct {
+	// targetBases is the number of bases examined.
+	targetBases int64
+	// coveredBases is the number of bases with depth > 0.
+	coveredBases int64
+	// totalDepth is the sum of depths over all the examined bases.
+	totalDepth int64
+}
+
+func (s *depthSummary) mergeFrom(src depthSummary) {
+	s.targetBases += src.targetBases
+	s.coveredBases += src.coveredBases
+	s.totalDepth += src.totalDepth
+}
+
+// depthCounter computes per-base depth over a single-reference range [start,
+// limit). Records must be added in coordinate order.
+type depthCounter struct {
+	refID        int
+	start, limit int
+	// base is the first position that hasn't been flushed yet.
+	base int
+	// depth is the depth just before base.
+	depth int
+	// delta[i] is the change in depth at position base+i.
+	delta []int32
+	emit  func(r depthRun)
+}
+
+func newDepthCounter(refID, start, limit int, emit func(r depthRun)) *depthCounter {
+	return &depthCounter{
+		refID: refID,
+		start: start,
+		limit: limit,
+		base:  start,
+		emit:  emit,
+	}
+}
+
+// add counts the aligned bases of the record. Deletions and skipped regions
+// are not counted, as in "samtools depth".
+func (c *depthCounter) add(rec *sam.Record) {
+	c.flush(rec.Pos)
+	pos := rec.Pos
+	for _, co := range rec.Cigar {
+		n := co.Len()
+		switch co.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			c.addRange(pos, pos+n)
+			pos += n
+		case sam.CigarDeletion, sam.CigarSkipped:
+			pos += n
+		}
+	}
+}
+
+func (c *depthCounter) addRange(start, end int) {
+	if start < c.base {
+		start = c.base
+	}
+	if end > c.limit {
+		end = c.limit
+	}
+	if start >= end {
+		return
+	}
+	for len(c.delta) <= end-c.base {
+		c.delta = append(c.delta, 0)
+	}
+	c.delta[start-c.base]++
+	c.delta[end-c.base]--
+}
+
+// flush emits the depths of positions [c.base, pos). It must be called only
+// when no record added later can cover these positions.
+func (c *depthCounter) flush(pos int) {
+	if pos > c.limit {
+		pos = c.limit
+	}
+	if pos <= c.base {
+		return
+	}
+	n := pos - c.base
+	runStart := c.base
+	for i := 0; i < n && i < len(c.delta); i++ {
+		if c.delta[i] == 0 {
+			continue
+		}
+		c.emitRun(runStart, c.base+i, c.depth)
+		runStart = c.base + i
+		c.depth += int(c.delta[i])
+	}
+	c.emitRun(runStart, pos, c.depth)
+	if n < len(c.delta) {
+		c.delta = c.delta[n:]
+	} else {
+		c.delta = c.delta[:0]
+	}
+	c.base = pos
+}
+
+func (c *depthCounter) emitRun(start, end, depth int) {
+	if start >= end || depth == 0 {
+		return
+	}
+	c.emit(depthRun{refID: c.refID, start: start, end: end, depth: depth})
+}
+
+// depthShard describes a single-reference range whose depth is computed by
+// one worker.
+type depthShard struct {
+	ref          *sam.Reference
+	start, limit int
+	shardIdx     int
+}
+
+// splitDepthShards splits the shards into single-reference ranges. Unmapped
+// ranges are dropped.
+func splitDepthShards(header *sam.Header, shards []gbam.Shard) []depthShard {
+	refs := header.Refs()
+	var result []depthShard
+	for _, shard := range shards {
+		if shard.StartRef == nil {
+			continue
+		}
+		lastRefID := len(refs) - 1
+		if shard.EndRef != nil {
+			lastRefID = shard.EndRef.ID()
+		}
+		for refID := shard.StartRef.ID(); refID <= lastRefID; refID++ {
+			ref := refs[refID]
+			start, limit := 0, ref.Len()
+			if refID == shard.StartRef.ID() {
+				start = shard.Start
+			}
+			if shard.EndRef != nil && refID == shard.EndRef.ID() && shard.End < limit {
+				limit = shard.End
+			}
+			if start >= limit {
+				continue
+			}
+			result = append(result, depthShard{ref: ref, start: start, limit: limit, shardIdx: len(result)})
+		}
+	}
+	return result
+}
+
+// generateDepthShards lists the ranges to scan. If opts.regions is set, it
+// yields one range per region, in coordinate order. Overlapping regions are
+// merged, so that no base is counted twice. Else it partitions the whole
+// genome using Provider.GenerateShards.
+func generateDepthShards(provider bamprovider.Provider, header *sam.Header, opts depthOpts) ([]depthShard, error) {
+	if opts.regions == "" {
+		shards, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{})
+		if err != nil {
+			return nil, err
+		}
+		return splitDepthShards(header, shards), nil
+	}
+	regions, err := parseRegionsFlag(opts.regions)
+	if err != nil {
+		return nil, err
+	}
+	var shards []gbam.Shard
+	for _, region := range regions {
+		if region.startRefName != region.limitRefName || region.startSeq != 0 || region.limitSeq != 0 {
+			return nil, fmt.Errorf("%+v: depth supports only regions of form 'chr:begin-end'", region)
+		}
+		ref := bamprovider.RefByName(header, region.startRefName)
+		if ref == nil {
+			return nil, fmt.Errorf("Reference %v not found in header", region.startRefName)
+		}
+		if region.startPos >= region.limitPos {
+			continue
+		}
+		shards = append(shards, gbam.Shard{
+			StartRef: ref,
+			EndRef:   ref,
+			Start:    region.startPos,
+			End:      region.limitPos,
+		})
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		if shards[i].StartRef.ID() != shards[j].StartRef.ID() {
+			return shards[i].StartRef.ID() < shards[j].StartRef.ID()
+		}
+		return shards[i].Start < shards[j].Start
+	})
+	var merged []gbam.Shard
+	for _, shard := range shards {
+		if n := len(merged); n > 0 && merged[n-1].StartRef == shard.StartRef && merged[n-1].End >= shard.Start {
+			if shard.End > merged[n-1].End {
+				merged[n-1].End = shard.End
+			}
+			continue
+		}
+		shard.ShardIdx = len(merged)
+		merged = append(merged, shard)
+	}
+	return splitDepthShards(header, merged), nil
+}
+
+// clipToBED calls cb for each part of [start,end) on refID that's covered by
+// the BED. If bed is nil, cb is called for the whole range.
+func clipToBED(bed *interval.BEDUnion, refID, start, end int, cb func(start, end int)) {
+	if bed == nil {
+		cb(start, end)
+		return
+	}
+	overlaps := bed.OverlapByID(refID, interval.PosType(start), interval.PosType(end))
+	for i := 0; i+1 < len(overlaps); i += 2 {
+		s, e := int(overlaps[i]), int(overlaps[i+1])
+		if s < start {
+			s = start
+		}
+		if e > end {
+			e = end
+		}
+		if s < e {
+			cb(s, e)
+		}
+	}
+}
+
+// depthShardWorker computes the depth of one shard. It reports each depth run
+// through emit, and returns the per-shard summary.
+func depthShardWorker(provider bamprovider.Provider, filter *bamfilter.Expr, bed *interval.BEDUnion,
+	opts depthOpts, shard depthShard, emit func(r depthRun)) (depthSummary, error) {
+	var summary depthSummary
+	refID := shard.ref.ID()
+	clipToBED(bed, refID, shard.start, shard.limit, func(start, end int) {
+		summary.targetBases += int64(end - start)
+	})
+	if summary.targetBases == 0 {
+		return summary, nil
+	}
+	counter := newDepthCounter(refID, shard.start, shard.limit, func(r depthRun) {
+		clipToBED(bed, r.refID, r.start, r.end, func(start, end int) {
+			summary.coveredBases += int64(end - start)
+			summary.totalDepth += int64(end-start) * int64(r.depth)
+			emit(depthRun{refID: r.refID, start: start, end: end, depth: r.depth})
+		})
+	})
+	readStart := shard.start - opts.padding
+	if readStart < 0 {
+		readStart = 0
+	}
+	iter := provider.NewIterator(gbam.Shard{
+		StartRef: shard.ref,
+		EndRef:   shard.ref,
+		Start:    readStart,
+		End:      shard.limit,
+		ShardIdx: shard.shardIdx,
+	})
+	for iter.Scan() {
+		rec := iter.Record()
+		if int(rec.Flags)&opts.excludeFlags == 0 &&
+			(filter == nil || filter.Evaluate(rec)) {
+			counter.add(rec)
+		}
+		sam.PutInFreePool(rec)
+	}
+	counter.flush(shard.limit)
+	return summary, iter.Close()
+}
+
+// bedGraphWriter prints depth runs in bedGraph format. It coalesces adjacent
+// runs of the same depth, or, if window>0, aggregates runs into fixed-size
+// bins.
+type bedGraphWriter struct {
+	out    *bufio.Writer
+	header *sam.Header
+	window int
+
+	// The run that has not been printed yet.
+	cur      depthRun
+	curValid bool
+
+	// The bin that has not been printed yet. Used only when window>0.
+	binRefID, binStart int
+	binSum             int64
+	binValid           bool
+}
+
+func (w *bedGraphWriter) add(r depthRun) {
+	if w.window > 0 {
+		w.addToBins(r)
+		return
+	}
+	if w.curValid && w.cur.refID == r.refID && w.cur.end == r.start && w.cur.depth == r.depth {
+		w.cur.end = r.end
+		return
+	}
+	w.flushRun()
+	w.cur, w.curValid = r, true
+}
+
+func (w *bedGraphWriter) addToBins(r depthRun) {
+	for start := r.start; start < r.end; {
+		binStart := start / w.window * w.window
+		end := binStart + w.window
+		if end > r.end {
+			end = r.end
+		}
+		if !w.binValid || w.binRefID != r.refID || w.binStart != binStart {
+			w.flushBin()
+			w.binRefID, w.binStart, w.binSum, w.binValid = r.refID, binStart, 0, true
+		}
+		w.binSum += int64(end-start) * int64(r.depth)
+		start = end
+	}
+}
+
+func (w *bedGraphWriter) flushRun() {
+	if !w.curValid {
+		return
+	}
+	fmt.Fprintf(w.out, "%s\t%d\t%d\t%d\n", w.header.Refs()[w.cur.refID].Name(), w.cur.start, w.cur.end, w.cur.depth)
+	w.curValid = false
+}
+
+func (w *bedGraphWriter) flushBin() {
+	if !w.binValid {
+		return
+	}
+	ref := w.header.Refs()[w.binRefID]
+	end := w.binStart + w.window
+	if end > ref.Len() {
+		end = ref.Len()
+	}
+	fmt.Fprintf(w.out, "%s\t%d\t%d\t%.2f\n", ref.Name(), w.binStart, end, float64(w.binSum)/float64(end-w.binStart))
+	w.binValid = false
+}
+
+// finish prints any pending data.
+func (w *bedGraphWriter) finish() error {
+	w.flushRun()
+	w.flushBin()
+	return w.out.Flush()
+}
+
+func printDepthSummary(header *sam.Header, summaries []depthSummary) error {
+	out := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(out, "#ref\ttarget_bases\tcovered_bases\ttotal_depth\tmean_depth\tcoverage\n")
+	var total depthSummary
+	printLine := func(name string, s depthSummary) {
+		mean := 0.0
+		if s.targetBases > 0 {
+			mean = float64(s.totalDepth) / float64(s.targetBases)
+		}
+		fmt.Fprintf(out, "%s\t%d\t%d\t%d\t%.4f\t%s\n", name, s.targetBases, s.coveredBases, s.totalDepth,
+			mean, percent(int(s.coveredBases), int(s.targetBases)))
+	}
+	for refID, s := range summaries {
+		if s.targetBases == 0 {
+			continue
+		}
+		printLine(header.Refs()[refID].Name(), s)
+		total.mergeFrom(s)
+	}
+	printLine("*", total)
+	return out.Flush()
+}
+
+// depthFields lists the fields read by depthShardWorker.
+var depthFields = []gbam.FieldType{gbam.FieldCoord, gbam.FieldFlags, gbam.FieldCigar}
+
+func depth(path string, opts depthOpts) error {
+	if opts.format != "bedgraph" && opts.format != "tsv" {
+		return fmt.Errorf("depth: unknown format '%s'; must be either 'bedgraph' or 'tsv'", opts.format)
+	}
+	var filter *bamfilter.Expr
+	if opts.filter != "" {
+		var err error
+		if filter, err = bamfilter.Parse(opts.filter); err != nil {
+			return err
+		}
+	}
+	// Read only the fields needed to compute the depth, plus the ones that the
+	// filter refers to.
+	popts := bamprovider.ProviderOpts{
+		Index:      opts.index,
+		DropFields: dropFieldsExcept(depthFields),
+	}
+	if filter != nil {
+		popts.DropFields = dropFieldsExcept(depthFields, filter.Fields())
+		popts.AuxTags = filter.AuxTags()
+	}
+	provider := bamprovider.NewProvider(path, popts)
+	header, err := provider.GetHeader()
+	if err != nil {
+		provider.Close() // nolint: errcheck
+		return err
+	}
+	var bed *interval.BEDUnion
+	if opts.bedPath != "" {
+		u, err := interval.NewBEDUnionFromPath(opts.bedPath, interval.NewBEDOpts{SAMHeader: header})
+		if err != nil {
+			provider.Close() // nolint: errcheck
+			return err
+		}
+		bed = &u
+	}
+	shards, err := generateDepthShards(provider, header, opts)
+	if err != nil {
+		provider.Close() // nolint: errcheck
+		return err
+	}
+
+	e := errors.Once{}
+	var oq *syncqueue.OrderedQueue
+	if opts.format == "bedgraph" {
+		oq = syncqueue.NewOrderedQueue(len(shards) + 1)
+	}
+	shardCh := make(chan depthShard, len(shards))
+	for _, shard := range shards {
+		shardCh <- shard
+	}
+	close(shardCh)
+
+	parallelism := runtime.NumCPU()
+	summaryCh := make(chan []depthSummary, parallelism)
+	wgW := sync.WaitGroup{}
+	for i := 0; i < parallelism; i++ {
+		wgW.Add(1)
+		go func() {
+			defer wgW.Done()
+			summaries := make([]depthSummary, len(header.Refs()))
+			var localBED *interval.BEDUnion
+			if bed != nil {
+				u := bed.Clone()
+				localBED = &u
+			}
+			for shard := range shardCh {
+				emit := func(r depthRun) {}
+				var runCh chan depthRun
+				if oq != nil {
+					runCh = make(chan depthRun, 16<<10)
+					e.Set(oq.Insert(shard.shardIdx, runCh))
+					emit = func(r depthRun) { runCh <- r }
+				}
+				summary, err := depthShardWorker(provider, filter, localBED, opts, shard, emit)
+				e.Set(err)
+				summaries[shard.ref.ID()].mergeFrom(summary)
+				if runCh != nil {
+					close(runCh)
+				}
+			}
+			summaryCh <- summaries
+		}()
+	}
+
+	// The display thread for bedgraph.
+	wgR := sync.WaitGroup{}
+	if oq != nil {
+		wgR.Add(1)
+		go func() {
+			defer wgR.Done()
+			w := bedGraphWriter{out: bufio.NewWriter(os.Stdout), header: header, window: opts.window}
+			for {
+				val, ok, err := oq.Next()
+				if err != nil {
+					e.Set(err)
+					break
+				}
+				if !ok {
+					break
+				}
+				for r := range val.(chan depthRun) {
+					w.add(r)
+				}
+			}
+			e.Set(w.finish())
+		}()
+	}
+	wgW.Wait()
+	if oq != nil {
+		oq.Close(nil)
+		wgR.Wait()
+	}
+	summaries := make([]depthSummary, len(header.Refs()))
+	for i := 0; i < parallelism; i++ {
+		for refID, s := range <-summaryCh {
+			summaries[refID].mergeFrom(s)
+		}
+	}
+	e.Set(provider.Close())
+	if err := e.Err(); err != nil {
+		return err
+	}
+	if opts.format == "tsv" {
+		return printDepthSummary(header, summaries)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"v.io/x/lib/gosh"
+)
+
+func TestDepth(t *testing.T) {
+	if !testutil.IsBazel() {
+		t.Skip("not bazel")
+	}
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam")
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+	pamtoolPath := testutil.GoExecutable(t, "//go/src/github.com/grailbio/bio/cmd/bio-pamtool/bio-pamtool")
+	dir := sh.MakeTempDir()
+	pamPath := filepath.Join(dir, "test.pam")
+	sh.Cmd(pamtoolPath, "convert", bamPath, pamPath).Run()
+	assert.NoError(t, sh.Err)
+
+	for _, path := range []string{bamPath, pamPath} {
+		expected := "chr1	122	132	1\n"
+		assert.Equal(t, expected, sh.Cmd(pamtoolPath, "depth", "-filter", "rec_name==\"read1\"", "-regions", "chr1:1-1000", path).CombinedOutput())
+		expected = "chr1	120	130	0.80\n" + "chr1	130	140	0.20\n"
+		assert.Equal(t, expected, sh.Cmd(pamtoolPath, "depth", "-filter", "rec_name==\"read1\"", "-regions", "chr1:1-1000", "-window", "10", path).CombinedOutput())
+		expected = "#ref	target_bases	covered_bases	total_depth	mean_depth	coverage\n" +
+			"chr1	1000	10	10	0.0100	1.00%\n" +
+			"*	1000	10	10	0.0100	1.00%\n"
+		assert.Equal(t, expected, sh.Cmd(pamtoolPath, "depth", "-filter", "rec_name==\"read1\"", "-regions", "chr1:1-1000", "-format", "tsv", path).CombinedOutput())
+
+		// Overlapping regions are merged, so no base is counted twice. read1
+		// is in both regions.
+		for _, args := range [][]string{nil, {"-window", "10"}, {"-format", "tsv"}} {
+			args = append([]string{"depth", "-filter", "rec_name==\"read1\""}, args...)
+			assert.Equal(t,
+				sh.Cmd(pamtoolPath, append(args, "-regions", "chr1:1-1000", path)...).CombinedOutput(),
+				sh.Cmd(pamtoolPath, append(args, "-regions", "chr1:101-1000,chr1:1-600", path)...).CombinedOutput(),
+				"args=%v", args)
+		}
+	}
+}
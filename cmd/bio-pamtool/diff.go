@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/pam"
+	gsam "github.com/grailbio/bio/encoding/sam"
+	"github.com/grailbio/hts/sam"
+)
+
+type diffOpts struct {
+	// The fields to compare, and the options for reading the files. Records
+	// are always matched by their coordinate, name, and flags.
+	checksumOpts
+	// maxExamples is the max number of differing records to print.
+	maxExamples int
+}
+
+// diffKey identifies a record among the records at the same position.
+type diffKey struct {
+	name  string
+	flags sam.Flags
+}
+
+// shardDiff is the result of comparing one shard of the two files.
+type shardDiff struct {
+	// onlyA and onlyB count the records found in only one of the files.
+	onlyA, onlyB int
+	// differ counts the matching records with different fields.
+	differ int
+	// fields counts the matching records that differ in each field.
+	fields [gbam.NumFields]int
+	// examples describes the first differences found in the shard, at most
+	// diffOpts.maxExamples of them.
+	examples []string
+}
+
+func (d *shardDiff) mergeFrom(src shardDiff, maxExamples int) {
+	d.onlyA += src.onlyA
+	d.onlyB += src.onlyB
+	d.differ += src.differ
+	for f, n := range src.fields {
+		d.fields[f] += n
+	}
+	for _, ex := range src.examples {
+		if len(d.examples) < maxExamples {
+			d.examples = append(d.examples, ex)
+		}
+	}
+}
+
+func (d *shardDiff) addExample(maxExamples int, format string, args ...interface{}) {
+	if len(d.examples) < maxExamples {
+		d.examples = append(d.examples, fmt.Sprintf(format, args...))
+	}
+}
+
+func formatRecord(r *sam.Record) string {
+	buf, err := gsam.AppendRecord(nil, r)
+	if err != nil {
+		return fmt.Sprintf("%s: %v", r.Name, err)
+	}
+	return string(buf)
+}
+
+// diffFields returns the fields that differ between a and b, among the fields
+// selected by opts. The coordinate, name, and flags are not compared, since
+// they are used to match the records.
+func diffFields(a, b *sam.Record, opts checksumOpts) []gbam.FieldType {
+	var fields []gbam.FieldType
+	if (opts.all || opts.mapQ) && a.MapQ != b.MapQ {
+		fields = append(fields, gbam.FieldMapq)
+	}
+	if (opts.all || opts.cigar) && !cigarEqual(a.Cigar, b.Cigar) {
+		fields = append(fields, gbam.FieldCigar)
+	}
+	if opts.all || opts.matePos {
+		if a.MateRef.ID() != b.MateRef.ID() {
+			fields = append(fields, gbam.FieldMateRefID)
+		}
+		if a.MatePos != b.MatePos {
+			fields = append(fields, gbam.FieldMatePos)
+		}
+	}
+	if (opts.all || opts.tempLen) && a.TempLen != b.TempLen {
+		fields = append(fields, gbam.FieldTempLen)
+	}
+	if (opts.all || opts.seq) && !bytes.Equal(a.Seq.Expand(), b.Seq.Expand()) {
+		fields = append(fields, gbam.FieldSeq)
+	}
+	if (opts.all || opts.qual) && !bytes.Equal(a.Qual, b.Qual) {
+		fields = append(fields, gbam.FieldQual)
+	}
+	if (opts.all || opts.aux) && !auxEqual(a.AuxFields, b.AuxFields) {
+		fields = append(fields, gbam.FieldAux)
+	}
+	return fields
+}
+
+func cigarEqual(a, b sam.Cigar) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func auxEqual(a, b sam.AuxFields) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordGroups reads the records of a coordinate-sorted iterator in groups of
+// records at the same position.
+type recordGroups struct {
+	iter bamprovider.Iterator
+	next *sam.Record
+}
+
+func newRecordGroups(iter bamprovider.Iterator) *recordGroups {
+	g := &recordGroups{iter: iter}
+	if iter.Scan() {
+		g.next = iter.Record()
+	}
+	return g
+}
+
+// group returns the records at the next position. It returns an empty slice
+// at the end of the iterator.
+func (g *recordGroups) group() []*sam.Record {
+	var recs []*sam.Record
+	for g.next != nil && (len(recs) == 0 || comparePositions(recs[0], g.next) == 0) {
+		recs = append(recs, g.next)
+		g.next = nil
+		if g.iter.Scan() {
+			g.next = g.iter.Record()
+		}
+	}
+	return recs
+}
+
+// comparePositions compares the positions of the records in the coordinate
+// sort order. Unmapped records without a position are sorted last.
+func comparePositions(a, b *sam.Record) int {
+	refID := func(r *sam.Record) int {
+		if r.Ref == nil {
+			return math.MaxInt32
+		}
+		return r.Ref.ID()
+	}
+	if ra, rb := refID(a), refID(b); ra != rb {
+		return ra - rb
+	}
+	return a.Pos - b.Pos
+}
+
+// diffGroups compares the records at the same position in the two files.
+func diffGroups(groupA, groupB []*sam.Record, opts diffOpts, d *shardDiff) {
+	recsA := map[diffKey][]*sam.Record{}
+	for _, r := range groupA {
+		key := diffKey{r.Name, r.Flags}
+		recsA[key] = append(recsA[key], r)
+	}
+	for _, b := range groupB {
+		key := diffKey{b.Name, b.Flags}
+		matches := recsA[key]
+		if len(matches) == 0 {
+			d.onlyB++
+			d.addExample(opts.maxExamples, "only in B: %s", formatRecord(b))
+			continue
+		}
+		a := matches[0]
+		recsA[key] = matches[1:]
+		pam.BinQual(opts.qualBins, a.Qual)
+		pam.BinQual(opts.qualBins, b.Qual)
+		if fields := diffFields(a, b, opts.checksumOpts); len(fields) > 0 {
+			d.differ++
+			names := make([]string, len(fields))
+			for i, f := range fields {
+				d.fields[f]++
+				names[i] = f.String()
+			}
+			d.addExample(opts.maxExamples, "differ in %s:\n  A: %s\n  B: %s",
+				strings.Join(names, ","), formatRecord(a), formatRecord(b))
+		}
+	}
+	// Report the unmatched records of A in file order.
+	for _, a := range groupA {
+		key := diffKey{a.Name, a.Flags}
+		if matches := recsA[key]; len(matches) > 0 && matches[0] == a {
+			recsA[key] = matches[1:]
+			d.onlyA++
+			d.addExample(opts.maxExamples, "only in A: %s", formatRecord(a))
+		}
+	}
+}
+
+func freeRecords(recs []*sam.Record) {
+	for _, r := range recs {
+		sam.PutInFreePool(r)
+	}
+}
+
+// diffShard compares the records of the two files in the shard.
+func diffShard(providerA, providerB bamprovider.Provider, shard gbam.Shard, opts diffOpts) (shardDiff, error) {
+	d := shardDiff{}
+	iterA := providerA.NewIterator(shard)
+	iterB := providerB.NewIterator(shard)
+	groupsA, groupsB := newRecordGroups(iterA), newRecordGroups(iterB)
+	groupA, groupB := groupsA.group(), groupsB.group()
+	for len(groupA) > 0 || len(groupB) > 0 {
+		var c int
+		switch {
+		case len(groupA) == 0:
+			c = 1
+		case len(groupB) == 0:
+			c = -1
+		default:
+			c = comparePositions(groupA[0], groupB[0])
+		}
+		switch {
+		case c < 0:
+			diffGroups(groupA, nil, opts, &d)
+			freeRecords(groupA)
+			groupA = groupsA.group()
+		case c > 0:
+			diffGroups(nil, groupB, opts, &d)
+			freeRecords(groupB)
+			groupB = groupsB.group()
+		default:
+			diffGroups(groupA, groupB, opts, &d)
+			freeRecords(groupA)
+			freeRecords(groupB)
+			groupA, groupB = groupsA.group(), groupsB.group()
+		}
+	}
+	e := errors.Once{}
+	e.Set(iterA.Close())
+	e.Set(iterB.Close())
+	return d, e.Err()
+}
+
+// checkSameRefs checks that the two headers list the same references, so
+// that the shards of one file can be used to read the other.
+func checkSameRefs(headerA, headerB *sam.Header) error {
+	refsA, refsB := headerA.Refs(), headerB.Refs()
+	if len(refsA) != len(refsB) {
+		return fmt.Errorf("diff: the files have %d and %d references", len(refsA), len(refsB))
+	}
+	for i := range refsA {
+		if refsA[i].Name() != refsB[i].Name() || refsA[i].Len() != refsB[i].Len() {
+			return fmt.Errorf("diff: reference %d differs: %v vs %v", i, refsA[i], refsB[i])
+		}
+	}
+	return nil
+}
+
+// diff compares the records of two coordinate-sorted files, ignoring the order
+// of the records at the same position. It prints a summary of the differences,
+// and returns an error if the files differ.
+func diff(pathA, pathB string, opts diffOpts) error {
+	providerOpts := bamprovider.ProviderOpts{Reference: opts.reference}
+	providerOpts.DropFields = opts.dropFields()
+	// The name is always needed to match the records.
+	for i, f := range providerOpts.DropFields {
+		if f == gbam.FieldName {
+			providerOpts.DropFields = append(providerOpts.DropFields[:i], providerOpts.DropFields[i+1:]...)
+			break
+		}
+	}
+	providerA := bamprovider.NewProvider(pathA, providerOpts)
+	providerB := bamprovider.NewProvider(pathB, providerOpts)
+	closeProviders := func() error {
+		e := errors.Once{}
+		e.Set(providerA.Close())
+		e.Set(providerB.Close())
+		return e.Err()
+	}
+	headerA, err := providerA.GetHeader()
+	if err != nil {
+		closeProviders() // nolint: errcheck
+		return err
+	}
+	headerB, err := providerB.GetHeader()
+	if err != nil {
+		closeProviders() // nolint: errcheck
+		return err
+	}
+	if err := checkSameRefs(headerA, headerB); err != nil {
+		closeProviders() // nolint: errcheck
+		return err
+	}
+	// The records at one position are read in one shard, since their order
+	// may differ between the files.
+	shards, err := providerA.GenerateShards(bamprovider.GenerateShardsOpts{
+		IncludeUnmapped: true,
+	})
+	if err != nil {
+		closeProviders() // nolint: errcheck
+		return err
+	}
+	shardCh := gbam.NewShardChannel(shards)
+	diffs := make([]shardDiff, len(shards))
+	wg := sync.WaitGroup{}
+	e := errors.Once{}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shardCh {
+				d, err := diffShard(providerA, providerB, shard, opts)
+				e.Set(err)
+				diffs[shard.ShardIdx] = d
+			}
+		}()
+	}
+	wg.Wait()
+	e.Set(closeProviders())
+	if err := e.Err(); err != nil {
+		return err
+	}
+	// Merge in shard order, so that the examples are listed in file order.
+	total := shardDiff{}
+	for _, d := range diffs {
+		total.mergeFrom(d, opts.maxExamples)
+	}
+	for _, ex := range total.examples {
+		fmt.Println(ex)
+	}
+	fmt.Printf("only in A: %d\n", total.onlyA)
+	fmt.Printf("only in B: %d\n", total.onlyB)
+	fmt.Printf("differing records: %d\n", total.differ)
+	for f, n := range total.fields {
+		if n > 0 {
+			fmt.Printf("  %s: %d\n", gbam.FieldType(f), n)
+		}
+	}
+	if total.onlyA > 0 || total.onlyB > 0 || total.differ > 0 {
+		return fmt.Errorf("%s and %s differ", pathA, pathB)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup)
+
+	chr1, err := sam.NewReference("chr1", "", "", 10000, nil, nil)
+	require.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	require.NoError(t, err)
+	header.SortOrder = sam.Coordinate
+
+	newRecord := func(i int) *sam.Record {
+		ref, pos, flags := chr1, i/4*10, sam.Flags(0)
+		cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}
+		if i >= 40 {
+			ref, pos, flags, cigar = nil, -1, sam.Unmapped, nil
+		}
+		r, err := sam.NewRecord(fmt.Sprintf("r%03d", i), ref, nil, pos, -1, 0, 60,
+			cigar, []byte("ACGT"), []byte{30, 30, 30, 30}, nil)
+		require.NoError(t, err)
+		r.Flags = flags
+		return r
+	}
+	writeFile := func(name string, recs []*sam.Record) string {
+		path := filepath.Join(tempDir, name)
+		w := pam.NewWriter(pam.WriteOpts{}, header, path)
+		for _, r := range recs {
+			w.Write(r)
+		}
+		require.NoError(t, w.Close())
+		return path
+	}
+
+	var recsA, recsB []*sam.Record
+	for i := 0; i < 44; i++ {
+		recsA = append(recsA, newRecord(i))
+	}
+	// B stores the records at each position in reverse order.
+	for i := 0; i < 44; i += 4 {
+		for j := i + 3; j >= i; j-- {
+			recsB = append(recsB, newRecord(j))
+		}
+	}
+	pathA := writeFile("a.pam", recsA)
+	pathB := writeFile("b.pam", recsB)
+	opts := diffOpts{checksumOpts: checksumOpts{all: true}, maxExamples: 10}
+	assert.NoError(t, diff(pathA, pathB, opts))
+
+	// Drop one record, add one, and change the mapq and seq of others.
+	recsB = recsB[1:]
+	extra := newRecord(5)
+	extra.Name = "extra"
+	recsB = append(recsB[:7], append([]*sam.Record{extra}, recsB[7:]...)...)
+	recsB[12].MapQ = 10
+	recsB[20].Seq = sam.NewSeq([]byte("AAAA"))
+	recsB[20].MapQ = 11
+	pathB = writeFile("b2.pam", recsB)
+	assert.Error(t, diff(pathA, pathB, opts))
+
+	providerA := bamprovider.NewProvider(pathA, bamprovider.ProviderOpts{})
+	providerB := bamprovider.NewProvider(pathB, bamprovider.ProviderOpts{})
+	d, err := diffShard(providerA, providerB, gbam.UniversalShard(header), opts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, d.onlyA)
+	assert.Equal(t, 1, d.onlyB)
+	assert.Equal(t, 2, d.differ)
+	assert.Equal(t, 2, d.fields[gbam.FieldMapq])
+	assert.Equal(t, 1, d.fields[gbam.FieldSeq])
+	assert.Equal(t, 0, d.fields[gbam.FieldQual])
+	assert.Len(t, d.examples, 4)
+
+	// Unselected fields are not compared.
+	d, err = diffShard(providerA, providerB, gbam.UniversalShard(header),
+		diffOpts{checksumOpts: checksumOpts{seq: true}, maxExamples: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 1, d.differ)
+	assert.Equal(t, 0, d.fields[gbam.FieldMapq])
+	assert.Len(t, d.examples, 1)
+	require.NoError(t, providerA.Close())
+	require.NoError(t, providerB.Close())
+}
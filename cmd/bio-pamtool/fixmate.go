@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/fixmate"
+)
+
+type fixmateOpts struct {
+	// index sets the name of the BAM index file. If empty, bampath+".bai" is used.
+	index string
+	// reference is the pathname of the reference FASTA, for CRAM or for PAM with
+	// a reference-encoded seq field.
+	reference string
+	// format is the output format, either "bam" or "pam". If empty, the format
+	// is guessed from the destination path.
+	format string
+	// transformers is a comma-separated list of transformers for the rewritten
+	// PAM fields.
+	transformers string
+	// bytesPerBlock is the goal size of a PAM recordio block.
+	bytesPerBlock int
+
+	shardSize   int
+	parallelism int
+	diskShards  int
+	scratchDir  string
+}
+
+func fixMates(srcPath, dstPath string, opts fixmateOpts) error {
+	format := bamprovider.GuessFileType(dstPath)
+	if opts.format != "" {
+		format = bamprovider.ParseFileType(opts.format)
+	}
+	providerOpts, closeReference, err := newProviderOpts(opts.index, opts.reference)
+	if err != nil {
+		return err
+	}
+	defer closeReference() // nolint: errcheck
+	fopts := fixmate.Opts{
+		ProviderOpts: providerOpts,
+		ShardSize:    opts.shardSize,
+		Parallelism:  opts.parallelism,
+		DiskShards:   opts.diskShards,
+		ScratchDir:   opts.scratchDir,
+		MaxBufSize:   opts.bytesPerBlock,
+	}
+	if opts.transformers != "" {
+		fopts.Transformers = strings.Split(opts.transformers, ",")
+	}
+	switch format {
+	case bamprovider.BAM:
+		return fixmate.FixBAM(srcPath, dstPath, fopts)
+	case bamprovider.PAM:
+		return fixmate.FixPAM(srcPath, dstPath, fopts)
+	default:
+		return fmt.Errorf("fixmate: cannot determine the output format of %s; set -format", dstPath)
+	}
+}
@@ -0,0 +1,45 @@
+package main_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"v.io/x/lib/gosh"
+)
+
+func TestFixmate(t *testing.T) {
+	if !testutil.IsBazel() {
+		t.Skip("not bazel")
+	}
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam")
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+	pamtoolPath := testutil.GoExecutable(t, "//go/src/github.com/grailbio/bio/cmd/bio-pamtool/bio-pamtool")
+	dir := sh.MakeTempDir()
+	pamPath := filepath.Join(dir, "test.pam")
+	sh.Cmd(pamtoolPath, "convert", bamPath, pamPath).Run()
+	require.NoError(t, sh.Err)
+
+	fixedBAMPath := filepath.Join(dir, "fixed.bam")
+	sh.Cmd(pamtoolPath, "fixmate", pamPath, fixedBAMPath).Run()
+	require.NoError(t, sh.Err)
+	fixedPAMPath := filepath.Join(dir, "fixed.pam")
+	sh.Cmd(pamtoolPath, "fixmate", pamPath, fixedPAMPath).Run()
+	require.NoError(t, sh.Err)
+
+	// Both outputs store the same records.
+	assert.Equal(t,
+		sh.Cmd(pamtoolPath, "checksum", "-all", fixedBAMPath).Stdout(),
+		sh.Cmd(pamtoolPath, "checksum", "-all", fixedPAMPath).Stdout())
+	// Fixing the mates is idempotent.
+	refixedPAMPath := filepath.Join(dir, "refixed.pam")
+	sh.Cmd(pamtoolPath, "fixmate", fixedPAMPath, refixedPAMPath).Run()
+	require.NoError(t, sh.Err)
+	assert.Equal(t,
+		sh.Cmd(pamtoolPath, "checksum", "-all", fixedPAMPath).Stdout(),
+		sh.Cmd(pamtoolPath, "checksum", "-all", refixedPAMPath).Stdout())
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"runtime"
 
 	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamfilter"
 	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/hts/sam"
 )
@@ -87,17 +92,127 @@ func percent(a int, b int) string {
 	return fmt.Sprintf("%.2f%%", float64(a)*100/float64(b))
 }
 
-func flagstat(path string) error {
-	provider := bamprovider.NewProvider(path, bamprovider.ProviderOpts{
-		DropFields: []gbam.FieldType{
-			gbam.FieldCigar,
-			gbam.FieldMatePos,
-			gbam.FieldTempLen,
-			gbam.FieldName,
-			gbam.FieldSeq,
-			gbam.FieldQual,
-			gbam.FieldAux,
-		}})
+// flagstatFields lists the fields read by aggrFlagstat.record.
+var flagstatFields = []gbam.FieldType{gbam.FieldCoord, gbam.FieldFlags, gbam.FieldMapq, gbam.FieldMateRefID}
+
+// flagstatCounts is the JSON form of aggrFlagstat.
+type flagstatCounts struct {
+	Total         int `json:"total"`
+	Mapped        int `json:"mapped"`
+	Duplicate     int `json:"duplicate"`
+	Secondary     int `json:"secondary"`
+	Supplementary int `json:"supplementary"`
+	Paired        int `json:"paired"`
+	ProperPair    int `json:"properly_paired"`
+	Singleton     int `json:"singletons"`
+	PairMapped    int `json:"with_itself_and_mate_mapped"`
+	DiffChr       int `json:"with_mate_mapped_to_different_chr"`
+	DiffChrHigh   int `json:"with_mate_mapped_to_different_chr_mapq5"`
+	Read1         int `json:"read1"`
+	Read2         int `json:"read2"`
+}
+
+func (stat *aggrFlagstat) counts() flagstatCounts {
+	return flagstatCounts{
+		Total:         stat.total,
+		Mapped:        stat.mapped,
+		Duplicate:     stat.duplicate,
+		Secondary:     stat.secondary,
+		Supplementary: stat.supplementary,
+		Paired:        stat.paired,
+		ProperPair:    stat.goodPair,
+		Singleton:     stat.single,
+		PairMapped:    stat.pairMap,
+		DiffChr:       stat.diffChr,
+		DiffChrHigh:   stat.diffHigh,
+		Read1:         stat.r1,
+		Read2:         stat.r2,
+	}
+}
+
+// flagstatReport is the JSON output of flagstat.
+type flagstatReport struct {
+	QCPassed flagstatCounts `json:"qc_passed"`
+	QCFailed flagstatCounts `json:"qc_failed"`
+}
+
+// writeFlagstatText writes the stats in the format of "samtools flagstat".
+func writeFlagstatText(out io.Writer, qc, failed aggrFlagstat) error {
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "%d + %d in total (QC-passed reads + QC-failed reads)\n", qc.total, failed.total)
+	fmt.Fprintf(w, "%d + %d secondary\n", qc.secondary, failed.secondary)
+	fmt.Fprintf(w, "%d + %d supplementary\n", qc.supplementary, failed.supplementary)
+	fmt.Fprintf(w, "%d + %d duplicates\n", qc.duplicate, failed.duplicate)
+	fmt.Fprintf(w, "%d + %d mapped (%s:%s)\n", qc.mapped, failed.mapped,
+		percent(qc.mapped, qc.total), percent(failed.mapped, failed.total))
+	fmt.Fprintf(w, "%d + %d paired in sequencing\n", qc.paired, failed.paired)
+	fmt.Fprintf(w, "%d + %d read1\n", qc.r1, failed.r1)
+	fmt.Fprintf(w, "%d + %d read2\n", qc.r2, failed.r2)
+	fmt.Fprintf(w, "%d + %d properly paired (%s:%s)\n", qc.goodPair, failed.goodPair,
+		percent(qc.goodPair, qc.paired), percent(failed.goodPair, failed.paired))
+	fmt.Fprintf(w, "%d + %d with itself and mate mapped\n", qc.pairMap, failed.pairMap)
+	fmt.Fprintf(w, "%d + %d singletons (%s:%s)\n", qc.single, failed.single,
+		percent(qc.single, qc.total), percent(failed.single, failed.total))
+	fmt.Fprintf(w, "%d + %d with mate mapped to a different chr\n", qc.diffChr, failed.diffChr)
+	fmt.Fprintf(w, "%d + %d with mate mapped to a different chr (mapQ>=5)\n", qc.diffHigh, failed.diffHigh)
+	return w.Flush()
+}
+
+// writeFlagstatTSV writes the stats in the format of "samtools flagstat -O
+// tsv". Each line lists the QC-passed value, the QC-failed value, and the
+// description.
+func writeFlagstatTSV(out io.Writer, qc, failed aggrFlagstat) error {
+	w := bufio.NewWriter(out)
+	count := func(a, b int, desc string) {
+		fmt.Fprintf(w, "%d\t%d\t%s\n", a, b, desc)
+	}
+	pct := func(a, b, total0, total1 int, desc string) {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", percent(a, total0), percent(b, total1), desc)
+	}
+	count(qc.total, failed.total, "total (QC-passed reads + QC-failed reads)")
+	count(qc.secondary, failed.secondary, "secondary")
+	count(qc.supplementary, failed.supplementary, "supplementary")
+	count(qc.duplicate, failed.duplicate, "duplicates")
+	count(qc.mapped, failed.mapped, "mapped")
+	pct(qc.mapped, failed.mapped, qc.total, failed.total, "mapped %")
+	count(qc.paired, failed.paired, "paired in sequencing")
+	count(qc.r1, failed.r1, "read1")
+	count(qc.r2, failed.r2, "read2")
+	count(qc.goodPair, failed.goodPair, "properly paired")
+	pct(qc.goodPair, failed.goodPair, qc.paired, failed.paired, "properly paired %")
+	count(qc.pairMap, failed.pairMap, "with itself and mate mapped")
+	count(qc.single, failed.single, "singletons")
+	pct(qc.single, failed.single, qc.total, failed.total, "singletons %")
+	count(qc.diffChr, failed.diffChr, "with mate mapped to a different chr")
+	count(qc.diffHigh, failed.diffHigh, "with mate mapped to a different chr (mapQ>=5)")
+	return w.Flush()
+}
+
+// flagstat computes the flag stats of the file. format is one of "text",
+// "json", or "tsv".
+func flagstat(path, reference, filterExpr, format string) error {
+	if format != "text" && format != "json" && format != "tsv" {
+		return fmt.Errorf("flagstat: unknown format '%s'", format)
+	}
+	var filter *bamfilter.Expr
+	if filterExpr != "" {
+		var err error
+		if filter, err = bamfilter.Parse(filterExpr); err != nil {
+			return err
+		}
+	}
+	opts, closeReference, err := newProviderOpts("", reference)
+	if err != nil {
+		return err
+	}
+	defer closeReference() // nolint: errcheck
+	// Read only the fields needed by the stats and the filter.
+	opts.DropFields = dropFieldsExcept(flagstatFields)
+	if filter != nil {
+		opts.DropFields = dropFieldsExcept(flagstatFields, filter.Fields())
+		opts.AuxTags = filter.AuxTags()
+	}
+	provider := bamprovider.NewProvider(path, opts)
 	shards, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{
 		IncludeUnmapped:     true,
 		SplitMappedCoords:   true,
@@ -117,6 +232,10 @@ func flagstat(path string) error {
 				iter := provider.NewIterator(shard)
 				for iter.Scan() {
 					rec := iter.Record()
+					if filter != nil && !filter.Evaluate(rec) {
+						sam.PutInFreePool(rec)
+						continue
+					}
 					stat := &qcStats
 					if (rec.Flags & sam.QCFail) != 0 {
 						stat = &failedStats
@@ -141,21 +260,17 @@ func flagstat(path string) error {
 	if err := provider.Close(); err != nil {
 		return err
 	}
-	fmt.Printf("%d + %d in total (QC-passed reads + QC-failed reads)\n", qc.total, failed.total)
-	fmt.Printf("%d + %d secondary\n", qc.secondary, failed.secondary)
-	fmt.Printf("%d + %d supplementary\n", qc.supplementary, failed.supplementary)
-	fmt.Printf("%d + %d duplicates\n", qc.duplicate, failed.duplicate)
-	fmt.Printf("%d + %d mapped (%s:%s)\n", qc.mapped, failed.mapped,
-		percent(qc.mapped, qc.total), percent(failed.mapped, failed.total))
-	fmt.Printf("%d + %d paired in sequencing\n", qc.paired, failed.paired)
-	fmt.Printf("%d + %d read1\n", qc.r1, failed.r1)
-	fmt.Printf("%d + %d read2\n", qc.r2, failed.r1)
-	fmt.Printf("%d + %d properly paired (%s:%s)\n", qc.goodPair, failed.goodPair,
-		percent(qc.goodPair, qc.paired), percent(failed.goodPair, failed.paired))
-	fmt.Printf("%d + %d with itself and mate mapped\n", qc.pairMap, failed.pairMap)
-	fmt.Printf("%d + %d singletons (%s:%s)\n", qc.single, failed.single,
-		percent(qc.single, qc.total), percent(failed.single, failed.total))
-	fmt.Printf("%d + %d with mate mapped to a different chr\n", qc.diffChr, failed.diffChr)
-	fmt.Printf("%d + %d with mate mapped to a different chr (mapQ>=5)\n", qc.diffHigh, failed.diffHigh)
-	return nil
+	switch format {
+	case "json":
+		js, err := json.MarshalIndent(flagstatReport{QCPassed: qc.counts(), QCFailed: failed.counts()}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(js))
+		return nil
+	case "tsv":
+		return writeFlagstatTSV(os.Stdout, qc, failed)
+	default:
+		return writeFlagstatText(os.Stdout, qc, failed)
+	}
 }
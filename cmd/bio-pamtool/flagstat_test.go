@@ -1,11 +1,14 @@
 package main_test
 
 import (
+	"encoding/json"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/grailbio/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"v.io/x/lib/gosh"
 )
 
@@ -43,4 +46,26 @@ func TestFlagStat(t *testing.T) {
 	output = sh.Cmd(pamtoolPath, "flagstat", bamPath).Stdout()
 	assert.NoError(t, sh.Err)
 	assert.Equal(t, expected, output)
+
+	output = sh.Cmd(pamtoolPath, "flagstat", "-format=tsv", pamPath).Stdout()
+	assert.NoError(t, sh.Err)
+	assert.True(t, strings.HasPrefix(output, `20042	0	total (QC-passed reads + QC-failed reads)
+0	0	secondary
+42	0	supplementary
+0	0	duplicates
+18840	0	mapped
+94.00%	N/A	mapped %
+`), output)
+
+	output = sh.Cmd(pamtoolPath, "flagstat", "-format=json", pamPath).Stdout()
+	assert.NoError(t, sh.Err)
+	var report struct {
+		QCPassed map[string]int `json:"qc_passed"`
+		QCFailed map[string]int `json:"qc_failed"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(output), &report))
+	assert.Equal(t, 20042, report.QCPassed["total"])
+	assert.Equal(t, 17964, report.QCPassed["properly_paired"])
+	assert.Equal(t, 50, report.QCPassed["with_mate_mapped_to_different_chr_mapq5"])
+	assert.Equal(t, 0, report.QCFailed["total"])
 }
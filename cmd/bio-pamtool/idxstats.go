@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+type idxstatsOpts struct {
+	// index sets the name of the BAM index file. If empty, bampath+".bai" is used.
+	index string
+	// reference is the pathname of the reference FASTA, for CRAM or for PAM with
+	// a reference-encoded seq field.
+	reference string
+	// format is the output format, either "text" or "json".
+	format string
+}
+
+// aggrIdxstats counts the records placed on each reference.
+type aggrIdxstats struct {
+	// mapped and unmapped are indexed by the reference ID.
+	mapped, unmapped []int64
+	// unplaced is the number of records without a reference.
+	unplaced int64
+}
+
+func newAggrIdxstats(nRefs int) aggrIdxstats {
+	return aggrIdxstats{mapped: make([]int64, nRefs), unmapped: make([]int64, nRefs)}
+}
+
+func (stat *aggrIdxstats) mergeFrom(src aggrIdxstats) {
+	for i := range src.mapped {
+		stat.mapped[i] += src.mapped[i]
+		stat.unmapped[i] += src.unmapped[i]
+	}
+	stat.unplaced += src.unplaced
+}
+
+func (stat *aggrIdxstats) record(r *sam.Record) {
+	switch {
+	case r.Ref == nil:
+		stat.unplaced++
+	case (r.Flags & sam.Unmapped) != 0:
+		// An unmapped read placed next to its mate.
+		stat.unmapped[r.Ref.ID()]++
+	default:
+		stat.mapped[r.Ref.ID()]++
+	}
+}
+
+// idxstatsRef is one line of the idxstats report.
+type idxstatsRef struct {
+	Name     string `json:"name"`
+	Length   int    `json:"length"`
+	Mapped   int64  `json:"mapped"`
+	Unmapped int64  `json:"unmapped"`
+}
+
+// report lists the counts for each reference, followed by the unplaced
+// records under the name "*", as done by samtools idxstats.
+func (stat *aggrIdxstats) report(header *sam.Header) []idxstatsRef {
+	var refs []idxstatsRef
+	for i, ref := range header.Refs() {
+		refs = append(refs, idxstatsRef{
+			Name:     ref.Name(),
+			Length:   ref.Len(),
+			Mapped:   stat.mapped[i],
+			Unmapped: stat.unmapped[i],
+		})
+	}
+	return append(refs, idxstatsRef{Name: "*", Unmapped: stat.unplaced})
+}
+
+func idxstats(path string, opts idxstatsOpts) error {
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("idxstats: unknown format '%s'", opts.format)
+	}
+	providerOpts, closeReference, err := newProviderOpts(opts.index, opts.reference)
+	if err != nil {
+		return err
+	}
+	defer closeReference() // nolint: errcheck
+	providerOpts.DropFields = dropFieldsExcept([]gbam.FieldType{gbam.FieldCoord, gbam.FieldFlags})
+	provider := bamprovider.NewProvider(path, providerOpts)
+	header, err := provider.GetHeader()
+	if err != nil {
+		provider.Close() // nolint: errcheck
+		return err
+	}
+	shards, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{
+		IncludeUnmapped:     true,
+		SplitMappedCoords:   true,
+		SplitUnmappedCoords: true,
+	})
+	if err != nil {
+		provider.Close() // nolint: errcheck
+		return err
+	}
+	shardCh := gbam.NewShardChannel(shards)
+	statCh := make(chan aggrIdxstats, len(shards))
+	wg := sync.WaitGroup{}
+	e := errors.Once{}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shardCh {
+				stat := newAggrIdxstats(len(header.Refs()))
+				iter := provider.NewIterator(shard)
+				for iter.Scan() {
+					rec := iter.Record()
+					stat.record(rec)
+					sam.PutInFreePool(rec)
+				}
+				e.Set(iter.Close())
+				statCh <- stat
+			}
+		}()
+	}
+	wg.Wait()
+	close(statCh)
+	total := newAggrIdxstats(len(header.Refs()))
+	for stat := range statCh {
+		total.mergeFrom(stat)
+	}
+	e.Set(provider.Close())
+	if err := e.Err(); err != nil {
+		return err
+	}
+	refs := total.report(header)
+	if opts.format == "json" {
+		js, err := json.MarshalIndent(refs, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(js))
+		return nil
+	}
+	for _, ref := range refs {
+		fmt.Printf("%s\t%d\t%d\t%d\n", ref.Name, ref.Length, ref.Mapped, ref.Unmapped)
+	}
+	return nil
+}
@@ -1,17 +1,66 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 
 	"github.com/grailbio/base/cmdutil"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/bamfilter"
 	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/bio/encoding/converter"
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/bio/encoding/fixmate"
+	"github.com/grailbio/bio/encoding/markdup"
 	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/hts/sam"
 	"v.io/x/lib/cmdline"
 )
 
+const referenceHelp = `Reference FASTA filename. It is required to read a CRAM file, or the seq field
+of a PAM file written with convert -reference-seq. If the FASTA index, reference + .fai, exists, sequences are read on demand;
+otherwise the whole FASTA file is loaded into memory.`
+
+// newProviderOpts creates the options for opening an input file. Arg
+// "reference", if nonempty, is the pathname of the reference FASTA for CRAM, or
+// for PAM with a reference-encoded seq field. The returned function closes the
+// reference file, if it is kept open to be read on demand. It must be called
+// after the providers created with the options are closed.
+func newProviderOpts(index, reference string) (bamprovider.ProviderOpts, func() error, error) {
+	opts := bamprovider.ProviderOpts{Index: index}
+	noClose := func() error { return nil }
+	if reference == "" {
+		return opts, noClose, nil
+	}
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, reference)
+	if err != nil {
+		return opts, noClose, err
+	}
+	if fai, err := file.Open(ctx, reference+".fai"); err == nil {
+		opts.Reference, err = fasta.NewIndexed(in.Reader(ctx), fai.Reader(ctx))
+		if e := fai.Close(ctx); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			in.Close(ctx) // nolint: errcheck
+			return opts, noClose, err
+		}
+		// The file is kept open so that the indexed FASTA can read it on demand.
+		return opts, func() error { return in.Close(ctx) }, nil
+	}
+	opts.Reference, err = fasta.New(in.Reader(ctx))
+	if e := in.Close(ctx); e != nil && err == nil {
+		err = e
+	}
+	return opts, noClose, err
+}
+
 func newCmdView() *cmdline.Command {
 	cmd := &cmdline.Command{
 		Name:     "view",
@@ -20,6 +69,7 @@ func newCmdView() *cmdline.Command {
 	}
 	flags := viewFlags{
 		bamIndex:   cmd.Flags.String("index", "", "Input BAM index filename. By default set to input bampath + .bai"),
+		reference:  cmd.Flags.String("reference", "", referenceHelp),
 		headerOnly: cmd.Flags.Bool("header", false, "Print only the header in SAM format"),
 		withHeader: cmd.Flags.Bool("with-header", false, "Print header before body"),
 		regions: cmd.Flags.String("regions", "", `A comma-separated list of regions to show.
@@ -34,7 +84,7 @@ The second format specifies the (chromosome, position, sequence) range as a
 when multiple reads are aligned at the same (chromosome, position).  For
 example, 'chr1:123:0-chr3:456:10'. An empty 'chr' part means unmapped reads,
 e.g., ':0:1000-:0:2000' will show 1000th to 2000th (0-based) unmapped reads.`),
-		filter: cmd.Flags.String("filter", "", filterHelp),
+		filter: cmd.Flags.String("filter", "", bamfilter.Help),
 	}
 	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
 		if len(argv) != 1 {
@@ -48,14 +98,17 @@ e.g., ':0:1000-:0:2000' will show 1000th to 2000th (0-based) unmapped reads.`),
 func newCmdFlagstat() *cmdline.Command {
 	cmd := &cmdline.Command{
 		Name:     "flagstat",
-		Short:    "Show stats of either a PAM or a BAM file. This command is a clone of 'samtools flagstat'.",
+		Short:    "Show stats of a PAM, BAM or CRAM file. This command is a clone of 'samtools flagstat'.",
 		ArgsName: "path",
 	}
+	referenceFlag := cmd.Flags.String("reference", "", referenceHelp)
+	filterFlag := cmd.Flags.String("filter", "", bamfilter.Help)
+	formatFlag := cmd.Flags.String("format", "text", `Output format. Value is one of "text", "json", or "tsv".`)
 	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
 		if len(argv) != 1 {
 			return fmt.Errorf("flagstat takes one pathname argument, but got %v", argv)
 		}
-		return flagstat(argv[0])
+		return flagstat(argv[0], *referenceFlag, *filterFlag, *formatFlag)
 	})
 	return cmd
 }
@@ -63,18 +116,25 @@ func newCmdFlagstat() *cmdline.Command {
 func newCmdConvert() *cmdline.Command {
 	cmd := &cmdline.Command{
 		Name:     "convert",
-		Short:    "Convert between BAM and PAM",
+		Short:    "Convert between BAM and PAM, or from CRAM to BAM or PAM",
 		ArgsName: "srcpath destpath",
 	}
 	baiFlag := cmd.Flags.String("index", "", "Input BAM index filename. By default, set to input bampath + .bai")
+	referenceFlag := cmd.Flags.String("reference", "", referenceHelp)
 	bytesPerShardFlag := cmd.Flags.Int64("bytes-per-shard", 4<<30, "A goal size of a PAM file shard")
 	bytesPerBlockFlag := cmd.Flags.Int("bytes-per-block", 8<<20, "A goal size of a PAM recordio block")
 	formatFlag := cmd.Flags.String("format", "", `
 Output file format. Value is either \"bam\" or \"pam\".
 If empty, the format is guessed from the input file
-(if the input is bam, output is pam and vice versa).`)
+(if the input is bam or cram, output is pam, and if the input is pam, output is bam).`)
 	transformersFlag := cmd.Flags.String("transformers", "", `Comma-separated list of transformers to apply during PAM generation.
 For example, "-transform=zstd 20".`)
+	qualBinsFlag := cmd.Flags.String("qual-bins", "", `If nonempty, bin the quality scores when generating PAM. This is lossy.
+The value is either "illumina8", for the Illumina 8-level binning, or a comma-separated
+list of "lo-hi:value" entries, each mapping the quality scores in range [lo,hi] to value.
+For example, "0-19:10,20-93:30". Scores not covered by any entry are unchanged.`)
+	referenceSeqFlag := cmd.Flags.Bool("reference-seq", false, `If true, store the seq field of the generated PAM as the difference from
+the -reference FASTA. The same FASTA must be given to read the seq field back.`)
 	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
 		if len(argv) != 2 {
 			return fmt.Errorf("convert takes srcpath destpath, but found %v", argv)
@@ -89,24 +149,49 @@ For example, "-transform=zstd 20".`)
 			}
 		} else {
 			switch bamprovider.GuessFileType(srcPath) {
-			case bamprovider.BAM:
+			case bamprovider.BAM, bamprovider.CRAM:
 				destFormat = bamprovider.PAM
 			case bamprovider.PAM:
 				destFormat = bamprovider.BAM
 			}
 		}
+		providerOpts, closeReference, err := newProviderOpts(*baiFlag, *referenceFlag)
+		if err != nil {
+			return err
+		}
+		defer closeReference() // nolint: errcheck
 		switch destFormat {
 		case bamprovider.PAM:
 			transformers := []string{}
 			if *transformersFlag != "" {
 				transformers = strings.Split(*transformersFlag, ",")
 			}
-			return converter.ConvertToPAM(pam.WriteOpts{
+			qualBins, err := pam.ParseQualBins(*qualBinsFlag)
+			if err != nil {
+				return err
+			}
+			opts := pam.WriteOpts{
 				MaxBufSize:   *bytesPerBlockFlag,
 				Transformers: transformers,
-			}, destPath, srcPath, *baiFlag, *bytesPerShardFlag)
+				QualBins:     qualBins,
+			}
+			if *referenceSeqFlag {
+				if providerOpts.Reference == nil {
+					return fmt.Errorf("convert: -reference-seq requires -reference")
+				}
+				opts.Reference = providerOpts.Reference
+			}
+			if bamprovider.GuessFileType(srcPath) == bamprovider.CRAM {
+				p := bamprovider.NewProvider(srcPath, providerOpts)
+				err := converter.ConvertProviderToPAM(opts, destPath, p, *bytesPerShardFlag)
+				if e := p.Close(); e != nil && err == nil {
+					err = e
+				}
+				return err
+			}
+			return converter.ConvertToPAM(opts, destPath, srcPath, *baiFlag, *bytesPerShardFlag)
 		case bamprovider.BAM:
-			p := bamprovider.NewProvider(srcPath, bamprovider.ProviderOpts{Index: *baiFlag})
+			p := bamprovider.NewProvider(srcPath, providerOpts)
 			err := converter.ConvertToBAM(destPath, p)
 			if e := p.Close(); e != nil && err == nil {
 				err = e
@@ -120,33 +205,362 @@ For example, "-transform=zstd 20".`)
 	return cmd
 }
 
+// addFieldFlags defines the flags that select the fields of checksumOpts.
+// verb describes what is done with the selected fields.
+func addFieldFlags(flags *flag.FlagSet, opts *checksumOpts, verb string) {
+	flags.BoolVar(&opts.name, "name", false, verb+" the name field")
+	flags.BoolVar(&opts.tempLen, "templen", false, verb+" the templen field")
+	flags.BoolVar(&opts.seq, "seq", false, verb+" the seq field")
+	flags.BoolVar(&opts.cigar, "cigar", false, verb+" the cigar field")
+	flags.BoolVar(&opts.aux, "aux", false, verb+" the aux field")
+	flags.BoolVar(&opts.mapQ, "mapq", false, verb+" the mapq field")
+	flags.BoolVar(&opts.matePos, "matePos", false, verb+" the mateRef and matePos fields")
+	flags.BoolVar(&opts.qual, "qual", false, verb+" the qual fields")
+	flags.BoolVar(&opts.all, "all", false, verb+" the all the fields")
+}
+
 func newCmdChecksum() *cmdline.Command {
 	cmd := &cmdline.Command{
 		Name: "checksum",
 		Short: `Compute a checksum of a BAM or PAM file.
-The checksum is a JSON string describing the summary of various attributes of the reads`,
+The checksum is a JSON string describing the summary of various attributes of the reads.
+With -format=tsv, it is a table with one line per reference.`,
 		ArgsName: "path",
 	}
 	opts := checksumOpts{}
 	cmd.Flags.StringVar(&opts.baiPath, "index", "", "Input BAM index filename. By default, set to input BAM filename + .bai")
-	cmd.Flags.BoolVar(&opts.name, "name", false, "Checksum the name field")
-	cmd.Flags.BoolVar(&opts.tempLen, "templen", false, "Checksum the templen field")
-	cmd.Flags.BoolVar(&opts.seq, "seq", false, "Checksum the seq field")
-	cmd.Flags.BoolVar(&opts.cigar, "cigar", false, "Checksum the cigar field")
-	cmd.Flags.BoolVar(&opts.aux, "aux", false, "Checksum the aux field")
-	cmd.Flags.BoolVar(&opts.mapQ, "mapq", false, "Checksum the mapq field")
-	cmd.Flags.BoolVar(&opts.matePos, "matePos", false, "Checksum the mateRef and matePos fields")
-	cmd.Flags.BoolVar(&opts.qual, "qual", false, "Checksum the qual fields")
-	cmd.Flags.BoolVar(&opts.all, "all", false, "Checksum the all the fields")
+	addFieldFlags(&cmd.Flags, &opts, "Checksum")
+	cmd.Flags.StringVar(&opts.format, "format", "json", `Output format. Value is either "json" or "tsv".
+The tsv output has one line per reference. It omits the quality binning info.`)
+	qualBinsFlag := cmd.Flags.String("qual-bins", "", `Bin the quality scores before checksumming them.
+The value is in the same format as convert's -qual-bins flag.`)
+	referenceFlag := cmd.Flags.String("reference", "", referenceHelp)
 	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
 		if len(argv) != 1 {
 			return fmt.Errorf("verify takes a path, but found %v", argv)
 		}
+		var err error
+		if opts.qualBins, err = pam.ParseQualBins(*qualBinsFlag); err != nil {
+			return err
+		}
+		providerOpts, closeReference, err := newProviderOpts("", *referenceFlag)
+		if err != nil {
+			return err
+		}
+		defer closeReference() // nolint: errcheck
+		opts.reference = providerOpts.Reference
 		return checksum(argv[0], opts)
 	})
 	return cmd
 }
 
+func newCmdDepth() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name: "depth",
+		Short: `Compute per-base read depth of a BAM or PAM file.
+By default, the output is in bedGraph format. Bases with zero depth are not printed.`,
+		ArgsName: "path",
+	}
+	opts := depthOpts{}
+	cmd.Flags.StringVar(&opts.index, "index", "", "Input BAM index filename. By default, set to input BAM filename + .bai")
+	cmd.Flags.StringVar(&opts.regions, "regions", "", `A comma-separated list of regions to compute depth for.
+Each region must be of form 'chr:begin-end', where [begin,end] is a 1-based, closed interval.
+Overlapping regions are merged, and the output is in coordinate order.
+If empty, the whole genome is scanned.`)
+	cmd.Flags.StringVar(&opts.filter, "filter", "", bamfilter.Help)
+	cmd.Flags.StringVar(&opts.bedPath, "bed", "", "If set, depth is computed only for the intervals in this BED file")
+	cmd.Flags.StringVar(&opts.format, "format", "bedgraph", `Output format. Value is either "bedgraph" or "tsv".
+"bedgraph" prints the depth of each run of bases, or the mean depth of each bin if -window is set.
+"tsv" prints the per-reference summary of depths.`)
+	cmd.Flags.IntVar(&opts.window, "window", 0, "If >0, report the mean depth of each window of this many bases")
+	cmd.Flags.IntVar(&opts.padding, "max-read-span", 1000, `Maximum number of reference bases covered by a read.
+Reads that span more bases may be undercounted at shard boundaries.`)
+	cmd.Flags.IntVar(&opts.excludeFlags, "exclude-flags", int(sam.Unmapped|sam.Secondary|sam.QCFail|sam.Duplicate),
+		"Records with any of these flag bits are ignored. The default is the same as samtools depth.")
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 1 {
+			return fmt.Errorf("depth takes one pathname argument, but got %v", argv)
+		}
+		return depth(argv[0], opts)
+	})
+	return cmd
+}
+
+func newCmdValidate() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name: "validate",
+		Short: `Check the integrity of a PAM file.
+It checks that the shards cover all the coordinates without a gap or an overlap,
+that every shard has all the field files, and that the field files have the
+same number of records, with monotonic block indexes. It exits with an error if
+a problem is found.`,
+		ArgsName: "path",
+	}
+	opts := validateOpts{}
+	cmd.Flags.StringVar(&opts.format, "format", "text", `Output format. Value is either "text" or "json".`)
+	cmd.Flags.BoolVar(&opts.repair, "repair", false, `If true, delete the shards that have problems, as well as the field files
+that don't belong to any shard, e.g., ones left by an interrupted writer.
+The remaining shards become readable, but the records in the deleted shards are lost.
+The file is then validated again, and it exits with an error if problems remain,
+e.g., gaps left by the deleted shards.`)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 1 {
+			return fmt.Errorf("validate takes one pathname argument, but got %v", argv)
+		}
+		return validate(argv[0], opts)
+	})
+	return cmd
+}
+
+func newCmdCat() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name: "cat",
+		Short: `Concatenate PAM files that store disjoint coordinate ranges.
+The shard ranges of the source files must together cover all the coordinates
+without a gap or an overlap, and the files must have the same header. The field
+files are hardlinked or copied into destpath without decoding the records.`,
+		ArgsName: "srcpath... destpath",
+	}
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) < 2 {
+			return fmt.Errorf("cat takes srcpath... destpath, but found %v", argv)
+		}
+		return pamutil.Concat(vcontext.Background(), argv[len(argv)-1], argv[:len(argv)-1])
+	})
+	return cmd
+}
+
+func newCmdReshard() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name: "reshard",
+		Short: `Rewrite a PAM file with a different number of file shards.
+Shards are split only at position boundaries, so the resulting number of shards
+may be smaller than requested.`,
+		ArgsName: "srcpath destpath",
+	}
+	referenceFlag := cmd.Flags.String("reference", "", referenceHelp)
+	numShardsFlag := cmd.Flags.Int("num-shards", 0, "The target number of file shards. It is ignored if -bytes-per-shard is set")
+	bytesPerShardFlag := cmd.Flags.Int64("bytes-per-shard", 0, "If >0, the goal size of a file shard")
+	bytesPerBlockFlag := cmd.Flags.Int("bytes-per-block", 8<<20, "A goal size of a PAM recordio block")
+	transformersFlag := cmd.Flags.String("transformers", "", `Comma-separated list of transformers to apply to the new files.
+For example, "-transform=zstd 20".`)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 2 {
+			return fmt.Errorf("reshard takes srcpath destpath, but found %v", argv)
+		}
+		if *numShardsFlag <= 0 && *bytesPerShardFlag <= 0 {
+			return fmt.Errorf("reshard: either -num-shards or -bytes-per-shard must be set")
+		}
+		providerOpts, closeReference, err := newProviderOpts("", *referenceFlag)
+		if err != nil {
+			return err
+		}
+		defer closeReference() // nolint: errcheck
+		opts := pam.ReshardOpts{
+			BytesPerShard: *bytesPerShardFlag,
+			NumShards:     *numShardsFlag,
+			MaxBufSize:    *bytesPerBlockFlag,
+			Reference:     providerOpts.Reference,
+		}
+		if *transformersFlag != "" {
+			opts.Transformers = strings.Split(*transformersFlag, ",")
+		}
+		return pam.Reshard(argv[0], argv[1], opts)
+	})
+	return cmd
+}
+
+func newCmdMarkdup() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name: "markdup",
+		Short: `Mark duplicate reads in a coordinate-sorted BAM or PAM file.
+Reads are grouped by the unclipped 5' positions and orientations of the pair,
+and the reads of the pair with the highest base-quality sum are kept. The others
+get the duplicate flag (0x400). Existing duplicate flags are cleared. For a PAM
+output, only the flags field is rewritten; the other fields are hardlinked from
+srcpath when possible.`,
+		ArgsName: "srcpath destpath",
+	}
+	opts := markdupOpts{}
+	cmd.Flags.StringVar(&opts.index, "index", "", "Input BAM index filename. By default, set to input BAM filename + .bai")
+	cmd.Flags.StringVar(&opts.reference, "reference", "", referenceHelp)
+	cmd.Flags.StringVar(&opts.metricsPath, "metrics", "", "If set, write duplication metrics to this file, in the format of Picard MarkDuplicates")
+	cmd.Flags.StringVar(&opts.format, "format", "", `Output file format. Value is either "bam" or "pam".
+If empty, the format is guessed from destpath. A PAM output requires a PAM input.`)
+	cmd.Flags.StringVar(&opts.umiTag, "umi-tag", "", `If set, the aux tag that stores the unique molecular identifier, e.g., "RX".
+Reads with different UMIs are never duplicates of each other.`)
+	cmd.Flags.IntVar(&opts.shardSize, "shard-size", markdup.DefaultShardSize, "Number of reference bases processed by one task")
+	cmd.Flags.IntVar(&opts.padding, "padding", markdup.DefaultPadding, `Maximum number of reference bases covered by a read, including clipped bases.
+Duplicates of longer reads may be missed at shard boundaries.`)
+	cmd.Flags.IntVar(&opts.parallelism, "parallelism", 0, "Number of shards processed concurrently. If <=0, use the number of CPUs")
+	cmd.Flags.IntVar(&opts.diskMateShards, "disk-mate-shards", 0, "If >0, store distant mates on disk in this many shards instead of in memory")
+	cmd.Flags.IntVar(&opts.diskShards, "disk-shards", markdup.DefaultDiskShards, `Number of temporary files that store the duplicates by read name, and by position.
+Only a few of them are loaded in memory at a time`)
+	cmd.Flags.StringVar(&opts.scratchDir, "scratch-dir", os.TempDir(), "Directory for the temporary files, including the distant mates stored on disk")
+	cmd.Flags.IntVar(&opts.bytesPerBlock, "bytes-per-block", 8<<20, "A goal size of a PAM recordio block")
+	cmd.Flags.StringVar(&opts.transformers, "transformers", "", `Comma-separated list of transformers to apply to the new PAM flags field.
+For example, "-transform=zstd 20".`)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 2 {
+			return fmt.Errorf("markdup takes srcpath destpath, but found %v", argv)
+		}
+		return markDuplicates(argv[0], argv[1], opts)
+	})
+	return cmd
+}
+
+func newCmdFixmate() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name: "fixmate",
+		Short: `Fix the mate information in a coordinate-sorted BAM or PAM file.
+For each primary record of a paired read, the mate reference, mate position,
+template length, mate-reverse and mate-unmapped flags, and the MC and MQ aux
+tags are recomputed from its mate. Reads whose mate is missing from the file are
+marked as having an unmapped mate. For a PAM output, only the fields that may
+change are rewritten; the other fields are hardlinked from srcpath when possible.`,
+		ArgsName: "srcpath destpath",
+	}
+	opts := fixmateOpts{}
+	cmd.Flags.StringVar(&opts.index, "index", "", "Input BAM index filename. By default, set to input BAM filename + .bai")
+	cmd.Flags.StringVar(&opts.reference, "reference", "", referenceHelp)
+	cmd.Flags.StringVar(&opts.format, "format", "", `Output file format. Value is either "bam" or "pam".
+If empty, the format is guessed from destpath. A PAM output requires a PAM input.`)
+	cmd.Flags.IntVar(&opts.shardSize, "shard-size", fixmate.DefaultShardSize, "Number of reference bases processed by one task")
+	cmd.Flags.IntVar(&opts.parallelism, "parallelism", 0, "Number of shards processed concurrently. If <=0, use the number of CPUs")
+	cmd.Flags.IntVar(&opts.diskShards, "disk-shards", fixmate.DefaultDiskShards, `Number of temporary files that store the reads whose mate is in another shard,
+and the mate corrections. Only a few of them are loaded in memory at a time`)
+	cmd.Flags.StringVar(&opts.scratchDir, "scratch-dir", os.TempDir(), "Directory for the temporary files")
+	cmd.Flags.IntVar(&opts.bytesPerBlock, "bytes-per-block", 8<<20, "A goal size of a PAM recordio block")
+	cmd.Flags.StringVar(&opts.transformers, "transformers", "", `Comma-separated list of transformers to apply to the rewritten PAM fields.
+For example, "-transform=zstd 20".`)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 2 {
+			return fmt.Errorf("fixmate takes srcpath destpath, but found %v", argv)
+		}
+		return fixMates(argv[0], argv[1], opts)
+	})
+	return cmd
+}
+
+func newCmdSubset() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name: "subset",
+		Short: `Write a subset of the records of a BAM or PAM file to a new BAM or PAM file.
+The records are selected by genomic regions, a filter expression, and
+downsampling. A record is written only if it satisfies all the given conditions.
+The records are written in the same order as in srcpath.`,
+		ArgsName: "srcpath destpath",
+	}
+	opts := subsetOpts{}
+	cmd.Flags.StringVar(&opts.index, "index", "", "Input BAM index filename. By default, set to input BAM filename + .bai")
+	cmd.Flags.StringVar(&opts.reference, "reference", "", referenceHelp)
+	cmd.Flags.StringVar(&opts.regions, "regions", "", `A comma-separated list of regions to write.
+Each region must be of form 'chr:begin-end', where [begin,end] is a 1-based, closed interval.
+Records that overlap any of the regions, or any interval of -bed, are written.
+If neither -regions nor -bed is set, the whole file, including unmapped records, is scanned.`)
+	cmd.Flags.StringVar(&opts.bedPath, "bed", "", "If set, write the records that overlap the intervals in this BED file")
+	cmd.Flags.IntVar(&opts.padding, "max-read-span", 1000, `Maximum number of reference bases covered by a read.
+Records that start more than this many bases before a region may be dropped.`)
+	cmd.Flags.StringVar(&opts.filter, "filter", "", bamfilter.Help)
+	cmd.Flags.Float64Var(&opts.fraction, "fraction", 1, `Fraction of the reads to keep, in range (0, 1].
+Reads are selected by the hash of the read name, so that mates are kept or
+dropped together, and the result is deterministic.`)
+	cmd.Flags.Int64Var(&opts.seed, "seed", 0, "Seed of the read-name hash used by -fraction")
+	cmd.Flags.StringVar(&opts.format, "format", "", `Output file format. Value is either "bam" or "pam".
+If empty, the format is guessed from destpath.`)
+	cmd.Flags.IntVar(&opts.parallelism, "parallelism", 0, "Number of shards processed concurrently. If <=0, use the number of CPUs")
+	cmd.Flags.IntVar(&opts.bytesPerBlock, "bytes-per-block", 8<<20, "A goal size of a PAM recordio block")
+	cmd.Flags.StringVar(&opts.transformers, "transformers", "", `Comma-separated list of transformers to apply to the PAM output.
+For example, "-transform=zstd 20".`)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 2 {
+			return fmt.Errorf("subset takes srcpath destpath, but found %v", argv)
+		}
+		return subset(argv[0], argv[1], opts)
+	})
+	return cmd
+}
+
+func newCmdStats() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name: "stats",
+		Short: `Compute summary statistics and histograms of a BAM or PAM file.
+The output follows the format of 'samtools stats'. It includes the summary numbers
+(SN), per-cycle base qualities (FFQ, LFQ), GC content (GCF, GCL), insert sizes (IS),
+read lengths (RL, FRL, LRL), and mapping qualities (MAPQ).`,
+		ArgsName: "path",
+	}
+	opts := statsOpts{}
+	cmd.Flags.StringVar(&opts.index, "index", "", "Input BAM index filename. By default, set to input BAM filename + .bai")
+	cmd.Flags.StringVar(&opts.reference, "reference", "", referenceHelp)
+	cmd.Flags.IntVar(&opts.maxInsertSize, "max-insert-size", 8000, "Largest insert size stored in the IS histogram")
+	cmd.Flags.StringVar(&opts.format, "format", "text", `Output format. Value is either "text" or "json".`)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 1 {
+			return fmt.Errorf("stats takes one path, but found %v", argv)
+		}
+		return stats(argv[0], opts)
+	})
+	return cmd
+}
+
+func newCmdIdxstats() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name: "idxstats",
+		Short: `Count the mapped and unmapped records on each reference of a BAM or PAM file.
+This command is a clone of 'samtools idxstats'. Each line lists the reference name,
+the reference length, and the numbers of mapped and unmapped records. The last
+line, named "*", counts the records without a reference.`,
+		ArgsName: "path",
+	}
+	opts := idxstatsOpts{}
+	cmd.Flags.StringVar(&opts.index, "index", "", "Input BAM index filename. By default, set to input BAM filename + .bai")
+	cmd.Flags.StringVar(&opts.reference, "reference", "", referenceHelp)
+	cmd.Flags.StringVar(&opts.format, "format", "text", `Output format. Value is either "text" or "json".`)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 1 {
+			return fmt.Errorf("idxstats takes one path, but found %v", argv)
+		}
+		return idxstats(argv[0], opts)
+	})
+	return cmd
+}
+
+func newCmdDiff() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name: "diff",
+		Short: `Compare the records of two coordinate-sorted BAM or PAM files.
+Records are matched by their coordinate, name, and flags, regardless of their
+order at the same position. The command lists the records found in only one of
+the files, and the matching records whose selected fields differ. It fails if
+the files differ.`,
+		ArgsName: "pathA pathB",
+	}
+	opts := diffOpts{}
+	addFieldFlags(&cmd.Flags, &opts.checksumOpts, "Compare")
+	cmd.Flags.IntVar(&opts.maxExamples, "max-examples", 10, "Max number of differing records to print")
+	qualBinsFlag := cmd.Flags.String("qual-bins", "", `Bin the quality scores before comparing them.
+The value is in the same format as convert's -qual-bins flag.`)
+	referenceFlag := cmd.Flags.String("reference", "", referenceHelp)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 2 {
+			return fmt.Errorf("diff takes pathA pathB, but found %v", argv)
+		}
+		var err error
+		if opts.qualBins, err = pam.ParseQualBins(*qualBinsFlag); err != nil {
+			return err
+		}
+		providerOpts, closeReference, err := newProviderOpts("", *referenceFlag)
+		if err != nil {
+			return err
+		}
+		defer closeReference() // nolint: errcheck
+		opts.reference = providerOpts.Reference
+		return diff(argv[0], argv[1], opts)
+	})
+	return cmd
+}
+
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 	cmdline.HideGlobalFlagsExcept()
@@ -160,6 +574,16 @@ func main() {
 				newCmdFlagstat(),
 				newCmdView(),
 				newCmdChecksum(),
+				newCmdDepth(),
+				newCmdValidate(),
+				newCmdCat(),
+				newCmdReshard(),
+				newCmdMarkdup(),
+				newCmdFixmate(),
+				newCmdSubset(),
+				newCmdStats(),
+				newCmdIdxstats(),
+				newCmdDiff(),
 			},
 		})
 }
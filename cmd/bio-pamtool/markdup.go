@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/markdup"
+)
+
+type markdupOpts struct {
+	// index sets the name of the BAM index file. If empty, bampath+".bai" is used.
+	index string
+	// reference is the pathname of the reference FASTA, for CRAM or for PAM with
+	// a reference-encoded seq field.
+	reference string
+	// metricsPath, if nonempty, is the file the Picard-style metrics are written to.
+	metricsPath string
+	// format is the output format, either "bam" or "pam". If empty, the format
+	// is guessed from the destination path.
+	format string
+	// transformers is a comma-separated list of transformers for the PAM flags
+	// field.
+	transformers string
+	// bytesPerBlock is the goal size of a PAM recordio block.
+	bytesPerBlock int
+
+	umiTag         string
+	shardSize      int
+	padding        int
+	parallelism    int
+	diskMateShards int
+	diskShards     int
+	scratchDir     string
+}
+
+// writeMarkdupMetrics writes the metrics to the given path. Arg "comment" is
+// recorded in the file header.
+func writeMarkdupMetrics(path, comment string, metrics []markdup.Metrics) error {
+	ctx := vcontext.Background()
+	out, err := file.Create(ctx, path)
+	if err != nil {
+		return err
+	}
+	if err := markdup.WriteMetrics(out.Writer(ctx), comment, metrics); err != nil {
+		out.Discard(ctx) // nolint: errcheck
+		return err
+	}
+	return out.Close(ctx)
+}
+
+func markDuplicates(srcPath, dstPath string, opts markdupOpts) error {
+	format := bamprovider.GuessFileType(dstPath)
+	if opts.format != "" {
+		format = bamprovider.ParseFileType(opts.format)
+	}
+	providerOpts, closeReference, err := newProviderOpts(opts.index, opts.reference)
+	if err != nil {
+		return err
+	}
+	defer closeReference() // nolint: errcheck
+	mopts := markdup.Opts{
+		ProviderOpts:   providerOpts,
+		ShardSize:      opts.shardSize,
+		Padding:        opts.padding,
+		Parallelism:    opts.parallelism,
+		DiskMateShards: opts.diskMateShards,
+		DiskShards:     opts.diskShards,
+		ScratchDir:     opts.scratchDir,
+		UMITag:         opts.umiTag,
+		MaxBufSize:     opts.bytesPerBlock,
+	}
+	if opts.transformers != "" {
+		mopts.Transformers = strings.Split(opts.transformers, ",")
+	}
+	var metrics []markdup.Metrics
+	switch format {
+	case bamprovider.BAM:
+		metrics, err = markdup.MarkBAM(srcPath, dstPath, mopts)
+	case bamprovider.PAM:
+		metrics, err = markdup.MarkPAM(srcPath, dstPath, mopts)
+	default:
+		return fmt.Errorf("markdup: cannot determine the output format of %s; set -format", dstPath)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.metricsPath == "" {
+		return nil
+	}
+	return writeMarkdupMetrics(opts.metricsPath, strings.Join(os.Args, " "), metrics)
+}
@@ -0,0 +1,52 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"v.io/x/lib/gosh"
+)
+
+func TestMarkdup(t *testing.T) {
+	if !testutil.IsBazel() {
+		t.Skip("not bazel")
+	}
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam")
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+	pamtoolPath := testutil.GoExecutable(t, "//go/src/github.com/grailbio/bio/cmd/bio-pamtool/bio-pamtool")
+	dir := sh.MakeTempDir()
+	pamPath := filepath.Join(dir, "test.pam")
+	sh.Cmd(pamtoolPath, "convert", bamPath, pamPath).Run()
+	require.NoError(t, sh.Err)
+
+	markedBAMPath := filepath.Join(dir, "marked.bam")
+	bamMetricsPath := filepath.Join(dir, "bam.metrics")
+	sh.Cmd(pamtoolPath, "markdup", "-metrics", bamMetricsPath, pamPath, markedBAMPath).Run()
+	require.NoError(t, sh.Err)
+
+	markedPAMPath := filepath.Join(dir, "marked.pam")
+	pamMetricsPath := filepath.Join(dir, "pam.metrics")
+	sh.Cmd(pamtoolPath, "markdup", "-metrics", pamMetricsPath, pamPath, markedPAMPath).Run()
+	require.NoError(t, sh.Err)
+
+	// Both outputs mark the same records.
+	assert.Equal(t,
+		sh.Cmd(pamtoolPath, "flagstat", markedBAMPath).Stdout(),
+		sh.Cmd(pamtoolPath, "flagstat", markedPAMPath).Stdout())
+
+	bamMetrics, err := ioutil.ReadFile(bamMetricsPath)
+	require.NoError(t, err)
+	pamMetrics, err := ioutil.ReadFile(pamMetricsPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(bamMetrics), "## METRICS CLASS\tpicard.sam.DuplicationMetrics\n")
+	// The metrics are the same, except for the command line in the header.
+	trimHeader := func(s string) string { return s[strings.Index(s, "\n\n"):] }
+	assert.Equal(t, trimHeader(string(bamMetrics)), trimHeader(string(pamMetrics)))
+}
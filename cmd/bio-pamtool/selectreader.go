@@ -0,0 +1,172 @@
+package main
+
+import (
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+// maxSelectGap is the max number of unselected records between two runs of
+// selected records that are read by one iterator in the second pass of
+// selectReader. Starting an iterator costs about as much as reading a few
+// recordio blocks, so it is cheaper to read and discard short gaps.
+const maxSelectGap = 1 << 16
+
+// dropFieldsExcept returns the fields that are not listed in any of the args.
+// FieldCoord is never dropped, since the readers need it to seek.
+func dropFieldsExcept(fieldLists ...[]gbam.FieldType) []gbam.FieldType {
+	var need [gbam.NumFields]bool
+	need[gbam.FieldCoord] = true
+	for _, fields := range fieldLists {
+		for _, f := range fields {
+			need[f] = true
+		}
+	}
+	var drop []gbam.FieldType
+	for f, ok := range need {
+		if !ok {
+			drop = append(drop, gbam.FieldType(f))
+		}
+	}
+	return drop
+}
+
+// selectReader reads the records that satisfy a predicate. For a PAM file, it
+// reads each shard in two passes. The first pass reads only the fields needed
+// by the predicate, and it finds the ranges of the selected records. The
+// second pass reads the other fields only in these ranges. This saves I/O
+// when the predicate is selective. Thread safe.
+type selectReader struct {
+	// provider reads all the fields that the caller needs.
+	provider bamprovider.Provider
+	// selectProvider reads only the fields needed by the predicate. It is nil
+	// if the file is read in one pass.
+	selectProvider bamprovider.Provider
+	// maxGap is the max number of unselected records read in the second
+	// pass between two selected records. Cf. maxSelectGap.
+	maxGap int
+}
+
+// newSelectReader creates a selectReader that reads the file through provider.
+// path and opts must be the ones used to create the provider. fields and
+// auxTags list the fields and the aux tags needed by the predicate. If
+// auxTags is empty, the predicate may read any aux tag.
+func newSelectReader(provider bamprovider.Provider, path string, opts bamprovider.ProviderOpts,
+	fields []gbam.FieldType, auxTags []string) *selectReader {
+	r := &selectReader{provider: provider}
+	if bamprovider.GuessFileType(path) != bamprovider.PAM {
+		// The other formats store all the fields of a record together, so
+		// reading fewer fields saves little I/O.
+		return r
+	}
+	selectOpts := opts
+	selectOpts.DropFields = append([]gbam.FieldType{}, opts.DropFields...)
+	dropped := map[gbam.FieldType]bool{}
+	for _, f := range opts.DropFields {
+		dropped[f] = true
+	}
+	for _, f := range dropFieldsExcept(fields) {
+		if !dropped[f] {
+			selectOpts.DropFields = append(selectOpts.DropFields, f)
+		}
+	}
+	narrowed := len(selectOpts.DropFields) > len(opts.DropFields)
+	if len(opts.AuxTags) == 0 && len(auxTags) > 0 {
+		selectOpts.AuxTags = auxTags
+		narrowed = true
+	}
+	if !narrowed {
+		// The predicate needs all the fields that the caller reads.
+		return r
+	}
+	r.selectProvider = bamprovider.NewProvider(path, selectOpts)
+	r.maxGap = maxSelectGap
+	return r
+}
+
+// scan calls cb for every record in the shard that satisfies keep, in file
+// order. cb takes ownership of the record. keep must be deterministic, since
+// it may be called more than once for the same record. If keep is nil, every
+// record is passed to cb.
+func (r *selectReader) scan(shard gbam.Shard, keep func(*sam.Record) bool, cb func(*sam.Record) error) error {
+	if r.selectProvider == nil || keep == nil {
+		return scanRange(r.provider, shard, keep, cb)
+	}
+	ranges, err := r.selectRanges(shard, keep)
+	if err != nil {
+		return err
+	}
+	header, err := r.provider.GetHeader()
+	if err != nil {
+		return err
+	}
+	for _, cr := range ranges {
+		if err := scanRange(r.provider, gbam.CoordRangeToShard(header, cr, 0, shard.ShardIdx), keep, cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectRanges runs the first pass on the shard. It returns the ranges that
+// contain all the records that satisfy keep.
+func (r *selectReader) selectRanges(shard gbam.Shard, keep func(*sam.Record) bool) ([]biopb.CoordRange, error) {
+	// Compute the coordinates of the records in the same way as the PAM reader
+	// does.
+	coords := gbam.NewCoordGenerator()
+	start := gbam.NewCoord(shard.StartRef, shard.PaddedStart(), int32(shard.StartSeq))
+	coords.LastRec = biopb.Coord{RefId: start.RefId, Pos: start.Pos, Seq: start.Seq - 1}
+
+	var (
+		ranges []biopb.CoordRange
+		gap    int
+	)
+	iter := r.selectProvider.NewIterator(shard)
+	for iter.Scan() {
+		rec := iter.Record()
+		coord := coords.GenerateFromRecord(rec)
+		if keep(rec) {
+			// The range limit is the smallest coordinate after coord.
+			limit := biopb.Coord{RefId: coord.RefId, Pos: coord.Pos, Seq: coord.Seq + 1}
+			if len(ranges) > 0 && gap <= r.maxGap {
+				ranges[len(ranges)-1].Limit = limit
+			} else {
+				ranges = append(ranges, biopb.CoordRange{Start: coord, Limit: limit})
+			}
+			gap = 0
+		} else {
+			gap++
+		}
+		sam.PutInFreePool(rec)
+	}
+	return ranges, iter.Close()
+}
+
+// scanRange calls cb for every record in the shard that satisfies keep. cb
+// takes ownership of the record. keep may be nil, in which case every record
+// is passed to cb.
+func scanRange(provider bamprovider.Provider, shard gbam.Shard, keep func(*sam.Record) bool, cb func(*sam.Record) error) error {
+	iter := provider.NewIterator(shard)
+	e := errors.Once{}
+	for iter.Scan() {
+		rec := iter.Record()
+		if keep == nil || keep(rec) {
+			e.Set(cb(rec))
+		} else {
+			sam.PutInFreePool(rec)
+		}
+	}
+	e.Set(iter.Close())
+	return e.Err()
+}
+
+// close closes the provider used for the first pass. It does not close the
+// provider passed to newSelectReader.
+func (r *selectReader) close() error {
+	if r.selectProvider == nil {
+		return nil
+	}
+	return r.selectProvider.Close()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamfilter"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectReader(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup)
+
+	chr1, err := sam.NewReference("chr1", "", "", 10000, nil, nil)
+	require.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 10000, nil, nil)
+	require.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	require.NoError(t, err)
+	header.SortOrder = sam.Coordinate
+
+	// Three records at each position, followed by unmapped records.
+	path := filepath.Join(tempDir, "test.pam")
+	w := pam.NewWriter(pam.WriteOpts{}, header, path)
+	for i := 0; i < 330; i++ {
+		ref, pos, flags := chr1, i/3*10, sam.Flags(0)
+		var cigar sam.Cigar
+		if i >= 150 {
+			ref, pos = chr2, (i-150)/3*10
+		}
+		if i >= 300 {
+			ref, pos, flags = nil, -1, sam.Unmapped
+		} else {
+			cigar = sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}
+		}
+		r, err := sam.NewRecord(fmt.Sprintf("r%03d", i), ref, nil, pos, -1, 0, byte(i%60),
+			cigar, []byte("ACGT"), []byte{30, 30, 30, 30}, nil)
+		require.NoError(t, err)
+		r.Flags = flags
+		aux, err := sam.NewAux(sam.NewTag("NM"), i%5)
+		require.NoError(t, err)
+		r.AuxFields = sam.AuxFields{aux}
+		w.Write(r)
+	}
+	require.NoError(t, w.Close())
+
+	// Some shards start in the middle of a position.
+	shards := []gbam.Shard{
+		{StartRef: chr1, Start: 0, EndRef: chr1, End: 200, EndSeq: 1},
+		{StartRef: chr1, Start: 200, StartSeq: 1, EndRef: chr2, End: 100},
+		{StartRef: chr2, Start: 100, EndRef: nil, End: 0, EndSeq: 10},
+		{StartRef: nil, Start: 0, StartSeq: 10, EndRef: nil, End: 1},
+	}
+	opts := bamprovider.ProviderOpts{}
+	provider := bamprovider.NewProvider(path, opts)
+	readNames := func(scan func(shard gbam.Shard, cb func(*sam.Record) error) error) []string {
+		var names []string
+		for _, shard := range shards {
+			require.NoError(t, scan(shard, func(r *sam.Record) error {
+				names = append(names, r.Name)
+				sam.PutInFreePool(r)
+				return nil
+			}))
+		}
+		return names
+	}
+	for _, str := range []string{
+		`tag("NM") == 0`,
+		`mapping_quality > 50`,
+		`re(rec_name, "7$")`,
+		`unmapped && rec_name > "r320"`,
+		`position == 200`,
+		`sequence_length == 4 && position == 200`,
+		`rec_name == "none"`,
+	} {
+		expr, err := bamfilter.Parse(str)
+		require.NoError(t, err)
+		reader := newSelectReader(provider, path, opts, expr.Fields(), expr.AuxTags())
+		require.NotNil(t, reader.selectProvider)
+		// Read a few unselected records between the selected ones at most.
+		reader.maxGap = 2
+		expected := readNames(func(shard gbam.Shard, cb func(*sam.Record) error) error {
+			return scanRange(provider, shard, expr.Evaluate, cb)
+		})
+		got := readNames(func(shard gbam.Shard, cb func(*sam.Record) error) error {
+			return reader.scan(shard, expr.Evaluate, cb)
+		})
+		assert.Equal(t, expected, got, "expr=%s", str)
+		require.NoError(t, reader.close())
+	}
+	// The records are read in one pass if every field is needed.
+	reader := newSelectReader(provider, path, opts, []gbam.FieldType{
+		gbam.FieldCoord, gbam.FieldFlags, gbam.FieldMapq, gbam.FieldCigar, gbam.FieldMateRefID, gbam.FieldMatePos,
+		gbam.FieldTempLen, gbam.FieldName, gbam.FieldSeq, gbam.FieldQual, gbam.FieldAux}, nil)
+	assert.Nil(t, reader.selectProvider)
+	require.NoError(t, provider.Close())
+}
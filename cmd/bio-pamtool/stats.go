@@ -0,0 +1,674 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/hts/sam"
+)
+
+type statsOpts struct {
+	// index sets the name of the BAM index file. If empty, bampath+".bai" is used.
+	index string
+	// reference is the pathname of the reference FASTA, for CRAM or for PAM with
+	// a reference-encoded seq field.
+	reference string
+	// maxInsertSize is the largest insert size stored in the histogram.
+	maxInsertSize int
+	// format is the output format, either "text" or "json".
+	format string
+}
+
+// pairOrientation is the relative orientation of the reads of a pair, as
+// defined by samtools stats.
+type pairOrientation int
+
+const (
+	inwardPair pairOrientation = iota
+	outwardPair
+	otherPair
+	numPairOrientations
+)
+
+// aggrStats accumulates the stats reported by "samtools stats". Secondary and
+// supplementary records are counted only in the secondary and supplementary
+// fields.
+type aggrStats struct {
+	maxInsertSize int
+
+	raw           int
+	first, last   int
+	mapped        int
+	pairedMapped  int
+	unmapped      int
+	properPair    int
+	paired        int
+	duplicate     int
+	mq0           int
+	qcFail        int
+	secondary     int
+	supplementary int
+
+	totalLen, firstLen, lastLen     int
+	maxLen, maxFirstLen, maxLastLen int
+	basesMapped                     int
+	basesMappedCigar                int
+	basesDuplicated                 int
+	mismatches                      int
+	qualSum, qualCount              int
+
+	// pairs is indexed by pairOrientation.
+	pairs   [numPairOrientations]int
+	diffChr int
+
+	// firstQuals[cycle][q] is the number of first-fragment bases with quality q
+	// at the given 0-based cycle. Likewise for lastQuals.
+	firstQuals, lastQuals [][]int
+	// firstGC[p] is the number of first-fragment reads whose GC content rounds
+	// to p percent. Likewise for lastGC.
+	firstGC, lastGC []int
+	// insertSizes[size][o] is the number of pairs with the given insert size
+	// and orientation o. Insert sizes above maxInsertSize are not stored.
+	insertSizes [][numPairOrientations]int
+	// Histograms indexed by read length.
+	readLengths, firstLengths, lastLengths []int
+	// mapq is indexed by the mapping quality of the mapped reads.
+	mapq []int
+}
+
+func newAggrStats(maxInsertSize int) aggrStats {
+	return aggrStats{
+		maxInsertSize: maxInsertSize,
+		firstGC:       make([]int, 101),
+		lastGC:        make([]int, 101),
+		mapq:          make([]int, 256),
+	}
+}
+
+// incHist increments (*hist)[i], growing the histogram as needed.
+func incHist(hist *[]int, i, n int) {
+	if i >= len(*hist) {
+		*hist = append(*hist, make([]int, i+1-len(*hist))...)
+	}
+	(*hist)[i] += n
+}
+
+func mergeHist(dst *[]int, src []int) {
+	for i, n := range src {
+		if n != 0 {
+			incHist(dst, i, n)
+		}
+	}
+}
+
+func mergeQualHist(dst *[][]int, src [][]int) {
+	if len(src) > len(*dst) {
+		*dst = append(*dst, make([][]int, len(src)-len(*dst))...)
+	}
+	for cycle := range src {
+		mergeHist(&(*dst)[cycle], src[cycle])
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (stat *aggrStats) mergeFrom(src aggrStats) {
+	stat.raw += src.raw
+	stat.first += src.first
+	stat.last += src.last
+	stat.mapped += src.mapped
+	stat.pairedMapped += src.pairedMapped
+	stat.unmapped += src.unmapped
+	stat.properPair += src.properPair
+	stat.paired += src.paired
+	stat.duplicate += src.duplicate
+	stat.mq0 += src.mq0
+	stat.qcFail += src.qcFail
+	stat.secondary += src.secondary
+	stat.supplementary += src.supplementary
+	stat.totalLen += src.totalLen
+	stat.firstLen += src.firstLen
+	stat.lastLen += src.lastLen
+	stat.maxLen = maxInt(stat.maxLen, src.maxLen)
+	stat.maxFirstLen = maxInt(stat.maxFirstLen, src.maxFirstLen)
+	stat.maxLastLen = maxInt(stat.maxLastLen, src.maxLastLen)
+	stat.basesMapped += src.basesMapped
+	stat.basesMappedCigar += src.basesMappedCigar
+	stat.basesDuplicated += src.basesDuplicated
+	stat.mismatches += src.mismatches
+	stat.qualSum += src.qualSum
+	stat.qualCount += src.qualCount
+	for o, n := range src.pairs {
+		stat.pairs[o] += n
+	}
+	stat.diffChr += src.diffChr
+	mergeQualHist(&stat.firstQuals, src.firstQuals)
+	mergeQualHist(&stat.lastQuals, src.lastQuals)
+	mergeHist(&stat.firstGC, src.firstGC)
+	mergeHist(&stat.lastGC, src.lastGC)
+	if len(src.insertSizes) > len(stat.insertSizes) {
+		stat.insertSizes = append(stat.insertSizes, make([][numPairOrientations]int, len(src.insertSizes)-len(stat.insertSizes))...)
+	}
+	for size, counts := range src.insertSizes {
+		for o, n := range counts {
+			stat.insertSizes[size][o] += n
+		}
+	}
+	mergeHist(&stat.readLengths, src.readLengths)
+	mergeHist(&stat.firstLengths, src.firstLengths)
+	mergeHist(&stat.lastLengths, src.lastLengths)
+	mergeHist(&stat.mapq, src.mapq)
+}
+
+func (stat *aggrStats) record(r *sam.Record) {
+	f := r.Flags
+	if (f & sam.Secondary) != 0 {
+		stat.secondary++
+		return
+	}
+	if (f & sam.Supplementary) != 0 {
+		stat.supplementary++
+		return
+	}
+	stat.raw++
+	if (f & sam.QCFail) != 0 {
+		stat.qcFail++
+	}
+	// As in samtools, an unpaired read is a first fragment.
+	first := (f&sam.Paired) == 0 || (f&sam.Read1) != 0 && (f&sam.Read2) == 0
+	last := (f&sam.Paired) != 0 && (f&sam.Read2) != 0 && (f&sam.Read1) == 0
+
+	seqLen := r.Seq.Length
+	stat.totalLen += seqLen
+	stat.maxLen = maxInt(stat.maxLen, seqLen)
+	incHist(&stat.readLengths, seqLen, 1)
+	quals, gc := &stat.firstQuals, stat.firstGC
+	switch {
+	case first:
+		stat.first++
+		stat.firstLen += seqLen
+		stat.maxFirstLen = maxInt(stat.maxFirstLen, seqLen)
+		incHist(&stat.firstLengths, seqLen, 1)
+	case last:
+		stat.last++
+		stat.lastLen += seqLen
+		stat.maxLastLen = maxInt(stat.maxLastLen, seqLen)
+		incHist(&stat.lastLengths, seqLen, 1)
+		quals, gc = &stat.lastQuals, stat.lastGC
+	default:
+		quals, gc = nil, nil
+	}
+	if quals != nil && len(r.Qual) > 0 && r.Qual[0] != 0xff {
+		if len(r.Qual) > len(*quals) {
+			*quals = append(*quals, make([][]int, len(r.Qual)-len(*quals))...)
+		}
+		reverse := (f & sam.Reverse) != 0
+		for i, q := range r.Qual {
+			// The cycle is the position in the read as sequenced.
+			cycle := i
+			if reverse {
+				cycle = len(r.Qual) - 1 - i
+			}
+			incHist(&(*quals)[cycle], int(q), 1)
+			stat.qualSum += int(q)
+		}
+		stat.qualCount += len(r.Qual)
+	}
+	if gc != nil && seqLen > 0 {
+		nGC := 0
+		for _, b := range r.Seq.Expand() {
+			if b == 'G' || b == 'C' || b == 'g' || b == 'c' {
+				nGC++
+			}
+		}
+		gc[int(math.Round(float64(nGC)*100/float64(seqLen)))]++
+	}
+	if (f & sam.Duplicate) != 0 {
+		stat.duplicate++
+		stat.basesDuplicated += seqLen
+	}
+	if (f & sam.Paired) != 0 {
+		stat.paired++
+	}
+	if (f & sam.Unmapped) != 0 {
+		stat.unmapped++
+		return
+	}
+
+	stat.mapped++
+	stat.mapq[r.MapQ]++
+	if r.MapQ == 0 {
+		stat.mq0++
+	}
+	stat.basesMapped += seqLen
+	for _, op := range r.Cigar {
+		switch op.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			stat.basesMappedCigar += op.Len()
+		}
+	}
+	if nm, ok := gbam.AuxInt(r.AuxFields.Get(nmTag)); ok {
+		stat.mismatches += nm
+	}
+	if (f&sam.Paired) == 0 || (f&sam.MateUnmapped) != 0 {
+		return
+	}
+	stat.pairedMapped++
+	if (f & sam.ProperPair) != 0 {
+		stat.properPair++
+	}
+	if r.MateRef == nil || r.Ref.ID() != r.MateRef.ID() {
+		if first {
+			stat.diffChr++
+		}
+		return
+	}
+	// Each pair is counted once, from the leftmost read.
+	if r.TempLen <= 0 {
+		return
+	}
+	o := orientation(r)
+	stat.pairs[o]++
+	if r.TempLen <= stat.maxInsertSize {
+		if r.TempLen >= len(stat.insertSizes) {
+			stat.insertSizes = append(stat.insertSizes, make([][numPairOrientations]int, r.TempLen+1-len(stat.insertSizes))...)
+		}
+		stat.insertSizes[r.TempLen][o]++
+	}
+}
+
+// orientation returns the orientation of the pair of r. It follows the logic
+// of samtools stats.
+func orientation(r *sam.Record) pairOrientation {
+	f := r.Flags
+	isFst := 1
+	if (f & sam.Read1) == 0 {
+		isFst = -1
+	}
+	isFwd, isMateFwd := 1, 1
+	if (f & sam.Reverse) != 0 {
+		isFwd = -1
+	}
+	if (f & sam.MateReverse) != 0 {
+		isMateFwd = -1
+	}
+	posFst := r.MatePos - r.Pos
+	switch {
+	case isFwd*isMateFwd > 0:
+		return otherPair
+	case isFst*posFst > 0:
+		if isFst*isFwd > 0 {
+			return inwardPair
+		}
+		return outwardPair
+	case isFst*posFst < 0:
+		if isFst*isFwd > 0 {
+			return outwardPair
+		}
+		return inwardPair
+	default:
+		return inwardPair
+	}
+}
+
+var nmTag = sam.NewTag("NM")
+
+// statsSummary is the "SN" section of the report.
+type statsSummary struct {
+	RawTotalSequences      int     `json:"raw_total_sequences"`
+	IsSorted               bool    `json:"is_sorted"`
+	FirstFragments         int     `json:"first_fragments"`
+	LastFragments          int     `json:"last_fragments"`
+	ReadsMapped            int     `json:"reads_mapped"`
+	ReadsMappedAndPaired   int     `json:"reads_mapped_and_paired"`
+	ReadsUnmapped          int     `json:"reads_unmapped"`
+	ReadsProperlyPaired    int     `json:"reads_properly_paired"`
+	ReadsPaired            int     `json:"reads_paired"`
+	ReadsDuplicated        int     `json:"reads_duplicated"`
+	ReadsMQ0               int     `json:"reads_mq0"`
+	ReadsQCFailed          int     `json:"reads_qc_failed"`
+	NonPrimaryAlignments   int     `json:"non_primary_alignments"`
+	SupplementaryAlignment int     `json:"supplementary_alignments"`
+	TotalLength            int     `json:"total_length"`
+	TotalFirstLength       int     `json:"total_first_fragment_length"`
+	TotalLastLength        int     `json:"total_last_fragment_length"`
+	BasesMapped            int     `json:"bases_mapped"`
+	BasesMappedCigar       int     `json:"bases_mapped_cigar"`
+	BasesDuplicated        int     `json:"bases_duplicated"`
+	Mismatches             int     `json:"mismatches"`
+	ErrorRate              float64 `json:"error_rate"`
+	AverageLength          int     `json:"average_length"`
+	AverageFirstLength     int     `json:"average_first_fragment_length"`
+	AverageLastLength      int     `json:"average_last_fragment_length"`
+	MaxLength              int     `json:"maximum_length"`
+	MaxFirstLength         int     `json:"maximum_first_fragment_length"`
+	MaxLastLength          int     `json:"maximum_last_fragment_length"`
+	AverageQuality         float64 `json:"average_quality"`
+	InsertSizeAverage      float64 `json:"insert_size_average"`
+	InsertSizeStdDev       float64 `json:"insert_size_standard_deviation"`
+	InwardPairs            int     `json:"inward_oriented_pairs"`
+	OutwardPairs           int     `json:"outward_oriented_pairs"`
+	OtherPairs             int     `json:"pairs_with_other_orientation"`
+	DiffChrPairs           int     `json:"pairs_on_different_chromosomes"`
+	ProperlyPairedPercent  float64 `json:"percentage_of_properly_paired_reads"`
+}
+
+// statsBin is one nonempty bin of a histogram.
+type statsBin struct {
+	Value int `json:"value"`
+	Count int `json:"count"`
+}
+
+// statsInsertSizeBin is one nonempty bin of the insert size histogram.
+type statsInsertSizeBin struct {
+	InsertSize int `json:"insert_size"`
+	Total      int `json:"total"`
+	Inward     int `json:"inward"`
+	Outward    int `json:"outward"`
+	Other      int `json:"other"`
+}
+
+// statsReport is the report of the stats command.
+type statsReport struct {
+	Summary statsSummary `json:"summary"`
+	// FirstFragmentQualities[cycle][q] is the number of bases with quality q at
+	// the given 0-based cycle. Likewise for LastFragmentQualities.
+	FirstFragmentQualities [][]int              `json:"first_fragment_qualities"`
+	LastFragmentQualities  [][]int              `json:"last_fragment_qualities"`
+	FirstFragmentGC        []statsBin           `json:"first_fragment_gc"`
+	LastFragmentGC         []statsBin           `json:"last_fragment_gc"`
+	InsertSizes            []statsInsertSizeBin `json:"insert_sizes"`
+	ReadLengths            []statsBin           `json:"read_lengths"`
+	FirstFragmentLengths   []statsBin           `json:"first_fragment_lengths"`
+	LastFragmentLengths    []statsBin           `json:"last_fragment_lengths"`
+	MappingQualities       []statsBin           `json:"mapping_qualities"`
+}
+
+func histBins(hist []int) []statsBin {
+	bins := []statsBin{}
+	for i, n := range hist {
+		if n != 0 {
+			bins = append(bins, statsBin{Value: i, Count: n})
+		}
+	}
+	return bins
+}
+
+// qualTable pads the rows of a per-cycle quality histogram to the same length.
+func qualTable(quals [][]int) [][]int {
+	maxQual := 0
+	for _, row := range quals {
+		maxQual = maxInt(maxQual, len(row))
+	}
+	table := make([][]int, len(quals))
+	for i, row := range quals {
+		table[i] = make([]int, maxQual)
+		copy(table[i], row)
+	}
+	return table
+}
+
+func divide(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+func (stat *aggrStats) report(header *sam.Header) statsReport {
+	r := statsReport{
+		Summary: statsSummary{
+			RawTotalSequences:      stat.raw,
+			IsSorted:               header.SortOrder == sam.Coordinate,
+			FirstFragments:         stat.first,
+			LastFragments:          stat.last,
+			ReadsMapped:            stat.mapped,
+			ReadsMappedAndPaired:   stat.pairedMapped,
+			ReadsUnmapped:          stat.unmapped,
+			ReadsProperlyPaired:    stat.properPair,
+			ReadsPaired:            stat.paired,
+			ReadsDuplicated:        stat.duplicate,
+			ReadsMQ0:               stat.mq0,
+			ReadsQCFailed:          stat.qcFail,
+			NonPrimaryAlignments:   stat.secondary,
+			SupplementaryAlignment: stat.supplementary,
+			TotalLength:            stat.totalLen,
+			TotalFirstLength:       stat.firstLen,
+			TotalLastLength:        stat.lastLen,
+			BasesMapped:            stat.basesMapped,
+			BasesMappedCigar:       stat.basesMappedCigar,
+			BasesDuplicated:        stat.basesDuplicated,
+			Mismatches:             stat.mismatches,
+			ErrorRate:              divide(stat.mismatches, stat.basesMappedCigar),
+			AverageLength:          int(divide(stat.totalLen, stat.raw)),
+			AverageFirstLength:     int(divide(stat.firstLen, stat.first)),
+			AverageLastLength:      int(divide(stat.lastLen, stat.last)),
+			MaxLength:              stat.maxLen,
+			MaxFirstLength:         stat.maxFirstLen,
+			MaxLastLength:          stat.maxLastLen,
+			AverageQuality:         divide(stat.qualSum, stat.qualCount),
+			InwardPairs:            stat.pairs[inwardPair],
+			OutwardPairs:           stat.pairs[outwardPair],
+			OtherPairs:             stat.pairs[otherPair],
+			DiffChrPairs:           stat.diffChr,
+			ProperlyPairedPercent:  100 * divide(stat.properPair, stat.raw),
+		},
+		FirstFragmentQualities: qualTable(stat.firstQuals),
+		LastFragmentQualities:  qualTable(stat.lastQuals),
+		FirstFragmentGC:        histBins(stat.firstGC),
+		LastFragmentGC:         histBins(stat.lastGC),
+		InsertSizes:            []statsInsertSizeBin{},
+		ReadLengths:            histBins(stat.readLengths),
+		FirstFragmentLengths:   histBins(stat.firstLengths),
+		LastFragmentLengths:    histBins(stat.lastLengths),
+		MappingQualities:       histBins(stat.mapq),
+	}
+	var nPairs, sum, sumSq float64
+	for size, c := range stat.insertSizes {
+		total := c[inwardPair] + c[outwardPair] + c[otherPair]
+		if total == 0 {
+			continue
+		}
+		r.InsertSizes = append(r.InsertSizes, statsInsertSizeBin{
+			InsertSize: size,
+			Total:      total,
+			Inward:     c[inwardPair],
+			Outward:    c[outwardPair],
+			Other:      c[otherPair],
+		})
+		nPairs += float64(total)
+		sum += float64(total) * float64(size)
+		sumSq += float64(total) * float64(size) * float64(size)
+	}
+	if nPairs > 0 {
+		avg := sum / nPairs
+		r.Summary.InsertSizeAverage = avg
+		r.Summary.InsertSizeStdDev = math.Sqrt(math.Max(0, sumSq/nPairs-avg*avg))
+	}
+	return r
+}
+
+// writeStatsText writes the report in the format of "samtools stats".
+func writeStatsText(out io.Writer, r statsReport) error {
+	w := bufio.NewWriter(out)
+	s := r.Summary
+	isSorted := 0
+	if s.IsSorted {
+		isSorted = 1
+	}
+	fmt.Fprintln(w, "# This file was produced by bio-pamtool stats.")
+	fmt.Fprintln(w, "# Summary Numbers. Use `grep ^SN | cut -f 2-` to get just this part.")
+	sn := func(name string, value interface{}) {
+		switch v := value.(type) {
+		case float64:
+			fmt.Fprintf(w, "SN\t%s:\t%.1f\n", name, v)
+		default:
+			fmt.Fprintf(w, "SN\t%s:\t%v\n", name, v)
+		}
+	}
+	sn("raw total sequences", s.RawTotalSequences)
+	sn("filtered sequences", 0)
+	sn("sequences", s.RawTotalSequences)
+	sn("is sorted", isSorted)
+	sn("1st fragments", s.FirstFragments)
+	sn("last fragments", s.LastFragments)
+	sn("reads mapped", s.ReadsMapped)
+	sn("reads mapped and paired", s.ReadsMappedAndPaired)
+	sn("reads unmapped", s.ReadsUnmapped)
+	sn("reads properly paired", s.ReadsProperlyPaired)
+	sn("reads paired", s.ReadsPaired)
+	sn("reads duplicated", s.ReadsDuplicated)
+	sn("reads MQ0", s.ReadsMQ0)
+	sn("reads QC failed", s.ReadsQCFailed)
+	sn("non-primary alignments", s.NonPrimaryAlignments)
+	sn("supplementary alignments", s.SupplementaryAlignment)
+	sn("total length", s.TotalLength)
+	sn("total first fragment length", s.TotalFirstLength)
+	sn("total last fragment length", s.TotalLastLength)
+	sn("bases mapped", s.BasesMapped)
+	sn("bases mapped (cigar)", s.BasesMappedCigar)
+	sn("bases duplicated", s.BasesDuplicated)
+	sn("mismatches", s.Mismatches)
+	fmt.Fprintf(w, "SN\terror rate:\t%e\n", s.ErrorRate)
+	sn("average length", s.AverageLength)
+	sn("average first fragment length", s.AverageFirstLength)
+	sn("average last fragment length", s.AverageLastLength)
+	sn("maximum length", s.MaxLength)
+	sn("maximum first fragment length", s.MaxFirstLength)
+	sn("maximum last fragment length", s.MaxLastLength)
+	sn("average quality", s.AverageQuality)
+	sn("insert size average", s.InsertSizeAverage)
+	sn("insert size standard deviation", s.InsertSizeStdDev)
+	sn("inward oriented pairs", s.InwardPairs)
+	sn("outward oriented pairs", s.OutwardPairs)
+	sn("pairs with other orientation", s.OtherPairs)
+	sn("pairs on different chromosomes", s.DiffChrPairs)
+	sn("percentage of properly paired reads (%)", s.ProperlyPairedPercent)
+
+	quals := func(section string, table [][]int) {
+		for i, row := range table {
+			fmt.Fprintf(w, "%s\t%d", section, i+1)
+			for _, n := range row {
+				fmt.Fprintf(w, "\t%d", n)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	bins := func(section string, bins []statsBin) {
+		for _, b := range bins {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", section, b.Value, b.Count)
+		}
+	}
+	fmt.Fprintln(w, "# First Fragment Qualities. Use `grep ^FFQ | cut -f 2-` to get just this part.")
+	fmt.Fprintln(w, "# Columns correspond to qualities and rows to cycles. First column is the cycle number.")
+	quals("FFQ", r.FirstFragmentQualities)
+	fmt.Fprintln(w, "# Last Fragment Qualities. Use `grep ^LFQ | cut -f 2-` to get just this part.")
+	fmt.Fprintln(w, "# Columns correspond to qualities and rows to cycles. First column is the cycle number.")
+	quals("LFQ", r.LastFragmentQualities)
+	fmt.Fprintln(w, "# GC Content of first fragments. Use `grep ^GCF | cut -f 2-` to get just this part.")
+	bins("GCF", r.FirstFragmentGC)
+	fmt.Fprintln(w, "# GC Content of last fragments. Use `grep ^GCL | cut -f 2-` to get just this part.")
+	bins("GCL", r.LastFragmentGC)
+	fmt.Fprintln(w, "# Insert sizes. Use `grep ^IS | cut -f 2-` to get just this part. "+
+		"The columns are: insert size, pairs total, inward oriented pairs, outward oriented pairs, other pairs")
+	for _, b := range r.InsertSizes {
+		fmt.Fprintf(w, "IS\t%d\t%d\t%d\t%d\t%d\n", b.InsertSize, b.Total, b.Inward, b.Outward, b.Other)
+	}
+	fmt.Fprintln(w, "# Read lengths. Use `grep ^RL | cut -f 2-` to get just this part. The columns are: read length, count")
+	bins("RL", r.ReadLengths)
+	fmt.Fprintln(w, "# Read lengths - first fragments. Use `grep ^FRL | cut -f 2-` to get just this part. The columns are: read length, count")
+	bins("FRL", r.FirstFragmentLengths)
+	fmt.Fprintln(w, "# Read lengths - last fragments. Use `grep ^LRL | cut -f 2-` to get just this part. The columns are: read length, count")
+	bins("LRL", r.LastFragmentLengths)
+	fmt.Fprintln(w, "# Mapping qualities. Use `grep ^MAPQ | cut -f 2-` to get just this part. The columns are: mapq, count")
+	bins("MAPQ", r.MappingQualities)
+	return w.Flush()
+}
+
+// statsFields lists the fields read by aggrStats.record.
+var statsFields = []gbam.FieldType{
+	gbam.FieldCoord, gbam.FieldFlags, gbam.FieldMapq, gbam.FieldCigar, gbam.FieldMateRefID,
+	gbam.FieldMatePos, gbam.FieldTempLen, gbam.FieldSeq, gbam.FieldQual, gbam.FieldAux}
+
+func stats(path string, opts statsOpts) error {
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("stats: unknown format '%s'", opts.format)
+	}
+	providerOpts, closeReference, err := newProviderOpts(opts.index, opts.reference)
+	if err != nil {
+		return err
+	}
+	defer closeReference() // nolint: errcheck
+	providerOpts.DropFields = dropFieldsExcept(statsFields)
+	providerOpts.AuxTags = []string{"NM"}
+	provider := bamprovider.NewProvider(path, providerOpts)
+	header, err := provider.GetHeader()
+	if err != nil {
+		provider.Close() // nolint: errcheck
+		return err
+	}
+	shards, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{
+		IncludeUnmapped:     true,
+		SplitMappedCoords:   true,
+		SplitUnmappedCoords: true,
+	})
+	if err != nil {
+		provider.Close() // nolint: errcheck
+		return err
+	}
+	shardCh := gbam.NewShardChannel(shards)
+	statCh := make(chan aggrStats, len(shards))
+	wg := sync.WaitGroup{}
+	e := errors.Once{}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shardCh {
+				stat := newAggrStats(opts.maxInsertSize)
+				iter := provider.NewIterator(shard)
+				for iter.Scan() {
+					rec := iter.Record()
+					stat.record(rec)
+					sam.PutInFreePool(rec)
+				}
+				e.Set(iter.Close())
+				statCh <- stat
+			}
+		}()
+	}
+	wg.Wait()
+	close(statCh)
+	total := newAggrStats(opts.maxInsertSize)
+	for stat := range statCh {
+		total.mergeFrom(stat)
+	}
+	e.Set(provider.Close())
+	if err := e.Err(); err != nil {
+		return err
+	}
+	report := total.report(header)
+	if opts.format == "json" {
+		js, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(js))
+		return nil
+	}
+	return writeStatsText(os.Stdout, report)
+}
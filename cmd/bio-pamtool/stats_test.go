@@ -0,0 +1,71 @@
+package main_test
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"v.io/x/lib/gosh"
+)
+
+func TestStats(t *testing.T) {
+	if !testutil.IsBazel() {
+		t.Skip("not bazel")
+	}
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+	dir := sh.MakeTempDir()
+	pamPath := filepath.Join(dir, "test.pam")
+
+	pamtoolPath := testutil.GoExecutable(t, "//go/src/github.com/grailbio/bio/cmd/bio-pamtool/bio-pamtool")
+	sh.Cmd(pamtoolPath, "convert", bamPath, pamPath).Run()
+	require.NoError(t, sh.Err)
+
+	for _, args := range [][]string{
+		{"stats"},
+		{"stats", "-format", "json"},
+		{"idxstats"},
+		{"idxstats", "-format", "json"},
+	} {
+		bamOutput := sh.Cmd(pamtoolPath, append(args, bamPath)...).Stdout()
+		require.NoError(t, sh.Err)
+		pamOutput := sh.Cmd(pamtoolPath, append(args, pamPath)...).Stdout()
+		require.NoError(t, sh.Err)
+		assert.Equal(t, bamOutput, pamOutput, "args=%v", args)
+	}
+
+	// The numbers agree with flagstat.
+	output := sh.Cmd(pamtoolPath, "stats", pamPath).Stdout()
+	require.NoError(t, sh.Err)
+	for _, line := range []string{
+		"SN\traw total sequences:\t20000\n",
+		"SN\tsupplementary alignments:\t42\n",
+		"SN\treads paired:\t20000\n",
+		"SN\t1st fragments:\t10000\n",
+		"SN\tlast fragments:\t10000\n",
+	} {
+		assert.Contains(t, output, line)
+	}
+
+	// Every record is counted once by idxstats.
+	output = sh.Cmd(pamtoolPath, "idxstats", pamPath).Stdout()
+	require.NoError(t, sh.Err)
+	total := 0
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	for _, line := range lines {
+		cols := strings.Split(line, "\t")
+		require.Len(t, cols, 4, "line=%s", line)
+		for _, col := range cols[2:] {
+			n, err := strconv.Atoi(col)
+			require.NoError(t, err)
+			total += n
+		}
+	}
+	assert.Equal(t, 20042, total)
+	assert.True(t, strings.HasPrefix(lines[len(lines)-1], "*\t0\t"), lines[len(lines)-1])
+}
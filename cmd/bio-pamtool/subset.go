@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+
+	"blainsmith.com/go/seahash"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/traverse"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamfilter"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/bio/interval"
+	"github.com/grailbio/hts/sam"
+)
+
+type subsetOpts struct {
+	// index sets the name of the BAM index file. If empty, bampath+".bai" is used.
+	index string
+	// reference is the pathname of the reference FASTA, for CRAM or for PAM with
+	// a reference-encoded seq field.
+	reference string
+	// regions is a comma-separated list of regions of form "chr:begin-end".
+	regions string
+	// bedPath, if nonempty, adds the intervals in the BED file to the regions.
+	bedPath string
+	// padding is the maximum reference span of a record. Records that start
+	// more than padding bases before a region are not included.
+	padding int
+	// filter is a filter expression. Only records matching the expression are
+	// written.
+	filter string
+	// fraction is the fraction of the read names to keep.
+	fraction float64
+	// seed selects the subset of read names kept when fraction < 1.
+	seed int64
+	// format is the output format, either "bam" or "pam". If empty, the format
+	// is guessed from the destination path.
+	format string
+	// transformers is a comma-separated list of transformers for the PAM output.
+	transformers string
+	// bytesPerBlock is the goal size of a PAM recordio block.
+	bytesPerBlock int
+	// parallelism is the number of shards processed concurrently.
+	parallelism int
+}
+
+// subsetShard is a range of the input scanned by one task.
+type subsetShard struct {
+	// shard is the range of alignment positions to read.
+	shard gbam.Shard
+	// regionStart, if >=0, is the start of the region covered by the shard. The
+	// records that start before regionStart are included only if they overlap
+	// the region.
+	regionStart int
+}
+
+// generateSubsetShards lists the ranges to scan. If opts.regions or
+// opts.bedPath is set, it yields ranges that cover only the regions. Else it
+// partitions the whole file using Provider.GenerateShards.
+func generateSubsetShards(provider bamprovider.Provider, header *sam.Header, opts subsetOpts) ([]subsetShard, error) {
+	if opts.regions == "" && opts.bedPath == "" {
+		shards, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{IncludeUnmapped: true})
+		if err != nil {
+			return nil, err
+		}
+		result := make([]subsetShard, len(shards))
+		for i, shard := range shards {
+			result[i] = subsetShard{shard: shard, regionStart: -1}
+		}
+		return result, nil
+	}
+	gopts := bamprovider.GenerateShardsOpts{Strategy: bamprovider.RegionBased}
+	if opts.regions != "" {
+		for _, str := range strings.Split(opts.regions, ",") {
+			e, err := interval.ParseRegionString(str)
+			if err != nil {
+				return nil, err
+			}
+			gopts.Regions = append(gopts.Regions, e)
+		}
+	}
+	if opts.bedPath != "" {
+		u, err := interval.NewBEDUnionFromPath(opts.bedPath, interval.NewBEDOpts{SAMHeader: header})
+		if err != nil {
+			return nil, err
+		}
+		gopts.BEDUnion = &u
+	}
+	shards, err := provider.GenerateShards(gopts)
+	if err != nil {
+		return nil, err
+	}
+	// Extend each shard backward to pick up the records that start before the
+	// region but overlap it, without overlapping the previous shard.
+	result := make([]subsetShard, len(shards))
+	for i, shard := range shards {
+		start := shard.PadStart(opts.padding)
+		if i > 0 {
+			if prev := shards[i-1]; prev.EndRef == shard.StartRef && prev.End > start {
+				start = prev.End
+			}
+		}
+		result[i] = subsetShard{
+			shard: gbam.Shard{
+				StartRef: shard.StartRef,
+				EndRef:   shard.EndRef,
+				Start:    start,
+				End:      shard.End,
+				ShardIdx: i,
+			},
+			regionStart: shard.Start,
+		}
+	}
+	return result, nil
+}
+
+// subsetSelector decides whether a record is written. Thread compatible.
+type subsetSelector struct {
+	filter *bamfilter.Expr
+	// threshold is the max read-name hash that is kept. Downsampling is
+	// disabled if sample is false.
+	sample    bool
+	threshold uint64
+	buf       []byte
+}
+
+func newSubsetSelector(filter *bamfilter.Expr, opts subsetOpts) *subsetSelector {
+	s := &subsetSelector{filter: filter}
+	if opts.fraction < 1 {
+		s.sample = true
+		s.threshold = uint64(math.Ldexp(opts.fraction, 64))
+		s.buf = make([]byte, 8)
+		binary.LittleEndian.PutUint64(s.buf, uint64(opts.seed))
+	}
+	return s
+}
+
+// keep returns true if the record in the given shard should be written.
+func (s *subsetSelector) keep(shard subsetShard, r *sam.Record) bool {
+	if shard.regionStart >= 0 && r.Pos < shard.regionStart {
+		end := r.Pos + 1
+		if (r.Flags & sam.Unmapped) == 0 {
+			end = r.End()
+		}
+		if end <= shard.regionStart {
+			return false
+		}
+	}
+	if s.filter != nil && !s.filter.Evaluate(r) {
+		return false
+	}
+	if s.sample {
+		// The hash depends only on the name, so that the mates and the
+		// secondary alignments of a read are kept or dropped together.
+		s.buf = append(s.buf[:8], r.Name...)
+		if seahash.Sum64(s.buf) > s.threshold {
+			return false
+		}
+	}
+	return true
+}
+
+// newSubsetReader creates a reader that evaluates subsetSelector.keep on the
+// fields that it needs before reading the other fields.
+func newSubsetReader(provider bamprovider.Provider, srcPath string, providerOpts bamprovider.ProviderOpts,
+	filter *bamfilter.Expr, opts subsetOpts) *selectReader {
+	if filter == nil && opts.fraction >= 1 {
+		// Only the records just outside the regions are dropped, which is too
+		// few to be worth a separate pass.
+		return &selectReader{provider: provider}
+	}
+	fields := []gbam.FieldType{gbam.FieldFlags, gbam.FieldCigar, gbam.FieldName}
+	var auxTags []string
+	if filter != nil {
+		fields = append(fields, filter.Fields()...)
+		auxTags = filter.AuxTags()
+	}
+	return newSelectReader(provider, srcPath, providerOpts, fields, auxTags)
+}
+
+// scanSubsetShard calls cb for every record in the shard that should be
+// written. The records are freed after cb returns.
+func scanSubsetShard(reader *selectReader, sel *subsetSelector, shard subsetShard, cb func(r *sam.Record) error) error {
+	return reader.scan(shard.shard,
+		func(r *sam.Record) bool { return sel.keep(shard, r) },
+		func(r *sam.Record) error {
+			err := cb(r)
+			sam.PutInFreePool(r)
+			return err
+		})
+}
+
+// writeSubsetBAM writes the selected records of all the shards to a BAM file.
+func writeSubsetBAM(reader *selectReader, header *sam.Header, filter *bamfilter.Expr,
+	shards []subsetShard, dstPath string, opts subsetOpts) error {
+	return gbam.WriteShardedBAM(dstPath, header, len(shards), opts.parallelism,
+		func(shardIdx int, add func(r *sam.Record) error) error {
+			sel := newSubsetSelector(filter, opts)
+			return scanSubsetShard(reader, sel, shards[shardIdx], add)
+		})
+}
+
+// writeSubsetPAM writes the selected records of all the shards to a PAM file.
+// Consecutive shards are grouped into one PAM file shard, so that the number of
+// files stays small even when there are many regions.
+func writeSubsetPAM(reader *selectReader, header *sam.Header, filter *bamfilter.Expr,
+	shards []subsetShard, dstPath string, opts subsetOpts) error {
+	if err := pamutil.Remove(dstPath); err != nil {
+		return err
+	}
+	nGroups := opts.parallelism * 4
+	if nGroups > len(shards) {
+		nGroups = len(shards)
+	}
+	if nGroups == 0 {
+		// Create one empty shard.
+		nGroups = 1
+	}
+	// The PAM file shards must together cover the universal range.
+	groupStart := func(g int) biopb.Coord {
+		if g == 0 {
+			return biopb.Coord{RefId: 0, Pos: 0}
+		}
+		if g == nGroups {
+			return biopb.Coord{RefId: biopb.InfinityRefID, Pos: biopb.InfinityPos}
+		}
+		s := shards[g*len(shards)/nGroups].shard
+		return gbam.NewCoord(s.StartRef, s.Start, int32(s.StartSeq))
+	}
+	wopts := pam.WriteOpts{MaxBufSize: opts.bytesPerBlock}
+	if opts.transformers != "" {
+		wopts.Transformers = strings.Split(opts.transformers, ",")
+	}
+	return traverse.Limit(opts.parallelism).Each(nGroups, func(g int) error {
+		wopts := wopts
+		wopts.Range = biopb.CoordRange{Start: groupStart(g), Limit: groupStart(g + 1)}
+		w := pam.NewWriter(wopts, header, dstPath)
+		sel := newSubsetSelector(filter, opts)
+		e := errors.Once{}
+		for i := g * len(shards) / nGroups; i < (g+1)*len(shards)/nGroups; i++ {
+			e.Set(scanSubsetShard(reader, sel, shards[i], func(r *sam.Record) error {
+				w.Write(r)
+				return w.Err()
+			}))
+		}
+		e.Set(w.Close())
+		return e.Err()
+	})
+}
+
+func subset(srcPath, dstPath string, opts subsetOpts) error {
+	if opts.fraction <= 0 || opts.fraction > 1 {
+		return fmt.Errorf("subset: -fraction must be in (0, 1], but found %v", opts.fraction)
+	}
+	if opts.parallelism <= 0 {
+		opts.parallelism = runtime.NumCPU()
+	}
+	format := bamprovider.GuessFileType(dstPath)
+	if opts.format != "" {
+		format = bamprovider.ParseFileType(opts.format)
+	}
+	if format != bamprovider.BAM && format != bamprovider.PAM {
+		return fmt.Errorf("subset: cannot determine the output format of %s; set -format", dstPath)
+	}
+	var filter *bamfilter.Expr
+	if opts.filter != "" {
+		var err error
+		if filter, err = bamfilter.Parse(opts.filter); err != nil {
+			return err
+		}
+	}
+	providerOpts, closeReference, err := newProviderOpts(opts.index, opts.reference)
+	if err != nil {
+		return err
+	}
+	defer closeReference() // nolint: errcheck
+	provider := bamprovider.NewProvider(srcPath, providerOpts)
+	header, err := provider.GetHeader()
+	if err == nil {
+		var shards []subsetShard
+		if shards, err = generateSubsetShards(provider, header, opts); err == nil {
+			reader := newSubsetReader(provider, srcPath, providerOpts, filter, opts)
+			if format == bamprovider.BAM {
+				err = writeSubsetBAM(reader, header, filter, shards, dstPath, opts)
+			} else {
+				err = writeSubsetPAM(reader, header, filter, shards, dstPath, opts)
+			}
+			if e := reader.close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	if e := provider.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/bio/internal/bamtest"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"v.io/x/lib/gosh"
+)
+
+func TestSubset(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup)
+
+	chr1, err := sam.NewReference("chr1", "", "", 10000, nil, nil)
+	require.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 10000, nil, nil)
+	require.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	require.NoError(t, err)
+	header.SortOrder = sam.Coordinate
+
+	// 40 pairs on each reference, 100 bases apart, with the mates 50 bases
+	// apart, followed by 20 unmapped pairs.
+	var recs []*sam.Record
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("r%03d", i)
+		if i >= 80 {
+			for _, flags := range []sam.Flags{sam.Read1, sam.Read2} {
+				recs = append(recs, bamtest.NewRecord(t, name, nil, -1,
+					sam.Paired|sam.Unmapped|sam.MateUnmapped|flags, nil, -1, ""))
+			}
+			continue
+		}
+		ref := chr1
+		if i >= 40 {
+			ref = chr2
+		}
+		pos := i % 40 * 100
+		recs = append(recs,
+			bamtest.NewRecord(t, name, ref, pos, sam.Paired|sam.Read1|sam.MateReverse, ref, pos+50, "10M"),
+			bamtest.NewRecord(t, name, ref, pos+50, sam.Paired|sam.Read2|sam.Reverse, ref, pos, "10M"))
+	}
+	srcPath := filepath.Join(tempDir, "src.pam")
+	bamtest.WritePAM(t, srcPath, header, recs)
+
+	toStrings := func(recs []*sam.Record) []string {
+		var strs []string
+		for _, r := range recs {
+			strs = append(strs, r.String())
+		}
+		return strs
+	}
+	// selected lists the records of recs for which keep returns true.
+	selected := func(keep func(r *sam.Record) bool) []string {
+		var strs []string
+		for _, r := range recs {
+			if keep(r) {
+				strs = append(strs, r.String())
+			}
+		}
+		return strs
+	}
+	inRegions := func(r *sam.Record) bool {
+		return (r.Ref == chr1 && r.Pos < 2000 && r.End() > 1000) ||
+			(r.Ref == chr2 && r.Pos < 3500 && r.End() > 3000)
+	}
+	// checkPairs checks that the mates of every read are both written or both
+	// dropped, and returns the number of reads written.
+	checkPairs := func(got []string, args string) int {
+		counts := map[string]int{}
+		for _, r := range recs {
+			counts[r.Name] = 0
+		}
+		for _, r := range recs {
+			for _, str := range got {
+				if str == r.String() {
+					counts[r.Name]++
+				}
+			}
+		}
+		n := 0
+		for name, c := range counts {
+			assert.Truef(t, c == 0 || c == 2, "args=%s: read %s has %d records", args, name, c)
+			if c > 0 {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, test := range []struct {
+		args string
+		opts subsetOpts
+		// keep, if not nil, selects the expected records.
+		keep func(r *sam.Record) bool
+		// n is the expected number of records. If keep is nil, n is the number
+		// of reads that downsampling chooses from.
+		n int
+	}{
+		{"", subsetOpts{}, func(r *sam.Record) bool { return true }, 200},
+		{"-regions", subsetOpts{regions: "chr1:1001-2000,chr2:3001-3500"}, inRegions, 30},
+		{"-filter", subsetOpts{filter: "!unmapped"}, func(r *sam.Record) bool { return r.Ref != nil }, 160},
+		{"-fraction", subsetOpts{fraction: 0.5, seed: 1}, nil, 100},
+		{"-regions -fraction", subsetOpts{regions: "chr1:1-10000", fraction: 0.5, seed: 2}, nil, 40},
+	} {
+		opts := test.opts
+		opts.padding = 1000
+		opts.bytesPerBlock = 8 << 20
+		opts.parallelism = 3
+		if opts.fraction == 0 {
+			opts.fraction = 1
+		}
+		bamPath := filepath.Join(tempDir, "subset.bam")
+		require.NoError(t, subset(srcPath, bamPath, opts), "args=%s", test.args)
+		pamPath := filepath.Join(tempDir, "subset.pam")
+		require.NoError(t, subset(srcPath, pamPath, opts), "args=%s", test.args)
+
+		gotRecs := bamtest.ReadBAM(t, bamPath)
+		got := toStrings(gotRecs)
+		// The BAM and PAM outputs store the same records.
+		assert.Equal(t, got, toStrings(bamtest.ReadPAM(t, pamPath)), "args=%s", test.args)
+		if test.keep != nil {
+			assert.Len(t, got, test.n, "args=%s", test.args)
+			assert.Equal(t, selected(test.keep), got, "args=%s", test.args)
+			continue
+		}
+		// Downsampling keeps some of the reads, along with both of their mates.
+		nReads := checkPairs(got, test.args)
+		assert.Truef(t, nReads > 0 && nReads < test.n, "args=%s: kept %d of %d reads", test.args, nReads, test.n)
+		if opts.regions != "" {
+			for _, r := range gotRecs {
+				assert.Equal(t, "chr1", r.Ref.Name(), "args=%s", test.args)
+			}
+		}
+	}
+}
+
+func TestSubsetBAMAndPAM(t *testing.T) {
+	if !testutil.IsBazel() {
+		t.Skip("not bazel")
+	}
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam")
+
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+	pamtoolPath := testutil.GoExecutable(t, "//go/src/github.com/grailbio/bio/cmd/bio-pamtool/bio-pamtool")
+	dir := sh.MakeTempDir()
+	pamPath := filepath.Join(dir, "test.pam")
+	sh.Cmd(pamtoolPath, "convert", bamPath, pamPath).Run()
+	require.NoError(t, sh.Err)
+
+	for _, args := range [][]string{
+		{"-regions", "chr1:1-100000000,chr2:1-1000000"},
+		{"-filter", "!unmapped"},
+		{"-fraction", "0.5", "-seed", "1"},
+	} {
+		// The BAM and PAM outputs store the same records.
+		subsetBAMPath := filepath.Join(dir, "subset.bam")
+		sh.Cmd(pamtoolPath, append(append([]string{"subset"}, args...), pamPath, subsetBAMPath)...).Run()
+		require.NoError(t, sh.Err)
+		subsetPAMPath := filepath.Join(dir, "subset.pam")
+		sh.Cmd(pamtoolPath, append(append([]string{"subset"}, args...), pamPath, subsetPAMPath)...).Run()
+		require.NoError(t, sh.Err)
+		assert.Equal(t,
+			sh.Cmd(pamtoolPath, "checksum", "-all", subsetBAMPath).Stdout(),
+			sh.Cmd(pamtoolPath, "checksum", "-all", subsetPAMPath).Stdout(), "args=%v", args)
+	}
+
+	// A fraction of 1 keeps every record.
+	allPAMPath := filepath.Join(dir, "all.pam")
+	sh.Cmd(pamtoolPath, "subset", bamPath, allPAMPath).Run()
+	require.NoError(t, sh.Err)
+	assert.Equal(t,
+		sh.Cmd(pamtoolPath, "checksum", "-all", bamPath).Stdout(),
+		sh.Cmd(pamtoolPath, "checksum", "-all", allPAMPath).Stdout())
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+)
+
+type validateOpts struct {
+	// format is the output format, either "text" or "json".
+	format string
+	// repair causes the invalid shards and the orphan field files to be deleted.
+	repair bool
+}
+
+// printValidateReport prints the report in a human-readable form.
+func printValidateReport(out io.Writer, report pamutil.ValidateReport) {
+	for _, s := range report.Shards {
+		status := "OK"
+		if len(s.Problems) > 0 {
+			status = "INVALID"
+		}
+		fmt.Fprintf(out, "shard %s: %d records, %d fields: %s\n", s.Shard, s.NumRecords, len(s.Fields), status)
+		for _, p := range s.Problems {
+			fmt.Fprintf(out, "  %s\n", p)
+		}
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintf(out, "%s\n", p)
+	}
+	for _, path := range report.OrphanFiles {
+		fmt.Fprintf(out, "orphan file: %s\n", path)
+	}
+	status := "OK"
+	if !report.OK() {
+		status = "INVALID"
+	}
+	fmt.Fprintf(out, "%s: %d shards, %d records: %s\n", report.Dir, len(report.Shards), report.NumRecords, status)
+}
+
+func validate(path string, opts validateOpts) error {
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("validate: unknown format '%s'", opts.format)
+	}
+	ctx := vcontext.Background()
+	report, err := pamutil.Validate(ctx, path)
+	if err != nil {
+		return err
+	}
+	if opts.format == "json" {
+		js, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(js))
+	} else {
+		printValidateReport(os.Stdout, report)
+	}
+	if report.OK() {
+		return nil
+	}
+	if !opts.repair {
+		return fmt.Errorf("%s: invalid PAM file", path)
+	}
+	removed, err := pamutil.RemoveInvalidShards(ctx, report)
+	for _, path := range removed {
+		fmt.Fprintf(os.Stderr, "removed %s\n", path)
+	}
+	if err != nil {
+		return err
+	}
+	// Check again, since the deleted shards leave gaps in the ranges, and some
+	// problems, such as overlapping ranges, are not fixed by deleting files.
+	if report, err = pamutil.Validate(ctx, path); err != nil {
+		return err
+	}
+	if !report.OK() {
+		printValidateReport(os.Stderr, report)
+		return fmt.Errorf("%s: problems remain after repair", path)
+	}
+	return nil
+}
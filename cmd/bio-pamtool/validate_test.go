@@ -0,0 +1,52 @@
+package main_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"v.io/x/lib/gosh"
+)
+
+func TestValidate(t *testing.T) {
+	if !testutil.IsBazel() {
+		t.Skip("not bazel")
+	}
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+	pamtoolPath := testutil.GoExecutable(t, "//go/src/github.com/grailbio/bio/cmd/bio-pamtool/bio-pamtool")
+	dir := sh.MakeTempDir()
+	pamPath := filepath.Join(dir, "test.pam")
+	sh.Cmd(pamtoolPath, "convert", bamPath, pamPath).Run()
+	assert.NoError(t, sh.Err)
+
+	output := sh.Cmd(pamtoolPath, "validate", "-format=json", pamPath).Stdout()
+	assert.NoError(t, sh.Err)
+	var report pamutil.ValidateReport
+	assert.NoError(t, json.Unmarshal([]byte(output), &report))
+	assert.True(t, report.OK())
+	assert.Equal(t, int64(20042), report.NumRecords)
+	assert.Equal(t, 1, len(report.Shards))
+
+	// Remove a field file.
+	assert.NoError(t, os.Remove(filepath.Join(pamPath, report.Shards[0].Shard+".mapq")))
+	cmd := sh.Cmd(pamtoolPath, "validate", pamPath)
+	cmd.ExitErrorIsOk = true
+	output = cmd.Stdout()
+	assert.Contains(t, output, "field mapq: file not found")
+	assert.Contains(t, output, ": INVALID\n")
+
+	// The only shard is deleted, which leaves a gap, so the repair still fails.
+	cmd = sh.Cmd(pamtoolPath, "validate", "-repair", pamPath)
+	cmd.ExitErrorIsOk = true
+	_, stderr := cmd.StdoutStderr()
+	assert.Error(t, cmd.Err)
+	assert.Contains(t, stderr, "problems remain after repair")
+	_, err := os.Stat(filepath.Join(pamPath, report.Shards[0].Shard+".index"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"os"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -11,7 +13,9 @@ import (
 	"github.com/grailbio/base/errors"
 	"github.com/grailbio/base/syncqueue"
 	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamfilter"
 	"github.com/grailbio/bio/encoding/bamprovider"
+	gsam "github.com/grailbio/bio/encoding/sam"
 	"github.com/grailbio/hts/sam"
 )
 
@@ -84,12 +88,16 @@ func parseRegionsFlag(flag string) ([]viewRegion, error) {
 // Scan shards in parallel, and output records matching the filter in order.
 //
 // REQUIRES: ShardIdx field of shards[] must have values 0, 1, 2, ...
-func viewShards(provider bamprovider.Provider, filter *filterExpr, shards []gbam.Shard) error {
+func viewShards(reader *selectReader, filter *bamfilter.Expr, shards []gbam.Shard) error {
 	shardCh := gbam.NewShardChannel(shards)
 	wgW := sync.WaitGroup{}
 	wgR := sync.WaitGroup{}
 	e := errors.Once{}
 	oq := syncqueue.NewOrderedQueue(len(shards))
+	var keep func(*sam.Record) bool
+	if filter != nil {
+		keep = filter.Evaluate
+	}
 
 	// The reader thread
 	for i := 0; i < runtime.NumCPU(); i++ {
@@ -99,13 +107,10 @@ func viewShards(provider bamprovider.Provider, filter *filterExpr, shards []gbam
 			for shard := range shardCh {
 				recCh := make(chan *sam.Record, 16<<10)
 				oq.Insert(shard.ShardIdx, recCh)
-				iter := provider.NewIterator(shard)
-				for iter.Scan() {
-					if filter == nil || evaluateFilterExpr(filter, iter.Record()) {
-						recCh <- iter.Record()
-					}
-				}
-				e.Set(iter.Close())
+				e.Set(reader.scan(shard, keep, func(rec *sam.Record) error {
+					recCh <- rec
+					return nil
+				}))
 				close(recCh)
 			}
 		}()
@@ -115,6 +120,8 @@ func viewShards(provider bamprovider.Provider, filter *filterExpr, shards []gbam
 	// The display thread
 	go func() {
 		defer wgR.Done()
+		out := bufio.NewWriterSize(os.Stdout, 1<<20)
+		var buf []byte
 		for {
 			val, ok, err := oq.Next()
 			if err != nil {
@@ -126,15 +133,19 @@ func viewShards(provider bamprovider.Provider, filter *filterExpr, shards []gbam
 			}
 
 			for rec := range val.(chan *sam.Record) {
-				s, err := rec.MarshalText()
+				buf, err = gsam.AppendRecord(buf[:0], rec)
+				sam.PutInFreePool(rec)
 				if err != nil {
 					e.Set(err)
 					continue
 				}
-				sam.PutInFreePool(rec)
-				fmt.Print(string(s), "\n")
+				buf = append(buf, '\n')
+				if _, err := out.Write(buf); err != nil {
+					e.Set(err)
+				}
 			}
 		}
+		e.Set(out.Flush())
 	}()
 	wgW.Wait()
 	oq.Close(nil)
@@ -142,8 +153,8 @@ func viewShards(provider bamprovider.Provider, filter *filterExpr, shards []gbam
 	return e.Err()
 }
 
-func viewAll(provider bamprovider.Provider, filter *filterExpr) error {
-	shards, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{
+func viewAll(reader *selectReader, filter *bamfilter.Expr) error {
+	shards, err := reader.provider.GenerateShards(bamprovider.GenerateShardsOpts{
 		IncludeUnmapped:     true,
 		SplitUnmappedCoords: true,
 		SplitMappedCoords:   true,
@@ -151,11 +162,11 @@ func viewAll(provider bamprovider.Provider, filter *filterExpr) error {
 	if err != nil {
 		return err
 	}
-	return viewShards(provider, filter, shards)
+	return viewShards(reader, filter, shards)
 }
 
-func viewSubregion(provider bamprovider.Provider, region viewRegion, filter *filterExpr) error {
-	header, err := provider.GetHeader()
+func viewSubregion(reader *selectReader, region viewRegion, filter *bamfilter.Expr) error {
+	header, err := reader.provider.GetHeader()
 	if err != nil {
 		return err
 	}
@@ -183,11 +194,12 @@ func viewSubregion(provider bamprovider.Provider, region viewRegion, filter *fil
 	if shard.EndRef, err = findRef(region.limitRefName); err != nil {
 		return err
 	}
-	return viewShards(provider, filter, []gbam.Shard{shard})
+	return viewShards(reader, filter, []gbam.Shard{shard})
 }
 
 type viewFlags struct {
 	bamIndex   *string
+	reference  *string
 	withHeader *bool
 	headerOnly *bool
 	regions    *string
@@ -205,15 +217,20 @@ func view(flags viewFlags, path string) error {
 			return err
 		}
 	}
-	var filter *filterExpr
+	var filter *bamfilter.Expr
 	if *flags.filter != "" {
 		var err error
-		filter, err = parseFilterExpr(*flags.filter)
+		filter, err = bamfilter.Parse(*flags.filter)
 		if err != nil {
 			return err
 		}
 	}
-	provider := bamprovider.NewProvider(path, bamprovider.ProviderOpts{Index: *flags.bamIndex})
+	opts, closeReference, err := newProviderOpts(*flags.bamIndex, *flags.reference)
+	if err != nil {
+		return err
+	}
+	defer closeReference() // nolint: errcheck
+	provider := bamprovider.NewProvider(path, opts)
 	if *flags.headerOnly || *flags.withHeader {
 		header, err := provider.GetHeader()
 		if err != nil {
@@ -228,16 +245,23 @@ func view(flags viewFlags, path string) error {
 			return nil
 		}
 	}
+	// With a filter, read only the fields it needs until a record matches.
+	reader := &selectReader{provider: provider}
+	if filter != nil {
+		reader = newSelectReader(provider, path, opts, filter.Fields(), filter.AuxTags())
+	}
 	if len(regions) > 0 {
 		for _, region := range regions {
-			if err := viewSubregion(provider, region, filter); err != nil {
+			if err := viewSubregion(reader, region, filter); err != nil {
+				reader.close() // nolint: errcheck
 				return err
 			}
 		}
 	} else {
-		if err := viewAll(provider, filter); err != nil {
+		if err := viewAll(reader, filter); err != nil {
+			reader.close() // nolint: errcheck
 			return err
 		}
 	}
-	return nil
+	return reader.close()
 }
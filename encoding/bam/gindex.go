@@ -14,6 +14,10 @@ import (
 
 const (
 	maxRecordSize = 0xffffff
+
+	// DefaultGIndexByteInterval is the default spacing, in bytes of the
+	// .bam file, between the entries of a .gbai index.
+	DefaultGIndexByteInterval = 64 * 1024
 )
 
 // GIndex is an alternate .bam file index format that uses the .gbai
@@ -188,6 +192,81 @@ func compareFilePos(x, y *GIndexEntry) int {
 	return int(int64(x.VOffset) - int64(y.VOffset))
 }
 
+// gIndexBuilder chooses the entries of a .gbai index as the records of a
+// .bam file are visited in file order, and writes them to a gIndexWriter.
+type gIndexBuilder struct {
+	w            *gIndexWriter
+	byteInterval int
+
+	prevRefID      int32
+	prevPos        int32
+	prevFileOffset uint64
+	firstRecord    bool
+}
+
+// newGIndexBuilder creates a gIndexBuilder that writes entries spaced by about
+// byteInterval bytes in the .bam file to w. It writes the .gbai header
+// immediately.
+func newGIndexBuilder(w io.Writer, byteInterval int) (*gIndexBuilder, error) {
+	b := &gIndexBuilder{
+		w:            newGIndexWriter(w),
+		byteInterval: byteInterval,
+		firstRecord:  true,
+	}
+	if err := b.w.writeHeader(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// add visits the record at (refID, pos) that begins at voffset in the .bam
+// file.
+func (b *gIndexBuilder) add(refID, pos int32, voffset uint64) error {
+	fileOffset := voffset >> 16
+
+	// Always add an entry for the first record of a new RefID.
+	if b.firstRecord || refID != b.prevRefID {
+		entry := GIndexEntry{
+			RefID:   refID,
+			Pos:     pos,
+			Seq:     0,
+			VOffset: voffset,
+		}
+		if err := b.w.append(&entry); err != nil {
+			return err
+		}
+		b.prevRefID = refID
+		b.prevPos = pos
+		b.prevFileOffset = fileOffset
+		b.firstRecord = false
+		return nil
+	}
+
+	firstOccurrence := false
+	if pos != b.prevPos {
+		b.prevPos = pos
+		firstOccurrence = true
+	}
+	if firstOccurrence && (fileOffset-b.prevFileOffset) >= uint64(b.byteInterval) {
+		entry := GIndexEntry{
+			RefID:   refID,
+			Pos:     pos,
+			Seq:     0,
+			VOffset: voffset,
+		}
+		if err := b.w.append(&entry); err != nil {
+			return err
+		}
+		b.prevFileOffset = fileOffset
+	}
+	return nil
+}
+
+// close flushes the .gbai file.
+func (b *gIndexBuilder) close() error {
+	return b.w.close()
+}
+
 // WriteGIndex reads a .bam file from r, and writes a .gbai file to w.
 // The spacing between voffset file locations will be approximately
 // byteInterval, and parallelism controls the .bam file read
@@ -207,20 +286,14 @@ func WriteGIndex(w io.Writer, r io.Reader, byteInterval, parallelism int) error
 	if err := header.DecodeBinary(bgzfReader); err != nil {
 		return err
 	}
-	gindex := newGIndexWriter(w)
-	if err := gindex.writeHeader(); err != nil {
+	gindex, err := newGIndexBuilder(w, byteInterval)
+	if err != nil {
 		return err
 	}
 
 	// Read through all alignment records, and output voffsets at shard boundaries.
-	prevRefID := int32(0)
-	prevPos := int32(0)
-	prevFileOffset := uint64(0)
-
 	sizeBuf := make([]byte, 4)
 	buf := make([]byte, maxRecordSize)
-	firstRecord := true
-
 	for {
 		// Read the record size.
 		_, err := io.ReadFull(bgzfReader, sizeBuf)
@@ -244,41 +317,8 @@ func WriteGIndex(w io.Writer, r io.Reader, byteInterval, parallelism int) error
 		// Parse the relevant fields
 		refID := int32(binary.LittleEndian.Uint32(buf[0:4]))
 		pos := int32(binary.LittleEndian.Uint32(buf[4:8]))
-
-		// Always add an entry for the first record of a new RefID.
-		if firstRecord || refID != prevRefID {
-			entry := GIndexEntry{
-				RefID:   refID,
-				Pos:     pos,
-				Seq:     0,
-				VOffset: toVOffset(recordVOffset),
-			}
-			if err := gindex.append(&entry); err != nil {
-				return err
-			}
-			prevRefID = refID
-			prevPos = pos
-			prevFileOffset = uint64(recordVOffset.File)
-			firstRecord = false
-			continue
-		}
-
-		firstOccurrence := false
-		if pos != prevPos {
-			prevPos = pos
-			firstOccurrence = true
-		}
-		if firstOccurrence && (uint64(recordVOffset.File)-prevFileOffset) >= uint64(byteInterval) {
-			entry := GIndexEntry{
-				RefID:   refID,
-				Pos:     pos,
-				Seq:     0,
-				VOffset: toVOffset(recordVOffset),
-			}
-			if err := gindex.append(&entry); err != nil {
-				return err
-			}
-			prevFileOffset = uint64(recordVOffset.File)
+		if err := gindex.add(refID, pos, toVOffset(recordVOffset)); err != nil {
+			return err
 		}
 	}
 	return gindex.close()
@@ -0,0 +1,474 @@
+package bam
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/sam"
+)
+
+// IndexFormat is the format of a standard BAM index file.
+type IndexFormat int
+
+const (
+	// BAIFormat is the .bai format. It can index references of length up to
+	// 2^29-1.
+	BAIFormat IndexFormat = iota
+	// CSIFormat is the .csi format, which can index longer references.
+	CSIFormat
+)
+
+const (
+	// indexMinShift is the log2 of the smallest bin size, and the size of a
+	// linear index window. It is fixed for .bai, and we use the same value
+	// for .csi, as samtools does.
+	indexMinShift = 14
+	// baiDepth is the number of levels of the .bai binning scheme, excluding
+	// the root.
+	baiDepth = 5
+	// maxBAIRefLen is the length of the longest reference a .bai can index.
+	maxBAIRefLen = 1<<29 - 1
+	// noVOffset marks a linear index window without records.
+	noVOffset = ^uint64(0)
+)
+
+// Ext returns the file name extension for the format, ".bai" or ".csi".
+func (f IndexFormat) Ext() string {
+	if f == CSIFormat {
+		return ".csi"
+	}
+	return ".bai"
+}
+
+// String implements fmt.Stringer.
+func (f IndexFormat) String() string {
+	return f.Ext()[1:]
+}
+
+// IndexFormatFor returns the format needed to index a BAM file with the given
+// header: BAIFormat, unless a reference is too long for it.
+func IndexFormatFor(header *sam.Header) IndexFormat {
+	for _, ref := range header.Refs() {
+		if ref.Len() > maxBAIRefLen {
+			return CSIFormat
+		}
+	}
+	return BAIFormat
+}
+
+// indexEntry is the part of a BAM record needed to index it.
+type indexEntry struct {
+	// refID and pos are the reference and position fields of the record. The
+	// record is unplaced if either is negative.
+	refID, pos int
+	// end is the end of the span of the record on the reference, [pos, end).
+	end    int
+	mapped bool
+	// beginVOffset and endVOffset are the voffsets of the record's first
+	// byte and of the byte just after the record.
+	beginVOffset, endVOffset uint64
+}
+
+func newIndexEntry(r *sam.Record, begin, end uint64) indexEntry {
+	e := indexEntry{
+		refID:        r.Ref.ID(),
+		pos:          r.Pos,
+		end:          r.Pos + 1,
+		mapped:       r.Flags&sam.Unmapped == 0,
+		beginVOffset: begin,
+		endVOffset:   end,
+	}
+	if e.mapped {
+		if end := r.End(); end > e.pos {
+			e.end = end
+		}
+	}
+	return e
+}
+
+// indexChunk is a range of voffsets [begin, end) in the BAM file.
+type indexChunk struct {
+	begin, end uint64
+}
+
+// refIndex is the index of one reference.
+type refIndex struct {
+	bins map[uint32][]indexChunk
+	// linear[i] is the voffset of the first record that overlaps the i'th
+	// window of 1<<indexMinShift bases, or noVOffset.
+	linear []uint64
+	// begin and end are the voffsets of the first record and of the end of the
+	// last record of the reference.
+	begin, end uint64
+	// nMapped and nUnmapped count the records placed on the reference.
+	nMapped, nUnmapped uint64
+}
+
+// IndexBuilder builds a .bai or .csi index from the records of a
+// coordinate-sorted BAM file, added in file order. It follows the indexing
+// scheme of htslib, described in the SAM/BAM spec.
+type IndexBuilder struct {
+	format          IndexFormat
+	minShift, depth int
+	refs            []refIndex
+	// nUnplaced counts the records without a reference.
+	nUnplaced uint64
+
+	// The ref, pos, and placement of the last record, to check the order.
+	lastRefID, lastPos int
+	seenUnplaced       bool
+
+	// cur is the chunk being extended with records of the same bin, on
+	// reference curRefID.
+	cur              indexChunk
+	curRefID, curBin int
+}
+
+// NewIndexBuilder creates an IndexBuilder for a BAM file with the given
+// header. It returns an error if the format cannot index one of the
+// references.
+func NewIndexBuilder(header *sam.Header, format IndexFormat) (*IndexBuilder, error) {
+	b := &IndexBuilder{
+		format:   format,
+		minShift: indexMinShift,
+		depth:    baiDepth,
+		curRefID: -1,
+	}
+	maxLen := 0
+	for _, ref := range header.Refs() {
+		if ref.Len() > maxLen {
+			maxLen = ref.Len()
+		}
+	}
+	switch format {
+	case BAIFormat:
+		if maxLen > maxBAIRefLen {
+			return nil, fmt.Errorf("bam index: reference length %d is too long for a .bai index, use .csi", maxLen)
+		}
+	case CSIFormat:
+		// Use enough levels for the longest reference, as htslib does.
+		b.depth = 0
+		for s := int64(1) << uint(b.minShift); int64(maxLen)+256 > s; s <<= 3 {
+			b.depth++
+		}
+	default:
+		return nil, fmt.Errorf("bam index: unknown format %d", format)
+	}
+	b.refs = make([]refIndex, len(header.Refs()))
+	for i := range b.refs {
+		b.refs[i].bins = map[uint32][]indexChunk{}
+	}
+	return b, nil
+}
+
+// Add adds a record, which spans the voffsets of the given chunk in the BAM
+// file. The records must be added in file order, and the file must be
+// sorted by coordinate.
+func (b *IndexBuilder) Add(r *sam.Record, chunk bgzf.Chunk) error {
+	return b.add(newIndexEntry(r, toVOffset(chunk.Begin), toVOffset(chunk.End)))
+}
+
+func (b *IndexBuilder) add(e indexEntry) error {
+	if e.refID < 0 || e.pos < 0 {
+		b.flush()
+		b.nUnplaced++
+		b.seenUnplaced = true
+		return nil
+	}
+	if e.refID >= len(b.refs) {
+		return fmt.Errorf("bam index: invalid reference ID %d", e.refID)
+	}
+	if b.seenUnplaced || e.refID < b.lastRefID || (e.refID == b.lastRefID && e.pos < b.lastPos) {
+		return fmt.Errorf("bam index: records are not sorted by coordinate at reference %d, position %d", e.refID, e.pos)
+	}
+	if b.format == BAIFormat && e.end > maxBAIRefLen {
+		return fmt.Errorf("bam index: record at reference %d, position %d is beyond the .bai limit", e.refID, e.pos)
+	}
+	b.lastRefID, b.lastPos = e.refID, e.pos
+
+	ref := &b.refs[e.refID]
+	bin := int(reg2bin(e.pos, e.end, b.minShift, b.depth))
+	if e.refID == b.curRefID && bin == b.curBin {
+		b.cur.end = e.endVOffset
+	} else {
+		b.flush()
+		b.cur = indexChunk{e.beginVOffset, e.endVOffset}
+		b.curRefID, b.curBin = e.refID, bin
+	}
+
+	first, last := e.pos>>uint(b.minShift), (e.end-1)>>uint(b.minShift)
+	for len(ref.linear) <= last {
+		ref.linear = append(ref.linear, noVOffset)
+	}
+	for w := first; w <= last; w++ {
+		if ref.linear[w] == noVOffset {
+			ref.linear[w] = e.beginVOffset
+		}
+	}
+
+	if ref.nMapped+ref.nUnmapped == 0 {
+		ref.begin = e.beginVOffset
+	}
+	ref.end = e.endVOffset
+	if e.mapped {
+		ref.nMapped++
+	} else {
+		ref.nUnmapped++
+	}
+	return nil
+}
+
+// flush adds the current chunk to its bin. Chunks that touch the same BGZF
+// block are merged, since reading one of them reads the whole block anyway.
+func (b *IndexBuilder) flush() {
+	if b.curRefID < 0 {
+		return
+	}
+	bins := b.refs[b.curRefID].bins
+	bin := uint32(b.curBin)
+	chunks := bins[bin]
+	if n := len(chunks); n > 0 && chunks[n-1].end>>16 >= b.cur.begin>>16 {
+		if b.cur.end > chunks[n-1].end {
+			chunks[n-1].end = b.cur.end
+		}
+	} else {
+		bins[bin] = append(chunks, b.cur)
+	}
+	b.curRefID = -1
+}
+
+// Write writes the index. No records can be added after Write. A .csi index
+// is BGZF-compressed, as required by the spec.
+func (b *IndexBuilder) Write(w io.Writer) error {
+	b.flush()
+	for i := range b.refs {
+		ref := &b.refs[i]
+		// Empty windows take the voffset of the window before them, or of the
+		// first record of the reference.
+		prev := ref.begin
+		for j, v := range ref.linear {
+			if v == noVOffset {
+				ref.linear[j] = prev
+			}
+			prev = ref.linear[j]
+		}
+	}
+	if b.format == CSIFormat {
+		bw := bgzf.NewWriter(w, 1)
+		if err := b.write(bw); err != nil {
+			bw.Close() // nolint: errcheck
+			return err
+		}
+		return bw.Close()
+	}
+	return b.write(w)
+}
+
+func (b *IndexBuilder) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var buf [8]byte
+	put32 := func(v uint32) {
+		binary.LittleEndian.PutUint32(buf[:4], v)
+		bw.Write(buf[:4]) // nolint: errcheck
+	}
+	put64 := func(v uint64) {
+		binary.LittleEndian.PutUint64(buf[:], v)
+		bw.Write(buf[:]) // nolint: errcheck
+	}
+
+	if b.format == CSIFormat {
+		bw.WriteString("CSI\x01") // nolint: errcheck
+		put32(uint32(b.minShift))
+		put32(uint32(b.depth))
+		put32(0) // l_aux
+	} else {
+		bw.WriteString("BAI\x01") // nolint: errcheck
+	}
+	put32(uint32(len(b.refs)))
+	// The pseudo-bin that stores the reference statistics.
+	pseudoBin := uint32(numBins(b.depth) + 1)
+	for i := range b.refs {
+		ref := &b.refs[i]
+		hasRecords := ref.nMapped+ref.nUnmapped > 0
+		binIDs := make([]uint32, 0, len(ref.bins))
+		for bin := range ref.bins {
+			binIDs = append(binIDs, bin)
+		}
+		sort.Slice(binIDs, func(i, j int) bool { return binIDs[i] < binIDs[j] })
+		nBins := len(binIDs)
+		if hasRecords {
+			nBins++
+		}
+		put32(uint32(nBins))
+		for _, bin := range binIDs {
+			put32(bin)
+			if b.format == CSIFormat {
+				put64(b.binLeftVOffset(ref, bin))
+			}
+			chunks := ref.bins[bin]
+			put32(uint32(len(chunks)))
+			for _, c := range chunks {
+				put64(c.begin)
+				put64(c.end)
+			}
+		}
+		if hasRecords {
+			put32(pseudoBin)
+			if b.format == CSIFormat {
+				put64(0)
+			}
+			put32(2)
+			put64(ref.begin)
+			put64(ref.end)
+			put64(ref.nMapped)
+			put64(ref.nUnmapped)
+		}
+		if b.format == BAIFormat {
+			put32(uint32(len(ref.linear)))
+			for _, v := range ref.linear {
+				put64(v)
+			}
+		}
+	}
+	put64(b.nUnplaced)
+	return bw.Flush()
+}
+
+// binLeftVOffset returns the smallest voffset of a record in the bin, as
+// derived from the linear index. It is 0 if unknown.
+func (b *IndexBuilder) binLeftVOffset(ref *refIndex, bin uint32) uint64 {
+	level := 0
+	for t := bin; t > 0; t = (t - 1) >> 3 {
+		level++
+	}
+	w := int(bin-uint32(numBins(level-1))) << uint(3*(b.depth-level))
+	if w < len(ref.linear) {
+		return ref.linear[w]
+	}
+	return 0
+}
+
+// numBins returns the number of bins of a binning scheme with the given depth.
+// It is also the number of the first bin at level depth+1.
+func numBins(depth int) int {
+	return (1<<uint(3*(depth+1)) - 1) / 7
+}
+
+// reg2bin returns the smallest bin that contains the 0-based, half-open
+// interval [beg, end).
+func reg2bin(beg, end, minShift, depth int) uint32 {
+	end--
+	s := uint(minShift)
+	t := (1<<uint(3*depth) - 1) / 7
+	for l := depth; l > 0; l-- {
+		if beg>>s == end>>s {
+			return uint32(t + beg>>s)
+		}
+		s += 3
+		t -= 1 << uint(3*(l-1))
+	}
+	return 0
+}
+
+// WriteIndex reads a coordinate-sorted BAM file from r, and writes its index
+// in the given format to w.
+func WriteIndex(w io.Writer, r io.Reader, format IndexFormat, parallelism int) error {
+	bgzfReader, err := bgzf.NewReader(r, parallelism)
+	if err != nil {
+		return err
+	}
+	header, err := sam.NewHeader(nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := header.DecodeBinary(bgzfReader); err != nil {
+		return err
+	}
+	b, err := NewIndexBuilder(header, format)
+	if err != nil {
+		return err
+	}
+
+	sizeBuf := make([]byte, 4)
+	buf := make([]byte, maxRecordSize)
+	var (
+		prev    indexEntry
+		hasPrev bool
+	)
+	for {
+		_, err := io.ReadFull(bgzfReader, sizeBuf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		begin := toVOffset(bgzfReader.LastChunk().Begin)
+		// The previous record ends where this one begins. The reader reports
+		// the end of a block instead of the start of the next one.
+		if hasPrev {
+			prev.endVOffset = begin
+			if err := b.add(prev); err != nil {
+				return err
+			}
+		}
+		sz := int(binary.LittleEndian.Uint32(sizeBuf))
+		if sz > maxRecordSize {
+			return fmt.Errorf("bam record exceeds max: %d", sz)
+		}
+		_, err = io.ReadFull(bgzfReader, buf[0:sz])
+		if err == io.EOF {
+			return fmt.Errorf("could not read full bam record")
+		} else if err != nil {
+			return err
+		}
+		if prev, err = parseIndexEntry(buf[0:sz]); err != nil {
+			return err
+		}
+		prev.beginVOffset = begin
+		prev.endVOffset = toVOffset(bgzfReader.LastChunk().End)
+		hasPrev = true
+	}
+	if hasPrev {
+		if err := b.add(prev); err != nil {
+			return err
+		}
+	}
+	return b.Write(w)
+}
+
+// parseIndexEntry extracts the fields needed for indexing from a serialized
+// BAM record, excluding the block size.
+func parseIndexEntry(buf []byte) (indexEntry, error) {
+	if len(buf) < 32 {
+		return indexEntry{}, fmt.Errorf("bam record is too short: %d bytes", len(buf))
+	}
+	e := indexEntry{
+		refID: int(int32(binary.LittleEndian.Uint32(buf[0:4]))),
+		pos:   int(int32(binary.LittleEndian.Uint32(buf[4:8]))),
+	}
+	e.end = e.pos + 1
+	lName := int(buf[8])
+	nCigarOps := int(binary.LittleEndian.Uint16(buf[12:14]))
+	flags := sam.Flags(binary.LittleEndian.Uint16(buf[14:16]))
+	e.mapped = flags&sam.Unmapped == 0
+	if !e.mapped || e.refID < 0 || e.pos < 0 {
+		return e, nil
+	}
+	cigar := buf[32+lName:]
+	if len(cigar) < 4*nCigarOps {
+		return indexEntry{}, fmt.Errorf("bam record is too short for its cigar: %d bytes", len(buf))
+	}
+	refLen := 0
+	for i := 0; i < nCigarOps; i++ {
+		op := sam.CigarOp(binary.LittleEndian.Uint32(cigar[4*i:]))
+		refLen += op.Len() * op.Type().Consumes().Reference
+	}
+	if refLen > 0 {
+		e.end = e.pos + refLen
+	}
+	return e, nil
+}
@@ -0,0 +1,215 @@
+package bam_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/bgzf"
+	"github.com/grailbio/hts/csi"
+	"github.com/grailbio/hts/sam"
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSortedRecords creates n random records sorted by coordinate, some of them
+// unmapped, followed by unplaced records.
+func newSortedRecords(refs []*sam.Reference, n, maxSpan int) []*sam.Record {
+	rnd := rand.New(rand.NewSource(0))
+	var records []*sam.Record
+	for i := 0; i < n; i++ {
+		ref := refs[rnd.Intn(len(refs))]
+		span := 1 + rnd.Intn(maxSpan)
+		pos := rnd.Intn(ref.Len() - span)
+		cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 10)}
+		if span > 20 {
+			// Long records skip part of the reference.
+			cigar = sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 10), sam.NewCigarOp(sam.CigarSkipped, span-20),
+				sam.NewCigarOp(sam.CigarMatch, 10)}
+		}
+		r := &sam.Record{Ref: ref, Pos: pos, MatePos: -1, MapQ: 60, Cigar: cigar}
+		if rnd.Intn(10) == 0 {
+			// An unmapped record placed next to its mate.
+			r.Flags = sam.Unmapped
+			r.Cigar = nil
+		}
+		records = append(records, r)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Ref.ID() != records[j].Ref.ID() {
+			return records[i].Ref.ID() < records[j].Ref.ID()
+		}
+		return records[i].Pos < records[j].Pos
+	})
+	for i := 0; i < n/100; i++ {
+		records = append(records, &sam.Record{Pos: -1, MatePos: -1, Flags: sam.Unmapped})
+	}
+	for i, r := range records {
+		r.Name = fmt.Sprintf("r%06d", i)
+	}
+	return records
+}
+
+// writeIndexedBAM writes the records with a ShardedBAMWriter, using several
+// compressors that complete their shards out of order.
+func writeIndexedBAM(t *testing.T, header *sam.Header, records []*sam.Record, format gbam.IndexFormat) (bamData, indexData []byte) {
+	const nShards = 7
+	var bamBuf, indexBuf bytes.Buffer
+	w, err := gbam.NewShardedBAMWriterWithIndex(&bamBuf, gzip.DefaultCompression, nShards, header,
+		gbam.ShardedBAMIndexOpts{Index: &indexBuf, IndexFormat: format})
+	require.NoError(t, err)
+	compressors := []*gbam.ShardedBAMCompressor{w.GetCompressor(), w.GetCompressor()}
+	shardSize := (len(records) + nShards - 1) / nShards
+	for shard := nShards - 1; shard >= 0; shard-- {
+		c := compressors[shard%len(compressors)]
+		require.NoError(t, c.StartShard(shard))
+		for i := shard * shardSize; i < (shard+1)*shardSize && i < len(records); i++ {
+			require.NoError(t, c.AddRecord(records[i]))
+		}
+		require.NoError(t, c.CloseShard())
+	}
+	require.NoError(t, w.Close())
+	return bamBuf.Bytes(), indexBuf.Bytes()
+}
+
+func recordEnd(r *sam.Record) int {
+	if r.Flags&sam.Unmapped != 0 || r.End() == r.Pos {
+		return r.Pos + 1
+	}
+	return r.End()
+}
+
+// verifyQuery checks that the chunks returned by an index for the interval
+// [beg, end) of ref contain all the records that overlap the interval.
+func verifyQuery(t *testing.T, bamData []byte, records []*sam.Record, ref *sam.Reference, beg, end int, chunks []bgzf.Chunk) {
+	var expected, actual []string
+	for _, r := range records {
+		if r.Ref == ref && r.Pos < end && recordEnd(r) > beg {
+			expected = append(expected, r.Name)
+		}
+	}
+	reader, err := bam.NewReader(bytes.NewReader(bamData), 1)
+	require.NoError(t, err)
+	iter, err := bam.NewIterator(reader, chunks)
+	require.NoError(t, err)
+	for iter.Next() {
+		r := iter.Record()
+		if r.Ref != nil && r.Ref.ID() == ref.ID() && r.Pos < end && recordEnd(r) > beg {
+			actual = append(actual, r.Name)
+		}
+	}
+	require.NoError(t, iter.Error())
+	assert.Equal(t, expected, actual, "ref=%v, beg=%d, end=%d", ref.Name(), beg, end)
+}
+
+func countRecords(records []*sam.Record) (mapped, unmapped map[int]uint64, unplaced uint64) {
+	mapped, unmapped = map[int]uint64{}, map[int]uint64{}
+	for _, r := range records {
+		switch {
+		case r.Ref == nil:
+			unplaced++
+		case r.Flags&sam.Unmapped != 0:
+			unmapped[r.Ref.ID()]++
+		default:
+			mapped[r.Ref.ID()]++
+		}
+	}
+	return
+}
+
+func TestWriteBAI(t *testing.T) {
+	var refs []*sam.Reference
+	for i, length := range []int{100000, 2000000, 1000} {
+		ref, err := sam.NewReference(fmt.Sprintf("chr%d", i+1), "", "", length, nil, nil)
+		require.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	header, err := sam.NewHeader(nil, refs)
+	require.NoError(t, err)
+	assert.Equal(t, gbam.BAIFormat, gbam.IndexFormatFor(header))
+	// chr3 has no records.
+	records := newSortedRecords(refs[:2], 20000, 100000)
+	bamData, indexData := writeIndexedBAM(t, header, records, gbam.BAIFormat)
+
+	// The standalone indexer produces an equivalent index.
+	var standaloneData bytes.Buffer
+	require.NoError(t, gbam.WriteIndex(&standaloneData, bytes.NewReader(bamData), gbam.BAIFormat, 1))
+
+	mapped, unmapped, unplaced := countRecords(records)
+	for _, data := range [][]byte{indexData, standaloneData.Bytes()} {
+		index, err := bam.ReadIndex(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, len(refs), index.NumRefs())
+		n, ok := index.Unmapped()
+		assert.True(t, ok)
+		assert.Equal(t, unplaced, n)
+		for _, ref := range refs {
+			stats, ok := index.ReferenceStats(ref.ID())
+			if ref.ID() == 2 {
+				assert.False(t, ok)
+				continue
+			}
+			assert.True(t, ok)
+			assert.Equal(t, mapped[ref.ID()], stats.Mapped)
+			assert.Equal(t, unmapped[ref.ID()], stats.Unmapped)
+		}
+
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 200; i++ {
+			ref := refs[rnd.Intn(2)]
+			beg := rnd.Intn(ref.Len())
+			end := beg + 1 + rnd.Intn(1+rnd.Intn(50000))
+			chunks, err := index.Chunks(ref, beg, end)
+			require.NoError(t, err)
+			verifyQuery(t, bamData, records, ref, beg, end, chunks)
+		}
+	}
+}
+
+func TestWriteCSI(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	require.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 1<<31-1, nil, nil)
+	require.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	require.NoError(t, err)
+	assert.Equal(t, gbam.CSIFormat, gbam.IndexFormatFor(header))
+	_, err = gbam.NewShardedBAMWriterWithIndex(&bytes.Buffer{}, gzip.DefaultCompression, 1, header,
+		gbam.ShardedBAMIndexOpts{Index: &bytes.Buffer{}, IndexFormat: gbam.BAIFormat})
+	assert.Error(t, err)
+
+	// Use sparse records, so that each bin holds one chunk. The records start
+	// after the second window, since hts reads bin 37450 as the pseudo-bin of
+	// a depth-5 index.
+	var records []*sam.Record
+	for _, ref := range header.Refs() {
+		for pos := 50000; pos < ref.Len()-1000; pos += ref.Len() / 300 {
+			records = append(records, &sam.Record{Name: fmt.Sprintf("r%06d", len(records)), Ref: ref, Pos: pos,
+				MatePos: -1, MapQ: 60, Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 100)}})
+		}
+	}
+	bamData, indexData := writeIndexedBAM(t, header, records, gbam.CSIFormat)
+
+	var standaloneData bytes.Buffer
+	require.NoError(t, gbam.WriteIndex(&standaloneData, bytes.NewReader(bamData), gbam.CSIFormat, 1))
+	for _, data := range [][]byte{indexData, standaloneData.Bytes()} {
+		r, err := bgzf.NewReader(bytes.NewReader(data), 1)
+		require.NoError(t, err)
+		index, err := csi.ReadFrom(r)
+		require.NoError(t, err)
+		assert.Equal(t, 2, index.NumRefs())
+		n, ok := index.Unmapped()
+		assert.True(t, ok)
+		assert.Equal(t, uint64(0), n)
+
+		for _, r := range records {
+			chunks := index.Chunks(r.Ref.ID(), r.Pos, r.Pos+1)
+			verifyQuery(t, bamData, records, r.Ref, r.Pos, r.Pos+1, chunks)
+		}
+	}
+}
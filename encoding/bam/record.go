@@ -0,0 +1,39 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bam
+
+import (
+	"github.com/grailbio/hts/sam"
+)
+
+// HasNoMappedMate returns true if the record is not paired, or its mate is
+// unmapped.
+func HasNoMappedMate(r *sam.Record) bool {
+	return (r.Flags&sam.Paired) == 0 || (r.Flags&sam.MateUnmapped) != 0
+}
+
+// AuxInt returns the value of an integer aux field. It returns false if the
+// field is nil or not an integer.
+func AuxInt(aux sam.Aux) (int, bool) {
+	if aux == nil || aux.Type() == 'A' {
+		// The value of an 'A' field is a byte.
+		return 0, false
+	}
+	switch v := aux.Value().(type) {
+	case int8:
+		return int(v), true
+	case uint8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	}
+	return 0, false
+}
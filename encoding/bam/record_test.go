@@ -0,0 +1,37 @@
+package bam
+
+import (
+	"testing"
+
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/expect"
+)
+
+func TestAuxInt(t *testing.T) {
+	for _, test := range []struct {
+		value interface{}
+		want  int
+		ok    bool
+	}{
+		{uint8(200), 200, true},
+		{int8(-3), -3, true},
+		{int16(-300), -300, true},
+		{uint16(60000), 60000, true},
+		{int32(-70000), -70000, true},
+		{uint32(70000), 70000, true},
+		{"10M", 0, false},
+		{float32(1.5), 0, false},
+	} {
+		aux, err := sam.NewAux(sam.NewTag("XX"), test.value)
+		expect.NoError(t, err)
+		v, ok := AuxInt(aux)
+		expect.EQ(t, v, test.want, test.value)
+		expect.EQ(t, ok, test.ok, test.value)
+	}
+	// A character is not an integer, even though its value is a byte.
+	v, ok := AuxInt(sam.Aux("XXAZ"))
+	expect.EQ(t, v, 0)
+	expect.False(t, ok)
+	_, ok = AuxInt(nil)
+	expect.False(t, ok)
+}
@@ -2,10 +2,17 @@ package bam
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"runtime"
 	"sync"
 
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
 	"github.com/grailbio/base/syncqueue"
+	"github.com/grailbio/base/vcontext"
 	"github.com/grailbio/bio/encoding/bgzf"
 	htsbam "github.com/grailbio/hts/bam"
 	"github.com/grailbio/hts/sam"
@@ -34,6 +41,10 @@ import (
 // other threads.  Compression occurs during AddRecord and CloseShard,
 // so each of the cores can compress independently.
 //
+// NewShardedBAMWriterWithIndex also builds a .bai, .csi, or .gbai index
+// of the output as the shards are written, so that a coordinate-sorted BAM
+// file does not need to be read again to index it.
+//
 // Example use of ShardedBAMWriter:
 //
 //   f, _ := os.Create("output.bam")
@@ -98,8 +109,10 @@ func (c *ShardedBAMCompressor) StartShard(shardNum int) error {
 	}
 
 	var err error
-	c.bgzf, err = bgzf.NewWriter(&c.output.buf, c.writer.gzLevel)
-	return err
+	if c.bgzf, err = bgzf.NewWriter(&c.output.buf, c.writer.gzLevel); err != nil {
+		return c.writer.abort(err)
+	}
+	return nil
 }
 
 // addHeader adds a sam header to the current shard.  This must be
@@ -115,8 +128,47 @@ func (c *ShardedBAMCompressor) AddRecord(r *sam.Record) error {
 	if err := htsbam.Marshal(r, &c.buf); err != nil {
 		return err
 	}
-	_, err := c.buf.WriteTo(c.bgzf)
-	return err
+	begin := c.bgzf.VOffset()
+	if _, err := c.buf.WriteTo(c.bgzf); err != nil {
+		return err
+	}
+	if c.writer.indexing() {
+		// The voffsets are relative to the start of the shard until the
+		// shard is written out.
+		c.output.index = append(c.output.index, newIndexEntry(r, begin, c.bgzf.VOffset()))
+	}
+	return nil
+}
+
+// AddSerializedRecords adds a sequence of serialized BAM records to the
+// current in-progress shard. Each record starts with its 4-byte block_size,
+// as in a BAM file.
+func (c *ShardedBAMCompressor) AddSerializedRecords(data []byte) error {
+	if !c.writer.indexing() {
+		_, err := c.bgzf.Write(data)
+		return err
+	}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return fmt.Errorf("truncated bam record: %d bytes", len(data))
+		}
+		size := 4 + int(binary.LittleEndian.Uint32(data))
+		if size > len(data) {
+			return fmt.Errorf("truncated bam record: %d bytes, expected %d", len(data), size)
+		}
+		e, err := parseIndexEntry(data[4:size])
+		if err != nil {
+			return err
+		}
+		e.beginVOffset = c.bgzf.VOffset()
+		if _, err := c.bgzf.Write(data[:size]); err != nil {
+			return err
+		}
+		e.endVOffset = c.bgzf.VOffset()
+		c.output.index = append(c.output.index, e)
+		data = data[size:]
+	}
+	return nil
 }
 
 // CloseShard finalizes the in-progress shard, and passes the
@@ -129,7 +181,7 @@ func (c *ShardedBAMCompressor) AddRecord(r *sam.Record) error {
 // calling CloseShard(), otherwise, calls to CloseShard() will block.
 func (c *ShardedBAMCompressor) CloseShard() error {
 	if err := c.bgzf.CloseWithoutTerminator(); err != nil {
-		return err
+		return c.writer.abort(err)
 	}
 	f := c.output
 	c.output = nil
@@ -141,6 +193,8 @@ func (c *ShardedBAMCompressor) CloseShard() error {
 type shardedBAMBuffer struct {
 	buf      bytes.Buffer
 	shardNum int
+	// index lists the records of the shard, if the writer builds an index.
+	index []indexEntry
 }
 
 // ShardedBAMWriter writes out ShardedBAMBuffers in the order of their
@@ -151,15 +205,61 @@ type ShardedBAMWriter struct {
 	queue     *syncqueue.OrderedQueue
 	waitGroup sync.WaitGroup
 	err       error
+
+	// offset is the number of bytes written to w so far.
+	offset uint64
+	// The indexes of the output, if requested.
+	index  *IndexBuilder
+	gindex *gIndexBuilder
+	opts   ShardedBAMIndexOpts
+}
+
+// ShardedBAMIndexOpts lists the indexes that a ShardedBAMWriter builds as it
+// writes a BAM file. The records must be sorted by coordinate across shards
+// for the indexes to be valid.
+type ShardedBAMIndexOpts struct {
+	// Index, if not nil, receives a .bai or .csi index of the BAM file, in
+	// IndexFormat.
+	Index       io.Writer
+	IndexFormat IndexFormat
+	// GIndex, if not nil, receives a .gbai index of the BAM file. Its
+	// entries are spaced by about GIndexByteInterval bytes of the BAM file,
+	// as done by WriteGIndex.  If GIndexByteInterval is zero,
+	// DefaultGIndexByteInterval is used.
+	GIndex             io.Writer
+	GIndexByteInterval int
 }
 
 // NewShardedBAMWriter creates a new ShardedBAMWriter that writes the
 // output bam to w.
 func NewShardedBAMWriter(w io.Writer, gzLevel, queueSize int, header *sam.Header) (*ShardedBAMWriter, error) {
+	return NewShardedBAMWriterWithIndex(w, gzLevel, queueSize, header, ShardedBAMIndexOpts{})
+}
+
+// NewShardedBAMWriterWithIndex creates a new ShardedBAMWriter that writes the
+// output bam to w, and the indexes listed in opts. The indexes are built
+// while the shards are written, and they are completed by Close.
+func NewShardedBAMWriterWithIndex(w io.Writer, gzLevel, queueSize int, header *sam.Header, opts ShardedBAMIndexOpts) (*ShardedBAMWriter, error) {
 	bw := ShardedBAMWriter{
 		w:       w,
 		gzLevel: gzLevel,
 		queue:   syncqueue.NewOrderedQueue(queueSize),
+		opts:    opts,
+	}
+	var err error
+	if opts.Index != nil {
+		if bw.index, err = NewIndexBuilder(header, opts.IndexFormat); err != nil {
+			return nil, err
+		}
+	}
+	if opts.GIndex != nil {
+		byteInterval := opts.GIndexByteInterval
+		if byteInterval == 0 {
+			byteInterval = DefaultGIndexByteInterval
+		}
+		if bw.gindex, err = newGIndexBuilder(opts.GIndex, byteInterval); err != nil {
+			return nil, err
+		}
 	}
 
 	c := bw.GetCompressor()
@@ -189,6 +289,13 @@ func (bw *ShardedBAMWriter) GetCompressor() *ShardedBAMCompressor {
 	}
 }
 
+// abort fails the writer with the given error, because a shard will never be
+// added. Otherwise the writer would wait for the shard forever. It returns err.
+func (bw *ShardedBAMWriter) abort(err error) error {
+	bw.queue.Close(err) // nolint: errcheck
+	return err
+}
+
 // addShard inserts a shard into the ShardedBAMWriter.  The
 // ShardedBAMWriter writes the shards out in sequential order by
 // shardNum, so if shard is not the next shard to be written, then
@@ -209,27 +316,120 @@ func (bw *ShardedBAMWriter) writeShards() {
 			break
 		}
 		shard := entry.(*shardedBAMBuffer)
-		_, err = shard.buf.WriteTo(bw.w)
+		if bw.indexing() {
+			if err = bw.indexShard(shard); err != nil {
+				bw.err = err
+				bw.queue.Close(err) // nolint: errcheck
+				return
+			}
+		}
+		n, err := shard.buf.WriteTo(bw.w)
 		if err != nil {
 			bw.err = err
 			bw.queue.Close(err) // nolint: errcheck
 			return
 		}
+		bw.offset += uint64(n)
+	}
+}
+
+// indexing returns true if bw builds an index.
+func (bw *ShardedBAMWriter) indexing() bool {
+	return bw.index != nil || bw.gindex != nil
+}
+
+// indexShard adds the records of the shard to the indexes. The shard is about
+// to be written at bw.offset.
+func (bw *ShardedBAMWriter) indexShard(shard *shardedBAMBuffer) error {
+	base := bw.offset << 16
+	for _, e := range shard.index {
+		e.beginVOffset += base
+		e.endVOffset += base
+		if bw.index != nil {
+			if err := bw.index.add(e); err != nil {
+				return err
+			}
+		}
+		if bw.gindex != nil {
+			if err := bw.gindex.add(int32(e.refID), int32(e.pos), e.beginVOffset); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
 }
 
 // Close the bam file.  This should be called only after all shards
-// have been added with WriteShard.  Returns an error of failure.
+// have been added with WriteShard.  Returns an error of failure.  The
+// .gbai index, if any, is closed even on failure.
 func (bw *ShardedBAMWriter) Close() error {
+	var e errors.Once
 	err := bw.queue.Close(nil)
 	bw.waitGroup.Wait()
-	if bw.err != nil {
-		return bw.err
+	e.Set(bw.err)
+	e.Set(err)
+	if e.Err() == nil {
+		_, err = bw.w.Write(magicBlock)
+		e.Set(err)
+	}
+	if bw.index != nil && e.Err() == nil {
+		e.Set(bw.index.Write(bw.opts.Index))
 	}
+	if bw.gindex != nil {
+		e.Set(bw.gindex.close())
+	}
+	return e.Err()
+}
+
+// WriteShardedBAM creates a BAM file "path" with the given header, and writes
+// the records of numShards shards to it, in the order of the shard indexes.
+// It calls writeShard for each shard index in [0, numShards), on up to
+// "parallelism" shards concurrently; writeShard must pass the records of the
+// shard to "add", in the order in which they appear in the file. If
+// parallelism <= 0, runtime.NumCPU() is used.
+func WriteShardedBAM(path string, header *sam.Header, numShards, parallelism int,
+	writeShard func(shardIdx int, add func(r *sam.Record) error) error) error {
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	ctx := vcontext.Background()
+	out, err := file.Create(ctx, path)
 	if err != nil {
 		return err
 	}
-
-	_, err = bw.w.Write(magicBlock)
-	return err
+	w, err := NewShardedBAMWriter(out.Writer(ctx), gzip.DefaultCompression, parallelism*4, header)
+	if err != nil {
+		out.Discard(ctx) // nolint: errcheck
+		return err
+	}
+	var (
+		wg sync.WaitGroup
+		e  errors.Once
+	)
+	// The shards are sent in order, so that ShardedBAMWriter does not need to
+	// buffer too many of them.
+	reqCh := make(chan int, numShards)
+	for i := 0; i < numShards; i++ {
+		reqCh <- i
+	}
+	close(reqCh)
+	for wi := 0; wi < parallelism; wi++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := w.GetCompressor()
+			for shardIdx := range reqCh {
+				if err := c.StartShard(shardIdx); err != nil {
+					e.Set(err)
+					break
+				}
+				e.Set(writeShard(shardIdx, c.AddRecord))
+				e.Set(c.CloseShard())
+			}
+		}()
+	}
+	wg.Wait()
+	e.Set(w.Close())
+	e.Set(out.Close(ctx))
+	return e.Err()
 }
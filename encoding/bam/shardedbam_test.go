@@ -3,7 +3,9 @@ package bam_test
 import (
 	"bytes"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -133,6 +135,46 @@ func TestShardedBAMSmall(t *testing.T) {
 	writeAndVerify(t, header, records, 2, 3, false)
 }
 
+func TestWriteShardedBAM(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	assert.NoError(t, err)
+	var records []*sam.Record
+	for i := 0; i < 100; i++ {
+		records = append(records, &sam.Record{Name: fmt.Sprintf("r%d", i), Ref: chr1, Pos: i * 10, MatePos: -1})
+	}
+	const numShards = 7
+	shardRecords := func(shardIdx int) []*sam.Record {
+		return records[shardIdx*len(records)/numShards : (shardIdx+1)*len(records)/numShards]
+	}
+	path := filepath.Join(tempDir, "test.bam")
+	assert.NoError(t, gbam.WriteShardedBAM(path, header, numShards, 3,
+		func(shardIdx int, add func(r *sam.Record) error) error {
+			for _, r := range shardRecords(shardIdx) {
+				if err := add(r); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	verifyBAM(t, records, bytes.NewBuffer(data))
+
+	// An error from one shard is returned.
+	err = gbam.WriteShardedBAM(path, header, numShards, 3,
+		func(shardIdx int, add func(r *sam.Record) error) error {
+			if shardIdx == 4 {
+				return fmt.Errorf("shard %d failed", shardIdx)
+			}
+			return nil
+		})
+	expect.Regexp(t, err, "shard 4 failed")
+}
+
 func TestShardedBAMLarge(t *testing.T) {
 	filename := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
 	f, err := os.Open(filename)
@@ -153,6 +195,105 @@ func TestShardedBAMLarge(t *testing.T) {
 	writeAndVerify(t, reader.Header(), records, 3, 6, false)
 }
 
+func TestShardedBAMGIndex(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	assert.NoError(t, err)
+	records := newSortedRecords([]*sam.Reference{chr1}, 20000, 100)
+	var serialized bytes.Buffer
+	for _, r := range records {
+		assert.NoError(t, bam.Marshal(r, &serialized))
+	}
+
+	// Add the records one by one, and as a block of serialized records.
+	for _, addSerialized := range []bool{false, true} {
+		var bamBuf, indexBuf, gindexBuf bytes.Buffer
+		w, err := gbam.NewShardedBAMWriterWithIndex(&bamBuf, gzip.DefaultCompression, 10, header,
+			gbam.ShardedBAMIndexOpts{Index: &indexBuf, GIndex: &gindexBuf, GIndexByteInterval: 4096})
+		assert.NoError(t, err)
+		c := w.GetCompressor()
+		assert.NoError(t, c.StartShard(0))
+		if addSerialized {
+			assert.NoError(t, c.AddSerializedRecords(serialized.Bytes()))
+		} else {
+			for _, r := range records {
+				assert.NoError(t, c.AddRecord(r))
+			}
+		}
+		assert.NoError(t, c.CloseShard())
+		assert.NoError(t, w.Close())
+		reader, err := bam.NewReader(bytes.NewReader(bamBuf.Bytes()), 1)
+		assert.NoError(t, err)
+		for i := 0; ; i++ {
+			r, err := reader.Read()
+			if err == io.EOF {
+				expect.EQ(t, i, len(records))
+				break
+			}
+			assert.NoError(t, err)
+			expect.EQ(t, r.String(), records[i].String())
+		}
+
+		// The indexes are the same as those built by reading the BAM file.
+		var expected bytes.Buffer
+		assert.NoError(t, gbam.WriteGIndex(&expected, bytes.NewReader(bamBuf.Bytes()), 4096, 1))
+		expectedGIndex, err := gbam.ReadGIndex(&expected)
+		assert.NoError(t, err)
+		gindex, err := gbam.ReadGIndex(&gindexBuf)
+		assert.NoError(t, err)
+		expect.True(t, len(*gindex) > 10, "entries: %d", len(*gindex))
+		expect.EQ(t, *gindex, *expectedGIndex)
+
+		expected.Reset()
+		assert.NoError(t, gbam.WriteIndex(&expected, bytes.NewReader(bamBuf.Bytes()), gbam.BAIFormat, 1))
+		expect.EQ(t, indexBuf.Bytes(), expected.Bytes())
+	}
+}
+
+// errWriter is an io.Writer that always fails.
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, fmt.Errorf("write failed") }
+
+func TestShardedBAMWriterErrors(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	assert.NoError(t, err)
+	records := newSortedRecords([]*sam.Reference{chr1}, 1000, 100)
+
+	// The .gbai index is complete even if writing the .bai index fails.
+	var bamBuf, gindexBuf bytes.Buffer
+	w, err := gbam.NewShardedBAMWriterWithIndex(&bamBuf, gzip.DefaultCompression, 10, header,
+		gbam.ShardedBAMIndexOpts{Index: errWriter{}, GIndex: &gindexBuf})
+	assert.NoError(t, err)
+	c := w.GetCompressor()
+	assert.NoError(t, c.StartShard(0))
+	for _, r := range records {
+		assert.NoError(t, c.AddRecord(r))
+	}
+	assert.NoError(t, c.CloseShard())
+	expect.Regexp(t, w.Close(), "write failed")
+	gindex, err := gbam.ReadGIndex(&gindexBuf)
+	assert.NoError(t, err)
+	expect.True(t, len(*gindex) > 0)
+
+	// When the output cannot be written, the shards are rejected instead of
+	// filling up the queue.
+	w, err = gbam.NewShardedBAMWriter(errWriter{}, gzip.DefaultCompression, 2, header)
+	assert.NoError(t, err)
+	c = w.GetCompressor()
+	var shardErr error
+	for i := 0; i < 10 && shardErr == nil; i++ {
+		assert.NoError(t, c.StartShard(i))
+		assert.NoError(t, c.AddRecord(records[i]))
+		shardErr = c.CloseShard()
+	}
+	expect.Regexp(t, shardErr, "write failed")
+	expect.Regexp(t, w.Close(), "write failed")
+}
+
 func processShards(b *testing.B, provider bamprovider.Provider, worker int, channel chan gbam.Shard,
 	shardedwriter *gbam.ShardedBAMWriter, biogoout chan []*sam.Record) {
 
@@ -0,0 +1,962 @@
+// Package bamfilter parses and evaluates filter expressions, which define
+// boolean conditions on sam.Records. The syntax is very similar to sambamba's:
+//
+//	https://github.com/biod/sambamba/wiki/%5Bsambamba-view%5D-Filter-expression-syntax.
+//
+// Example:
+//
+//	expr, err := bamfilter.Parse(`mapping_quality >= 60 && tag("NM") <= 3`)
+//	if err != nil {
+//	  ...
+//	}
+//	for iter.Scan() {
+//	  if expr.Evaluate(iter.Record()) {
+//	    ...
+//	  }
+//	}
+package bamfilter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// Help describes the syntax of filter expressions. It is suitable for the
+// help message of a commandline flag.
+const Help = `Filter expression defines a boolean condition on a single record.
+
+EXAMPLES:
+   mapping_quality >= 60 && sequence_length < 150
+   (paired && first_of_pair) || unmapped
+   re(ref_name, "^name:[0-9]+$")
+   tag("NM") > 3 || has_tag("SA")
+   cigar_count('S') > 0 && mean_base_quality < 20.5
+   re(sequence, "^(CA)+") && position + sequence_length > 1000
+
+SYNTAX:
+
+  Expressions are parsed using the Go parser. The operator precedence rules
+  follow Go's.
+
+  expr = intliteral | floatliteral | stringliteral
+       re(expr, regexp) |  // Partial regex match.
+       binary_op | equality_op
+       logical_op | arith_op
+       (expr) |
+       symbol | function
+
+  # Args to a binary op can be numbers or strings.
+  # The two args must be of the same type, but an integer can be compared
+  # with a float.
+  binary_op = expr > expr | expr >= expr | expr < expr | expr <= expr
+
+  # Args to an equality op can be numbers, strings, or bools.
+  # The two args must be of the same type.
+  equality_op = expr == expr |
+        expr != expr
+
+  logical_op = expr && expr |
+        expr || expr |
+        !expr
+
+  # Args to an arithmetic op must be numbers. The result is an integer if
+  # both args are integers, else it is a float. The args to % must be integers.
+  arith_op = expr + expr | expr - expr | expr * expr | expr / expr |
+        expr % expr | -expr
+
+  // The following expressions extract a field value from a record.
+  symbol = string_field | int_field | float_field | boolean_flag
+
+  string_field = ref_name |  // sam.Record.Ref.Name()
+       mate_ref_name |       // sam.Record.MateRef.Name()
+       rec_name |            // sam.Record.Name
+       cigar |               // sam.Record.Cigar, e.g., "10S90M"
+       sequence              // sam.Record.Seq, e.g., "ACGT"
+
+  int_field = ref_id |  // sam.Record.Ref.ID()
+       position |       // sam.Record.Pos
+       mate_ref_id |    // sam.Record.MateRef.ID()
+       mate_position |  // sam.Record.MatePos
+       sequence_length |  // sam.Record.Seq.Length
+       mapping_quality |  // sam.Record.MapQ
+       template_length |  // sam.Record.TempLen
+       min_base_quality   // The min of sam.Record.Qual
+
+  float_field = mean_base_quality  // The mean of sam.Record.Qual
+
+  // The following expressions extracts values from sam.Record.Flags.
+  booolean_flag = paired | proper_pair | unmapped | mate_is_unmapped |
+       is_reverse_strand | mate_is_reverse_strand |
+       first_of_pair | second_of_pair |  // R1 or R2
+       secondary_alignment| failed_quality_control| duplicate | supplementary |
+       chimeric
+
+  Note: flag 'chimeric' is shorthand for (paired && !unmapped && !made_unmapped && (ref_id != mate_ref_id))
+
+  function = tag(tagname) |   // The value of an aux field, e.g., tag("NM")
+       has_tag(tagname) |     // True iff the record has the aux field.
+       cigar_count(cigarop) | // The number of cigar operations of the type.
+       cigar_length(cigarop)  // The total length of the cigar operations of the type.
+
+  tagname is a two-character string literal. tag() yields an integer, a float,
+  or a string depending on the type of the aux field. Character ('A') and hex
+  ('H') fields are strings. Array ('B') fields are not supported.
+
+  cigarop is one of "MIDNSHP=X", as a string or a character literal, e.g., 'S'.
+
+  Some values may be missing: tag() of a field that the record does not have,
+  the base qualities of a record without quality scores, and the result of
+  an integer division by zero. A comparison involving a missing value, or
+  between values whose types turn out to differ, is false.
+
+  intliteral is 0, 1, 0x10, etc.
+  floatliteral is 1.5, 1e-3, etc.
+  stringliteral is "foo", "文字", etc. It supports all golang string escape sequences.
+
+`
+
+// nodeType defines the type of Expr node.
+type nodeType int
+
+const (
+	nodeInvalid    nodeType = iota
+	nodeIntConst            // integer literal
+	nodeFloatConst          // float literal
+	nodeStrConst            // string literal
+	nodeNOT                 // !
+	nodeLAND                // &&
+	nodeLOR                 // ||
+	nodeEQL                 // ==
+	nodeNEQ                 // !=
+	nodeGEQ                 // >=
+	nodeLEQ                 // <=
+	nodeLSS                 // <
+	nodeGTR                 // >
+	nodeNeg                 // unary -
+	nodeAdd                 // +
+	nodeSub                 // -
+	nodeMul                 // *
+	nodeQuo                 // /
+	nodeRem                 // %
+	nodeRegex               // regex match
+
+	// Field extractors.
+	nodeRecName   // sam.Record.Name
+	nodeRefName   // sam.Record.Ref.Name()
+	nodeRefID     // sam.Record.Ref.ID()
+	nodePos       // sam.Record.Pos
+	nodeSeqLength // sam.Record.Seq.Length
+	nodeMateRefName
+	nodeMateRefID
+	nodeMatePos
+	nodeMapq     // sam.Record.MapQ
+	nodeTempLen  // sam.Record.TempLen
+	nodeCigar    // sam.Record.Cigar.String()
+	nodeSeq      // sam.Record.Seq.Expand()
+	nodeMeanQual // mean of sam.Record.Qual
+	nodeMinQual  // min of sam.Record.Qual
+
+	// Functions.
+	nodeTag         // value of the aux field
+	nodeHasTag      // existence of the aux field
+	nodeCigarCount  // number of the cigar ops of a type
+	nodeCigarLength // total length of the cigar ops of a type
+
+	// Predicates on sam.Record.Flags bits.
+	nodePaired
+	nodeProperPair
+	nodeUnmapped
+	nodeMateUnmapped
+	nodeReverse
+	nodeMateReverse
+	nodeRead1
+	nodeRead2
+	nodeSecondary
+	nodeQCFail
+	nodeDuplicate
+	nodeSupplementary
+	nodeChimeric
+)
+
+type valueType int
+
+const (
+	valueTypeInt valueType = iota
+	valueTypeStr
+	valueTypeBool
+	valueTypeFloat
+	// valueTypeAny is the static type of an expression whose type is known
+	// only when evaluated, e.g., tag("XX").
+	valueTypeAny
+	// valueTypeMissing is the type of a missing value, e.g., tag("XX") of a
+	// record that does not have the XX field. It is never a static type.
+	valueTypeMissing
+)
+
+// Result of evaluating an exprNode.
+type exprValue struct {
+	vtype      valueType
+	intValue   int64
+	floatValue float64
+	strValue   string
+	boolValue  bool
+}
+
+// Expr is a parsed filter expression. It is thread safe.
+type Expr struct {
+	ntype      nodeType
+	vtype      valueType
+	x, y       *Expr           // Used by unary or binary ops.
+	intConst   int64           // set if ntype==nodeIntConst
+	floatConst float64         // set if ntype==nodeFloatConst
+	strConst   string          // set if ntype==nodeStrConst
+	regexp     *regexp.Regexp  // set if ntype==nodeRegex
+	tag        sam.Tag         // set if ntype is nodeTag or nodeHasTag
+	cigarOp    sam.CigarOpType // set if ntype is nodeCigarCount or nodeCigarLength
+}
+
+type exprParser struct {
+	err error
+}
+
+func doassert(cond bool, expr exprValue) {
+	if !cond {
+		log.Panicf("Broken expr: %+v", expr)
+	}
+}
+
+func boolValue(v bool) exprValue {
+	return exprValue{vtype: valueTypeBool, boolValue: v}
+}
+
+func intValue(v int64) exprValue {
+	return exprValue{vtype: valueTypeInt, intValue: v}
+}
+
+func floatValue(v float64) exprValue {
+	return exprValue{vtype: valueTypeFloat, floatValue: v}
+}
+
+func strValue(v string) exprValue {
+	return exprValue{vtype: valueTypeStr, strValue: v}
+}
+
+var missingValue = exprValue{vtype: valueTypeMissing}
+
+// isNumber checks if the value type is int or float.
+func isNumber(vtype valueType) bool {
+	return vtype == valueTypeInt || vtype == valueTypeFloat
+}
+
+// float returns the value of a number as a float.
+func (v exprValue) float() float64 {
+	if v.vtype == valueTypeInt {
+		return float64(v.intValue)
+	}
+	return v.floatValue
+}
+
+// auxValue converts an aux field to a value. It returns missingValue if the
+// field is nil or an array.
+func auxValue(aux sam.Aux) exprValue {
+	if aux == nil {
+		return missingValue
+	}
+	switch aux.Type() {
+	case 'A':
+		return strValue(string(aux[3:4]))
+	case 'B':
+		return missingValue
+	}
+	switch v := aux.Value().(type) {
+	case int8:
+		return intValue(int64(v))
+	case uint8:
+		return intValue(int64(v))
+	case int16:
+		return intValue(int64(v))
+	case uint16:
+		return intValue(int64(v))
+	case int32:
+		return intValue(int64(v))
+	case uint32:
+		return intValue(int64(v))
+	case float32:
+		return floatValue(float64(v))
+	case string:
+		return strValue(v)
+	case []byte:
+		return strValue(string(v))
+	}
+	return missingValue
+}
+
+// baseQualities returns the base qualities of the record, or nil if the record
+// has none.
+func baseQualities(rec *sam.Record) []byte {
+	if len(rec.Qual) == 0 || rec.Qual[0] == 0xff {
+		return nil
+	}
+	return rec.Qual
+}
+
+// compare evaluates a binary or an equality op. It returns false if either
+// value is missing, or if the values are of different types.
+func compare(op nodeType, x, y exprValue) bool {
+	switch {
+	case x.vtype == valueTypeInt && y.vtype == valueTypeInt:
+		switch op {
+		case nodeGEQ:
+			return x.intValue >= y.intValue
+		case nodeLEQ:
+			return x.intValue <= y.intValue
+		case nodeLSS:
+			return x.intValue < y.intValue
+		case nodeGTR:
+			return x.intValue > y.intValue
+		case nodeEQL:
+			return x.intValue == y.intValue
+		case nodeNEQ:
+			return x.intValue != y.intValue
+		}
+	case isNumber(x.vtype) && isNumber(y.vtype):
+		xf, yf := x.float(), y.float()
+		switch op {
+		case nodeGEQ:
+			return xf >= yf
+		case nodeLEQ:
+			return xf <= yf
+		case nodeLSS:
+			return xf < yf
+		case nodeGTR:
+			return xf > yf
+		case nodeEQL:
+			return xf == yf
+		case nodeNEQ:
+			return xf != yf
+		}
+	case x.vtype == valueTypeStr && y.vtype == valueTypeStr:
+		switch op {
+		case nodeGEQ:
+			return x.strValue >= y.strValue
+		case nodeLEQ:
+			return x.strValue <= y.strValue
+		case nodeLSS:
+			return x.strValue < y.strValue
+		case nodeGTR:
+			return x.strValue > y.strValue
+		case nodeEQL:
+			return x.strValue == y.strValue
+		case nodeNEQ:
+			return x.strValue != y.strValue
+		}
+	case x.vtype == valueTypeBool && y.vtype == valueTypeBool:
+		switch op {
+		case nodeEQL:
+			return x.boolValue == y.boolValue
+		case nodeNEQ:
+			return x.boolValue != y.boolValue
+		}
+		log.Panicf("Illegal type for op %v: %v, %v", op, x, y)
+	}
+	return false
+}
+
+// arith evaluates an arithmetic op. It returns missingValue if either value
+// is missing or not a number, or on an integer division by zero.
+func arith(op nodeType, x, y exprValue) exprValue {
+	if x.vtype == valueTypeInt && y.vtype == valueTypeInt {
+		switch op {
+		case nodeAdd:
+			return intValue(x.intValue + y.intValue)
+		case nodeSub:
+			return intValue(x.intValue - y.intValue)
+		case nodeMul:
+			return intValue(x.intValue * y.intValue)
+		case nodeQuo, nodeRem:
+			if y.intValue == 0 {
+				return missingValue
+			}
+			if op == nodeQuo {
+				return intValue(x.intValue / y.intValue)
+			}
+			return intValue(x.intValue % y.intValue)
+		}
+	}
+	if !isNumber(x.vtype) || !isNumber(y.vtype) {
+		return missingValue
+	}
+	switch op {
+	case nodeAdd:
+		return floatValue(x.float() + y.float())
+	case nodeSub:
+		return floatValue(x.float() - y.float())
+	case nodeMul:
+		return floatValue(x.float() * y.float())
+	case nodeQuo:
+		return floatValue(x.float() / y.float())
+	}
+	// % of a float, which can happen only with tag().
+	return missingValue
+}
+
+func (expr *Expr) eval(rec *sam.Record) exprValue {
+	switch expr.ntype {
+	case nodeIntConst:
+		return intValue(expr.intConst)
+	case nodeFloatConst:
+		return floatValue(expr.floatConst)
+	case nodeStrConst:
+		return strValue(expr.strConst)
+	case nodeRegex:
+		x := expr.x.eval(rec)
+		if x.vtype != valueTypeStr {
+			doassert(expr.x.vtype == valueTypeAny, x)
+			return boolValue(false)
+		}
+		return boolValue(expr.regexp.MatchString(x.strValue))
+	case nodeRecName:
+		return strValue(rec.Name)
+	case nodeRefName:
+		return strValue(rec.Ref.Name())
+	case nodeRefID:
+		return intValue(int64(rec.Ref.ID()))
+	case nodePos:
+		return intValue(int64(rec.Pos))
+	case nodeSeqLength:
+		return intValue(int64(rec.Seq.Length))
+	case nodeMateRefName:
+		return strValue(rec.MateRef.Name())
+	case nodeMateRefID:
+		return intValue(int64(rec.MateRef.ID()))
+	case nodeMatePos:
+		return intValue(int64(rec.MatePos))
+	case nodeMapq:
+		return intValue(int64(rec.MapQ))
+	case nodeTempLen:
+		return intValue(int64(rec.TempLen))
+	case nodeCigar:
+		return strValue(rec.Cigar.String())
+	case nodeSeq:
+		return strValue(string(rec.Seq.Expand()))
+	case nodeMeanQual:
+		qual := baseQualities(rec)
+		if qual == nil {
+			return missingValue
+		}
+		sum := 0
+		for _, q := range qual {
+			sum += int(q)
+		}
+		return floatValue(float64(sum) / float64(len(qual)))
+	case nodeMinQual:
+		qual := baseQualities(rec)
+		if qual == nil {
+			return missingValue
+		}
+		min := qual[0]
+		for _, q := range qual[1:] {
+			if q < min {
+				min = q
+			}
+		}
+		return intValue(int64(min))
+	case nodeTag:
+		return auxValue(rec.AuxFields.Get(expr.tag))
+	case nodeHasTag:
+		return boolValue(rec.AuxFields.Get(expr.tag) != nil)
+	case nodeCigarCount, nodeCigarLength:
+		n := 0
+		for _, op := range rec.Cigar {
+			if op.Type() != expr.cigarOp {
+				continue
+			}
+			if expr.ntype == nodeCigarCount {
+				n++
+			} else {
+				n += op.Len()
+			}
+		}
+		return intValue(int64(n))
+	case nodeReverse:
+		return boolValue((rec.Flags & sam.Reverse) != 0)
+	case nodeMateReverse:
+		return boolValue((rec.Flags & sam.MateReverse) != 0)
+	case nodePaired:
+		return boolValue((rec.Flags & sam.Paired) != 0)
+	case nodeProperPair:
+		return boolValue((rec.Flags & sam.ProperPair) != 0)
+	case nodeUnmapped:
+		return boolValue((rec.Flags & sam.Unmapped) != 0)
+	case nodeMateUnmapped:
+		return boolValue((rec.Flags & sam.MateUnmapped) != 0)
+	case nodeRead1:
+		return boolValue((rec.Flags & sam.Read1) != 0)
+	case nodeRead2:
+		return boolValue((rec.Flags & sam.Read2) != 0)
+	case nodeSecondary:
+		return boolValue((rec.Flags & sam.Secondary) != 0)
+	case nodeQCFail:
+		return boolValue((rec.Flags & sam.QCFail) != 0)
+	case nodeDuplicate:
+		return boolValue((rec.Flags & sam.Duplicate) != 0)
+	case nodeSupplementary:
+		return boolValue((rec.Flags & sam.Supplementary) != 0)
+	case nodeChimeric:
+		return boolValue((rec.Flags&sam.Paired) != 0 &&
+			(rec.Flags&sam.Unmapped) == 0 &&
+			(rec.Flags&sam.MateUnmapped) == 0 &&
+			(rec.Ref.ID() != rec.MateRef.ID()))
+	case nodeNOT:
+		x := expr.x.eval(rec)
+		doassert(x.vtype == valueTypeBool, x)
+		return boolValue(!x.boolValue)
+	case nodeLAND, nodeLOR:
+		x := expr.x.eval(rec)
+		doassert(x.vtype == valueTypeBool, x)
+		// Short-circuit, so that the costly fields such as sequence are
+		// extracted only when needed.
+		if expr.ntype == nodeLAND && !x.boolValue {
+			return boolValue(false)
+		}
+		if expr.ntype == nodeLOR && x.boolValue {
+			return boolValue(true)
+		}
+		y := expr.y.eval(rec)
+		doassert(y.vtype == valueTypeBool, y)
+		return boolValue(y.boolValue)
+	case nodeGEQ, nodeLEQ, nodeLSS, nodeGTR, nodeEQL, nodeNEQ:
+		return boolValue(compare(expr.ntype, expr.x.eval(rec), expr.y.eval(rec)))
+	case nodeNeg:
+		x := expr.x.eval(rec)
+		switch x.vtype {
+		case valueTypeInt:
+			return intValue(-x.intValue)
+		case valueTypeFloat:
+			return floatValue(-x.floatValue)
+		}
+		return missingValue
+	case nodeAdd, nodeSub, nodeMul, nodeQuo, nodeRem:
+		return arith(expr.ntype, expr.x.eval(rec), expr.y.eval(rec))
+	}
+	log.Panicf("Unknown expr: %+v", expr)
+	return exprValue{}
+}
+
+func (p *exprParser) setError(err error) {
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *exprParser) doassert(cond bool, message string, node interface{}) {
+	if !cond {
+		p.err = errors.New(message + ":" + astDebugString(node))
+	}
+}
+
+// isNumberType checks if an expression of the static type can yield a
+// number.
+func isNumberType(vtype valueType) bool {
+	return isNumber(vtype) || vtype == valueTypeAny
+}
+
+// comparableTypes checks if expressions of the static types can be compared.
+// If equality is false, the two types must be ordered.
+func comparableTypes(x, y valueType, equality bool) bool {
+	switch {
+	case x == valueTypeAny || y == valueTypeAny:
+		return x != valueTypeBool && y != valueTypeBool
+	case isNumber(x) && isNumber(y):
+		return true
+	case x == valueTypeStr:
+		return y == valueTypeStr
+	case x == valueTypeBool:
+		return equality && y == valueTypeBool
+	}
+	return false
+}
+
+// arithType computes the static type of an arithmetic op.
+func arithType(x, y valueType) valueType {
+	switch {
+	case x == valueTypeFloat || y == valueTypeFloat:
+		return valueTypeFloat
+	case x == valueTypeInt && y == valueTypeInt:
+		return valueTypeInt
+	}
+	return valueTypeAny
+}
+
+// parseStrArg parses the sole arg of a function call, which must be a string
+// or a character literal.
+func (p *exprParser) parseStrArg(fun string, e *ast.CallExpr) string {
+	if len(e.Args) != 1 {
+		p.setError(fmt.Errorf("Expect one arg for %s(), but found %v", fun, astDebugString(e)))
+		return ""
+	}
+	x := p.parse(e.Args[0])
+	if p.err != nil {
+		return ""
+	}
+	p.doassert(x.ntype == nodeStrConst, "Operand for "+fun+"() must be a string literal", e)
+	return x.strConst
+}
+
+func (p *exprParser) parse(node interface{}) *Expr {
+	switch e := node.(type) {
+	case *ast.ParenExpr:
+		return p.parse(e.X)
+	case *ast.CallExpr:
+		fun, ok := e.Fun.(*ast.Ident)
+		if !ok {
+			p.setError(fmt.Errorf("Expect ident, got %v", astDebugString(e.Fun)))
+			return nil
+		}
+		switch fun.Name {
+		case "re":
+			if len(e.Args) != 2 {
+				p.setError(fmt.Errorf("Expect two args for re(), but found %v",
+					astDebugString(node)))
+				return nil
+			}
+			x := p.parse(e.Args[0])
+			y := p.parse(e.Args[1])
+			if p.err != nil {
+				return nil
+			}
+			p.doassert((x.vtype == valueTypeStr || x.vtype == valueTypeAny) && y.ntype == nodeStrConst,
+				"Operands for re() must be a string and a string literal", node)
+			re, err := regexp.Compile(y.strConst)
+			p.setError(err)
+			return &Expr{
+				ntype:  nodeRegex,
+				vtype:  valueTypeBool,
+				x:      x,
+				regexp: re,
+			}
+		case "tag", "has_tag":
+			arg := p.parseStrArg(fun.Name, e)
+			if p.err != nil {
+				return nil
+			}
+			p.doassert(len(arg) == 2, "Aux tag name must have two characters", node)
+			expr := &Expr{ntype: nodeTag, vtype: valueTypeAny, tag: sam.NewTag(arg)}
+			if fun.Name == "has_tag" {
+				expr.ntype, expr.vtype = nodeHasTag, valueTypeBool
+			}
+			return expr
+		case "cigar_count", "cigar_length":
+			arg := p.parseStrArg(fun.Name, e)
+			if p.err != nil {
+				return nil
+			}
+			op := -1
+			if len(arg) == 1 {
+				op = strings.IndexByte("MIDNSHP=X", arg[0])
+			}
+			p.doassert(op >= 0, "Cigar op must be one of MIDNSHP=X", node)
+			expr := &Expr{ntype: nodeCigarCount, vtype: valueTypeInt, cigarOp: sam.CigarOpType(op)}
+			if fun.Name == "cigar_length" {
+				expr.ntype = nodeCigarLength
+			}
+			return expr
+		}
+	case *ast.UnaryExpr:
+		switch e.Op {
+		case token.NOT:
+			x := p.parse(e.X)
+			if p.err != nil {
+				return nil
+			}
+			p.doassert(x.vtype == valueTypeBool, "Operand for ! must be bool", node)
+			return &Expr{
+				ntype: nodeNOT,
+				vtype: valueTypeBool,
+				x:     x,
+			}
+		case token.SUB:
+			x := p.parse(e.X)
+			if p.err != nil {
+				return nil
+			}
+			p.doassert(isNumberType(x.vtype), "Operand for - must be a number", node)
+			return &Expr{
+				ntype: nodeNeg,
+				vtype: x.vtype,
+				x:     x,
+			}
+		}
+	case *ast.BinaryExpr:
+		ntype := nodeInvalid
+		vtype := valueTypeBool
+		x, y := p.parse(e.X), p.parse(e.Y)
+		if p.err != nil {
+			return nil
+		}
+		switch e.Op {
+		case token.LAND:
+			p.doassert(x.vtype == valueTypeBool && y.vtype == valueTypeBool, "Operands must be boolean", node)
+			ntype = nodeLAND
+		case token.LOR:
+			p.doassert(x.vtype == valueTypeBool && y.vtype == valueTypeBool, "Operands must be boolean", node)
+			ntype = nodeLOR
+		case token.NEQ, token.EQL:
+			p.doassert(comparableTypes(x.vtype, y.vtype, true), "Operands must of the same type", node)
+			ntype = nodeEQL
+			if e.Op == token.NEQ {
+				ntype = nodeNEQ
+			}
+		case token.GEQ, token.LEQ, token.LSS, token.GTR:
+			p.doassert(comparableTypes(x.vtype, y.vtype, false), "Wrong operand type", node)
+			ntype = nodeGEQ
+			if e.Op == token.LEQ {
+				ntype = nodeLEQ
+			} else if e.Op == token.LSS {
+				ntype = nodeLSS
+			} else if e.Op == token.GTR {
+				ntype = nodeGTR
+			}
+		case token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+			p.doassert(isNumberType(x.vtype) && isNumberType(y.vtype), "Operands must be numbers", node)
+			vtype = arithType(x.vtype, y.vtype)
+			switch e.Op {
+			case token.ADD:
+				ntype = nodeAdd
+			case token.SUB:
+				ntype = nodeSub
+			case token.MUL:
+				ntype = nodeMul
+			case token.QUO:
+				ntype = nodeQuo
+			case token.REM:
+				p.doassert(vtype != valueTypeFloat, "Operands for % must be integers", node)
+				ntype = nodeRem
+			}
+		default:
+			p.setError(fmt.Errorf("Unknown binary op: %v", astDebugString(node)))
+			return &Expr{}
+		}
+		return &Expr{
+			ntype: ntype,
+			vtype: vtype,
+			x:     x,
+			y:     y,
+		}
+	case *ast.BasicLit:
+		switch e.Kind {
+		case token.STRING, token.CHAR:
+			v, err := strconv.Unquote(e.Value)
+			p.setError(err)
+			return &Expr{
+				ntype:    nodeStrConst,
+				vtype:    valueTypeStr,
+				strConst: v,
+			}
+		case token.INT:
+			v, err := strconv.ParseInt(e.Value, 0, 64)
+			if err != nil {
+				p.err = err
+				v = -1
+			}
+			return &Expr{
+				ntype:    nodeIntConst,
+				vtype:    valueTypeInt,
+				intConst: v,
+			}
+		case token.FLOAT:
+			v, err := strconv.ParseFloat(e.Value, 64)
+			p.setError(err)
+			return &Expr{
+				ntype:      nodeFloatConst,
+				vtype:      valueTypeFloat,
+				floatConst: v,
+			}
+		}
+	case *ast.Ident:
+		switch e.Name {
+		case "ref_name":
+			return &Expr{ntype: nodeRefName, vtype: valueTypeStr}
+		case "mate_ref_name":
+			return &Expr{ntype: nodeMateRefName, vtype: valueTypeStr}
+		case "rec_name":
+			return &Expr{ntype: nodeRecName, vtype: valueTypeStr}
+		case "cigar":
+			return &Expr{ntype: nodeCigar, vtype: valueTypeStr}
+		case "sequence":
+			return &Expr{ntype: nodeSeq, vtype: valueTypeStr}
+		case "ref_id":
+			return &Expr{ntype: nodeRefID, vtype: valueTypeInt}
+		case "position":
+			return &Expr{ntype: nodePos, vtype: valueTypeInt}
+		case "mate_ref_id":
+			return &Expr{ntype: nodeMateRefID, vtype: valueTypeInt}
+		case "mate_position":
+			return &Expr{ntype: nodeMatePos, vtype: valueTypeInt}
+		case "sequence_length":
+			return &Expr{ntype: nodeSeqLength, vtype: valueTypeInt}
+		case "mapping_quality":
+			return &Expr{ntype: nodeMapq, vtype: valueTypeInt}
+		case "template_length":
+			return &Expr{ntype: nodeTempLen, vtype: valueTypeInt}
+		case "min_base_quality":
+			return &Expr{ntype: nodeMinQual, vtype: valueTypeInt}
+		case "mean_base_quality":
+			return &Expr{ntype: nodeMeanQual, vtype: valueTypeFloat}
+		case "paired":
+			return &Expr{ntype: nodePaired, vtype: valueTypeBool}
+		case "proper_pair":
+			return &Expr{ntype: nodeProperPair, vtype: valueTypeBool}
+		case "unmapped":
+			return &Expr{ntype: nodeUnmapped, vtype: valueTypeBool}
+		case "mate_is_unmapped":
+			return &Expr{ntype: nodeMateUnmapped, vtype: valueTypeBool}
+		case "is_reverse_strand":
+			return &Expr{ntype: nodeReverse, vtype: valueTypeBool}
+		case "mate_is_reverse_strand":
+			return &Expr{ntype: nodeMateReverse, vtype: valueTypeBool}
+		case "first_of_pair":
+			return &Expr{ntype: nodeRead1, vtype: valueTypeBool}
+		case "second_of_pair":
+			return &Expr{ntype: nodeRead2, vtype: valueTypeBool}
+		case "secondary_alignment":
+			return &Expr{ntype: nodeSecondary, vtype: valueTypeBool}
+		case "failed_quality_control":
+			return &Expr{ntype: nodeQCFail, vtype: valueTypeBool}
+		case "duplicate":
+			return &Expr{ntype: nodeDuplicate, vtype: valueTypeBool}
+		case "supplementary":
+			return &Expr{ntype: nodeSupplementary, vtype: valueTypeBool}
+		case "chimeric":
+			return &Expr{ntype: nodeChimeric, vtype: valueTypeBool}
+		}
+	}
+	p.setError(fmt.Errorf("Unknown expr type %v", astDebugString(node)))
+	return nil
+}
+
+// Pretty-print a golang AST object.
+func astDebugString(node interface{}) string {
+	out := bytes.Buffer{}
+	fset := token.NewFileSet()
+	ast.Fprint(&out, fset, node, nil)
+	return string(out.Bytes())
+}
+
+// Parse parses a filter expression. The syntax is described in Help.
+func Parse(str string) (*Expr, error) {
+	expr, err := parser.ParseExpr(str)
+	if err != nil {
+		return nil, err
+	}
+	p := exprParser{}
+	node := p.parse(expr)
+	if p.err != nil {
+		return nil, p.err
+	}
+	if node.vtype != valueTypeBool {
+		return nil, fmt.Errorf("Not a boolean expression: %v", astDebugString(expr))
+	}
+	return node, nil
+}
+
+// nodeFields lists the record fields read by each field extractor, function,
+// and flag predicate.
+var nodeFields = map[nodeType][]gbam.FieldType{
+	nodeRecName:       {gbam.FieldName},
+	nodeRefName:       {gbam.FieldCoord},
+	nodeRefID:         {gbam.FieldCoord},
+	nodePos:           {gbam.FieldCoord},
+	nodeSeqLength:     {gbam.FieldSeq},
+	nodeMateRefName:   {gbam.FieldMateRefID},
+	nodeMateRefID:     {gbam.FieldMateRefID},
+	nodeMatePos:       {gbam.FieldMatePos},
+	nodeMapq:          {gbam.FieldMapq},
+	nodeTempLen:       {gbam.FieldTempLen},
+	nodeCigar:         {gbam.FieldCigar},
+	nodeSeq:           {gbam.FieldSeq},
+	nodeMeanQual:      {gbam.FieldQual},
+	nodeMinQual:       {gbam.FieldQual},
+	nodeTag:           {gbam.FieldAux},
+	nodeHasTag:        {gbam.FieldAux},
+	nodeCigarCount:    {gbam.FieldCigar},
+	nodeCigarLength:   {gbam.FieldCigar},
+	nodePaired:        {gbam.FieldFlags},
+	nodeProperPair:    {gbam.FieldFlags},
+	nodeUnmapped:      {gbam.FieldFlags},
+	nodeMateUnmapped:  {gbam.FieldFlags},
+	nodeReverse:       {gbam.FieldFlags},
+	nodeMateReverse:   {gbam.FieldFlags},
+	nodeRead1:         {gbam.FieldFlags},
+	nodeRead2:         {gbam.FieldFlags},
+	nodeSecondary:     {gbam.FieldFlags},
+	nodeQCFail:        {gbam.FieldFlags},
+	nodeDuplicate:     {gbam.FieldFlags},
+	nodeSupplementary: {gbam.FieldFlags},
+	nodeChimeric:      {gbam.FieldFlags, gbam.FieldCoord, gbam.FieldMateRefID},
+}
+
+// walk calls cb for every node in the expression.
+func (expr *Expr) walk(cb func(*Expr)) {
+	cb(expr)
+	if expr.x != nil {
+		expr.x.walk(cb)
+	}
+	if expr.y != nil {
+		expr.y.walk(cb)
+	}
+}
+
+// Fields returns the record fields that the expression reads, in ascending
+// order. Evaluate yields the same result on records whose other fields are
+// dropped, e.g., via pam.ReadOpts.DropFields.
+func (expr *Expr) Fields() []gbam.FieldType {
+	var need [gbam.NumFields]bool
+	expr.walk(func(e *Expr) {
+		for _, f := range nodeFields[e.ntype] {
+			need[f] = true
+		}
+	})
+	var fields []gbam.FieldType
+	for f, ok := range need {
+		if ok {
+			fields = append(fields, gbam.FieldType(f))
+		}
+	}
+	return fields
+}
+
+// AuxTags returns the names of the aux tags that the expression reads, in
+// ascending order. Evaluate yields the same result on records whose other
+// tags are dropped, e.g., via pam.ReadOpts.AuxTags.
+func (expr *Expr) AuxTags() []string {
+	var tags []string
+	seen := map[sam.Tag]bool{}
+	expr.walk(func(e *Expr) {
+		if (e.ntype == nodeTag || e.ntype == nodeHasTag) && !seen[e.tag] {
+			seen[e.tag] = true
+			tags = append(tags, e.tag.String())
+		}
+	})
+	sort.Strings(tags)
+	return tags
+}
+
+// Evaluate checks if the record matches the expression condition.
+func (expr *Expr) Evaluate(rec *sam.Record) bool {
+	val := expr.eval(rec)
+	doassert(val.vtype == valueTypeBool, val)
+	return val.boolValue
+}
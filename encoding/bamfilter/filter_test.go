@@ -0,0 +1,196 @@
+package bamfilter
+
+import (
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func eval(t *testing.T, str string, r *sam.Record) bool {
+	expr, err := Parse(str)
+	require.NoError(t, err)
+	return expr.Evaluate(r)
+}
+
+func TestParser(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 10000, nil, nil)
+	require.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 10000, nil, nil)
+	require.NoError(t, err)
+	_, err = sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	require.NoError(t, err)
+
+	rec, err := sam.NewRecord("read1",
+		chr1,                             /*ref*/
+		chr2,                             /*materef*/
+		122 /*pos*/, 455 /*matepos*/, 20, /*templen*/
+		60, /*mapq*/
+		[]sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 4)}, /*cigar*/
+		[]byte("ACGT"),
+		[]byte{30, 31, 32, 33}, /*qual*/
+		nil /*aux*/)
+	require.NoError(t, err)
+	assert.True(t, eval(t, "mapping_quality == 0x3c", rec))
+	assert.True(t, eval(t, "(mapping_quality >= 60) && rec_name == \"read1\"", rec))
+	assert.False(t, eval(t, "(mapping_quality >= 61) && rec_name == \"read1\"", rec))
+	assert.True(t, eval(t, "(mapping_quality >= 61) || rec_name == \"read1\"", rec))
+	assert.True(t, eval(t, "ref_name == \"chr1\"", rec))
+	assert.True(t, eval(t, "re(ref_name, \"^ch.*1$\")", rec))
+	assert.True(t, eval(t, "re(ref_name, \"c\")", rec))
+	assert.False(t, eval(t, "re(ref_name, \"^chr$\")", rec))
+	assert.True(t, eval(t, "!re(ref_name, \"^chr$\")", rec))
+	assert.False(t, eval(t, "ref_name == \"chr2\"", rec))
+	assert.True(t, eval(t, "position == 122", rec))
+	assert.False(t, eval(t, "position != 122", rec))
+	assert.True(t, eval(t, "sequence_length == 4", rec))
+	assert.False(t, eval(t, "sequence_length < 4", rec))
+
+	assert.True(t, eval(t, "mate_ref_name >= \"chr1\"", rec))
+	assert.False(t, eval(t, "mate_ref_name < \"chr1\"", rec))
+	assert.True(t, eval(t, "mate_position >= 455", rec))
+	assert.False(t, eval(t, "mate_position < 455", rec))
+	assert.True(t, eval(t, "template_length == 20", rec))
+	assert.False(t, eval(t, "template_length != 20", rec))
+
+	rec.Flags = sam.Paired
+	assert.True(t, eval(t, "paired", rec))
+	assert.False(t, eval(t, "!paired", rec))
+
+	rec.Flags = sam.ProperPair | sam.Secondary | sam.Read1
+	assert.True(t, eval(t, "proper_pair && secondary_alignment", rec))
+	assert.True(t, eval(t, "proper_pair && first_of_pair", rec))
+	assert.False(t, eval(t, "proper_pair && second_of_pair", rec))
+}
+
+func TestExtendedSyntax(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 10000, nil, nil)
+	require.NoError(t, err)
+	_, err = sam.NewHeader(nil, []*sam.Reference{chr1})
+	require.NoError(t, err)
+	rec, err := sam.NewRecord("read1", chr1, nil, 100, -1, 0, 60,
+		[]sam.CigarOp{
+			sam.NewCigarOp(sam.CigarSoftClipped, 2),
+			sam.NewCigarOp(sam.CigarMatch, 4),
+			sam.NewCigarOp(sam.CigarSoftClipped, 1),
+		},
+		[]byte("CACAGTT"),
+		[]byte{30, 31, 32, 33, 34, 35, 36},
+		nil)
+	require.NoError(t, err)
+	for _, aux := range []struct {
+		tag   string
+		value interface{}
+	}{
+		{"NM", 4},
+		{"XF", float32(1.5)},
+		{"RG", "group1"},
+		{"XA", sam.ASCII('Q')},
+	} {
+		a, err := sam.NewAux(sam.NewTag(aux.tag), aux.value)
+		require.NoError(t, err)
+		rec.AuxFields = append(rec.AuxFields, a)
+	}
+
+	// Aux fields.
+	assert.True(t, eval(t, `tag("NM") > 3`, rec))
+	assert.False(t, eval(t, `tag("NM") > 4`, rec))
+	assert.True(t, eval(t, `tag("XF") == 1.5`, rec))
+	assert.True(t, eval(t, `tag("XF") < tag("NM")`, rec))
+	assert.True(t, eval(t, `tag("RG") == "group1"`, rec))
+	assert.True(t, eval(t, `re(tag("RG"), "^gr")`, rec))
+	assert.True(t, eval(t, `tag("XA") == "Q"`, rec))
+	assert.True(t, eval(t, `has_tag("NM")`, rec))
+	assert.False(t, eval(t, `has_tag("SA")`, rec))
+	// A comparison with a missing tag, or with a value of a different type, is
+	// false.
+	assert.False(t, eval(t, `tag("SA") == "x"`, rec))
+	assert.False(t, eval(t, `tag("SA") != "x"`, rec))
+	assert.True(t, eval(t, `!(tag("SA") == "x")`, rec))
+	assert.False(t, eval(t, `tag("RG") > 3`, rec))
+	assert.False(t, eval(t, `re(tag("NM"), "4")`, rec))
+
+	// Cigar. The sequence length includes the soft-clipped bases.
+	assert.True(t, eval(t, `cigar == "2S4M1S"`, rec))
+	assert.True(t, eval(t, `sequence_length == 7`, rec))
+	assert.True(t, eval(t, `cigar_count('S') == 2`, rec))
+	assert.True(t, eval(t, `cigar_length("S") == 3`, rec))
+	assert.True(t, eval(t, `cigar_count('I') == 0`, rec))
+
+	// Sequence and qualities.
+	assert.True(t, eval(t, `re(sequence, "^(CA)+GT")`, rec))
+	assert.False(t, eval(t, `re(sequence, "^(CA)+TT")`, rec))
+	assert.True(t, eval(t, `min_base_quality == 30`, rec))
+	assert.True(t, eval(t, `mean_base_quality == 33`, rec))
+	assert.True(t, eval(t, `mean_base_quality > 32.5`, rec))
+
+	// Arithmetic.
+	assert.True(t, eval(t, `position + sequence_length == 107`, rec))
+	assert.True(t, eval(t, `position - 2 * sequence_length == 86`, rec))
+	assert.True(t, eval(t, `(position - 2) * sequence_length == 686`, rec))
+	assert.True(t, eval(t, `position / 3 == 33`, rec))
+	assert.True(t, eval(t, `position % 3 == 1`, rec))
+	assert.True(t, eval(t, `position / 3.0 > 33.3`, rec))
+	assert.True(t, eval(t, `-position < -99`, rec))
+	assert.True(t, eval(t, `tag("NM") * 2 == 8`, rec))
+	assert.True(t, eval(t, `tag("XF") * 2 == 3`, rec))
+	// Integer division by zero yields a missing value.
+	assert.False(t, eval(t, `position / 0 == 0`, rec))
+	assert.False(t, eval(t, `position / 0 != 0`, rec))
+
+	// Missing base qualities.
+	rec.Qual = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	assert.False(t, eval(t, `mean_base_quality < 100`, rec))
+	assert.False(t, eval(t, `min_base_quality < 100`, rec))
+
+	// Bools can be compared for equality.
+	rec.Flags = sam.Paired
+	assert.True(t, eval(t, "paired != proper_pair", rec))
+}
+
+func TestParseError(t *testing.T) {
+	for _, str := range []string{
+		`mapping_quality`,
+		`tag("NM")`,
+		`tag("NMX") > 1`,
+		`tag(rec_name) > 1`,
+		`tag("NM", "XA") > 1`,
+		`cigar_count('Z') > 1`,
+		`cigar_count("MM") > 1`,
+		`re(ref_name, rec_name)`,
+		`rec_name + 1 > 1`,
+		`position % 1.5 == 1`,
+		`-rec_name == "x"`,
+		`rec_name == 1`,
+		`paired > proper_pair`,
+		`tag("NM") == paired`,
+		`unknown_field == 1`,
+	} {
+		_, err := Parse(str)
+		assert.Error(t, err, "expr=%s", str)
+	}
+}
+
+func TestFields(t *testing.T) {
+	for _, test := range []struct {
+		expr    string
+		fields  []gbam.FieldType
+		auxTags []string
+	}{
+		{"paired && mapping_quality > 10", []gbam.FieldType{gbam.FieldFlags, gbam.FieldMapq}, nil},
+		{"position == 10", []gbam.FieldType{gbam.FieldCoord}, nil},
+		{"chimeric", []gbam.FieldType{gbam.FieldCoord, gbam.FieldFlags, gbam.FieldMateRefID}, nil},
+		{"sequence_length > 10", []gbam.FieldType{gbam.FieldSeq}, nil},
+		{"sequence_length > 10 || cigar_count('S') > 0", []gbam.FieldType{gbam.FieldCigar, gbam.FieldSeq}, nil},
+		{`re(sequence, "A") && mean_base_quality > 10 && rec_name != "x"`,
+			[]gbam.FieldType{gbam.FieldName, gbam.FieldSeq, gbam.FieldQual}, nil},
+		{`tag("NM") > 1 || (has_tag("SA") && tag("NM") < 5)`, []gbam.FieldType{gbam.FieldAux}, []string{"NM", "SA"}},
+	} {
+		expr, err := Parse(test.expr)
+		require.NoError(t, err)
+		assert.Equal(t, test.fields, expr.Fields(), "expr=%s", test.expr)
+		assert.Equal(t, test.auxTags, expr.AuxTags(), "expr=%s", test.expr)
+	}
+}
@@ -12,7 +12,6 @@ import (
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/hts/sam"
-	"grail.com/bio/encoding/bam"
 )
 
 const (
@@ -36,7 +35,7 @@ type RecordProcessor interface {
 }
 
 type shardInfoUpdate struct {
-	shard           bam.Shard
+	shard           gbam.Shard
 	numStartPadding uint64 // number of reads in the start padding, including padding.
 	numReads        uint64 // number of reads in the actual shard.
 }
@@ -48,7 +47,7 @@ type shardInfoUpdate struct {
 // that includes information like number of records in each shard.
 // For an example of how to use GetDistantMates, see
 // ExampleResolvePairs() in distant_mates_test.go.
-func GetDistantMates(provider bamprovider.Provider, shardList []bam.Shard, opts *Opts,
+func GetDistantMates(provider bamprovider.Provider, shardList []gbam.Shard, opts *Opts,
 	createProcessor func() RecordProcessor) (distantMates *DistantMateTable, shardInfo *ShardInfo, returnErr error) {
 	log.Debug.Printf("scanning %d shards", len(shardList))
 	shardChannel := gbam.NewShardChannel(shardList)
@@ -142,7 +141,7 @@ func isDistantMate(shardInfo *ShardInfo, r *sam.Record) []int {
 	shards := []int{}
 	mateShard := shardInfo.getMateShard(r)
 	mateCoord := gbam.NewCoord(r.MateRef, r.MatePos, 0)
-	potentials := []bam.Shard{}
+	potentials := []gbam.Shard{}
 	for shardIdx := mateShard.ShardIdx; shardIdx >= 0; shardIdx-- {
 		info := shardInfo.GetInfoByIdx(shardIdx)
 		if info.Shard.CoordInShard(info.Shard.Padding, mateCoord) {
@@ -168,7 +167,7 @@ func isDistantMate(shardInfo *ShardInfo, r *sam.Record) []int {
 }
 
 func findDistantMates(provider bamprovider.Provider, worker int, shardInfo *ShardInfo,
-	opts *Opts, processor RecordProcessor, channel chan bam.Shard,
+	opts *Opts, processor RecordProcessor, channel chan gbam.Shard,
 	distantMates *DistantMateTable, collectionChannel chan interface{}) error {
 	for shard := range channel {
 		if shard.StartRef == nil {
@@ -207,7 +206,7 @@ func findDistantMates(provider bamprovider.Provider, worker int, shardInfo *Shar
 					log.Debug.Printf("Ignoring supplementary read %s", record.Name)
 				} else if (record.Flags & sam.Unmapped) != 0 {
 					log.Debug.Printf("Ignoring unmapped read %s", record.Name)
-				} else if (record.Flags & sam.MateUnmapped) != 0 {
+				} else if (record.Flags&sam.MateUnmapped) != 0 || record.MateRef == nil {
 					log.Debug.Printf("Ignoring singleton read %s", record.Name)
 				} else if mateShards := isDistantMate(shardInfo, record); len(mateShards) > 0 {
 					// The mate is in a different ref, or the mate's
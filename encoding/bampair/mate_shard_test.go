@@ -3,10 +3,10 @@ package bampair
 import (
 	"testing"
 
+	"github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/hts/sam"
 	"github.com/grailbio/testutil"
 	"github.com/stretchr/testify/assert"
-	"grail.com/bio/encoding/bam"
 )
 
 func createShardInfo() *ShardInfo {
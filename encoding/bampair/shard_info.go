@@ -6,7 +6,6 @@ import (
 	"github.com/biogo/store/llrb"
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/hts/sam"
-	"grail.com/bio/encoding/bam"
 )
 
 type key struct {
@@ -26,11 +25,11 @@ func (k key) Compare(c2 llrb.Comparable) int {
 
 // ShardInfoEntry contains handy information about a particular shard.
 type ShardInfoEntry struct {
-	Shard               bam.Shard // Shard is the bam.Shard object.
-	NumStartPadding     uint64    // NumStartPadding is the number of reads in the start padding.
-	NumReads            uint64    // NumReads is the number of reads in the actual shard.
-	PaddingStartFileIdx uint64    // PaddingStartFileIdx is the FileIdx of the first read in the start padding.
-	ShardStartFileIdx   uint64    // ShardStartFileIdx is the FileIdx of the first read in the shard (excluding the padding).
+	Shard               gbam.Shard // Shard is the gbam.Shard object.
+	NumStartPadding     uint64     // NumStartPadding is the number of reads in the start padding.
+	NumReads            uint64     // NumReads is the number of reads in the actual shard.
+	PaddingStartFileIdx uint64     // PaddingStartFileIdx is the FileIdx of the first read in the start padding.
+	ShardStartFileIdx   uint64     // ShardStartFileIdx is the FileIdx of the first read in the shard (excluding the padding).
 }
 
 // ShardInfo contains handy information about all shards, and is
@@ -47,7 +46,7 @@ func newShardInfo() *ShardInfo {
 	return &i
 }
 
-func (i *ShardInfo) add(shard *bam.Shard) {
+func (i *ShardInfo) add(shard *gbam.Shard) {
 	info := ShardInfoEntry{*shard, 0, 0, 0, 0}
 	e := key{shard.StartRef.ID(), shard.Start, &info}
 	i.byKey.Insert(e)
@@ -65,7 +64,7 @@ func (i *ShardInfo) getInfoByRecord(r *sam.Record) *ShardInfoEntry {
 }
 
 // GetInfoByShard returns the info for the given shard.
-func (i *ShardInfo) GetInfoByShard(shard *bam.Shard) *ShardInfoEntry {
+func (i *ShardInfo) GetInfoByShard(shard *gbam.Shard) *ShardInfoEntry {
 	k := key{shard.StartRef.ID(), shard.Start, nil}
 	c := i.byKey.Get(k)
 	if c != nil {
@@ -79,7 +78,7 @@ func (i *ShardInfo) GetInfoByIdx(shardIdx int) *ShardInfoEntry {
 	return i.byIndex[shardIdx]
 }
 
-func (i *ShardInfo) getMateShard(r *sam.Record) bam.Shard {
+func (i *ShardInfo) getMateShard(r *sam.Record) gbam.Shard {
 	k := key{r.MateRef.ID(), r.MatePos, nil}
 	c := i.byKey.Floor(k)
 	info := c.(key).info
@@ -89,7 +88,7 @@ func (i *ShardInfo) getMateShard(r *sam.Record) bam.Shard {
 	return info.Shard
 }
 
-func (i *ShardInfo) updateInfoByShard(shard *bam.Shard, numStartPadding, numReads uint64) {
+func (i *ShardInfo) updateInfoByShard(shard *gbam.Shard, numStartPadding, numReads uint64) {
 	info := i.GetInfoByShard(shard)
 	if info == nil {
 		panic(fmt.Sprintf("Could not find info for shard: %v", shard))
@@ -3,9 +3,9 @@ package bampair
 import (
 	"testing"
 
+	grailbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/hts/sam"
 	"github.com/stretchr/testify/assert"
-	grailbam "grail.com/bio/encoding/bam"
 )
 
 func newShard(ref *sam.Reference, start, end, padding, index int) *grailbam.Shard {
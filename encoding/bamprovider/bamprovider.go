@@ -23,6 +23,8 @@ const (
 	DefaultBytesPerShard = int64(128 << 20)
 	// DefaultMinBasesPerShard is the default value for GenerateShardsOpts.MinBasesPerShard
 	DefaultMinBasesPerShard = 10000
+	// DefaultBasesPerShard is the default value for GenerateShardsOpts.BasesPerShard
+	DefaultBasesPerShard = 100000
 )
 
 // BAMProvider implements Provider for BAM files.  Both BAM and the index
@@ -226,12 +228,23 @@ func (b *BAMProvider) allocateIterator() *bamIterator {
 	return &iter
 }
 
+// basesPerShard returns the shard length for the PositionBased strategy.
+func basesPerShard(opts GenerateShardsOpts) int {
+	if opts.BasesPerShard > 0 {
+		return opts.BasesPerShard
+	}
+	return DefaultBasesPerShard
+}
+
 // GenerateShards implements the Provider interface.
 func (b *BAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, error) {
 	header, err := b.GetHeader()
 	if err != nil {
 		return nil, err
 	}
+	if opts.Strategy == RegionBased {
+		return generateRegionShards(header, opts, b.regionBytes)
+	}
 	if opts.BytesPerShard <= 0 {
 		if opts.NumShards > 0 {
 			info, err := file.Stat(vcontext.Background(), b.Path)
@@ -252,7 +265,36 @@ func (b *BAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, err
 			b.Path, b.indexPath(), opts.BytesPerShard, opts.MinBasesPerShard, opts.Padding, opts.IncludeUnmapped)
 	}
 	return gbam.GetPositionBasedShards(
-		header, 100000, opts.Padding, opts.IncludeUnmapped)
+		header, basesPerShard(opts), opts.Padding, opts.IncludeUnmapped)
+}
+
+// regionBytes estimates the number of compressed bytes occupied by the records
+// in each region, using the BAM index.
+func (b *BAMProvider) regionBytes(regions []targetRegion) ([]int64, error) {
+	if err := b.readIndex(); err != nil {
+		return nil, err
+	}
+	sizes := make([]int64, len(regions))
+	for i, r := range regions {
+		if b.gindex != nil {
+			start := b.gindex.RecordOffset(int32(r.ref.ID()), int32(r.start), 0)
+			limit := b.gindex.RecordOffset(int32(r.ref.ID()), int32(r.end), 0)
+			sizes[i] = limit.File - start.File
+			continue
+		}
+		chunks, err := b.bindex.Chunks(r.ref, r.start, r.end)
+		if err == index.ErrInvalid {
+			// There are no reads in this region.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range chunks {
+			sizes[i] += c.End.File - c.Begin.File
+		}
+	}
+	return sizes, nil
 }
 
 // GetFileShards implements the Provider interface.
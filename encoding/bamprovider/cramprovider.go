@@ -0,0 +1,434 @@
+package bamprovider
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/cram"
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+// CRAMProvider implements Provider for CRAM files. Both the CRAM and the index
+// filenames are allowed to be S3 URLs.
+type CRAMProvider struct {
+	// Path of the *.cram file. Must be nonempty.
+	Path string
+	// Index is the pathname of the *.cram.crai file. If "", Path + ".crai".
+	Index string
+	// Reference is the reference the CRAM file was created with. It is needed
+	// to decode the sequences of mapped reads, unless the reference is embedded
+	// in the file.
+	Reference fasta.Fasta
+	err       errors.Once
+
+	mu        sync.Mutex
+	nActive   int
+	freeIters []*cramIterator
+
+	indexOnce sync.Once
+	index     []cram.IndexEntry
+
+	infoOnce sync.Once
+	header   *sam.Header
+	info     FileInfo
+}
+
+type cramIterator struct {
+	provider *CRAMProvider
+	in       file.File
+	reader   *cram.Reader
+	// Half-open coordinate range to read.
+	startAddr, limitAddr biopb.Coord
+
+	active bool
+	err    error
+	next   *sam.Record
+}
+
+func (c *CRAMProvider) indexPath() string {
+	index := c.Index
+	if index == "" {
+		index = c.Path + ".crai"
+	}
+	return index
+}
+
+// readIndex reads the *.crai file and caches its contents in c.index. Repeated
+// calls to this function returns c.index.
+func (c *CRAMProvider) readIndex() error {
+	c.indexOnce.Do(func() {
+		ctx := vcontext.Background()
+		in, err := file.Open(ctx, c.indexPath())
+		if err != nil {
+			c.err.Set(err)
+			return
+		}
+		index, err := cram.ReadIndex(in.Reader(ctx))
+		if err != nil {
+			c.err.Set(err)
+			in.Close(ctx) // nolint: errcheck
+			return
+		}
+		if err = in.Close(ctx); err != nil {
+			c.err.Set(err)
+			return
+		}
+		c.index = index
+	})
+	return c.err.Err()
+}
+
+// FileInfo implements the Provider interface.
+func (c *CRAMProvider) FileInfo() (FileInfo, error) {
+	c.initInfo()
+	if err := c.err.Err(); err != nil {
+		return FileInfo{}, err
+	}
+	return c.info, nil
+}
+
+// GetHeader implements the Provider interface.
+func (c *CRAMProvider) GetHeader() (*sam.Header, error) {
+	c.initInfo()
+	if err := c.err.Err(); err != nil {
+		return nil, err
+	}
+	return c.header, nil
+}
+
+// InitInfo sets c.info and c.header fields.
+func (c *CRAMProvider) initInfo() {
+	c.infoOnce.Do(func() {
+		ctx := vcontext.Background()
+		in, err := file.Open(ctx, c.Path)
+		if err != nil {
+			c.err.Set(err)
+			return
+		}
+		info, err := in.Stat(ctx)
+		if err != nil {
+			c.err.Set(err)
+			in.Close(ctx) // nolint: errcheck
+			return
+		}
+		c.info = FileInfo{ModTime: info.ModTime(), Size: info.Size()}
+		reader, err := cram.NewReader(in.Reader(ctx), c.Reference)
+		if err != nil {
+			c.err.Set(fmt.Errorf("%v: %v", c.Path, err))
+			in.Close(ctx) // nolint: errcheck
+			return
+		}
+		c.header = reader.Header()
+		if err := in.Close(ctx); err != nil {
+			c.err.Set(err)
+			return
+		}
+	})
+}
+
+// Close implements the Provider interface.
+func (c *CRAMProvider) Close() error {
+	if c.nActive > 0 {
+		vlog.Panicf("%d iterators still active for %+v", c.nActive, c)
+	}
+	for _, iter := range c.freeIters {
+		iter.internalClose()
+	}
+	c.freeIters = nil
+	return c.err.Err()
+}
+
+func (c *CRAMProvider) freeIterator(i *cramIterator) {
+	if !i.active {
+		vlog.Panic(i)
+	}
+	i.active = false
+	if i.Err() != nil {
+		// The iter may be invalid. Don't reuse it.
+		vlog.Errorf("freeiterator: %v", i.Err())
+		i.internalClose() // Will set c.err
+		i = nil
+	}
+	c.mu.Lock()
+	if i != nil {
+		c.freeIters = append(c.freeIters, i)
+	}
+	c.nActive--
+	if c.nActive < 0 {
+		vlog.Panicf("Negative active count for %+v", c)
+	}
+	c.mu.Unlock()
+}
+
+// Return an unused iterator. If c.freeIters is nonempty, this function returns
+// one from freeIters. Else, it opens the CRAM file, creates a CRAM reader and
+// returns an iterator containing them. On error, returns an iterator with
+// non-nil err field.
+func (c *CRAMProvider) allocateIterator() *cramIterator {
+	c.mu.Lock()
+	c.nActive++
+	if len(c.freeIters) > 0 {
+		iter := c.freeIters[len(c.freeIters)-1]
+		iter.active = true
+		iter.err = nil
+		iter.next = nil
+		c.freeIters = c.freeIters[:len(c.freeIters)-1]
+		c.mu.Unlock()
+		return iter
+	}
+	c.mu.Unlock()
+
+	iter := cramIterator{
+		provider: c,
+		active:   true,
+	}
+	if iter.err = c.readIndex(); iter.err != nil {
+		return &iter
+	}
+	ctx := vcontext.Background()
+	if iter.in, iter.err = file.Open(ctx, c.Path); iter.err != nil {
+		return &iter
+	}
+	iter.reader, iter.err = cram.NewReader(iter.in.Reader(ctx), c.Reference)
+	return &iter
+}
+
+// GenerateShards implements the Provider interface.
+func (c *CRAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, error) {
+	header, err := c.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Strategy == RegionBased {
+		return generateRegionShards(header, opts, c.regionBytes)
+	}
+	if opts.Strategy != ByteBased {
+		return gbam.GetPositionBasedShards(
+			header, basesPerShard(opts), opts.Padding, opts.IncludeUnmapped)
+	}
+	if err := c.readIndex(); err != nil {
+		return nil, err
+	}
+	if opts.BytesPerShard <= 0 {
+		if opts.NumShards > 0 {
+			var total int64
+			for _, e := range c.index {
+				total += int64(e.SliceSize)
+			}
+			opts.BytesPerShard = total / int64(opts.NumShards)
+		}
+		if opts.BytesPerShard <= 0 {
+			opts.BytesPerShard = DefaultBytesPerShard
+		}
+	}
+	if opts.MinBasesPerShard <= 0 {
+		opts.MinBasesPerShard = DefaultMinBasesPerShard
+	}
+	return c.byteBasedShards(header, opts), nil
+}
+
+// byteBasedShards implements the ByteBased sharding strategy. The shards of
+// each reference are delimited at the alignment starts of CRAM slices, so
+// that each shard has roughly opts.BytesPerShard bytes of slice data and at
+// least opts.MinBasesPerShard bases.
+func (c *CRAMProvider) byteBasedShards(header *sam.Header, opts GenerateShardsOpts) []gbam.Shard {
+	refs := header.Refs()
+	// boundaries[refid] lists the shard boundaries within the reference.
+	boundaries := make([][]int, len(refs))
+	nBytes := make([]int64, len(refs))
+	for _, e := range c.index {
+		if e.RefID < 0 || int(e.RefID) >= len(refs) {
+			continue
+		}
+		pos := int(e.Start) - 1
+		b := boundaries[e.RefID]
+		if nBytes[e.RefID] >= opts.BytesPerShard && pos-b[len(b)-1] >= opts.MinBasesPerShard {
+			boundaries[e.RefID] = append(b, pos)
+			nBytes[e.RefID] = 0
+		} else if b == nil {
+			boundaries[e.RefID] = []int{0}
+		}
+		nBytes[e.RefID] += int64(e.SliceSize)
+	}
+
+	var shards []gbam.Shard
+	for _, ref := range refs {
+		b := boundaries[ref.ID()]
+		if b == nil {
+			b = []int{0}
+		}
+		if ref.Len()-b[len(b)-1] < opts.MinBasesPerShard && len(b) > 1 {
+			// Merge a short last shard with the previous one.
+			b = b[:len(b)-1]
+		}
+		b = append(b, ref.Len())
+		for i := 0; i+1 < len(b); i++ {
+			if b[i] >= b[i+1] {
+				continue
+			}
+			shards = append(shards, gbam.Shard{
+				StartRef: ref,
+				EndRef:   ref,
+				Start:    b[i],
+				End:      b[i+1],
+				Padding:  opts.Padding,
+				ShardIdx: len(shards),
+			})
+		}
+	}
+	if opts.IncludeUnmapped {
+		shards = append(shards, gbam.Shard{
+			StartRef: nil,
+			EndRef:   nil,
+			Start:    0,
+			End:      math.MaxInt32,
+			ShardIdx: len(shards),
+		})
+	}
+	return shards
+}
+
+// regionBytes estimates the number of bytes occupied by the records in each
+// region, using the CRAM index. The size of a slice is attributed to a region
+// in proportion to the length of their overlap.
+func (c *CRAMProvider) regionBytes(regions []targetRegion) ([]int64, error) {
+	if err := c.readIndex(); err != nil {
+		return nil, err
+	}
+	sizes := make([]int64, len(regions))
+	for i, r := range regions {
+		for _, e := range c.index {
+			if int(e.RefID) != r.ref.ID() {
+				continue
+			}
+			start, end := int(e.Start)-1, int(e.Start)-1+int(e.Span)
+			if end <= start {
+				end = start + 1
+			}
+			overlap := end - start
+			if r.end < end {
+				overlap -= end - r.end
+			}
+			if r.start > start {
+				overlap -= r.start - start
+			}
+			if overlap <= 0 {
+				continue
+			}
+			sizes[i] += int64(e.SliceSize) * int64(overlap) / int64(end-start)
+		}
+	}
+	return sizes, nil
+}
+
+// GetFileShards implements the Provider interface.
+func (c *CRAMProvider) GetFileShards() ([]gbam.Shard, error) {
+	header, err := c.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	return []gbam.Shard{gbam.UniversalShard(header)}, nil
+}
+
+// NewIterator implements the Provider interface.
+func (c *CRAMProvider) NewIterator(shard gbam.Shard) Iterator {
+	iter := c.allocateIterator()
+	if iter.err != nil {
+		return iter
+	}
+	iter.reset(shard.StartRef, shard.PaddedStart(), shard.EndRef, shard.PaddedEnd())
+	return iter
+}
+
+// Reset the iterator to read the range [<startRef,startPos>, <endRef, endPos>).
+func (i *cramIterator) reset(startRef *sam.Reference, startPos int, endRef *sam.Reference, endPos int) {
+	i.startAddr = biopb.Coord{int32(startRef.ID()), int32(startPos), 0}
+	i.limitAddr = biopb.Coord{int32(endRef.ID()), int32(endPos), 0}
+	if i.startAddr.GE(i.limitAddr) {
+		i.err = fmt.Errorf("start coord (%v) not before limit coord (%v)", i.startAddr, i.limitAddr)
+		return
+	}
+	// Find the first slice that may contain a record at or after startAddr. The
+	// index lists slices in file order, which is also the coordinate order.
+	// Slices of unmapped reads have RefID -1, which sorts after all mapped
+	// coordinates.
+	for _, e := range i.provider.index {
+		limit := biopb.Coord{RefId: e.RefID, Pos: e.Start + e.Span}
+		if e.RefID < 0 {
+			limit = biopb.Coord{RefId: biopb.UnmappedRefID, Pos: biopb.InfinityPos}
+		}
+		if limit.LE(i.startAddr) {
+			continue
+		}
+		i.err = i.reader.SeekContainer(e.ContainerOffset)
+		return
+	}
+	// No record to read.
+	i.err = io.EOF
+}
+
+// Err implements the Iterator interface.
+func (i *cramIterator) Err() error {
+	if i.err == io.EOF {
+		return nil
+	}
+	return i.err
+}
+
+// Close implements the Iterator interface.
+func (i *cramIterator) Close() error {
+	err := i.Err()
+	i.provider.freeIterator(i)
+	return err
+}
+
+// Scan implements the Iterator interface.
+func (i *cramIterator) Scan() bool {
+	if !i.active {
+		vlog.Panic("Reusing iterator")
+	}
+	if i.err != nil {
+		return false
+	}
+	for {
+		i.next, i.err = i.reader.Read()
+		if i.err != nil {
+			return false
+		}
+		recAddr := gbam.CoordFromSAMRecord(i.next, 0)
+		if recAddr.LT(i.startAddr) {
+			sam.PutInFreePool(i.next)
+			continue
+		}
+		if !recAddr.LT(i.limitAddr) {
+			i.err = io.EOF
+			return false
+		}
+		return true
+	}
+}
+
+// Record implements the Iterator interface.
+func (i *cramIterator) Record() *sam.Record {
+	return i.next
+}
+
+func (i *cramIterator) internalClose() {
+	if i.in != nil {
+		if err := i.in.Close(vcontext.Background()); err != nil && i.err == nil {
+			i.err = err
+		}
+		i.in = nil
+	}
+	i.reader = nil
+	i.provider.err.Set(i.Err())
+}
@@ -1,7 +1,13 @@
-// Package bamprovider provider utilities for scanning a BAM/PAM file in
+// Package bamprovider provider utilities for scanning a BAM/PAM/CRAM file in
 // parallel.
 //
-// The Provider is an interface for reading BAM or PAM file in parallel.
+// The Provider is an interface for reading BAM, PAM or CRAM file in parallel.
+// Reading CRAM, or PAM whose seq field is encoded relative to a reference,
+// requires the reference FASTA that the file was created with; see
+// ProviderOpts.Reference.
+//
+// MergedProvider combines multiple coordinate-sorted BAM or PAM files into one
+// Provider.
 //
 // PairIterator is implemented on top of Provider to combine read pairs (R1+R2).
 package bamprovider
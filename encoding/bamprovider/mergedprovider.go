@@ -0,0 +1,462 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bamprovider
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// MergeOpts defines options for NewMergedProvider.
+type MergeOpts struct {
+	// KeepNames disables the renaming of records (Cf. MergedProvider). Set it
+	// only when the read names are known to be unique across the inputs.
+	KeepNames bool
+}
+
+// MergedProvider reads multiple coordinate-sorted BAM or PAM files as if they
+// were one file. It is created by NewMergedProvider.
+//
+// The merged header contains the union of the references in the inputs. A
+// reference that appears in multiple inputs must have the same length in each
+// of them, and the relative order of the references must be consistent across
+// the inputs. The merged header also contains the union of read groups. If two
+// inputs have different read groups with the same ID, the read group in the
+// later input is renamed to "<ID>-<input index>", and the RG tags of its
+// records are rewritten accordingly. Program and comment lines are copied from
+// the first input.
+//
+// Unrelated reads in different inputs may share a name, e.g., when the inputs
+// come from different sequencing runs. Thus, unless MergeOpts.KeepNames is
+// set, the name of every record is prefixed with "<RG>:", where RG is the read
+// group of the record in the merged header. Since reads in a read group have
+// unique names, and read groups from different inputs are renamed when they
+// conflict, the names are unique after merging, while the mates of a read,
+// even if stored in different inputs, still share a name. Records without an
+// RG tag are prefixed with "<i>:" instead, where i is the index of the input.
+// This applies to all records if the RG tag is dropped by ProviderOpts.
+//
+// Records yielded by the iterators refer to the merged header.
+type MergedProvider struct {
+	opts      MergeOpts
+	providers []Provider
+
+	once    sync.Once
+	err     errors.Once
+	header  *sam.Header
+	info    FileInfo
+	refMaps [][]int             // refMaps[i][refid in input i] = refid in header.
+	rgMaps  []map[string]string // rgMaps[i][RG in input i] = RG in header. Only renamed RGs are stored.
+}
+
+// NewMergedProvider creates a Provider that merges the records from the given
+// BAM or PAM files. optList is passed to NewProvider for each path, except that
+// ProviderOpts.Index is ignored.
+func NewMergedProvider(paths []string, mopts MergeOpts, optList ...ProviderOpts) Provider {
+	opts := mergeOpts(optList)
+	opts.Index = ""
+	p := &MergedProvider{opts: mopts}
+	for _, path := range paths {
+		p.providers = append(p.providers, NewProvider(path, opts))
+	}
+	return p
+}
+
+// mergeRefNames computes the union of reference names in the headers. The
+// result is ordered so that the order of references in each header is
+// preserved, if possible.
+func mergeRefNames(headers []*sam.Header) []string {
+	var names []string
+	index := map[string]int{}
+	for _, h := range headers {
+		insertAt := 0 // Position after the last known ref in h.
+		for _, ref := range h.Refs() {
+			if i, ok := index[ref.Name()]; ok {
+				insertAt = i + 1
+				continue
+			}
+			names = append(names, "")
+			copy(names[insertAt+1:], names[insertAt:])
+			names[insertAt] = ref.Name()
+			for i, name := range names {
+				index[name] = i
+			}
+			insertAt++
+		}
+	}
+	return names
+}
+
+func (p *MergedProvider) initInfo() {
+	p.once.Do(func() {
+		if len(p.providers) == 0 {
+			p.err.Set(fmt.Errorf("mergedprovider: no input"))
+			return
+		}
+		headers := make([]*sam.Header, len(p.providers))
+		for i, sub := range p.providers {
+			var err error
+			if headers[i], err = sub.GetHeader(); err != nil {
+				p.err.Set(err)
+				return
+			}
+			info, err := sub.FileInfo()
+			if err != nil {
+				p.err.Set(err)
+				return
+			}
+			if info.ModTime.After(p.info.ModTime) {
+				p.info.ModTime = info.ModTime
+			}
+			p.info.Size += info.Size
+		}
+
+		// Merge references.
+		refsByName := map[string]*sam.Reference{}
+		for _, h := range headers {
+			for _, ref := range h.Refs() {
+				if r, ok := refsByName[ref.Name()]; !ok {
+					refsByName[ref.Name()] = ref
+				} else if r.Len() != ref.Len() {
+					p.err.Set(fmt.Errorf("mergedprovider: reference %s has different lengths, %d and %d", ref.Name(), r.Len(), ref.Len()))
+					return
+				}
+			}
+		}
+		var refs []*sam.Reference
+		for _, name := range mergeRefNames(headers) {
+			refs = append(refs, refsByName[name].Clone())
+		}
+		header, err := sam.NewHeader(nil, refs)
+		if err != nil {
+			p.err.Set(err)
+			return
+		}
+		header.Version = headers[0].Version
+		header.SortOrder = sam.Coordinate
+		header.Comments = append(header.Comments, headers[0].Comments...)
+		for _, prog := range headers[0].Progs() {
+			if err := header.AddProgram(prog.Clone()); err != nil {
+				p.err.Set(err)
+				return
+			}
+		}
+		p.refMaps = make([][]int, len(headers))
+		for i, h := range headers {
+			p.refMaps[i] = make([]int, len(h.Refs()))
+			for j, ref := range h.Refs() {
+				p.refMaps[i][j] = refIndex(refs, ref.Name())
+				if j > 0 && p.refMaps[i][j] < p.refMaps[i][j-1] {
+					p.err.Set(fmt.Errorf("mergedprovider: references %s and %s are ordered inconsistently across inputs",
+						h.Refs()[j-1].Name(), ref.Name()))
+					return
+				}
+			}
+		}
+
+		// Merge read groups.
+		rgs := map[string]*sam.ReadGroup{}
+		p.rgMaps = make([]map[string]string, len(headers))
+		for i, h := range headers {
+			p.rgMaps[i] = map[string]string{}
+			for _, rg := range h.RGs() {
+				if existing, ok := rgs[rg.Name()]; ok && existing.String() == rg.String() {
+					continue
+				}
+				rg = rg.Clone()
+				name := rg.Name()
+				for n := i; rgs[name] != nil; n++ {
+					name = rg.Name() + "-" + strconv.Itoa(n)
+				}
+				if name != rg.Name() {
+					p.rgMaps[i][rg.Name()] = name
+					if err := rg.Set(sam.NewTag("ID"), name); err != nil {
+						p.err.Set(err)
+						return
+					}
+				}
+				if err := header.AddReadGroup(rg); err != nil {
+					p.err.Set(err)
+					return
+				}
+				rgs[name] = rg
+			}
+		}
+		p.header = header
+	})
+}
+
+func refIndex(refs []*sam.Reference, name string) int {
+	for i, ref := range refs {
+		if ref.Name() == name {
+			return i
+		}
+	}
+	panic(name)
+}
+
+// FileInfo implements the Provider interface. ModTime is the latest modtime of
+// the inputs, and Size is the sum of their sizes.
+func (p *MergedProvider) FileInfo() (FileInfo, error) {
+	p.initInfo()
+	return p.info, p.err.Err()
+}
+
+// GetHeader implements the Provider interface. It returns the merged header.
+func (p *MergedProvider) GetHeader() (*sam.Header, error) {
+	p.initInfo()
+	return p.header, p.err.Err()
+}
+
+// GenerateShards implements the Provider interface. Only the Automatic and
+// PositionBased strategies are supported. Shards cover the references in the
+// merged header, and they all span the same number of bases. The length is
+// opts.BasesPerShard, if set. Otherwise, it is chosen so that each shard holds
+// about opts.BytesPerShard bytes of the inputs, assuming that the records are
+// spread evenly over the references, or so that there are about
+// opts.NumShards shards. Shards span at least opts.MinBasesPerShard bases.
+func (p *MergedProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, error) {
+	if opts.Strategy != Automatic && opts.Strategy != PositionBased {
+		return nil, fmt.Errorf("GenerateShards: strategy %v not supported", opts.Strategy)
+	}
+	header, err := p.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	return gbam.GetPositionBasedShards(header, p.basesPerShard(header, opts), opts.Padding, opts.IncludeUnmapped)
+}
+
+// basesPerShard computes the length of the shards for GenerateShards.
+func (p *MergedProvider) basesPerShard(header *sam.Header, opts GenerateShardsOpts) int {
+	var totalBases int64
+	for _, ref := range header.Refs() {
+		totalBases += int64(ref.Len())
+	}
+	bases := int64(DefaultBasesPerShard)
+	switch {
+	case opts.BasesPerShard > 0:
+		bases = int64(opts.BasesPerShard)
+	case opts.BytesPerShard > 0 && p.info.Size > 0:
+		bases = int64(float64(totalBases) * float64(opts.BytesPerShard) / float64(p.info.Size))
+	case opts.NumShards > 0:
+		bases = (totalBases + int64(opts.NumShards) - 1) / int64(opts.NumShards)
+	}
+	if bases < int64(opts.MinBasesPerShard) {
+		bases = int64(opts.MinBasesPerShard)
+	}
+	if bases < 1 {
+		bases = 1
+	}
+	if bases > math.MaxInt32 {
+		bases = math.MaxInt32
+	}
+	return int(bases)
+}
+
+// GetFileShards implements the Provider interface. It returns a UniversalShard.
+func (p *MergedProvider) GetFileShards() ([]gbam.Shard, error) {
+	header, err := p.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	return []gbam.Shard{gbam.UniversalShard(header)}, nil
+}
+
+// inputPosition translates a (ref, pos) in the merged header into one in the
+// i'th input. If the input doesn't have the reference, it returns the start of
+// the next reference that the input has. exact is false in the latter case.
+func (p *MergedProvider) inputPosition(i int, ref *sam.Reference, pos int) (inputRef *sam.Reference, inputPos int, exact bool) {
+	if ref == nil {
+		return nil, pos, true
+	}
+	inputRefs := p.providerHeader(i).Refs()
+	for j, id := range p.refMaps[i] {
+		if id == ref.ID() {
+			return inputRefs[j], pos, true
+		}
+		if id > ref.ID() {
+			return inputRefs[j], 0, false
+		}
+	}
+	return nil, 0, false
+}
+
+func (p *MergedProvider) providerHeader(i int) *sam.Header {
+	h, err := p.providers[i].GetHeader()
+	if err != nil {
+		// initInfo has already read the header successfully.
+		panic(err)
+	}
+	return h
+}
+
+// inputShard translates a shard in the merged header to the i'th input.
+func (p *MergedProvider) inputShard(i int, shard gbam.Shard) gbam.Shard {
+	s := shard
+	var exact bool
+	if s.StartRef, s.Start, exact = p.inputPosition(i, shard.StartRef, shard.Start); !exact {
+		s.StartSeq = 0
+	}
+	if s.EndRef, s.End, exact = p.inputPosition(i, shard.EndRef, shard.End); !exact {
+		s.EndSeq = 0
+	}
+	return s
+}
+
+// NewIterator implements the Provider interface. The iterator yields the
+// records of all the inputs in coordinate order. Records at the same coordinate
+// are yielded in the order of the inputs.
+func (p *MergedProvider) NewIterator(shard gbam.Shard) Iterator {
+	if _, err := p.GetHeader(); err != nil {
+		return NewErrorIterator(err)
+	}
+	iter := &mergedIterator{provider: p, last: -1}
+	for i, sub := range p.providers {
+		iter.iters = append(iter.iters, sub.NewIterator(p.inputShard(i, shard)))
+	}
+	return iter
+}
+
+// Close implements the Provider interface.
+func (p *MergedProvider) Close() error {
+	for _, sub := range p.providers {
+		p.err.Set(sub.Close())
+	}
+	return p.err.Err()
+}
+
+var rgTag = sam.NewTag("RG")
+
+// remap updates the record read from the i'th input so that it refers to the
+// merged header.
+func (p *MergedProvider) remap(i int, rec *sam.Record) error {
+	refs := p.header.Refs()
+	if rec.Ref != nil {
+		rec.Ref = refs[p.refMaps[i][rec.Ref.ID()]]
+	}
+	if rec.MateRef != nil {
+		rec.MateRef = refs[p.refMaps[i][rec.MateRef.ID()]]
+	}
+	var rg string // RG of the record in the merged header.
+	for j, a := range rec.AuxFields {
+		if a.Tag() != rgTag {
+			continue
+		}
+		rg, _ = a.Value().(string)
+		if name, ok := p.rgMaps[i][rg]; ok {
+			newAux, err := sam.NewAux(rgTag, name)
+			if err != nil {
+				return err
+			}
+			// Copy the list, since the original may be backed by memory owned
+			// by the underlying reader.
+			aux := make([]sam.Aux, len(rec.AuxFields))
+			copy(aux, rec.AuxFields)
+			aux[j] = newAux
+			rec.AuxFields = aux
+			rg = name
+		}
+		break
+	}
+	if !p.opts.KeepNames {
+		if rg == "" {
+			rg = strconv.Itoa(i)
+		}
+		rec.Name = rg + ":" + rec.Name
+	}
+	return nil
+}
+
+// mergedIterator implements the Iterator interface for MergedProvider.
+type mergedIterator struct {
+	provider *MergedProvider
+	iters    []Iterator
+	started  bool
+	heap     mergeHeap
+	last     int // Index of the input that yielded rec. -1 if none.
+	rec      *sam.Record
+	err      errors.Once
+}
+
+type mergeEntry struct {
+	input int
+	rec   *sam.Record
+	coord biopb.Coord
+}
+
+// mergeHeap is a min-heap of records, ordered by (coord, input).
+type mergeHeap []mergeEntry
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if c := h[i].coord.Compare(h[j].coord); c != 0 {
+		return c < 0
+	}
+	return h[i].input < h[j].input
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeEntry)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// advance reads the next record from the i'th input and adds it to the heap.
+func (m *mergedIterator) advance(i int) {
+	iter := m.iters[i]
+	if !iter.Scan() {
+		m.err.Set(iter.Err())
+		return
+	}
+	rec := iter.Record()
+	if err := m.provider.remap(i, rec); err != nil {
+		m.err.Set(err)
+		return
+	}
+	heap.Push(&m.heap, mergeEntry{input: i, rec: rec, coord: gbam.CoordFromSAMRecord(rec, 0)})
+}
+
+// Scan implements the Iterator interface.
+func (m *mergedIterator) Scan() bool {
+	if !m.started {
+		m.started = true
+		for i := range m.iters {
+			m.advance(i)
+		}
+	} else if m.last >= 0 {
+		m.advance(m.last)
+	}
+	m.last = -1
+	if m.err.Err() != nil || len(m.heap) == 0 {
+		return false
+	}
+	e := heap.Pop(&m.heap).(mergeEntry)
+	m.rec, m.last = e.rec, e.input
+	return true
+}
+
+// Record implements the Iterator interface.
+func (m *mergedIterator) Record() *sam.Record { return m.rec }
+
+// Err implements the Iterator interface.
+func (m *mergedIterator) Err() error { return m.err.Err() }
+
+// Close implements the Iterator interface.
+func (m *mergedIterator) Close() error {
+	for _, iter := range m.iters {
+		m.err.Set(iter.Close())
+	}
+	return m.err.Err()
+}
@@ -102,13 +102,16 @@ func (p *PAMProvider) Close() error {
 
 // GenerateShards implements the Provider interface.
 func (p *PAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, error) {
-	if opts.Strategy != Automatic && opts.Strategy != ByteBased {
+	if opts.Strategy != Automatic && opts.Strategy != ByteBased && opts.Strategy != RegionBased {
 		return nil, fmt.Errorf("GenerateShards: strategy %v not supported", opts.Strategy)
 	}
 	header, err := p.GetHeader()
 	if err != nil {
 		return nil, err
 	}
+	if opts.Strategy == RegionBased {
+		return generateRegionShards(header, opts, p.regionBytes)
+	}
 	popts := pamutil.GenerateReadShardsOpts{
 		Range:                              gbam.UniversalRange,
 		SplitMappedCoords:                  opts.SplitMappedCoords,
@@ -132,6 +135,19 @@ func (p *PAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, err
 	return bamShards, nil
 }
 
+// regionBytes estimates the number of bytes occupied by the records in each
+// region, using the PAM field indexes.
+func (p *PAMProvider) regionBytes(regions []targetRegion) ([]int64, error) {
+	ranges := make([]biopb.CoordRange, len(regions))
+	for i, r := range regions {
+		ranges[i] = biopb.CoordRange{
+			Start: biopb.Coord{RefId: int32(r.ref.ID()), Pos: int32(r.start)},
+			Limit: biopb.Coord{RefId: int32(r.ref.ID()), Pos: int32(r.end)},
+		}
+	}
+	return pamutil.ApproxBytesInRanges(vcontext.Background(), p.Path, ranges, gbam.FieldNames)
+}
+
 // GetFileShards implements the Provider interface.
 func (p *PAMProvider) GetFileShards() ([]gbam.Shard, error) {
 	header, err := p.GetHeader()
@@ -152,7 +168,14 @@ func (p *PAMProvider) GetFileShards() ([]gbam.Shard, error) {
 
 // NewIterator implements Provider.GetIndexedReader.
 func (p *PAMProvider) NewIterator(shard gbam.Shard) Iterator {
+	p.mu.Lock()
+	if p.Opts.Reference != nil && p.Opts.ReferenceChecksums == nil {
+		// Share the checksums among the iterators, so that each reference
+		// sequence is hashed once.
+		p.Opts.ReferenceChecksums = pam.NewReferenceChecksums(p.Opts.Reference)
+	}
 	opts := p.Opts
+	p.mu.Unlock()
 	opts.Range.Start = biopb.Coord{int32(shard.StartRef.ID()), int32(shard.PaddedStart()), int32(shard.StartSeq)}
 	opts.Range.Limit = biopb.Coord{int32(shard.EndRef.ID()), int32(shard.PaddedEnd()), int32(shard.EndSeq)}
 	return &pamIterator{
@@ -6,8 +6,10 @@ import (
 
 	"github.com/grailbio/base/vcontext"
 	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/fasta"
 	"github.com/grailbio/bio/encoding/pam"
 	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/bio/interval"
 	"github.com/grailbio/hts/sam"
 	"v.io/x/lib/vlog"
 )
@@ -15,12 +17,23 @@ import (
 // ProviderOpts defines options for NewProvider.
 type ProviderOpts struct {
 	// Index specifies the name of the BAM inde file. This field is meaningful
-	// only for BAM files. If Index=="", it defaults to path + ".bai".
+	// only for BAM and CRAM files. If Index=="", it defaults to path + ".bai" for
+	// BAM, path + ".crai" for CRAM.
 	Index string
 
+	// Reference is the reference that a CRAM file, or a PAM file whose seq field
+	// is encoded relative to a reference (Cf. pam.WriteOpts.Reference), was
+	// created with. This field is meaningful only for CRAM and PAM files.
+	Reference fasta.Fasta
+
 	// DropFields causes the listed fields not to be filled in sam.Record. This
 	// option is recognized only by the PAM reader.
 	DropFields []gbam.FieldType
+
+	// AuxTags, if nonempty, causes only the listed aux tags to be filled in
+	// sam.Record.AuxFields. This option is recognized only by the PAM reader.
+	// Cf. pam.ReadOpts.AuxTags.
+	AuxTags []string
 }
 
 // ShardingStrategy defines algorithms used by Provider.GenerateShards.
@@ -28,7 +41,7 @@ type ShardingStrategy int
 
 const (
 	// Automatic picks some good strategy. In practice, it means ByteBased for
-	// PAM, PositionBased for BAM.
+	// PAM, PositionBased for BAM and CRAM.
 	Automatic ShardingStrategy = iota
 	// ByteBased strategy partitions the file so that each shard has roughly equal
 	// number of bytes.
@@ -38,6 +51,11 @@ const (
 	// uniform width - i.e., value of (limitpos - startpos) is uniform across
 	// shards.
 	PositionBased
+	// RegionBased strategy produces shards that cover only the regions listed in
+	// GenerateShardsOpts.Regions and GenerateShardsOpts.BEDUnion. A region is
+	// split into multiple shards of uniform width so that each shard has roughly
+	// BytesPerShard bytes of data. Shards never span two regions.
+	RegionBased
 )
 
 // GenerateShardsOpts defines behavior of Provider.GenerateShards.
@@ -67,16 +85,32 @@ type GenerateShardsOpts struct {
 	AlwaysSplitMappedAndUnmappedCoords bool
 
 	// BytesPerShard is the target shard size, in bytes. This is consulted only in
-	// ByteBased sharding strategy.
+	// ByteBased and RegionBased sharding strategies.
 	BytesPerShard int64
 
-	// NumShards is the target shard count. It is consulted by the ByteBased sharding
-	// strategy, and is ignored if BytesPerShard is set.
+	// NumShards is the target shard count. It is consulted by the ByteBased and
+	// RegionBased sharding strategies, and is ignored if BytesPerShard is set.
 	NumShards int
 
 	// MinBasesPerShard defines the nimimum number of bases in each shard. This is
-	// consulted only in ByteBased sharding strategy.
+	// consulted only in ByteBased and RegionBased sharding strategies.
 	MinBasesPerShard int
+
+	// BasesPerShard is the number of bases in each shard. This is consulted
+	// only in PositionBased sharding strategy, and in Automatic strategy when
+	// it picks PositionBased. If zero, DefaultBasesPerShard is used.
+	BasesPerShard int
+
+	// Regions lists the genomic regions to shard. This is consulted only in
+	// RegionBased sharding strategy. The regions may be unsorted and may
+	// overlap. It is an error to name a reference that is not in the header.
+	Regions []interval.Entry
+
+	// BEDUnion is an alternative way to specify the regions to shard. This is
+	// consulted only in RegionBased sharding strategy. If both Regions and
+	// BEDUnion are set, their union is sharded. References in BEDUnion that are
+	// not in the header are ignored.
+	BEDUnion *interval.BEDUnion
 }
 
 // Provider allows reading BAM or PAM file in parallel. Thread safe.
@@ -175,6 +209,8 @@ const (
 	BAM
 	// PAM file
 	PAM
+	// CRAM file
+	CRAM
 )
 
 // ParseFileType parses the file type string. "bam" returns bamprovider.BAM, for
@@ -185,6 +221,8 @@ func ParseFileType(name string) FileType {
 		return BAM
 	case "pam":
 		return PAM
+	case "cram":
+		return CRAM
 	default:
 		return Unknown
 	}
@@ -196,6 +234,9 @@ func GuessFileType(path string) FileType {
 	if strings.HasSuffix(path, ".bam") {
 		return BAM
 	}
+	if strings.HasSuffix(path, ".cram") {
+		return CRAM
+	}
 	if strings.Contains(path, ".pam") {
 		return PAM
 	}
@@ -213,20 +254,26 @@ func mergeOpts(optList []ProviderOpts) ProviderOpts {
 		if o.Index != "" {
 			opts.Index = o.Index
 		}
+		if o.Reference != nil {
+			opts.Reference = o.Reference
+		}
 		opts.DropFields = append(opts.DropFields, o.DropFields...)
+		opts.AuxTags = append(opts.AuxTags, o.AuxTags...)
 	}
 	return opts
 }
 
-// NewProvider creates a Provider object that can handle BAM or PAM file of
-// "path". The file type is autodetected from the path.
+// NewProvider creates a Provider object that can handle BAM, PAM or CRAM file
+// of "path". The file type is autodetected from the path.
 func NewProvider(path string, optList ...ProviderOpts) Provider {
 	opts := mergeOpts(optList)
 	switch GuessFileType(path) {
 	case BAM, Unknown:
 		return &BAMProvider{Path: path, Index: opts.Index}
 	case PAM:
-		return &PAMProvider{Path: path, Opts: pam.ReadOpts{DropFields: opts.DropFields}}
+		return &PAMProvider{Path: path, Opts: pam.ReadOpts{DropFields: opts.DropFields, AuxTags: opts.AuxTags, Reference: opts.Reference}}
+	case CRAM:
+		return &CRAMProvider{Path: path, Index: opts.Index, Reference: opts.Reference}
 	}
 	panic("shouldn't reach here")
 }
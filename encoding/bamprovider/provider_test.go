@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"sync"
 	"testing"
 
@@ -18,6 +19,7 @@ import (
 	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/bio/encoding/converter"
 	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/bio/interval"
 	"github.com/grailbio/hts/bam"
 	"github.com/grailbio/hts/sam"
 	"github.com/grailbio/testutil"
@@ -156,6 +158,216 @@ func TestBAMUnmappedOnly(t *testing.T) {
 		h.ElementsAre("read10", "read10"))
 }
 
+func TestMergedProvider(t *testing.T) {
+	tmpDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test-unmapped.bam")
+	pamPath := filepath.Join(tmpDir, "test-unmapped.pam")
+	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{}, pamPath, bamPath, "", math.MaxInt64))
+
+	p := bamprovider.NewMergedProvider([]string{bamPath, pamPath}, bamprovider.MergeOpts{KeepNames: true})
+	header, err := p.GetHeader()
+	assert.NoError(t, err)
+	bamHeader, err := bamprovider.NewProvider(bamPath).GetHeader()
+	assert.NoError(t, err)
+	assert.EQ(t, len(header.Refs()), len(bamHeader.Refs()))
+
+	shards, err := p.GenerateShards(bamprovider.GenerateShardsOpts{IncludeUnmapped: true})
+	assert.NoError(t, err)
+	var names []string
+	var prevCoord biopb.Coord
+	for _, shard := range shards {
+		iter := p.NewIterator(shard)
+		for iter.Scan() {
+			rec := iter.Record()
+			assert.True(t, rec.Ref == nil || header.Refs()[rec.Ref.ID()] == rec.Ref, "record %v must refer to the merged header", rec)
+			coord := gbam.CoordFromSAMRecord(rec, 0)
+			assert.True(t, prevCoord.LE(coord), "%v %v", prevCoord, coord)
+			prevCoord = coord
+			names = append(names, rec.Name)
+		}
+		assert.NoError(t, iter.Close())
+	}
+	assert.NoError(t, p.Close())
+
+	// Both inputs store the same records, so each name appears twice as often.
+	expected := []string{"read1", "read1", "read10", "read10", "read10", "read10", "read2", "read2", "read3", "read3"}
+	sort.Strings(names)
+	assert.EQ(t, names, expected)
+}
+
+func TestMergedProviderNames(t *testing.T) {
+	tmpDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	// Both inputs have read group A, with different samples, so A in the
+	// second input is renamed to A-1. Read group B is the same in both inputs.
+	texts := []string{
+		"@RG\tID:A\tSM:s0\n@RG\tID:B\tSM:s\n",
+		"@RG\tID:A\tSM:s1\n@RG\tID:B\tSM:s\n",
+	}
+	var paths []string
+	for i, text := range texts {
+		header, err := sam.NewHeader([]byte(text), []*sam.Reference{chr1})
+		assert.NoError(t, err)
+		path := filepath.Join(tmpDir, fmt.Sprintf("test%d.pam", i))
+		w := pam.NewWriter(pam.WriteOpts{}, header, path)
+		for pos, rg := range []string{"A", "B", ""} {
+			var aux []sam.Aux
+			if rg != "" {
+				a, err := sam.NewAux(sam.NewTag("RG"), rg)
+				assert.NoError(t, err)
+				aux = append(aux, a)
+			}
+			// The same name is used in both inputs.
+			r, err := sam.NewRecord("r", chr1, nil, pos, -1, 0, 60,
+				sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}, []byte("ACGT"), []byte{30, 30, 30, 30}, aux)
+			assert.NoError(t, err)
+			w.Write(r)
+		}
+		assert.NoError(t, w.Close())
+		paths = append(paths, path)
+	}
+
+	readNames := func(opts bamprovider.MergeOpts) []string {
+		p := bamprovider.NewMergedProvider(paths, opts)
+		header, err := p.GetHeader()
+		assert.NoError(t, err)
+		iter := p.NewIterator(gbam.UniversalShard(header))
+		names := readIterator(iter)
+		assert.NoError(t, iter.Close())
+		assert.NoError(t, p.Close())
+		return names
+	}
+	// The reads in B share the name, since B is the same read group in both
+	// inputs.
+	expect.EQ(t, readNames(bamprovider.MergeOpts{}), []string{"A:r", "A-1:r", "B:r", "B:r", "0:r", "1:r"})
+	expect.EQ(t, readNames(bamprovider.MergeOpts{KeepNames: true}), []string{"r", "r", "r", "r", "r", "r"})
+}
+
+func TestMergedProviderShardSize(t *testing.T) {
+	tmpDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	chr1, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 500000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	assert.NoError(t, err)
+	var paths []string
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(tmpDir, fmt.Sprintf("test%d.pam", i))
+		w := pam.NewWriter(pam.WriteOpts{}, header, path)
+		for pos := 0; pos < 500000; pos += 1000 {
+			r, err := sam.NewRecord(fmt.Sprintf("r%d", pos), chr1, nil, pos, -1, 0, 60,
+				sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}, []byte("ACGT"), []byte{30, 30, 30, 30}, nil)
+			assert.NoError(t, err)
+			w.Write(r)
+		}
+		assert.NoError(t, w.Close())
+		paths = append(paths, path)
+	}
+	p := bamprovider.NewMergedProvider(paths, bamprovider.MergeOpts{})
+	info, err := p.FileInfo()
+	assert.NoError(t, err)
+
+	for _, test := range []struct {
+		opts  bamprovider.GenerateShardsOpts
+		bases int
+	}{
+		{bamprovider.GenerateShardsOpts{}, 100000},
+		{bamprovider.GenerateShardsOpts{NumShards: 6}, 250000},
+		{bamprovider.GenerateShardsOpts{NumShards: 1000, MinBasesPerShard: 300000}, 300000},
+		{bamprovider.GenerateShardsOpts{BytesPerShard: info.Size}, 1500000},
+		// BytesPerShard takes precedence over NumShards.
+		{bamprovider.GenerateShardsOpts{BytesPerShard: info.Size, NumShards: 6}, 1500000},
+		// BasesPerShard takes precedence over both.
+		{bamprovider.GenerateShardsOpts{BasesPerShard: 200000, BytesPerShard: info.Size, NumShards: 6}, 200000},
+	} {
+		shards, err := p.GenerateShards(test.opts)
+		assert.NoError(t, err)
+		expected, err := gbam.GetPositionBasedShards(header, test.bases, 0, false)
+		assert.NoError(t, err)
+		expect.EQ(t, len(shards), len(expected), "opts %+v", test.opts)
+		expect.EQ(t, shards[0].End, expected[0].End, "opts %+v", test.opts)
+	}
+	assert.NoError(t, p.Close())
+}
+
+func TestRegionBasedShards(t *testing.T) {
+	tmpDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
+	pamPath := filepath.Join(tmpDir, "test.pam")
+	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{}, pamPath, bamPath, "", math.MaxInt64))
+
+	regions := []interval.Entry{
+		{RefName: "chr1", Start0: 1000000, End: 2000000},
+		{RefName: "chr1", Start0: 709000, End: 800000},
+		{RefName: "chr1", Start0: 750000, End: 900000}, // overlaps the previous one.
+	}
+	merged := []interval.Entry{
+		{RefName: "chr1", Start0: 709000, End: 900000},
+		{RefName: "chr1", Start0: 1000000, End: 2000000},
+	}
+	for _, path := range []string{bamPath, pamPath} {
+		p := bamprovider.NewProvider(path)
+		shards, err := p.GenerateShards(bamprovider.GenerateShardsOpts{
+			Strategy:         bamprovider.RegionBased,
+			Regions:          regions,
+			Padding:          10,
+			BytesPerShard:    8192,
+			MinBasesPerShard: 1000,
+		})
+		assert.NoError(t, err)
+		assert.True(t, len(shards) > len(merged), "path %s, shards %+v", path, shards)
+
+		// The shards must tile the merged regions exactly.
+		ri := 0
+		pos := int(merged[0].Start0)
+		for i, shard := range shards {
+			assert.EQ(t, shard.ShardIdx, i)
+			assert.EQ(t, shard.Padding, 10)
+			assert.EQ(t, shard.StartRef.Name(), "chr1")
+			assert.EQ(t, shard.EndRef.Name(), "chr1")
+			if pos == int(merged[ri].End) {
+				ri++
+				pos = int(merged[ri].Start0)
+			}
+			assert.EQ(t, shard.Start, pos, "path %s, shard %+v", path, shard)
+			assert.True(t, shard.End <= int(merged[ri].End), "path %s, shard %+v", path, shard)
+			pos = shard.End
+		}
+		assert.EQ(t, ri, len(merged)-1)
+		assert.EQ(t, pos, int(merged[ri].End))
+
+		// Reading the shards, ignoring the padding, must yield the same reads as
+		// reading the regions directly.
+		var got, want []string
+		for _, shard := range shards {
+			shard.Padding = 0
+			iter := p.NewIterator(shard)
+			got = append(got, readIterator(iter)...)
+			assert.NoError(t, iter.Close())
+		}
+		for _, r := range merged {
+			iter := bamprovider.NewRefIterator(p, r.RefName, int(r.Start0), int(r.End))
+			want = append(want, readIterator(iter)...)
+			assert.NoError(t, iter.Close())
+		}
+		assert.True(t, len(want) > 0)
+		assert.EQ(t, got, want, "path %s", path)
+
+		_, err = p.GenerateShards(bamprovider.GenerateShardsOpts{
+			Strategy: bamprovider.RegionBased,
+			Regions:  []interval.Entry{{RefName: "chr999", Start0: 0, End: 10}},
+		})
+		assert.Regexp(t, err, "chr999.*not found")
+		assert.NoError(t, p.Close())
+	}
+}
+
 // Test reading random ranges.
 func testRandom(t *testing.T, randomSeed int64) {
 	tmpDir, cleanup := testutil.TempDir(t, "", "")
@@ -350,10 +562,12 @@ func Example_shardedread() {
 func ExampleParseFileType() {
 	fmt.Printf("%d\n", bamprovider.ParseFileType("bam"))
 	fmt.Printf("%d\n", bamprovider.ParseFileType("pam"))
+	fmt.Printf("%d\n", bamprovider.ParseFileType("cram"))
 	fmt.Printf("%d\n", bamprovider.ParseFileType("invalid"))
 	// Output:
 	// 1
 	// 2
+	// 3
 	// 0
 }
 
@@ -0,0 +1,144 @@
+package bamprovider
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+// targetRegion is a half-open genomic interval [start, end) on ref.
+type targetRegion struct {
+	ref        *sam.Reference
+	start, end int
+}
+
+// targetRegions extracts the regions listed in opts.Regions and opts.BEDUnion.
+// The result is sorted in coordinate order. Overlapping or abutting regions are
+// merged, and regions are clipped to the reference boundaries.
+func targetRegions(header *sam.Header, opts GenerateShardsOpts) ([]targetRegion, error) {
+	if len(opts.Regions) == 0 && opts.BEDUnion == nil {
+		return nil, fmt.Errorf("GenerateShards: RegionBased strategy requires Regions or BEDUnion")
+	}
+	refs := header.Refs()
+	perRef := make([][]targetRegion, len(refs))
+	add := func(ref *sam.Reference, start, end int) {
+		if start < 0 {
+			start = 0
+		}
+		if end > ref.Len() {
+			end = ref.Len()
+		}
+		if start < end {
+			perRef[ref.ID()] = append(perRef[ref.ID()], targetRegion{ref, start, end})
+		}
+	}
+	for _, e := range opts.Regions {
+		ref := RefByName(header, e.RefName)
+		if ref == nil {
+			return nil, fmt.Errorf("GenerateShards: reference '%s' in region %+v not found", e.RefName, e)
+		}
+		if e.Start0 > e.End {
+			return nil, fmt.Errorf("GenerateShards: invalid region %+v", e)
+		}
+		add(ref, int(e.Start0), int(e.End))
+	}
+	if opts.BEDUnion != nil {
+		for _, ref := range refs {
+			intervals := opts.BEDUnion.RefByName(ref.Name())
+			for i := 0; i+1 < len(intervals); i += 2 {
+				add(ref, int(intervals[i]), int(intervals[i+1]))
+			}
+		}
+	}
+
+	var regions []targetRegion
+	for _, rs := range perRef {
+		sort.Slice(rs, func(i, j int) bool { return rs[i].start < rs[j].start })
+		for _, r := range rs {
+			if n := len(regions); n > 0 && regions[n-1].ref == r.ref && r.start <= regions[n-1].end {
+				if r.end > regions[n-1].end {
+					regions[n-1].end = r.end
+				}
+				continue
+			}
+			regions = append(regions, r)
+		}
+	}
+	return regions, nil
+}
+
+// generateRegionShards implements the RegionBased sharding strategy. Callback
+// regionBytes should return the approximate number of bytes of data in each of
+// the given regions.
+func generateRegionShards(header *sam.Header, opts GenerateShardsOpts,
+	regionBytes func(regions []targetRegion) ([]int64, error)) ([]gbam.Shard, error) {
+	regions, err := targetRegions(header, opts)
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := regionBytes(regions)
+	if err != nil {
+		return nil, err
+	}
+	totalBytes := int64(0)
+	for _, size := range sizes {
+		totalBytes += size
+	}
+	bytesPerShard := opts.BytesPerShard
+	if bytesPerShard <= 0 {
+		if opts.NumShards > 0 {
+			bytesPerShard = totalBytes / int64(opts.NumShards)
+		} else {
+			bytesPerShard = DefaultBytesPerShard
+		}
+	}
+	if bytesPerShard <= 0 {
+		bytesPerShard = 1
+	}
+	minBases := opts.MinBasesPerShard
+	if minBases <= 0 {
+		minBases = DefaultMinBasesPerShard
+	}
+
+	var shards []gbam.Shard
+	for i, r := range regions {
+		length := r.end - r.start
+		nShards := int((sizes[i] + bytesPerShard - 1) / bytesPerShard)
+		if maxShards := (length + minBases - 1) / minBases; nShards > maxShards {
+			nShards = maxShards
+		}
+		if nShards < 1 {
+			nShards = 1
+		}
+		width := (length + nShards - 1) / nShards
+		for start := r.start; start < r.end; start += width {
+			end := start + width
+			if end > r.end {
+				end = r.end
+			}
+			shards = append(shards, gbam.Shard{
+				StartRef: r.ref,
+				EndRef:   r.ref,
+				Start:    start,
+				End:      end,
+				Padding:  opts.Padding,
+				ShardIdx: len(shards),
+			})
+		}
+	}
+	if opts.IncludeUnmapped {
+		shards = append(shards, gbam.Shard{
+			StartRef: nil,
+			EndRef:   nil,
+			Start:    0,
+			End:      math.MaxInt32,
+			ShardIdx: len(shards),
+		})
+	}
+	vlog.VI(1).Infof("GenerateShards: %d regions, %d bytes, %d shards", len(regions), totalBytes, len(shards))
+	return shards, nil
+}
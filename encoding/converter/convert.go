@@ -207,13 +207,63 @@ func ConvertToPAM(opts pam.WriteOpts, pamPath, bamPath, baiPath string, bytesPer
 	return err
 }
 
+// ConvertProviderToPAM copies the records of "provider" to PAM. Unlike
+// ConvertToPAM, it works with any Provider, e.g., a CRAMProvider. The PAM
+// shards are the ByteBased shards of the provider, so bytesPerShard is
+// specified in terms of the input file.
+func ConvertProviderToPAM(opts pam.WriteOpts, pamPath string, provider bamprovider.Provider, bytesPerShard int64) error {
+	if pamPath == "" {
+		return fmt.Errorf("Empty pam path")
+	}
+	if bytesPerShard <= 0 {
+		return fmt.Errorf("Negative bytesPerShard: %v", bytesPerShard)
+	}
+	if e := pamutil.ValidateCoordRange(&opts.Range); e != nil {
+		return e
+	}
+	if !opts.Range.EQ(gbam.UniversalRange) {
+		return fmt.Errorf("WriteOpts.Range to ConvertProviderToPAM must be a universal range, but found %+v", opts)
+	}
+	shards, e := provider.GenerateShards(bamprovider.GenerateShardsOpts{
+		Strategy:        bamprovider.ByteBased,
+		BytesPerShard:   bytesPerShard,
+		IncludeUnmapped: true,
+	})
+	if e != nil {
+		return e
+	}
+	// Each PAM shard starts where the provider shard starts and ends where the
+	// next one starts, so that the PAM shards cover the universal range.
+	bounds := make([]bamShardBound, len(shards)+1)
+	for i, shard := range shards {
+		bounds[i].rec = biopb.Coord{int32(shard.StartRef.ID()), int32(shard.Start), 0}
+	}
+	bounds[0].rec = biopb.Coord{0, 0, 0}
+	bounds[len(shards)].rec = biopb.Coord{biopb.InfinityRefID, biopb.InfinityPos, 0}
+	vlog.Infof("%v: Creating %d shards: %+v", pamPath, len(shards), shards)
+	// Delete existing files to avoid mixing up files from multiple generations.
+	if e := pamutil.Remove(pamPath); e != nil {
+		return e
+	}
+	var totalRecs int64
+	err := traverse.Each(len(shards), func(i int) error {
+		nRecs, err := convertShard(opts, pamPath, provider, bounds[i], bounds[i+1])
+		atomic.AddInt64(&totalRecs, nRecs)
+		return err
+	})
+	vlog.Infof("%v: Finished converting, written %d records, error %v", pamPath, totalRecs, err)
+	return err
+}
+
 type convertRequest struct {
 	shardIdx int
 	records  []*sam.Record
 }
 
-// ConvertToBAM copies "provider" to a BAM file. Existing contents of "bamPath",
-// if any, are destroyed.
+// ConvertToBAM copies "provider" to a BAM file. If the header's sort order is
+// coordinate, it also writes the index of the BAM file to bamPath+".bai", or
+// bamPath+".csi" if a reference is too long for a .bai index, and a .gbai index
+// to bamPath+".gbai". Existing contents of the files, if any, are destroyed.
 func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
 	const recordsPerShard = 128 << 10
 	parallelism := runtime.NumCPU()
@@ -223,12 +273,39 @@ func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
 	if e != nil {
 		return e
 	}
+	var files []file.File
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close(ctx) // nolint: errcheck
+		}
+	}
 	out, e := file.Create(ctx, bamPath)
 	if e != nil {
 		return e
 	}
-	w, e := gbam.NewShardedBAMWriter(out.Writer(ctx), gzip.DefaultCompression, parallelism*4, header)
+	files = append(files, out)
+	var indexOpts gbam.ShardedBAMIndexOpts
+	if header.SortOrder == sam.Coordinate {
+		// The indexes are valid only for a coordinate-sorted file.
+		indexOpts.IndexFormat = gbam.IndexFormatFor(header)
+		indexOut, e := file.Create(ctx, bamPath+indexOpts.IndexFormat.Ext())
+		if e != nil {
+			closeFiles()
+			return e
+		}
+		files = append(files, indexOut)
+		indexOpts.Index = indexOut.Writer(ctx)
+		gindexOut, e := file.Create(ctx, bamPath+".gbai")
+		if e != nil {
+			closeFiles()
+			return e
+		}
+		files = append(files, gindexOut)
+		indexOpts.GIndex = gindexOut.Writer(ctx)
+	}
+	w, e := gbam.NewShardedBAMWriterWithIndex(out.Writer(ctx), gzip.DefaultCompression, parallelism*4, header, indexOpts)
 	if e != nil {
+		closeFiles()
 		return e
 	}
 
@@ -240,10 +317,17 @@ func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
 		wg.Add(1)
 		go func() {
 			c := w.GetCompressor()
+			failed := false
 			for req := range reqCh {
+				if failed {
+					// The writer has failed. Drain the remaining requests, so
+					// that the reader does not block.
+					continue
+				}
 				if e := c.StartShard(req.shardIdx); e != nil {
 					err.Set(e)
-					break
+					failed = true
+					continue
 				}
 				for _, r := range req.records {
 					c.AddRecord(r)
@@ -276,6 +360,8 @@ func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
 	err.Set(iter.Close())
 	wg.Wait()
 	err.Set(w.Close())
-	err.Set(out.Close(ctx))
+	for _, f := range files {
+		err.Set(f.Close(ctx))
+	}
 	return err.Err()
 }
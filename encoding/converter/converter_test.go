@@ -1,14 +1,18 @@
 package converter_test
 
 import (
+	"fmt"
 	"math"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/bio/encoding/converter"
 	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/bio/internal/bamtest"
 	"github.com/grailbio/hts/sam"
 	"github.com/grailbio/testutil"
 	"github.com/grailbio/testutil/assert"
@@ -28,11 +32,6 @@ func TestPAM(t *testing.T) {
 }
 
 func TestBAM(t *testing.T) {
-	sh := gosh.NewShell(t)
-	defer sh.Cleanup()
-	if !hasSamtools(t, sh) {
-		return
-	}
 	tempDir, cleanup := testutil.TempDir(t, "", "")
 	defer cleanup()
 
@@ -41,26 +40,88 @@ func TestBAM(t *testing.T) {
 	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{}, pamPath, bamPath, "", math.MaxInt64))
 
 	bam2Path := filepath.Join(tempDir, "test.bam")
-	convertToBAM(t, sh, pamPath, bam2Path)
+	// ConvertToBAM also writes the .bai index needed to read the BAM file.
+	p := bamprovider.NewProvider(pamPath)
+	assert.NoError(t, converter.ConvertToBAM(bam2Path, p))
+	assert.NoError(t, p.Close())
 	verifyFiles(t, pamPath, bam2Path)
+	verifyIdxstats(t, bam2Path)
 }
 
-func hasSamtools(t *testing.T, sh *gosh.Shell) bool {
-	if _, err := lookpath.Look(sh.Vars, "samtools"); err != nil {
-		t.Skipf("samtools not found on the machine. Skipping the test")
-		return false
+func TestBAMUnsorted(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	assert.NoError(t, err)
+	header.Version = "1.4"
+	header.SortOrder = sam.Unsorted
+	var recs []*sam.Record
+	for i, pos := range []int{100, 300, 500} {
+		recs = append(recs, bamtest.NewRecord(t, fmt.Sprintf("r%d", i), chr1, pos, 0, nil, -1, "10M"))
+	}
+	pamPath := filepath.Join(tempDir, "test.pam")
+	bamtest.WritePAM(t, pamPath, header, recs)
+
+	// The indexes are not written, since the header does not declare the
+	// records sorted by coordinate.
+	bamPath := filepath.Join(tempDir, "test.bam")
+	p := bamprovider.NewProvider(pamPath)
+	assert.NoError(t, converter.ConvertToBAM(bamPath, p))
+	assert.NoError(t, p.Close())
+	for _, ext := range []string{".bai", ".csi", ".gbai"} {
+		_, err := os.Stat(bamPath + ext)
+		assert.True(t, os.IsNotExist(err), "ext=%s, err=%v", ext, err)
+	}
+	got := bamtest.ReadBAM(t, bamPath)
+	assert.EQ(t, len(got), len(recs))
+	for i, r := range got {
+		assert.EQ(t, r.String(), recs[i].String())
 	}
-	return true
 }
 
-func convertToBAM(t *testing.T, sh *gosh.Shell, srcPath, destPath string) {
-	p := bamprovider.NewProvider(srcPath)
-	assert.NoError(t, converter.ConvertToBAM(destPath, p))
+// verifyIdxstats verifies that "samtools idxstats", which reads the index of
+// the BAM file, reports the number of records in the file. It does nothing if
+// samtools is not installed.
+func verifyIdxstats(t *testing.T, bamPath string) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	if _, err := lookpath.Look(sh.Vars, "samtools"); err != nil {
+		t.Logf("samtools not found on the machine. Skipping idxstats for %v", bamPath)
+		return
+	}
+	p := bamprovider.NewProvider(bamPath)
+	header, err := p.GetHeader()
+	assert.NoError(t, err)
+	mapped := make([]int, len(header.Refs()))
+	unmapped := make([]int, len(header.Refs()))
+	unplaced := 0
+	iter := p.NewIterator(gbam.UniversalShard(header))
+	for iter.Scan() {
+		r := iter.Record()
+		switch {
+		case r.Ref == nil:
+			unplaced++
+		case r.Flags&sam.Unmapped != 0:
+			unmapped[r.Ref.ID()]++
+		default:
+			mapped[r.Ref.ID()]++
+		}
+		sam.PutInFreePool(r)
+	}
+	assert.NoError(t, iter.Close())
 	assert.NoError(t, p.Close())
 
-	cmd := sh.Cmd("samtools", "index", destPath)
-	cmd.Run()
-	assert.NoError(t, cmd.Err)
+	var expected strings.Builder
+	for i, ref := range header.Refs() {
+		fmt.Fprintf(&expected, "%s\t%d\t%d\t%d\n", ref.Name(), ref.Len(), mapped[i], unmapped[i])
+	}
+	fmt.Fprintf(&expected, "*\t0\t0\t%d\n", unplaced)
+	cmd := sh.Cmd("samtools", "idxstats", bamPath)
+	assert.EQ(t, cmd.Stdout(), expected.String())
+	assert.NoError(t, sh.Err)
 }
 
 // verifyFiles verifes that files path0 and path1 store the same records in the
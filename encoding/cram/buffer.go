@@ -0,0 +1,197 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package cram
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errTruncated = errors.New("cram: truncated data")
+
+// buffer is a cursor over an in-memory byte slice. Reading past the end of the
+// slice sets err, and subsequent reads return zeros. The caller should check
+// err after decoding a logical unit, such as a block header or a record.
+type buffer struct {
+	b   []byte
+	off int
+	err error
+}
+
+func newBuffer(b []byte) *buffer {
+	return &buffer{b: b}
+}
+
+func (b *buffer) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// ReadByte implements io.ByteReader.
+func (b *buffer) ReadByte() (byte, error) {
+	if b.off >= len(b.b) {
+		b.setErr(errTruncated)
+		return 0, errTruncated
+	}
+	v := b.b[b.off]
+	b.off++
+	return v, nil
+}
+
+func (b *buffer) byte() byte {
+	v, _ := b.ReadByte()
+	return v
+}
+
+// bytes returns the next n bytes. The result aliases the underlying slice.
+func (b *buffer) bytes(n int) []byte {
+	if n < 0 || b.off+n > len(b.b) {
+		b.setErr(errTruncated)
+		b.off = len(b.b)
+		return nil
+	}
+	v := b.b[b.off : b.off+n : b.off+n]
+	b.off += n
+	return v
+}
+
+func (b *buffer) uint32() uint32 {
+	v := b.bytes(4)
+	if v == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(v)
+}
+
+func (b *buffer) itf8() int32 {
+	v, err := readITF8(b)
+	if err != nil {
+		b.setErr(err)
+	}
+	return v
+}
+
+func (b *buffer) ltf8() int64 {
+	v, err := readLTF8(b)
+	if err != nil {
+		b.setErr(err)
+	}
+	return v
+}
+
+func (b *buffer) itf8Array() []int32 {
+	n := b.itf8()
+	if n < 0 || int(n) > len(b.b)-b.off {
+		b.setErr(errTruncated)
+		return nil
+	}
+	v := make([]int32, n)
+	for i := range v {
+		v[i] = b.itf8()
+	}
+	return v
+}
+
+// remaining returns the number of unread bytes.
+func (b *buffer) remaining() int {
+	return len(b.b) - b.off
+}
+
+// readITF8 reads an ITF8-encoded integer. The number of leading one bits in
+// the first byte determines the number of bytes that follow.
+func readITF8(r io.ByteReader) (int32, error) {
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	switch {
+	case b0&0x80 == 0:
+		return int32(b0), nil
+	case b0&0x40 == 0:
+		n = 1
+	case b0&0x20 == 0:
+		n = 2
+	case b0&0x10 == 0:
+		n = 3
+	default:
+		n = 4
+	}
+	v := uint32(b0) & (0xff >> uint(n+1))
+	if n == 4 {
+		v = uint32(b0) & 0x0f
+	}
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if i == 3 {
+			// The 5-byte form uses only the low 4 bits of the last byte.
+			v = v<<4 | uint32(b&0x0f)
+		} else {
+			v = v<<8 | uint32(b)
+		}
+	}
+	return int32(v), nil
+}
+
+// readLTF8 reads an LTF8-encoded integer. It is the 64-bit counterpart of ITF8.
+func readLTF8(r io.ByteReader) (int64, error) {
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < 8 && b0&(0x80>>uint(n)) != 0 {
+		n++
+	}
+	var v uint64
+	if n < 8 {
+		v = uint64(b0) & (0xff >> uint(n+1))
+	}
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return int64(v), nil
+}
+
+// bitReader reads bits from the core data block, most significant bit first.
+type bitReader struct {
+	b   []byte
+	off int  // Index of the current byte.
+	bit uint // Number of bits already consumed in b[off].
+	err error
+}
+
+func (r *bitReader) readBit() uint32 {
+	if r.off >= len(r.b) {
+		if r.err == nil {
+			r.err = errTruncated
+		}
+		return 0
+	}
+	v := uint32(r.b[r.off]>>(7-r.bit)) & 1
+	r.bit++
+	if r.bit == 8 {
+		r.bit = 0
+		r.off++
+	}
+	return v
+}
+
+func (r *bitReader) readBits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.readBit()
+	}
+	return v
+}
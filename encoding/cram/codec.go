@@ -0,0 +1,359 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package cram
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Encoding IDs, as defined in the CRAM specification.
+const (
+	encodingNull          = 0
+	encodingExternal      = 1
+	encodingHuffman       = 3
+	encodingByteArrayLen  = 4
+	encodingByteArrayStop = 5
+	encodingBeta          = 6
+	encodingSubexp        = 7
+	encodingGamma         = 9
+)
+
+// dataSource is the set of blocks of a slice that codecs read from.
+type dataSource struct {
+	core     bitReader
+	external map[int32]*buffer
+	err      error
+}
+
+func (d *dataSource) setErr(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// ext returns the external block with the given content ID. It returns an
+// empty buffer and sets d.err if the block does not exist.
+func (d *dataSource) ext(id int32) *buffer {
+	b := d.external[id]
+	if b == nil {
+		d.setErr(fmt.Errorf("cram: external block %d not found", id))
+		b = newBuffer(nil)
+		d.external[id] = b
+	}
+	return b
+}
+
+// Err returns the first error encountered by the codecs.
+func (d *dataSource) Err() error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.core.err != nil {
+		return d.core.err
+	}
+	for id, b := range d.external {
+		if b.err != nil {
+			return fmt.Errorf("cram: external block %d: %v", id, b.err)
+		}
+	}
+	return nil
+}
+
+// codec decodes one data series. A data series holds either integers, bytes,
+// or byte arrays, so each codec implements only some of the methods. Others
+// set an error in the dataSource.
+type codec interface {
+	readInt(d *dataSource) int32
+	readByte(d *dataSource) byte
+	// readBytes reads a byte array whose length is encoded in the data.
+	readBytes(d *dataSource) []byte
+	// readN reads n bytes.
+	readN(d *dataSource, n int) []byte
+}
+
+// baseCodec provides default implementations of codec methods in terms of
+// readInt.
+type baseCodec struct {
+	name string
+}
+
+func (c baseCodec) readBytes(d *dataSource) []byte {
+	d.setErr(fmt.Errorf("cram: %s encoding cannot decode a byte array", c.name))
+	return nil
+}
+
+// intCodec is a codec that decodes integers from the core block.
+type intCodec interface {
+	readInt(d *dataSource) int32
+}
+
+func readNBytes(c intCodec, d *dataSource, n int) []byte {
+	v := make([]byte, n)
+	for i := range v {
+		v[i] = byte(c.readInt(d))
+	}
+	return v
+}
+
+// missingCodec is used for data series that are absent from the compression
+// header. It reports an error when used.
+type missingCodec struct {
+	key string
+}
+
+func (c missingCodec) fail(d *dataSource) {
+	d.setErr(fmt.Errorf("cram: data series %s is used but not encoded", c.key))
+}
+
+func (c missingCodec) readInt(d *dataSource) int32       { c.fail(d); return 0 }
+func (c missingCodec) readByte(d *dataSource) byte       { c.fail(d); return 0 }
+func (c missingCodec) readBytes(d *dataSource) []byte    { c.fail(d); return nil }
+func (c missingCodec) readN(d *dataSource, n int) []byte { c.fail(d); return nil }
+
+// externalCodec reads values from an external block. Integers are ITF8
+// encoded.
+type externalCodec struct {
+	baseCodec
+	id int32
+}
+
+func (c *externalCodec) readInt(d *dataSource) int32       { return d.ext(c.id).itf8() }
+func (c *externalCodec) readByte(d *dataSource) byte       { return d.ext(c.id).byte() }
+func (c *externalCodec) readN(d *dataSource, n int) []byte { return d.ext(c.id).bytes(n) }
+
+// huffmanCodec decodes canonical Huffman codes from the core block.
+type huffmanCodec struct {
+	baseCodec
+	// Symbols, their code lengths and codes, sorted by (length, symbol).
+	syms  []int32
+	lens  []int
+	codes []uint32
+}
+
+func newHuffmanCodec(syms []int32, lens []int32) (*huffmanCodec, error) {
+	if len(syms) == 0 || len(syms) != len(lens) {
+		return nil, fmt.Errorf("cram: invalid huffman alphabet, %d symbols, %d lengths", len(syms), len(lens))
+	}
+	c := &huffmanCodec{baseCodec: baseCodec{"huffman"}}
+	order := make([]int, len(syms))
+	for i := range order {
+		order[i] = i
+		if lens[i] < 0 || lens[i] > 31 {
+			return nil, fmt.Errorf("cram: invalid huffman code length %d", lens[i])
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if lens[order[i]] != lens[order[j]] {
+			return lens[order[i]] < lens[order[j]]
+		}
+		return syms[order[i]] < syms[order[j]]
+	})
+	var code uint32
+	for i, o := range order {
+		if i > 0 {
+			code = (code + 1) << uint(lens[o]-lens[order[i-1]])
+		}
+		c.syms = append(c.syms, syms[o])
+		c.lens = append(c.lens, int(lens[o]))
+		c.codes = append(c.codes, code)
+	}
+	return c, nil
+}
+
+func (c *huffmanCodec) readInt(d *dataSource) int32 {
+	if c.lens[0] == 0 {
+		// A single symbol, which takes no bits.
+		return c.syms[0]
+	}
+	var code uint32
+	n := 0
+	for i, l := range c.lens {
+		for n < l {
+			code = code<<1 | d.core.readBit()
+			n++
+		}
+		if c.codes[i] == code {
+			return c.syms[i]
+		}
+	}
+	d.setErr(fmt.Errorf("cram: invalid huffman code %b", code))
+	return 0
+}
+
+func (c *huffmanCodec) readByte(d *dataSource) byte       { return byte(c.readInt(d)) }
+func (c *huffmanCodec) readN(d *dataSource, n int) []byte { return readNBytes(c, d, n) }
+
+// betaCodec reads fixed-width integers from the core block.
+type betaCodec struct {
+	baseCodec
+	offset int32
+	nBits  int
+}
+
+func (c *betaCodec) readInt(d *dataSource) int32 {
+	return int32(d.core.readBits(c.nBits)) - c.offset
+}
+
+func (c *betaCodec) readByte(d *dataSource) byte       { return byte(c.readInt(d)) }
+func (c *betaCodec) readN(d *dataSource, n int) []byte { return readNBytes(c, d, n) }
+
+// subexpCodec reads sub-exponential codes from the core block.
+type subexpCodec struct {
+	baseCodec
+	offset int32
+	k      int
+}
+
+func (c *subexpCodec) readInt(d *dataSource) int32 {
+	u := 0
+	for d.core.readBit() == 1 && d.core.err == nil {
+		u++
+	}
+	var v uint32
+	if u == 0 {
+		v = d.core.readBits(c.k)
+	} else {
+		b := u + c.k - 1
+		v = 1<<uint(b) | d.core.readBits(b)
+	}
+	return int32(v) - c.offset
+}
+
+func (c *subexpCodec) readByte(d *dataSource) byte       { return byte(c.readInt(d)) }
+func (c *subexpCodec) readN(d *dataSource, n int) []byte { return readNBytes(c, d, n) }
+
+// gammaCodec reads Elias gamma codes from the core block.
+type gammaCodec struct {
+	baseCodec
+	offset int32
+}
+
+func (c *gammaCodec) readInt(d *dataSource) int32 {
+	n := 0
+	for d.core.readBit() == 0 && d.core.err == nil {
+		n++
+	}
+	v := uint32(1)<<uint(n) | d.core.readBits(n)
+	return int32(v) - c.offset
+}
+
+func (c *gammaCodec) readByte(d *dataSource) byte       { return byte(c.readInt(d)) }
+func (c *gammaCodec) readN(d *dataSource, n int) []byte { return readNBytes(c, d, n) }
+
+// byteArrayLenCodec reads a byte array as its length followed by its
+// contents, each with its own codec.
+type byteArrayLenCodec struct {
+	lenCodec, valCodec codec
+}
+
+func (c *byteArrayLenCodec) readBytes(d *dataSource) []byte {
+	n := c.lenCodec.readInt(d)
+	if n < 0 {
+		d.setErr(fmt.Errorf("cram: negative byte array length %d", n))
+		return nil
+	}
+	return c.valCodec.readN(d, int(n))
+}
+
+func (c *byteArrayLenCodec) readInt(d *dataSource) int32 {
+	d.setErr(fmt.Errorf("cram: byte_array_len encoding cannot decode an integer"))
+	return 0
+}
+
+func (c *byteArrayLenCodec) readByte(d *dataSource) byte {
+	d.setErr(fmt.Errorf("cram: byte_array_len encoding cannot decode a byte"))
+	return 0
+}
+
+func (c *byteArrayLenCodec) readN(d *dataSource, n int) []byte { return c.readBytes(d) }
+
+// byteArrayStopCodec reads a byte array terminated by a stop byte from an
+// external block.
+type byteArrayStopCodec struct {
+	stop byte
+	id   int32
+}
+
+func (c *byteArrayStopCodec) readBytes(d *dataSource) []byte {
+	b := d.ext(c.id)
+	for i := b.off; i < len(b.b); i++ {
+		if b.b[i] == c.stop {
+			v := b.b[b.off:i:i]
+			b.off = i + 1
+			return v
+		}
+	}
+	b.setErr(errTruncated)
+	return nil
+}
+
+func (c *byteArrayStopCodec) readInt(d *dataSource) int32 {
+	d.setErr(fmt.Errorf("cram: byte_array_stop encoding cannot decode an integer"))
+	return 0
+}
+
+func (c *byteArrayStopCodec) readByte(d *dataSource) byte {
+	d.setErr(fmt.Errorf("cram: byte_array_stop encoding cannot decode a byte"))
+	return 0
+}
+
+func (c *byteArrayStopCodec) readN(d *dataSource, n int) []byte { return c.readBytes(d) }
+
+// readEncoding parses an encoding specification: the encoding ID, followed by
+// the length of the parameters and the parameters themselves.
+func readEncoding(b *buffer) (codec, error) {
+	id := b.itf8()
+	n := b.itf8()
+	params := newBuffer(b.bytes(int(n)))
+	if b.err != nil {
+		return nil, b.err
+	}
+	var c codec
+	switch id {
+	case encodingNull:
+		c = missingCodec{"(null)"}
+	case encodingExternal:
+		c = &externalCodec{baseCodec: baseCodec{"external"}, id: params.itf8()}
+	case encodingHuffman:
+		syms := params.itf8Array()
+		lens := params.itf8Array()
+		if params.err != nil {
+			return nil, params.err
+		}
+		h, err := newHuffmanCodec(syms, lens)
+		if err != nil {
+			return nil, err
+		}
+		c = h
+	case encodingByteArrayLen:
+		lenCodec, err := readEncoding(params)
+		if err != nil {
+			return nil, err
+		}
+		valCodec, err := readEncoding(params)
+		if err != nil {
+			return nil, err
+		}
+		c = &byteArrayLenCodec{lenCodec: lenCodec, valCodec: valCodec}
+	case encodingByteArrayStop:
+		stop := params.byte()
+		c = &byteArrayStopCodec{stop: stop, id: params.itf8()}
+	case encodingBeta:
+		offset := params.itf8()
+		c = &betaCodec{baseCodec: baseCodec{"beta"}, offset: offset, nBits: int(params.itf8())}
+	case encodingSubexp:
+		offset := params.itf8()
+		c = &subexpCodec{baseCodec: baseCodec{"subexp"}, offset: offset, k: int(params.itf8())}
+	case encodingGamma:
+		c = &gammaCodec{baseCodec: baseCodec{"gamma"}, offset: params.itf8()}
+	default:
+		return nil, fmt.Errorf("cram: unsupported encoding %d", id)
+	}
+	if params.err != nil {
+		return nil, params.err
+	}
+	return c, nil
+}
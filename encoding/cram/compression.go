@@ -0,0 +1,153 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package cram
+
+import (
+	"fmt"
+)
+
+// compressionHeader describes how the records in a container are encoded.
+type compressionHeader struct {
+	readNamesIncluded bool // RN
+	apDelta           bool // AP
+	refRequired       bool // RR
+
+	// subst[b][code] is the base that substitutes the reference base b, which
+	// is one of "ACGTN", for the substitution code.
+	subst [5][4]byte
+
+	// tagLines lists the aux tags of each tag line. The tag ID is
+	// tag[0]<<16|tag[1]<<8|type.
+	tagLines [][]int32
+
+	// Data series codecs.
+	bf, cf, ri, rl, ap, rg, rn, mf, ns, np, ts, nf, tl, fn, fc, fp codec
+	ba, qs, bs, in, sc, hc, pd, dl, rs, bb, qq, mq                 codec
+
+	// Aux tag codecs, keyed by tag ID.
+	tags map[int32]codec
+}
+
+// refBases lists the bases in the order used by the substitution matrix.
+const refBases = "ACGTN"
+
+// baseIndex returns the index of base b in refBases. Bases other than ACGT map
+// to N.
+func baseIndex(b byte) int {
+	switch b {
+	case 'A', 'a':
+		return 0
+	case 'C', 'c':
+		return 1
+	case 'G', 'g':
+		return 2
+	case 'T', 't':
+		return 3
+	}
+	return 4
+}
+
+func readCompressionHeader(data []byte) (*compressionHeader, error) {
+	ch := &compressionHeader{
+		readNamesIncluded: true,
+		apDelta:           true,
+		refRequired:       true,
+		tags:              map[int32]codec{},
+	}
+	b := newBuffer(data)
+
+	// Preservation map.
+	b.itf8() // size in bytes
+	n := b.itf8()
+	for i := int32(0); i < n && b.err == nil; i++ {
+		key := string(b.bytes(2))
+		switch key {
+		case "RN":
+			ch.readNamesIncluded = b.byte() != 0
+		case "AP":
+			ch.apDelta = b.byte() != 0
+		case "RR":
+			ch.refRequired = b.byte() != 0
+		case "SM":
+			sm := b.bytes(5)
+			if sm == nil {
+				break
+			}
+			for ref := 0; ref < 5; ref++ {
+				j := 0
+				for base := 0; base < 5; base++ {
+					if base == ref {
+						continue
+					}
+					code := (sm[ref] >> uint(6-2*j)) & 3
+					ch.subst[ref][code] = refBases[base]
+					j++
+				}
+			}
+		case "TD":
+			td := b.bytes(int(b.itf8()))
+			start := 0
+			for j, c := range td {
+				if c != 0 {
+					continue
+				}
+				entry := td[start:j]
+				if len(entry)%3 != 0 {
+					return nil, fmt.Errorf("cram: invalid tag dictionary entry %q", entry)
+				}
+				var line []int32
+				for k := 0; k < len(entry); k += 3 {
+					line = append(line, int32(entry[k])<<16|int32(entry[k+1])<<8|int32(entry[k+2]))
+				}
+				ch.tagLines = append(ch.tagLines, line)
+				start = j + 1
+			}
+		default:
+			return nil, fmt.Errorf("cram: unknown preservation map key %q", key)
+		}
+	}
+
+	// Data series encoding map.
+	series := map[string]codec{}
+	b.itf8() // size in bytes
+	n = b.itf8()
+	for i := int32(0); i < n && b.err == nil; i++ {
+		key := string(b.bytes(2))
+		c, err := readEncoding(b)
+		if err != nil {
+			return nil, fmt.Errorf("cram: data series %s: %v", key, err)
+		}
+		series[key] = c
+	}
+	get := func(key string) codec {
+		if c, ok := series[key]; ok {
+			return c
+		}
+		return missingCodec{key}
+	}
+	ch.bf, ch.cf, ch.ri, ch.rl = get("BF"), get("CF"), get("RI"), get("RL")
+	ch.ap, ch.rg, ch.rn, ch.mf = get("AP"), get("RG"), get("RN"), get("MF")
+	ch.ns, ch.np, ch.ts, ch.nf = get("NS"), get("NP"), get("TS"), get("NF")
+	ch.tl, ch.fn, ch.fc, ch.fp = get("TL"), get("FN"), get("FC"), get("FP")
+	ch.ba, ch.qs, ch.bs, ch.in = get("BA"), get("QS"), get("BS"), get("IN")
+	ch.sc, ch.hc, ch.pd, ch.dl = get("SC"), get("HC"), get("PD"), get("DL")
+	ch.rs, ch.bb, ch.qq, ch.mq = get("RS"), get("BB"), get("QQ"), get("MQ")
+
+	// Tag encoding map.
+	b.itf8() // size in bytes
+	n = b.itf8()
+	for i := int32(0); i < n && b.err == nil; i++ {
+		key := b.itf8()
+		c, err := readEncoding(b)
+		if err != nil {
+			return nil, fmt.Errorf("cram: tag %c%c%c: %v", key>>16, key>>8&0xff, key&0xff, err)
+		}
+		ch.tags[key] = c
+	}
+	if b.err != nil {
+		return nil, fmt.Errorf("cram: read compression header: %v", b.err)
+	}
+	return ch, nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package cram implements a reader for CRAM files, versions 2.1 and 3.0.
+//
+// A CRAM file is a sequence of containers. Each container holds a compression
+// header and one or more slices, and each slice holds a core data block and
+// external data blocks from which records are decoded. Read sequences are
+// stored as differences against a reference, so the reader needs the reference
+// FASTA that the file was created with, unless the sequences are embedded in
+// the file.
+//
+// Limitations: blocks compressed with LZMA, or with the codecs introduced in
+// CRAM 3.1, are not supported. MD and NM tags are returned only if they are
+// stored in the file; they are not regenerated from the reference.
+package cram
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/hts/sam"
+	"github.com/klauspost/compress/gzip"
+)
+
+var cramMagic = []byte("CRAM")
+
+// fileDefinitionSize is the size of the CRAM file definition: the magic, the
+// major and minor versions, and the 20-byte file ID.
+const fileDefinitionSize = 26
+
+// Block compression methods.
+const (
+	methodRaw   = 0
+	methodGzip  = 1
+	methodBzip2 = 2
+	methodLZMA  = 3
+	methodRANS  = 4
+)
+
+// Block content types.
+const (
+	contentFileHeader        = 0
+	contentCompressionHeader = 1
+	contentSliceHeader       = 2
+	contentExternal          = 4
+	contentCore              = 5
+)
+
+// containerHeader is the header of a container.
+type containerHeader struct {
+	length        int32 // Size of the container data, excluding the header.
+	refID         int32
+	start         int32 // 1-based alignment start.
+	span          int32
+	nRecords      int32
+	recordCounter int64
+	bases         int64
+	nBlocks       int32
+	landmarks     []int32 // Slice offsets, relative to the container data.
+}
+
+// block is a decompressed block.
+type block struct {
+	contentType byte
+	contentID   int32
+	data        []byte
+}
+
+// Reader reads records from a CRAM file.
+type Reader struct {
+	in     io.Reader
+	r      *bufio.Reader
+	major  byte
+	minor  byte
+	header *sam.Header
+	ref    fasta.Fasta
+
+	recs []*sam.Record
+	next int
+}
+
+// NewReader creates a reader. It reads the file definition and the SAM header
+// from "in". Arg "ref" is the reference that the CRAM file was created with.
+// It may be nil if the file does not need a reference, e.g., it contains only
+// unmapped reads or embedded references.
+func NewReader(in io.Reader, ref fasta.Fasta) (*Reader, error) {
+	r := &Reader{in: in, r: bufio.NewReaderSize(in, 1<<20), ref: ref}
+	def := make([]byte, fileDefinitionSize)
+	if _, err := io.ReadFull(r.r, def); err != nil {
+		return nil, fmt.Errorf("cram: read file definition: %v", err)
+	}
+	if !bytes.Equal(def[:4], cramMagic) {
+		return nil, fmt.Errorf("cram: not a CRAM file")
+	}
+	r.major, r.minor = def[4], def[5]
+	// CRAM 3.1 and later need codecs that are not implemented.
+	if !(r.major == 2 && r.minor == 1) && !(r.major == 3 && r.minor == 0) {
+		return nil, fmt.Errorf("cram: unsupported version %d.%d; only versions 2.1 and 3.0 are supported", r.major, r.minor)
+	}
+	h, data, err := r.readContainer()
+	if err != nil {
+		return nil, err
+	}
+	if h.nBlocks < 1 {
+		return nil, fmt.Errorf("cram: SAM header container has no block")
+	}
+	blk, err := r.readBlock(newBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	text := newBuffer(blk.data)
+	n := int32(text.uint32())
+	headerText := text.bytes(int(n))
+	if text.err != nil {
+		return nil, fmt.Errorf("cram: read SAM header: %v", text.err)
+	}
+	if r.header, err = sam.NewHeader(bytes.TrimRight(headerText, "\x00"), nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Header returns the SAM header.
+func (r *Reader) Header() *sam.Header {
+	return r.header
+}
+
+// SeekContainer moves the reader to the container at the given file offset.
+// Offsets are usually obtained from the CRAM index. SeekContainer requires that
+// the reader was created with an io.Seeker.
+func (r *Reader) SeekContainer(off int64) error {
+	s, ok := r.in.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("cram: reader is not seekable")
+	}
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	r.r.Reset(r.in)
+	r.recs = r.recs[:0]
+	r.next = 0
+	return nil
+}
+
+// Read returns the next record. It returns io.EOF at the end of the file.
+func (r *Reader) Read() (*sam.Record, error) {
+	for r.next >= len(r.recs) {
+		if err := r.readRecords(); err != nil {
+			return nil, err
+		}
+	}
+	rec := r.recs[r.next]
+	r.recs[r.next] = nil
+	r.next++
+	return rec, nil
+}
+
+// readRecords decodes the records in the next container into r.recs.
+func (r *Reader) readRecords() error {
+	h, data, err := r.readContainer()
+	if err != nil {
+		return err
+	}
+	r.recs = r.recs[:0]
+	r.next = 0
+	if h.nRecords == 0 {
+		// An EOF container, or an empty one.
+		return nil
+	}
+	b := newBuffer(data)
+	blk, err := r.readBlock(b)
+	if err != nil {
+		return err
+	}
+	if blk.contentType != contentCompressionHeader {
+		return fmt.Errorf("cram: expect a compression header, found block type %d", blk.contentType)
+	}
+	ch, err := readCompressionHeader(blk.data)
+	if err != nil {
+		return err
+	}
+	for _, landmark := range h.landmarks {
+		if landmark < 0 || int(landmark) > len(data) {
+			return fmt.Errorf("cram: invalid slice offset %d", landmark)
+		}
+		if r.recs, err = r.readSlice(newBuffer(data[landmark:]), ch, r.recs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readContainer reads the next container and returns its header and the
+// container data. It returns io.EOF at the end of the file.
+func (r *Reader) readContainer() (h containerHeader, data []byte, err error) {
+	var lenBuf [4]byte
+	if _, err = io.ReadFull(r.r, lenBuf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errTruncated
+		}
+		return
+	}
+	h.length = int32(binary.LittleEndian.Uint32(lenBuf[:]))
+	itf8 := func() int32 {
+		v, e := readITF8(r.r)
+		if e != nil && err == nil {
+			err = e
+		}
+		return v
+	}
+	h.refID = itf8()
+	h.start = itf8()
+	h.span = itf8()
+	h.nRecords = itf8()
+	if r.major >= 3 {
+		var e error
+		if h.recordCounter, e = readLTF8(r.r); e != nil && err == nil {
+			err = e
+		}
+	} else {
+		h.recordCounter = int64(itf8())
+	}
+	var e error
+	if h.bases, e = readLTF8(r.r); e != nil && err == nil {
+		err = e
+	}
+	h.nBlocks = itf8()
+	nLandmarks := itf8()
+	if err == nil && (nLandmarks < 0 || nLandmarks > h.length) {
+		err = fmt.Errorf("cram: invalid container header %+v", h)
+	}
+	if err != nil {
+		return
+	}
+	h.landmarks = make([]int32, nLandmarks)
+	for i := range h.landmarks {
+		h.landmarks[i] = itf8()
+	}
+	if r.major >= 3 {
+		var crc [4]byte
+		if _, e := io.ReadFull(r.r, crc[:]); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = errTruncated
+		}
+		return
+	}
+	if h.length < 0 {
+		err = fmt.Errorf("cram: invalid container length %d", h.length)
+		return
+	}
+	data = make([]byte, h.length)
+	if _, err = io.ReadFull(r.r, data); err != nil {
+		err = fmt.Errorf("cram: read container: %v", err)
+	}
+	return
+}
+
+// readBlock reads and decompresses a block.
+func (r *Reader) readBlock(b *buffer) (*block, error) {
+	method := b.byte()
+	blk := &block{contentType: b.byte(), contentID: b.itf8()}
+	compSize := b.itf8()
+	rawSize := b.itf8()
+	data := b.bytes(int(compSize))
+	if r.major >= 3 {
+		b.uint32() // CRC32
+	}
+	if b.err != nil {
+		return nil, fmt.Errorf("cram: read block: %v", b.err)
+	}
+	var err error
+	switch method {
+	case methodRaw:
+		blk.data = data
+	case methodGzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			blk.data, err = ioutil.ReadAll(zr)
+		}
+	case methodBzip2:
+		blk.data, err = ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+	case methodRANS:
+		blk.data, err = ransUncompress(data)
+	case methodLZMA:
+		err = fmt.Errorf("cram: LZMA compression is not supported")
+	default:
+		err = fmt.Errorf("cram: unsupported block compression method %d", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(blk.data) != int(rawSize) {
+		return nil, fmt.Errorf("cram: block size mismatch: expect %d, found %d", rawSize, len(blk.data))
+	}
+	return blk, nil
+}
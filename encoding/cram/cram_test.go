@@ -0,0 +1,716 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package cram
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+	"github.com/klauspost/compress/gzip"
+)
+
+func putITF8(b *bytes.Buffer, v int32) {
+	u := uint32(v)
+	switch {
+	case u < 0x80:
+		b.WriteByte(byte(u))
+	case u < 0x4000:
+		b.Write([]byte{byte(u>>8) | 0x80, byte(u)})
+	case u < 0x200000:
+		b.Write([]byte{byte(u>>16) | 0xc0, byte(u >> 8), byte(u)})
+	case u < 0x10000000:
+		b.Write([]byte{byte(u>>24) | 0xe0, byte(u >> 16), byte(u >> 8), byte(u)})
+	default:
+		b.Write([]byte{byte(u>>28) | 0xf0, byte(u >> 20), byte(u >> 12), byte(u >> 4), byte(u & 0x0f)})
+	}
+}
+
+func putLTF8(b *bytes.Buffer, v int64) {
+	// Always use the 9-byte form.
+	b.WriteByte(0xff)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	b.Write(buf[:])
+}
+
+func TestITF8(t *testing.T) {
+	for _, v := range []int32{0, 1, 127, 128, 0x3fff, 0x4000, 0x1fffff, 0x200000, 0xfffffff, 0x10000000, -1, -2, 1 << 30} {
+		b := bytes.Buffer{}
+		putITF8(&b, v)
+		got, err := readITF8(&b)
+		assert.NoError(t, err)
+		assert.EQ(t, got, v)
+	}
+	for _, v := range []int64{0, 1, 1 << 40, -1} {
+		b := bytes.Buffer{}
+		putLTF8(&b, v)
+		got, err := readLTF8(&b)
+		assert.NoError(t, err)
+		assert.EQ(t, got, v)
+	}
+	// Short forms of LTF8.
+	got, err := readLTF8(bytes.NewReader([]byte{0x81, 0x02}))
+	assert.NoError(t, err)
+	assert.EQ(t, got, int64(0x102))
+}
+
+// ransNormalize scales the symbol counts so that the frequencies add up to
+// ransTotFreq, keeping every used symbol's frequency above zero.
+func ransNormalize(counts [256]int) (freq, cum [256]uint32) {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	var syms []int
+	total := uint32(0)
+	for s, c := range counts {
+		if c > 0 {
+			freq[s] = uint32(c * ransTotFreq / n)
+			if freq[s] == 0 {
+				freq[s] = 1
+			}
+			total += freq[s]
+			syms = append(syms, s)
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool { return freq[syms[i]] > freq[syms[j]] })
+	for i := 0; total != ransTotFreq; i = (i + 1) % len(syms) {
+		if total < ransTotFreq {
+			freq[syms[i]]++
+			total++
+		} else if freq[syms[i]] > 1 {
+			freq[syms[i]]--
+			total--
+		}
+	}
+	x := uint32(0)
+	for s := range freq {
+		cum[s] = x
+		x += freq[s]
+	}
+	return
+}
+
+// ransWriteTable writes a frequency table in the format read by readModel.
+func ransWriteTable(table *bytes.Buffer, freq [256]uint32) {
+	prev := -1
+	for s := range freq {
+		if freq[s] == 0 {
+			continue
+		}
+		table.WriteByte(byte(s))
+		if prev >= 0 && s == prev+1 {
+			table.WriteByte(0) // Run length.
+		}
+		if freq[s] >= 128 {
+			table.Write([]byte{byte(freq[s]>>8) | 128, byte(freq[s])})
+		} else {
+			table.WriteByte(byte(freq[s]))
+		}
+		prev = s
+	}
+	table.WriteByte(0)
+}
+
+// ransEncoder encodes symbols backwards, prepending the output bytes.
+type ransEncoder struct {
+	r      [4]uint32
+	stream []byte
+}
+
+func newRANSEncoder() *ransEncoder {
+	return &ransEncoder{r: [4]uint32{ransLowerBound, ransLowerBound, ransLowerBound, ransLowerBound}}
+}
+
+func (e *ransEncoder) prepend(b byte) { e.stream = append([]byte{b}, e.stream...) }
+
+func (e *ransEncoder) put(j int, freq, cum uint32) {
+	st := &e.r[j]
+	xMax := ((ransLowerBound >> ransFreqBits) << 8) * freq
+	for *st >= xMax {
+		e.prepend(byte(*st))
+		*st >>= 8
+	}
+	*st = ((*st / freq) << ransFreqBits) + (*st % freq) + cum
+}
+
+// finish returns the compressed payload, including the 9-byte header.
+func (e *ransEncoder) finish(order byte, table []byte, rawSize int) []byte {
+	for j := 3; j >= 0; j-- {
+		for k := 3; k >= 0; k-- {
+			e.prepend(byte(e.r[j] >> uint(8*k)))
+		}
+	}
+	out := bytes.Buffer{}
+	out.WriteByte(order)
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(len(table)+len(e.stream)))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(rawSize))
+	out.Write(hdr[:])
+	out.Write(table)
+	out.Write(e.stream)
+	return out.Bytes()
+}
+
+// ransCompressO0 is a reference order-0 rANS 4x8 encoder.
+func ransCompressO0(in []byte) []byte {
+	var counts [256]int
+	for _, c := range in {
+		counts[c]++
+	}
+	freq, cum := ransNormalize(counts)
+	table := bytes.Buffer{}
+	ransWriteTable(&table, freq)
+	e := newRANSEncoder()
+	for i := len(in) - 1; i >= 0; i-- {
+		e.put(i&3, freq[in[i]], cum[in[i]])
+	}
+	return e.finish(0, table.Bytes(), len(in))
+}
+
+// ransCompressO1 is a reference order-1 rANS 4x8 encoder, laid out like the
+// htslib one: the input is split into four quarters, each coded by its own
+// state with the previous symbol of the quarter as the context, and the last
+// state also codes the remainder.
+func ransCompressO1(in []byte) []byte {
+	quarter := len(in) / 4
+	// context returns the context of the symbol at in[i].
+	context := func(i int) byte {
+		if i < 4*quarter && i%quarter == 0 || i == 0 {
+			return 0
+		}
+		return in[i-1]
+	}
+	var counts [256][256]int
+	for i, c := range in {
+		counts[context(i)][c]++
+	}
+	var freq, cum [256][256]uint32
+	table := bytes.Buffer{}
+	prev := -1
+	for ctx := range counts {
+		n := 0
+		for _, c := range counts[ctx] {
+			n += c
+		}
+		if n == 0 {
+			continue
+		}
+		freq[ctx], cum[ctx] = ransNormalize(counts[ctx])
+		table.WriteByte(byte(ctx))
+		if prev >= 0 && ctx == prev+1 {
+			table.WriteByte(0) // Run length.
+		}
+		ransWriteTable(&table, freq[ctx])
+		prev = ctx
+	}
+	table.WriteByte(0)
+
+	e := newRANSEncoder()
+	put := func(j, i int) {
+		ctx, s := context(i), in[i]
+		e.put(j, freq[ctx][s], cum[ctx][s])
+	}
+	for i := len(in) - 1; i >= 4*quarter; i-- {
+		put(3, i)
+	}
+	for i := quarter - 1; i >= 0; i-- {
+		for j := 3; j >= 0; j-- {
+			put(j, j*quarter+i)
+		}
+	}
+	return e.finish(1, table.Bytes(), len(in))
+}
+
+func TestRANS(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, n := range []int{1, 3, 4, 5, 100, 10007} {
+		in := make([]byte, n)
+		for i := range in {
+			in[i] = "AACCCGTTTN!"[r.Intn(11)] + byte(r.Intn(2))
+		}
+		got, err := ransUncompress(ransCompressO0(in))
+		assert.NoError(t, err)
+		assert.EQ(t, got, in)
+	}
+}
+
+func TestRANSOrder1(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, n := range []int{1, 3, 4, 5, 7, 100, 10007} {
+		// Make each symbol depend on the previous one, as in quality scores.
+		in := make([]byte, n)
+		prev := 0
+		for i := range in {
+			prev = (prev + r.Intn(3)) % 40
+			in[i] = byte(prev) + 33
+		}
+		compressed := ransCompressO1(in)
+		assert.EQ(t, compressed[0], byte(1))
+		got, err := ransUncompress(compressed)
+		assert.NoError(t, err)
+		assert.EQ(t, got, in)
+
+		// A corrupt context table is detected.
+		if n > 100 {
+			_, err = ransUncompress(compressed[:20])
+			assert.NotNil(t, err)
+		}
+	}
+}
+
+func TestHuffman(t *testing.T) {
+	// Symbols 'A', 'B', 'C' with code lengths 1, 2, 2 get canonical codes 0, 10,
+	// 11.
+	c, err := newHuffmanCodec([]int32{'C', 'A', 'B'}, []int32{2, 1, 2})
+	assert.NoError(t, err)
+	d := &dataSource{core: bitReader{b: []byte{0x5c}}} // 0 10 11 10 0
+	var got []byte
+	for i := 0; i < 5; i++ {
+		got = append(got, c.readByte(d))
+	}
+	assert.NoError(t, d.Err())
+	assert.EQ(t, string(got), "ABCBA")
+
+	c, err = newHuffmanCodec([]int32{42}, []int32{0})
+	assert.NoError(t, err)
+	assert.EQ(t, c.readInt(d), int32(42))
+}
+
+// testCRAMWriter builds a CRAM 3.0 file in which all the data series are
+// stored in external blocks.
+type testCRAMWriter struct {
+	out bytes.Buffer
+}
+
+func (w *testCRAMWriter) block(method, contentType byte, id int32, data []byte) []byte {
+	raw := len(data)
+	switch method {
+	case methodGzip:
+		b := bytes.Buffer{}
+		zw := gzip.NewWriter(&b)
+		zw.Write(data) // nolint: errcheck
+		zw.Close()     // nolint: errcheck
+		data = b.Bytes()
+	case methodRANS:
+		data = ransCompressO0(data)
+	}
+	b := bytes.Buffer{}
+	b.WriteByte(method)
+	b.WriteByte(contentType)
+	putITF8(&b, id)
+	putITF8(&b, int32(len(data)))
+	putITF8(&b, int32(raw))
+	b.Write(data)
+	b.Write([]byte{0, 0, 0, 0}) // CRC32, not checked.
+	return b.Bytes()
+}
+
+func (w *testCRAMWriter) container(refID, start, span, nRecords int32, landmarks []int32, nBlocks int32, data []byte) {
+	b := bytes.Buffer{}
+	var l [4]byte
+	binary.LittleEndian.PutUint32(l[:], uint32(len(data)))
+	b.Write(l[:])
+	putITF8(&b, refID)
+	putITF8(&b, start)
+	putITF8(&b, span)
+	putITF8(&b, nRecords)
+	putLTF8(&b, 0)
+	putLTF8(&b, 0)
+	putITF8(&b, nBlocks)
+	putITF8(&b, int32(len(landmarks)))
+	for _, l := range landmarks {
+		putITF8(&b, l)
+	}
+	b.Write([]byte{0, 0, 0, 0})
+	w.out.Write(b.Bytes())
+	w.out.Write(data)
+}
+
+func encodingExternalParam(id int32) []byte {
+	p := bytes.Buffer{}
+	putITF8(&p, id)
+	b := bytes.Buffer{}
+	putITF8(&b, encodingExternal)
+	putITF8(&b, int32(p.Len()))
+	b.Write(p.Bytes())
+	return b.Bytes()
+}
+
+func encodingStopParam(id int32) []byte {
+	p := bytes.Buffer{}
+	p.WriteByte(0)
+	putITF8(&p, id)
+	b := bytes.Buffer{}
+	putITF8(&b, encodingByteArrayStop)
+	putITF8(&b, int32(p.Len()))
+	b.Write(p.Bytes())
+	return b.Bytes()
+}
+
+func encodingLenParam(lenID, valID int32) []byte {
+	p := bytes.Buffer{}
+	p.Write(encodingExternalParam(lenID))
+	p.Write(encodingExternalParam(valID))
+	b := bytes.Buffer{}
+	putITF8(&b, encodingByteArrayLen)
+	putITF8(&b, int32(p.Len()))
+	b.Write(p.Bytes())
+	return b.Bytes()
+}
+
+// Content IDs of the external blocks.
+var testSeries = []string{"BF", "CF", "RL", "AP", "RG", "MF", "NS", "NP", "TS", "NF", "TL", "FN", "FC", "FP", "BA", "QS", "BS", "DL", "MQ"}
+
+const (
+	testRNID    = 100
+	testINID    = 101
+	testSCID    = 102
+	testTagLen  = 103
+	testTagData = 104
+)
+
+func TestReader(t *testing.T) {
+	const refSeq = "ACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTACGTAC"
+	ref, err := fasta.New(strings.NewReader(">chr1\n" + refSeq + "\n"))
+	assert.NoError(t, err)
+
+	w := &testCRAMWriter{}
+	w.out.WriteString("CRAM")
+	w.out.Write([]byte{3, 0})
+	w.out.Write(make([]byte, 20))
+
+	// SAM header container.
+	text := "@HD\tVN:1.4\tSO:coordinate\n@SQ\tSN:chr1\tLN:50\n@RG\tID:rg0\tSM:s\n"
+	hdr := bytes.Buffer{}
+	var l [4]byte
+	binary.LittleEndian.PutUint32(l[:], uint32(len(text)))
+	hdr.Write(l[:])
+	hdr.WriteString(text)
+	w.container(0, 0, 0, 0, nil, 1, w.block(methodRaw, contentFileHeader, 0, hdr.Bytes()))
+
+	// Compression header.
+	ch := bytes.Buffer{}
+	pm := bytes.Buffer{}
+	putITF8(&pm, 5)
+	pm.WriteString("RN\x01AP\x01RR\x01")
+	// Substitution matrix: for each reference base, the other bases get codes
+	// 0, 1, 2, 3 in the order of "ACGTN".
+	pm.WriteString("SM")
+	pm.Write([]byte{0x1b, 0x1b, 0x1b, 0x1b, 0x1b})
+	pm.WriteString("TD")
+	td := "XAZ\x00\x00"
+	putITF8(&pm, int32(len(td)))
+	pm.WriteString(td)
+	putITF8(&ch, int32(pm.Len()))
+	ch.Write(pm.Bytes())
+
+	ds := bytes.Buffer{}
+	putITF8(&ds, int32(len(testSeries)+3))
+	for i, key := range testSeries {
+		ds.WriteString(key)
+		ds.Write(encodingExternalParam(int32(i + 1)))
+	}
+	ds.WriteString("RN")
+	ds.Write(encodingStopParam(testRNID))
+	ds.WriteString("IN")
+	ds.Write(encodingStopParam(testINID))
+	ds.WriteString("SC")
+	ds.Write(encodingStopParam(testSCID))
+	putITF8(&ch, int32(ds.Len()))
+	ch.Write(ds.Bytes())
+
+	tm := bytes.Buffer{}
+	putITF8(&tm, 1)
+	putITF8(&tm, 'X'<<16|'A'<<8|'Z')
+	tm.Write(encodingLenParam(testTagLen, testTagData))
+	putITF8(&ch, int32(tm.Len()))
+	ch.Write(tm.Bytes())
+
+	// Record data.
+	ext := map[int32]*bytes.Buffer{}
+	put := func(key string, v int32) {
+		for i, k := range testSeries {
+			if k == key {
+				id := int32(i + 1)
+				if ext[id] == nil {
+					ext[id] = &bytes.Buffer{}
+				}
+				if key == "FC" || key == "BA" || key == "QS" || key == "BS" {
+					ext[id].WriteByte(byte(v))
+				} else {
+					putITF8(ext[id], v)
+				}
+				return
+			}
+		}
+		panic(key)
+	}
+	putBytes := func(id int32, v string) {
+		if ext[id] == nil {
+			ext[id] = &bytes.Buffer{}
+		}
+		ext[id].WriteString(v)
+	}
+
+	// Record 0: read1 at chr1:11 (1-based), 8 bases, with a substitution at read
+	// position 3, a 2-base insertion at 5, and a 2-base deletion before 7. Its
+	// mate is the next record.
+	put("BF", int32(sam.Paired|sam.Read1))
+	put("CF", cfQualArray|cfMateDownstream)
+	put("RL", 8)
+	put("AP", 10) // Delta from the slice start, 1.
+	put("RG", 0)
+	putBytes(testRNID, "pair\x00")
+	put("NF", 0)
+	put("TL", 0)
+	ext[testTagLen] = &bytes.Buffer{}
+	putITF8(ext[testTagLen], 6)
+	putBytes(testTagData, "hello\x00")
+	put("FN", 3)
+	put("FC", 'X')
+	put("FP", 3)
+	put("BS", 2)
+	put("FC", 'I')
+	put("FP", 2)
+	putBytes(testINID, "GG\x00")
+	put("FC", 'D')
+	put("FP", 2)
+	put("DL", 2)
+	put("MQ", 60)
+	for i := 0; i < 8; i++ {
+		put("QS", int32(30+i))
+	}
+
+	// Record 1: read2 at chr1:31, reverse strand, 5 bases, no features.
+	put("BF", int32(sam.Paired|sam.Read2|sam.Reverse))
+	put("CF", cfQualArray)
+	put("RL", 5)
+	put("AP", 20)
+	put("RG", -1)
+	putBytes(testRNID, "pair\x00")
+	put("TL", 1)
+	put("FN", 0)
+	put("MQ", 50)
+	for i := 0; i < 5; i++ {
+		put("QS", 20)
+	}
+
+	// Record 2: unmapped, placed at chr1:40, with a detached mate.
+	put("BF", int32(sam.Unmapped|sam.Paired))
+	put("CF", cfQualArray|cfDetached)
+	put("RL", 4)
+	put("AP", 9)
+	put("RG", -1)
+	putBytes(testRNID, "lone\x00")
+	put("MF", mfMateReverse)
+	put("NS", 0)
+	put("NP", 45)
+	put("TS", 0)
+	put("TL", 1)
+	for _, c := range "ttGA" {
+		put("BA", c)
+	}
+	for i := 0; i < 4; i++ {
+		put("QS", 10)
+	}
+
+	// Slice.
+	slice := bytes.Buffer{}
+	sh := bytes.Buffer{}
+	putITF8(&sh, 0)  // ref ID
+	putITF8(&sh, 1)  // alignment start
+	putITF8(&sh, 45) // span
+	putITF8(&sh, 3)  // records
+	putLTF8(&sh, 0)
+	var ids []int32
+	for id := range ext {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	putITF8(&sh, int32(len(ids)+1))
+	putITF8(&sh, int32(len(ids)+1))
+	putITF8(&sh, 0)
+	for _, id := range ids {
+		putITF8(&sh, id)
+	}
+	putITF8(&sh, -1) // No embedded reference.
+	sum := md5.Sum([]byte(refSeq[:45]))
+	sh.Write(sum[:])
+	slice.Write(w.block(methodRaw, contentSliceHeader, 0, sh.Bytes()))
+	slice.Write(w.block(methodRaw, contentCore, 0, nil))
+	for i, id := range ids {
+		method := []byte{methodRaw, methodGzip, methodRANS}[i%3]
+		if ext[id].Len() == 0 {
+			method = methodRaw
+		}
+		slice.Write(w.block(method, contentExternal, id, ext[id].Bytes()))
+	}
+
+	chBlock := w.block(methodRaw, contentCompressionHeader, 0, ch.Bytes())
+	data := append(append([]byte{}, chBlock...), slice.Bytes()...)
+	w.container(0, 1, 45, 3, []int32{int32(len(chBlock))}, int32(len(ids)+3), data)
+	// EOF container.
+	w.container(-1, 4542278, 0, 0, nil, 1, w.block(methodRaw, contentCompressionHeader, 0, []byte{1, 0, 1, 0, 1, 0}))
+
+	r, err := NewReader(bytes.NewReader(w.out.Bytes()), ref)
+	assert.NoError(t, err)
+	assert.EQ(t, len(r.Header().Refs()), 1)
+	assert.EQ(t, r.Header().Refs()[0].Name(), "chr1")
+
+	var recs []*sam.Record
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		recs = append(recs, rec)
+	}
+	assert.EQ(t, len(recs), 3)
+
+	// The reference from position 10 is "GTACGTACGT". The read is GT, then T
+	// substituting A (code 2 of "CGTN"), C, the insertion GG, the deletion of GT,
+	// then AC.
+	r0 := recs[0]
+	assert.EQ(t, r0.Name, "pair")
+	assert.EQ(t, r0.Pos, 10)
+	assert.EQ(t, string(r0.Seq.Expand()), "GTTCGGAC")
+	assert.EQ(t, r0.Cigar.String(), "4M2I2D2M")
+	assert.EQ(t, r0.MapQ, byte(60))
+	assert.EQ(t, r0.Qual, []byte{30, 31, 32, 33, 34, 35, 36, 37})
+	assert.EQ(t, r0.MateRef, r0.Ref)
+	assert.EQ(t, r0.MatePos, 30)
+	assert.EQ(t, r0.Flags, sam.Paired|sam.Read1|sam.MateReverse)
+	assert.EQ(t, r0.TempLen, 25)
+	assert.EQ(t, len(r0.AuxFields), 2)
+	assert.EQ(t, r0.AuxFields[0].String(), "XA:Z:hello")
+	assert.EQ(t, r0.AuxFields[1].String(), "RG:Z:rg0")
+
+	r1 := recs[1]
+	assert.EQ(t, r1.Pos, 30)
+	assert.EQ(t, string(r1.Seq.Expand()), refSeq[30:35])
+	assert.EQ(t, r1.Cigar.String(), "5M")
+	assert.EQ(t, r1.MatePos, 10)
+	assert.EQ(t, r1.TempLen, -25)
+	assert.EQ(t, len(r1.AuxFields), 0)
+
+	r2 := recs[2]
+	assert.EQ(t, r2.Name, "lone")
+	assert.EQ(t, r2.Pos, 39)
+	assert.EQ(t, string(r2.Seq.Expand()), "TTGA")
+	assert.EQ(t, len(r2.Cigar), 0)
+	assert.EQ(t, r2.MatePos, 44)
+	assert.EQ(t, r2.Flags, sam.Unmapped|sam.Paired|sam.MateReverse)
+
+	// A wrong reference is detected by the MD5 check.
+	badRef, err := fasta.New(strings.NewReader(">chr1\n" + strings.Repeat("A", 50) + "\n"))
+	assert.NoError(t, err)
+	r, err = NewReader(bytes.NewReader(w.out.Bytes()), badRef)
+	assert.NoError(t, err)
+	_, err = r.Read()
+	assert.Regexp(t, err, "MD5 mismatch")
+
+	// Only versions 2.1 and 3.0 are supported.
+	for _, version := range [][]byte{{3, 1}, {2, 0}, {4, 0}} {
+		data := append([]byte{}, w.out.Bytes()...)
+		copy(data[4:], version)
+		_, err = NewReader(bytes.NewReader(data), ref)
+		assert.Regexp(t, err, "unsupported version")
+	}
+}
+
+// TestSamtoolsCRAM reads a CRAM file written by samtools from testdata/test.sam
+// (see testdata/gen.sh) and compares it against the SAM records.
+func TestSamtoolsCRAM(t *testing.T) {
+	dir := testutil.GetFilePath("//go/src/grail.com/bio/encoding/cram/testdata")
+	in, err := os.Open(dir + "/test.cram")
+	if os.IsNotExist(err) {
+		t.Fatalf("%s/test.cram not found; run testdata/gen.sh", dir)
+	}
+	assert.NoError(t, err)
+	defer in.Close() // nolint: errcheck
+	refIn, err := os.Open(dir + "/ref.fa")
+	assert.NoError(t, err)
+	defer refIn.Close() // nolint: errcheck
+	ref, err := fasta.New(refIn)
+	assert.NoError(t, err)
+	samIn, err := os.Open(dir + "/test.sam")
+	assert.NoError(t, err)
+	defer samIn.Close() // nolint: errcheck
+	sr, err := sam.NewReader(samIn)
+	assert.NoError(t, err)
+
+	r, err := NewReader(in, ref)
+	assert.NoError(t, err)
+	assert.EQ(t, len(r.Header().Refs()), len(sr.Header().Refs()))
+	// sortedAux returns the aux fields in tag order, since the CRAM reader
+	// always emits the RG tag last.
+	sortedAux := func(aux sam.AuxFields) []string {
+		var s []string
+		for _, a := range aux {
+			s = append(s, a.String())
+		}
+		sort.Strings(s)
+		return s
+	}
+	n := 0
+	for {
+		want, err := sr.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		got, err := r.Read()
+		assert.NoError(t, err, want.Name)
+		assert.EQ(t, got.Name, want.Name)
+		assert.EQ(t, got.Flags, want.Flags, want.Name)
+		assert.EQ(t, got.Ref.Name(), want.Ref.Name(), want.Name)
+		assert.EQ(t, got.Pos, want.Pos, want.Name)
+		assert.EQ(t, got.MapQ, want.MapQ, want.Name)
+		assert.EQ(t, got.Cigar.String(), want.Cigar.String(), want.Name)
+		assert.EQ(t, got.MateRef.Name(), want.MateRef.Name(), want.Name)
+		assert.EQ(t, got.MatePos, want.MatePos, want.Name)
+		assert.EQ(t, got.TempLen, want.TempLen, want.Name)
+		assert.EQ(t, string(got.Seq.Expand()), string(want.Seq.Expand()), want.Name)
+		assert.EQ(t, got.Qual, want.Qual, want.Name)
+		assert.EQ(t, sortedAux(got.AuxFields), sortedAux(want.AuxFields), want.Name)
+		n++
+	}
+	_, err = r.Read()
+	assert.EQ(t, err, io.EOF)
+	assert.EQ(t, n, 8)
+
+	idxIn, err := os.Open(dir + "/test.cram.crai")
+	assert.NoError(t, err)
+	defer idxIn.Close() // nolint: errcheck
+	entries, err := ReadIndex(idxIn)
+	assert.NoError(t, err)
+	assert.True(t, len(entries) > 0)
+}
+
+func TestReadIndex(t *testing.T) {
+	b := bytes.Buffer{}
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte("0\t1\t1000\t100\t200\t3000\n-1\t0\t0\t5000\t150\t400\n")) // nolint: errcheck
+	assert.NoError(t, zw.Close())
+	entries, err := ReadIndex(&b)
+	assert.NoError(t, err)
+	assert.EQ(t, entries, []IndexEntry{
+		{RefID: 0, Start: 1, Span: 1000, ContainerOffset: 100, SliceOffset: 200, SliceSize: 3000},
+		{RefID: -1, Start: 0, Span: 0, ContainerOffset: 5000, SliceOffset: 150, SliceSize: 400},
+	})
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package cram
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// IndexEntry is one line of a CRAM index (*.crai) file. It describes the
+// records of one reference in one slice.
+type IndexEntry struct {
+	// RefID is the reference ID. It is -1 for unmapped reads.
+	RefID int32
+	// Start is the 1-based alignment start, and Span is the alignment span.
+	// Both are zero for unmapped reads.
+	Start, Span int32
+	// ContainerOffset is the file offset of the container.
+	ContainerOffset int64
+	// SliceOffset is the offset of the slice, relative to the start of the
+	// container data. SliceSize is the size of the slice.
+	SliceOffset int64
+	SliceSize   int32
+}
+
+// ReadIndex reads a gzip-compressed CRAM index. The entries are returned in
+// the order of the file, which is the order of the containers in the CRAM
+// file.
+func ReadIndex(r io.Reader) ([]IndexEntry, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("cram: read index: %v", err)
+	}
+	var entries []IndexEntry
+	scanner := bufio.NewScanner(zr)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		cols := strings.Fields(text)
+		if len(cols) != 6 {
+			return nil, fmt.Errorf("cram: index line %d: expect 6 columns, found %q", line, text)
+		}
+		var vals [6]int64
+		for i, col := range cols {
+			if vals[i], err = strconv.ParseInt(col, 10, 64); err != nil {
+				return nil, fmt.Errorf("cram: index line %d: %v", line, err)
+			}
+		}
+		entries = append(entries, IndexEntry{
+			RefID:           int32(vals[0]),
+			Start:           int32(vals[1]),
+			Span:            int32(vals[2]),
+			ContainerOffset: vals[3],
+			SliceOffset:     vals[4],
+			SliceSize:       int32(vals[5]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cram: read index: %v", err)
+	}
+	return entries, zr.Close()
+}
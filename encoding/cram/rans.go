@@ -0,0 +1,220 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package cram
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// This file implements the decoder for the rANS 4x8 codec (block compression
+// method 4), used by CRAM 3.0. The codec interleaves four rANS states with
+// 8-bit renormalization, and models symbols with either order-0 or order-1
+// (previous symbol as context) frequencies, which sum to 1<<ransFreqBits.
+
+const (
+	ransFreqBits   = 12
+	ransTotFreq    = 1 << ransFreqBits
+	ransLowerBound = 1 << 23
+)
+
+// ransModel is a frequency table for one context.
+type ransModel struct {
+	freq [256]uint32
+	cum  [256]uint32
+	// sym[x] is the symbol whose cumulative range contains x.
+	sym [ransTotFreq]byte
+}
+
+// ransDecoder is a cursor over a compressed rANS payload.
+type ransDecoder struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (d *ransDecoder) byte() byte {
+	if d.off >= len(d.b) {
+		if d.err == nil {
+			d.err = errTruncated
+		}
+		return 0
+	}
+	v := d.b[d.off]
+	d.off++
+	return v
+}
+
+func (d *ransDecoder) uint32() uint32 {
+	if d.off+4 > len(d.b) {
+		if d.err == nil {
+			d.err = errTruncated
+		}
+		d.off = len(d.b)
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(d.b[d.off:])
+	d.off += 4
+	return v
+}
+
+// readFreq reads a frequency value, encoded in one or two bytes.
+func (d *ransDecoder) readFreq() uint32 {
+	f := uint32(d.byte())
+	if f >= 128 {
+		f = (f&127)<<8 | uint32(d.byte())
+	}
+	return f
+}
+
+// readModel reads a run-length encoded frequency table.
+func (d *ransDecoder) readModel(m *ransModel) {
+	var x uint32
+	rle := 0
+	sym := int(d.byte())
+	for {
+		f := d.readFreq()
+		if x+f > ransTotFreq || d.err != nil {
+			if d.err == nil {
+				d.err = fmt.Errorf("cram: corrupt rANS frequency table")
+			}
+			return
+		}
+		m.freq[sym] = f
+		m.cum[sym] = x
+		for i := x; i < x+f; i++ {
+			m.sym[i] = byte(sym)
+		}
+		x += f
+		sym = d.nextSymbol(sym, &rle)
+		if sym == 0 || d.err != nil {
+			return
+		}
+	}
+}
+
+// nextSymbol reads the next symbol of a run-length encoded symbol list. It
+// returns 0 at the end of the list.
+func (d *ransDecoder) nextSymbol(sym int, rle *int) int {
+	if *rle > 0 {
+		*rle--
+		if sym == 255 {
+			return 0
+		}
+		return sym + 1
+	}
+	next := int(d.byte())
+	if next == sym+1 {
+		*rle = int(d.byte())
+	}
+	return next
+}
+
+// step decodes one symbol from the state *r using model m.
+func (d *ransDecoder) step(r *uint32, m *ransModel) byte {
+	x := *r & (ransTotFreq - 1)
+	s := m.sym[x]
+	*r = m.freq[s]*(*r>>ransFreqBits) + x - m.cum[s]
+	// Like htslib, stop renormalizing silently at the end of the input.
+	for *r < ransLowerBound && d.off < len(d.b) {
+		*r = *r<<8 | uint32(d.b[d.off])
+		d.off++
+	}
+	return s
+}
+
+// ransUncompress decodes a rANS 4x8 payload. The payload starts with a
+// 9-byte header: the order (0 or 1), the compressed size and the uncompressed
+// size, both little endian uint32s.
+func ransUncompress(in []byte) ([]byte, error) {
+	d := &ransDecoder{b: in}
+	order := d.byte()
+	compSize := d.uint32()
+	rawSize := d.uint32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if int(compSize) > len(in)-9 {
+		return nil, errTruncated
+	}
+	d.b = in[:9+compSize]
+	out := make([]byte, rawSize)
+	switch order {
+	case 0:
+		d.uncompressO0(out)
+	case 1:
+		d.uncompressO1(out)
+	default:
+		return nil, fmt.Errorf("cram: unknown rANS order %d", order)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return out, nil
+}
+
+func (d *ransDecoder) uncompressO0(out []byte) {
+	m := &ransModel{}
+	d.readModel(m)
+	var r [4]uint32
+	for i := range r {
+		r[i] = d.uint32()
+	}
+	if d.err != nil {
+		return
+	}
+	for i := range out {
+		out[i] = d.step(&r[i&3], m)
+		if d.err != nil {
+			return
+		}
+	}
+}
+
+func (d *ransDecoder) uncompressO1(out []byte) {
+	models := make([]*ransModel, 256)
+	rle := 0
+	ctx := int(d.byte())
+	for {
+		m := &ransModel{}
+		d.readModel(m)
+		models[ctx] = m
+		ctx = d.nextSymbol(ctx, &rle)
+		if ctx == 0 || d.err != nil {
+			break
+		}
+	}
+	var r [4]uint32
+	for i := range r {
+		r[i] = d.uint32()
+	}
+	if d.err != nil {
+		return
+	}
+	// The output is split into four quarters, each decoded by its own state.
+	// The last state also decodes the remainder.
+	quarter := len(out) / 4
+	var last [4]byte
+	decode := func(j, i int) {
+		m := models[last[j]]
+		if m == nil {
+			if d.err == nil {
+				d.err = fmt.Errorf("cram: rANS context %d missing", last[j])
+			}
+			return
+		}
+		s := d.step(&r[j], m)
+		out[i] = s
+		last[j] = s
+	}
+	for i := 0; i < quarter && d.err == nil; i++ {
+		for j := 0; j < 4; j++ {
+			decode(j, j*quarter+i)
+		}
+	}
+	for i := 4 * quarter; i < len(out) && d.err == nil; i++ {
+		decode(3, i)
+	}
+}
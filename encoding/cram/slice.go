@@ -0,0 +1,607 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package cram
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"strconv"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// CRAM record flags (the CF data series).
+const (
+	cfQualArray      = 0x1
+	cfDetached       = 0x2
+	cfMateDownstream = 0x4
+	cfNoSeq          = 0x8
+)
+
+// Mate flags (the MF data series).
+const (
+	mfMateReverse  = 0x1
+	mfMateUnmapped = 0x2
+)
+
+// multiRefID is the slice reference ID for slices that contain records of
+// multiple references.
+const multiRefID = -2
+
+// sliceHeader is the header of a slice.
+type sliceHeader struct {
+	refID         int32
+	start         int32 // 1-based alignment start.
+	span          int32
+	nRecords      int32
+	recordCounter int64
+	nBlocks       int32
+	embeddedRefID int32
+	md5           []byte
+}
+
+// refSegment caches a section of a reference sequence. The bases are upper
+// case.
+type refSegment struct {
+	refID int
+	start int
+	seq   []byte
+}
+
+// base returns the reference base at pos, or 'N' if pos is outside the
+// segment.
+func (s *refSegment) base(pos int) byte {
+	if i := pos - s.start; i >= 0 && i < len(s.seq) {
+		return s.seq[i]
+	}
+	return 'N'
+}
+
+// covers checks if the segment contains [start, end) of the reference.
+func (s *refSegment) covers(refID, start, end int) bool {
+	return s.seq != nil && s.refID == refID && start >= s.start && end <= s.start+len(s.seq)
+}
+
+// loadRef loads [start, end) of reference refID into seg. The range is clipped
+// to the reference length.
+func (r *Reader) loadRef(seg *refSegment, refID, start, end int) error {
+	if r.ref == nil {
+		return fmt.Errorf("cram: a reference FASTA is required to decode the sequences")
+	}
+	refs := r.header.Refs()
+	if refID < 0 || refID >= len(refs) {
+		return fmt.Errorf("cram: invalid reference ID %d", refID)
+	}
+	name := refs[refID].Name()
+	n, err := r.ref.Len(name)
+	if err != nil {
+		return err
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > int(n) {
+		end = int(n)
+	}
+	seg.refID, seg.start, seg.seq = refID, start, []byte{}
+	if start >= end {
+		return nil
+	}
+	seq, err := r.ref.Get(name, uint64(start), uint64(end))
+	if err != nil {
+		return err
+	}
+	seg.seq = bytes.ToUpper([]byte(seq))
+	return nil
+}
+
+// readSlice decodes the slice at the beginning of b, and appends the records
+// to recs.
+func (r *Reader) readSlice(b *buffer, ch *compressionHeader, recs []*sam.Record) ([]*sam.Record, error) {
+	blk, err := r.readBlock(b)
+	if err != nil {
+		return recs, err
+	}
+	if blk.contentType != contentSliceHeader {
+		return recs, fmt.Errorf("cram: expect a slice header, found block type %d", blk.contentType)
+	}
+	hb := newBuffer(blk.data)
+	sh := sliceHeader{
+		refID:    hb.itf8(),
+		start:    hb.itf8(),
+		span:     hb.itf8(),
+		nRecords: hb.itf8(),
+	}
+	if r.major >= 3 {
+		sh.recordCounter = hb.ltf8()
+	} else {
+		sh.recordCounter = int64(hb.itf8())
+	}
+	sh.nBlocks = hb.itf8()
+	hb.itf8Array() // Block content IDs.
+	sh.embeddedRefID = hb.itf8()
+	sh.md5 = hb.bytes(16)
+	if hb.err != nil {
+		return recs, fmt.Errorf("cram: read slice header: %v", hb.err)
+	}
+
+	ds := &dataSource{external: map[int32]*buffer{}}
+	for i := int32(0); i < sh.nBlocks; i++ {
+		blk, err := r.readBlock(b)
+		if err != nil {
+			return recs, err
+		}
+		switch blk.contentType {
+		case contentCore:
+			ds.core = bitReader{b: blk.data}
+		case contentExternal:
+			ds.external[blk.contentID] = newBuffer(blk.data)
+		default:
+			return recs, fmt.Errorf("cram: unexpected block type %d in a slice", blk.contentType)
+		}
+	}
+
+	// Prepare the reference for the slice.
+	var seg refSegment
+	if sh.refID >= 0 && ch.refRequired {
+		start, end := int(sh.start)-1, int(sh.start)-1+int(sh.span)
+		if sh.embeddedRefID >= 0 {
+			ext := ds.external[sh.embeddedRefID]
+			if ext == nil {
+				return recs, fmt.Errorf("cram: embedded reference block %d not found", sh.embeddedRefID)
+			}
+			seg = refSegment{refID: int(sh.refID), start: start, seq: bytes.ToUpper(ext.b)}
+		} else {
+			if err := r.loadRef(&seg, int(sh.refID), start, end); err != nil {
+				return recs, err
+			}
+			if !isZero(sh.md5) && end <= seg.start+len(seg.seq) {
+				if sum := md5.Sum(seg.seq); !bytes.Equal(sum[:], sh.md5) {
+					return recs, fmt.Errorf("cram: reference MD5 mismatch for %s:%d-%d; wrong reference FASTA?",
+						r.header.Refs()[sh.refID].Name(), start+1, end)
+				}
+			}
+		}
+	}
+
+	d := sliceDecoder{
+		r:        r,
+		ch:       ch,
+		sh:       &sh,
+		ds:       ds,
+		seg:      &seg,
+		lastPos:  int(sh.start),
+		nextFrag: make([]int, sh.nRecords),
+		hasPrev:  make([]bool, sh.nRecords),
+	}
+	for i := range d.nextFrag {
+		d.nextFrag[i] = -1
+	}
+	first := len(recs)
+	for i := 0; i < int(sh.nRecords); i++ {
+		rec, err := d.readRecord()
+		if err != nil {
+			return recs, fmt.Errorf("cram: record %d: %v", sh.recordCounter+int64(i), err)
+		}
+		recs = append(recs, rec)
+	}
+	d.resolveMates(recs[first:])
+	return recs, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sliceDecoder holds the state for decoding the records of a slice.
+type sliceDecoder struct {
+	r       *Reader
+	ch      *compressionHeader
+	sh      *sliceHeader
+	ds      *dataSource
+	seg     *refSegment
+	lastPos int // 1-based position of the last record, for AP delta coding.
+	nRecs   int
+
+	// nextFrag[i] is the index of the next fragment of the i'th record in the
+	// slice, or -1.
+	nextFrag []int
+	// hasPrev[i] is true if some record has the i'th record as the next
+	// fragment.
+	hasPrev []bool
+
+	// Scratch space.
+	features []feature
+	cigar    []sam.CigarOp
+}
+
+// feature is a read feature of a mapped record.
+type feature struct {
+	code byte
+	pos  int // 1-based position in the read.
+	// Feature values. Only the fields relevant to the code are set.
+	n    int
+	b    byte
+	q    byte
+	data []byte
+}
+
+func (d *sliceDecoder) readRecord() (*sam.Record, error) {
+	ch, ds := d.ch, d.ds
+	idx := d.nRecs
+	d.nRecs++
+
+	rec := sam.GetFromFreePool()
+	rec.Name = ""
+	rec.Flags = sam.Flags(ch.bf.readInt(ds))
+	cf := ch.cf.readInt(ds)
+	refID := d.sh.refID
+	if refID == multiRefID {
+		refID = ch.ri.readInt(ds)
+	}
+	readLen := int(ch.rl.readInt(ds))
+	pos := int(ch.ap.readInt(ds))
+	if ch.apDelta {
+		pos += d.lastPos
+		d.lastPos = pos
+	}
+	rgIndex := ch.rg.readInt(ds)
+	if ch.readNamesIncluded {
+		rec.Name = string(ch.rn.readBytes(ds))
+	}
+
+	refs := d.r.header.Refs()
+	if refID >= int32(len(refs)) || refID < -1 {
+		return nil, fmt.Errorf("invalid reference ID %d", refID)
+	}
+	rec.Ref = nil
+	if refID >= 0 {
+		rec.Ref = refs[refID]
+	}
+	rec.Pos = pos - 1
+	rec.MateRef = nil
+	rec.MatePos = -1
+	rec.TempLen = 0
+
+	// Mate information.
+	if cf&cfDetached != 0 {
+		mf := ch.mf.readInt(ds)
+		if mf&mfMateReverse != 0 {
+			rec.Flags |= sam.MateReverse
+		}
+		if mf&mfMateUnmapped != 0 {
+			rec.Flags |= sam.MateUnmapped
+		}
+		if !ch.readNamesIncluded {
+			rec.Name = string(ch.rn.readBytes(ds))
+		}
+		mateRefID := ch.ns.readInt(ds)
+		if mateRefID >= int32(len(refs)) || mateRefID < -1 {
+			return nil, fmt.Errorf("invalid mate reference ID %d", mateRefID)
+		}
+		if mateRefID >= 0 {
+			rec.MateRef = refs[mateRefID]
+		}
+		rec.MatePos = int(ch.np.readInt(ds)) - 1
+		rec.TempLen = int(ch.ts.readInt(ds))
+	} else if cf&cfMateDownstream != 0 {
+		next := idx + 1 + int(ch.nf.readInt(ds))
+		if next <= idx || next >= int(d.sh.nRecords) {
+			return nil, fmt.Errorf("invalid next fragment %d", next)
+		}
+		d.nextFrag[idx] = next
+		d.hasPrev[next] = true
+	}
+	if rec.Name == "" && !ch.readNamesIncluded {
+		// Names of attached mates are assigned in resolveMates.
+		rec.Name = strconv.FormatInt(d.sh.recordCounter+int64(idx), 10)
+	}
+
+	// Aux fields.
+	rec.AuxFields = rec.AuxFields[:0]
+	tl := ch.tl.readInt(ds)
+	if tl < 0 || int(tl) >= len(ch.tagLines) {
+		if len(ch.tagLines) > 0 || tl != 0 {
+			return nil, fmt.Errorf("invalid tag line %d", tl)
+		}
+	} else {
+		for _, id := range ch.tagLines[tl] {
+			c, ok := ch.tags[id]
+			if !ok {
+				return nil, fmt.Errorf("tag %c%c%c is not encoded", id>>16, id>>8&0xff, id&0xff)
+			}
+			v := c.readBytes(ds)
+			typ := byte(id)
+			if (typ == 'Z' || typ == 'H') && len(v) > 0 && v[len(v)-1] == 0 {
+				v = v[:len(v)-1]
+			}
+			aux := make(sam.Aux, 3+len(v))
+			aux[0], aux[1], aux[2] = byte(id>>16), byte(id>>8), typ
+			copy(aux[3:], v)
+			rec.AuxFields = append(rec.AuxFields, aux)
+		}
+	}
+	if rgIndex >= 0 {
+		rgs := d.r.header.RGs()
+		if int(rgIndex) >= len(rgs) {
+			return nil, fmt.Errorf("invalid read group index %d", rgIndex)
+		}
+		rec.AuxFields = append(rec.AuxFields, sam.Aux(append([]byte("RGZ"), rgs[rgIndex].Name()...)))
+	}
+
+	var seq, qual []byte
+	if rec.Flags&sam.Unmapped == 0 {
+		if err := d.readMapped(rec, cf, readLen, &seq, &qual); err != nil {
+			return nil, err
+		}
+	} else {
+		rec.Cigar = nil
+		rec.MapQ = 0
+		if cf&cfNoSeq == 0 {
+			seq = append([]byte{}, ch.ba.readN(ds, readLen)...)
+		}
+		if cf&cfQualArray != 0 {
+			qual = append([]byte{}, ch.qs.readN(ds, readLen)...)
+		}
+	}
+	if err := ds.Err(); err != nil {
+		return nil, err
+	}
+	if cf&cfNoSeq != 0 {
+		seq = nil
+	}
+	rec.Seq = sam.NewSeq(seq)
+	if qual == nil || len(qual) != len(seq) {
+		qual = make([]byte, len(seq))
+		for i := range qual {
+			qual[i] = 0xff
+		}
+	}
+	rec.Qual = qual
+	return rec, nil
+}
+
+// readMapped decodes the read features, mapping quality and quality scores of
+// a mapped record, then reconstructs its sequence and cigar.
+func (d *sliceDecoder) readMapped(rec *sam.Record, cf int32, readLen int, seqp, qualp *[]byte) error {
+	ch, ds := d.ch, d.ds
+	nFeatures := int(ch.fn.readInt(ds))
+	if ds.Err() != nil {
+		return ds.Err()
+	}
+	if nFeatures < 0 {
+		return fmt.Errorf("invalid number of read features %d", nFeatures)
+	}
+	d.features = d.features[:0]
+	prevPos := 0
+	refLen := readLen
+	for i := 0; i < nFeatures; i++ {
+		f := feature{code: ch.fc.readByte(ds)}
+		f.pos = prevPos + int(ch.fp.readInt(ds))
+		prevPos = f.pos
+		switch f.code {
+		case 'B':
+			f.b = ch.ba.readByte(ds)
+			f.q = ch.qs.readByte(ds)
+		case 'X':
+			f.b = ch.bs.readByte(ds)
+		case 'I':
+			f.data = ch.in.readBytes(ds)
+			refLen -= len(f.data)
+		case 'S':
+			f.data = ch.sc.readBytes(ds)
+			refLen -= len(f.data)
+		case 'H':
+			f.n = int(ch.hc.readInt(ds))
+		case 'P':
+			f.n = int(ch.pd.readInt(ds))
+		case 'D':
+			f.n = int(ch.dl.readInt(ds))
+			refLen += f.n
+		case 'N':
+			f.n = int(ch.rs.readInt(ds))
+			refLen += f.n
+		case 'i':
+			f.b = ch.ba.readByte(ds)
+			refLen--
+		case 'b':
+			f.data = ch.bb.readBytes(ds)
+		case 'q':
+			f.data = ch.qq.readBytes(ds)
+		case 'Q':
+			f.q = ch.qs.readByte(ds)
+		default:
+			return fmt.Errorf("unknown read feature %q", f.code)
+		}
+		if err := ds.Err(); err != nil {
+			return err
+		}
+		d.features = append(d.features, f)
+	}
+	rec.MapQ = byte(ch.mq.readInt(ds))
+	var qual []byte
+	if cf&cfQualArray != 0 {
+		qual = append([]byte{}, ch.qs.readN(ds, readLen)...)
+	} else {
+		qual = make([]byte, readLen)
+		for i := range qual {
+			qual[i] = 0xff
+		}
+	}
+	if err := ds.Err(); err != nil {
+		return err
+	}
+
+	// Make sure that the reference covers the record.
+	if d.ch.refRequired && cf&cfNoSeq == 0 && rec.Ref != nil {
+		if refLen < 0 {
+			refLen = 0
+		}
+		if !d.seg.covers(rec.Ref.ID(), rec.Pos, rec.Pos+refLen) && d.sh.embeddedRefID < 0 {
+			if err := d.r.loadRef(d.seg, rec.Ref.ID(), rec.Pos, rec.Pos+refLen); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Reconstruct the sequence and the cigar.
+	seq := make([]byte, readLen)
+	d.cigar = d.cigar[:0]
+	readPos, refPos := 0, rec.Pos
+	match := func(n int) error {
+		if n < 0 || readPos+n > readLen {
+			return fmt.Errorf("read feature beyond read length %d", readLen)
+		}
+		for i := 0; i < n; i++ {
+			seq[readPos+i] = d.seg.base(refPos + i)
+		}
+		d.addCigar(sam.CigarMatch, n)
+		readPos += n
+		refPos += n
+		return nil
+	}
+	insert := func(op sam.CigarOpType, bases []byte) error {
+		if readPos+len(bases) > readLen {
+			return fmt.Errorf("read feature beyond read length %d", readLen)
+		}
+		copy(seq[readPos:], bases)
+		d.addCigar(op, len(bases))
+		readPos += len(bases)
+		return nil
+	}
+	for _, f := range d.features {
+		if err := match(f.pos - 1 - readPos); err != nil {
+			return err
+		}
+		var err error
+		switch f.code {
+		case 'B':
+			err = insert(sam.CigarMatch, []byte{f.b})
+			if err == nil {
+				qual[readPos-1] = f.q
+			}
+			refPos++
+		case 'X':
+			ref := d.seg.base(refPos)
+			err = insert(sam.CigarMatch, []byte{d.ch.subst[baseIndex(ref)][f.b&3]})
+			refPos++
+		case 'I':
+			err = insert(sam.CigarInsertion, f.data)
+		case 'i':
+			err = insert(sam.CigarInsertion, []byte{f.b})
+		case 'S':
+			err = insert(sam.CigarSoftClipped, f.data)
+		case 'b':
+			err = insert(sam.CigarMatch, f.data)
+			refPos += len(f.data)
+		case 'H':
+			d.addCigar(sam.CigarHardClipped, f.n)
+		case 'P':
+			d.addCigar(sam.CigarPadded, f.n)
+		case 'D':
+			d.addCigar(sam.CigarDeletion, f.n)
+			refPos += f.n
+		case 'N':
+			d.addCigar(sam.CigarSkipped, f.n)
+			refPos += f.n
+		case 'q':
+			if f.pos-1+len(f.data) > readLen {
+				return fmt.Errorf("quality scores beyond read length %d", readLen)
+			}
+			copy(qual[f.pos-1:], f.data)
+		case 'Q':
+			if f.pos < 1 || f.pos > readLen {
+				return fmt.Errorf("quality score beyond read length %d", readLen)
+			}
+			qual[f.pos-1] = f.q
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := match(readLen - readPos); err != nil {
+		return err
+	}
+	rec.Cigar = append(sam.Cigar(nil), d.cigar...)
+	*seqp, *qualp = seq, qual
+	return nil
+}
+
+// addCigar appends a cigar op, merging it with the last op if they have the
+// same type.
+func (d *sliceDecoder) addCigar(t sam.CigarOpType, n int) {
+	if n <= 0 {
+		return
+	}
+	if last := len(d.cigar) - 1; last >= 0 && d.cigar[last].Type() == t {
+		d.cigar[last] = sam.NewCigarOp(t, d.cigar[last].Len()+n)
+		return
+	}
+	d.cigar = append(d.cigar, sam.NewCigarOp(t, n))
+}
+
+// resolveMates fills the mate information of records whose mates are in the
+// same slice. The fragments of a template form a chain through nextFrag, and
+// each record's mate is the next fragment in the chain. The mate of the last
+// fragment is the first.
+func (d *sliceDecoder) resolveMates(recs []*sam.Record) {
+	for head := range recs {
+		if d.nextFrag[head] < 0 || d.hasPrev[head] {
+			continue
+		}
+		var chain []int
+		for i := head; i >= 0; i = d.nextFrag[i] {
+			chain = append(chain, i)
+		}
+		// Compute the template length if all the fragments are mapped to the same
+		// reference.
+		sameRef := true
+		left, right := -1, -1
+		for _, i := range chain {
+			rec := recs[i]
+			if rec.Flags&sam.Unmapped != 0 || rec.Ref != recs[head].Ref {
+				sameRef = false
+				break
+			}
+			if left < 0 || rec.Pos < left {
+				left = rec.Pos
+			}
+			if end := rec.End(); end > right {
+				right = end
+			}
+		}
+		leftAssigned := false
+		for k, i := range chain {
+			rec := recs[i]
+			mate := recs[chain[(k+1)%len(chain)]]
+			if i != head && !d.ch.readNamesIncluded {
+				rec.Name = recs[head].Name
+			}
+			rec.MateRef = mate.Ref
+			rec.MatePos = mate.Pos
+			if mate.Flags&sam.Unmapped != 0 {
+				rec.Flags |= sam.MateUnmapped
+			}
+			if mate.Flags&sam.Reverse != 0 {
+				rec.Flags |= sam.MateReverse
+			}
+			rec.TempLen = 0
+			if sameRef && len(chain) > 1 {
+				if rec.Pos == left && !leftAssigned {
+					rec.TempLen = right - left
+					leftAssigned = true
+				} else {
+					rec.TempLen = -(right - left)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+#!/bin/sh
+# Regenerates test.cram and its index from test.sam with samtools.
+set -e
+cd "$(dirname "$0")"
+samtools faidx ref.fa
+samtools view -C --output-fmt-option version=3.0 -T ref.fa -o test.cram test.sam
+samtools index test.cram
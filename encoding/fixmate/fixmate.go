@@ -0,0 +1,560 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package fixmate recomputes the mate information of the records in a
+// coordinate-sorted BAM or PAM file, in the same manner as samtools fixmate.
+//
+// For each primary record of a paired read, the MateRef, MatePos and TempLen
+// fields, the MateReverse and MateUnmapped flags, and the MC (mate cigar) and
+// MQ (mate mapping quality) aux tags are set from the primary record of its
+// mate. The ProperPair flag is cleared if either read is unmapped. If the mate
+// is missing from the file, e.g., because it was filtered out, the record is
+// marked as having an unmapped mate, and its mate fields and tags are cleared.
+// Unpaired, secondary and supplementary records are left intact.
+//
+// Mates are matched by read name, since MateRef and MatePos may be stale.
+// Thus, unlike bampair.GetDistantMates and bamprovider.NewPairIterators, which
+// locate mates using these fields, the file is first scanned in shards in
+// parallel, and the reads whose mate is not in the same shard are matched by
+// name. To bound the memory usage, these reads are spread over temporary files
+// by the hash of their names, and the files are matched one at a time. The
+// corrections, which are computed only for the records that need to change,
+// are also stored in temporary files, one per group of consecutive shards, and
+// each file is loaded when its records are written.
+package fixmate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"blainsmith.com/go/seahash"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/traverse"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/internal/diskfile"
+	"github.com/grailbio/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+const (
+	// DefaultShardSize is the default value of Opts.ShardSize.
+	DefaultShardSize = 5000000
+	// DefaultDiskShards is the default value of Opts.DiskShards.
+	DefaultDiskShards = 256
+)
+
+var (
+	mcTag = sam.NewTag("MC")
+	mqTag = sam.NewTag("MQ")
+)
+
+// Opts controls the behavior of FixBAM and FixPAM.
+type Opts struct {
+	// ProviderOpts is passed to bamprovider.NewProvider when opening the input.
+	ProviderOpts bamprovider.ProviderOpts
+
+	// ShardSize is the width of the genomic range processed by one task. If <=
+	// 0, DefaultShardSize is used.
+	ShardSize int
+
+	// Parallelism is the number of shards processed concurrently. If <= 0,
+	// runtime.NumCPU() is used.
+	Parallelism int
+
+	// DiskShards is the number of temporary files that store the reads whose
+	// mate is in another shard, and the number of files that store the
+	// corrections. A file is loaded in memory only while it is used. If <= 0,
+	// DefaultDiskShards is used.
+	DiskShards int
+
+	// ScratchDir is the directory in which the temporary files are created.
+	// If empty, the default directory for temporary files is used.
+	ScratchDir string
+
+	// MaxBufSize and Transformers are used by FixPAM when writing the new
+	// field files. They are the same as pam.WriteOpts.
+	MaxBufSize   int
+	Transformers []string
+}
+
+// readKey identifies one read of a template. Flags stores only the Read1 and
+// Read2 bits.
+type readKey struct {
+	name  string
+	flags sam.Flags
+}
+
+// mateFields is the set of mate-related values of a record. mc is "" if the
+// record has no MC tag, and mq is -1 if the record has no MQ tag.
+type mateFields struct {
+	flags     sam.Flags
+	mateRefID int
+	matePos   int
+	tempLen   int
+	mc        string
+	mq        int
+}
+
+// readInfo summarizes a primary record of a paired read.
+type readInfo struct {
+	key readKey
+	// shard is the index of the shard that contains the record.
+	shard    int
+	refID    int
+	pos, end int
+	flags    sam.Flags
+	mapq     byte
+	cigar    string
+	// cur is the current values of the mate fields of the record.
+	cur mateFields
+}
+
+func newReadInfo(r *sam.Record, shard int) *readInfo {
+	info := &readInfo{
+		key:   readKey{r.Name, r.Flags & (sam.Read1 | sam.Read2)},
+		shard: shard,
+		refID: r.Ref.ID(),
+		pos:   r.Pos,
+		end:   r.Pos,
+		flags: r.Flags,
+		mapq:  r.MapQ,
+		cur: mateFields{
+			flags:     r.Flags,
+			mateRefID: r.MateRef.ID(),
+			matePos:   r.MatePos,
+			tempLen:   r.TempLen,
+			mq:        -1,
+		},
+	}
+	if (r.Flags & sam.Unmapped) == 0 {
+		info.end = r.End()
+		info.cigar = r.Cigar.String()
+	}
+	if aux, ok := r.Tag(mcTag[:]); ok {
+		info.cur.mc = fmt.Sprint(aux.Value())
+	}
+	if aux, ok := r.Tag(mqTag[:]); ok {
+		if v, ok := gbam.AuxInt(aux); ok {
+			info.cur.mq = v
+		}
+	}
+	return info
+}
+
+func (r *readInfo) encode(e *diskfile.Encoder) {
+	e.PutString(r.key.name)
+	e.PutInt(int(r.key.flags))
+	e.PutInt(r.shard)
+	e.PutInt(r.refID)
+	e.PutInt(r.pos)
+	e.PutInt(r.end)
+	e.PutInt(int(r.flags))
+	e.PutInt(int(r.mapq))
+	e.PutString(r.cigar)
+	r.cur.encode(e)
+}
+
+func decodeReadInfo(d *diskfile.Decoder) *readInfo {
+	r := &readInfo{}
+	r.key.name = d.String()
+	r.key.flags = sam.Flags(d.Int())
+	r.shard = d.Int()
+	r.refID = d.Int()
+	r.pos = d.Int()
+	r.end = d.Int()
+	r.flags = sam.Flags(d.Int())
+	r.mapq = byte(d.Int())
+	r.cigar = d.String()
+	r.cur = decodeMateFields(d)
+	return r
+}
+
+func (f *mateFields) encode(e *diskfile.Encoder) {
+	e.PutInt(int(f.flags))
+	e.PutInt(f.mateRefID)
+	e.PutInt(f.matePos)
+	e.PutInt(f.tempLen)
+	e.PutString(f.mc)
+	e.PutInt(f.mq)
+}
+
+func decodeMateFields(d *diskfile.Decoder) (f mateFields) {
+	f.flags = sam.Flags(d.Int())
+	f.mateRefID = d.Int()
+	f.matePos = d.Int()
+	f.tempLen = d.Int()
+	f.mc = d.String()
+	f.mq = d.Int()
+	return f
+}
+
+func (r *readInfo) unmapped() bool { return (r.flags & sam.Unmapped) != 0 }
+
+// fixedFields computes the mate fields of r. Arg mate is nil if the mate is
+// missing.
+func fixedFields(r, mate *readInfo) mateFields {
+	f := mateFields{
+		flags:     r.flags &^ (sam.MateReverse | sam.MateUnmapped),
+		mateRefID: -1,
+		matePos:   -1,
+		mq:        -1,
+	}
+	if mate == nil {
+		f.flags = (f.flags | sam.MateUnmapped) &^ sam.ProperPair
+		return f
+	}
+	f.mateRefID, f.matePos = mate.refID, mate.pos
+	if (mate.flags & sam.Reverse) != 0 {
+		f.flags |= sam.MateReverse
+	}
+	if mate.unmapped() {
+		f.flags |= sam.MateUnmapped
+	} else {
+		f.mc = mate.cigar
+		f.mq = int(mate.mapq)
+	}
+	if r.unmapped() || mate.unmapped() {
+		f.flags &^= sam.ProperPair
+		return f
+	}
+	if r.refID == mate.refID {
+		left, right := r.pos, r.end
+		if mate.pos < left {
+			left = mate.pos
+		}
+		if mate.end > right {
+			right = mate.end
+		}
+		f.tempLen = right - left
+		if r.pos > mate.pos || (r.pos == mate.pos && (r.flags&sam.Read1) == 0) {
+			f.tempLen = -f.tempLen
+		}
+	}
+	return f
+}
+
+// setAux replaces the aux field with the given tag, or appends it if the record
+// doesn't have one. If aux is nil, the field is removed.
+func setAux(r *sam.Record, tag sam.Tag, aux sam.Aux) {
+	for i, a := range r.AuxFields {
+		if a.Tag() == tag {
+			if aux != nil {
+				r.AuxFields[i] = aux
+			} else {
+				r.AuxFields = append(r.AuxFields[:i], r.AuxFields[i+1:]...)
+			}
+			return
+		}
+	}
+	if aux != nil {
+		r.AuxFields = append(r.AuxFields, aux)
+	}
+}
+
+// fixer finds and applies the mate corrections.
+type fixer struct {
+	opts     Opts
+	provider bamprovider.Provider
+	header   *sam.Header
+	// shards are the genomic ranges processed by one task. The last one
+	// stores the unmapped reads.
+	shards []gbam.Shard
+
+	// scratchDir stores the temporary files.
+	scratchDir string
+	// unmatched[i] stores the reads whose mate is not in the same shard, and
+	// whose name hashes to i.
+	unmatched []*diskfile.File
+	// fixes[g] stores the new mate fields of the records that need to change
+	// in the shards of group g (Cf. group).
+	fixes []*diskfile.File
+	// Number of corrections and of reads with a missing mate.
+	nFixes, nMissing int64
+
+	mu sync.Mutex
+	// loaded stores the contents of the recently used files in fixes, keyed
+	// by group. lru lists the groups in loaded, least recently used first.
+	loaded map[int]map[readKey]mateFields
+	lru    []int
+}
+
+func newFixer(provider bamprovider.Provider, opts Opts) (*fixer, error) {
+	if opts.ShardSize <= 0 {
+		opts.ShardSize = DefaultShardSize
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = runtime.NumCPU()
+	}
+	if opts.DiskShards <= 0 {
+		opts.DiskShards = DefaultDiskShards
+	}
+	header, err := provider.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	if header.SortOrder != sam.Coordinate && header.SortOrder != sam.UnknownOrder {
+		return nil, fmt.Errorf("fixmate: the input must be sorted by coordinate, but its sort order is %v", header.SortOrder)
+	}
+	shards, err := gbam.GetPositionBasedShards(header, opts.ShardSize, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	scratchDir, err := ioutil.TempDir(opts.ScratchDir, "fixmate")
+	if err != nil {
+		return nil, err
+	}
+	f := &fixer{
+		opts:       opts,
+		provider:   provider,
+		header:     header,
+		shards:     shards,
+		scratchDir: scratchDir,
+		loaded:     map[int]map[readKey]mateFields{},
+	}
+	nGroups := opts.DiskShards
+	if nGroups > len(shards) {
+		nGroups = len(shards)
+	}
+	for i := 0; i < opts.DiskShards && err == nil; i++ {
+		var d *diskfile.File
+		if d, err = diskfile.New(filepath.Join(scratchDir, fmt.Sprintf("unmatched-%04d", i))); err == nil {
+			f.unmatched = append(f.unmatched, d)
+		}
+	}
+	for g := 0; g < nGroups && err == nil; g++ {
+		var d *diskfile.File
+		if d, err = diskfile.New(filepath.Join(scratchDir, fmt.Sprintf("fixes-%04d", g))); err == nil {
+			f.fixes = append(f.fixes, d)
+		}
+	}
+	if err != nil {
+		f.close() // nolint: errcheck
+		return nil, err
+	}
+	return f, nil
+}
+
+// close removes the temporary files.
+func (f *fixer) close() error {
+	for _, d := range append(f.unmatched, f.fixes...) {
+		d.Close() // nolint: errcheck
+	}
+	return os.RemoveAll(f.scratchDir)
+}
+
+// group returns the index of the file in f.fixes that stores the corrections
+// for the given shard. Each group consists of consecutive shards.
+func (f *fixer) group(shardIdx int) int {
+	return shardIdx * len(f.fixes) / len(f.shards)
+}
+
+// shardIndex returns the index of the shard that contains the record.
+func (f *fixer) shardIndex(r *sam.Record) int {
+	refID := r.Ref.ID()
+	if refID < 0 {
+		return len(f.shards) - 1
+	}
+	return sort.Search(len(f.shards)-1, func(i int) bool {
+		s := f.shards[i]
+		return s.EndRef.ID() > refID || (s.EndRef.ID() == refID && s.End > r.Pos)
+	})
+}
+
+// addFix records the correction for r, if r needs one. Arg mate is nil if the
+// mate is missing.
+func (f *fixer) addFix(r, mate *readInfo) error {
+	if mate == nil {
+		atomic.AddInt64(&f.nMissing, 1)
+	}
+	fields := fixedFields(r, mate)
+	if fields == r.cur {
+		return nil
+	}
+	atomic.AddInt64(&f.nFixes, 1)
+	e := diskfile.Encoder{}
+	e.PutString(r.key.name)
+	e.PutInt(int(r.key.flags))
+	fields.encode(&e)
+	return f.fixes[f.group(r.shard)].Add(&e)
+}
+
+// addFixes records the corrections for a group of primary reads with the same
+// name.
+func (f *fixer) addFixes(group []*readInfo) error {
+	switch len(group) {
+	case 1:
+		return f.addFix(group[0], nil)
+	case 2:
+		if err := f.addFix(group[0], group[1]); err != nil {
+			return err
+		}
+		return f.addFix(group[1], group[0])
+	default:
+		return fmt.Errorf("fixmate: found %d primary records named %s", len(group), group[0].key.name)
+	}
+}
+
+// find scans the input and computes the corrections. It must be called before
+// fix.
+func (f *fixer) find() error {
+	err := traverse.Limit(f.opts.Parallelism).Each(len(f.shards), f.findInShard)
+	for _, d := range f.unmatched {
+		if e := d.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = traverse.Limit(f.opts.Parallelism).Each(len(f.unmatched), f.match)
+	for _, d := range f.fixes {
+		if e := d.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	vlog.VI(1).Infof("fixmate: %d records to fix, %d missing mates", f.nFixes, f.nMissing)
+	return err
+}
+
+// findInShard computes the corrections for the pairs in the shard, and stores
+// the remaining reads in f.unmatched.
+func (f *fixer) findInShard(shardIdx int) error {
+	byName := map[string][]*readInfo{}
+	iter := f.provider.NewIterator(f.shards[shardIdx])
+	for iter.Scan() {
+		r := iter.Record()
+		if (r.Flags&sam.Paired) != 0 && (r.Flags&(sam.Secondary|sam.Supplementary)) == 0 {
+			byName[r.Name] = append(byName[r.Name], newReadInfo(r, shardIdx))
+		}
+		sam.PutInFreePool(r)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	e := diskfile.Encoder{}
+	for name, group := range byName {
+		if len(group) == 1 {
+			e.Reset()
+			group[0].encode(&e)
+			if err := f.unmatched[seahash.Sum64([]byte(name))%uint64(len(f.unmatched))].Add(&e); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := f.addFixes(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match matches the reads stored in f.unmatched[i] with their mates, and
+// computes their corrections. The reads left have no mate in the file.
+func (f *fixer) match(i int) error {
+	byName := map[string][]*readInfo{}
+	err := f.unmatched[i].Read(func(d *diskfile.Decoder) error {
+		r := decodeReadInfo(d)
+		byName[r.key.name] = append(byName[r.key.name], r)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, group := range byName {
+		if err := f.addFixes(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupFixes returns the corrections for the records in the shards of group g,
+// keyed by read. It is thread safe after find returns.
+func (f *fixer) groupFixes(g int) (map[readKey]mateFields, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, lg := range f.lru {
+		if lg == g {
+			f.lru = append(append(f.lru[:i], f.lru[i+1:]...), g)
+			return f.loaded[g], nil
+		}
+	}
+	fixes := map[readKey]mateFields{}
+	err := f.fixes[g].Read(func(d *diskfile.Decoder) error {
+		key := readKey{name: d.String(), flags: sam.Flags(d.Int())}
+		fixes[key] = decodeMateFields(d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Each of the concurrent tasks uses at most two groups at a time, when it
+	// crosses a group boundary.
+	if len(f.lru) >= 2*f.opts.Parallelism {
+		delete(f.loaded, f.lru[0])
+		f.lru = f.lru[1:]
+	}
+	f.loaded[g] = fixes
+	f.lru = append(f.lru, g)
+	return fixes, nil
+}
+
+// fix applies the correction, if any, to the record. It is thread safe after
+// find returns.
+func (f *fixer) fix(r *sam.Record) error {
+	if (r.Flags & (sam.Secondary | sam.Supplementary)) != 0 {
+		return nil
+	}
+	fixes, err := f.groupFixes(f.group(f.shardIndex(r)))
+	if err != nil {
+		return err
+	}
+	fields, ok := fixes[readKey{r.Name, r.Flags & (sam.Read1 | sam.Read2)}]
+	if !ok {
+		return nil
+	}
+	r.Flags = fields.flags
+	r.MateRef, r.MatePos, r.TempLen = nil, fields.matePos, fields.tempLen
+	if fields.mateRefID >= 0 {
+		r.MateRef = f.header.Refs()[fields.mateRefID]
+	}
+	var mc, mq sam.Aux
+	if fields.mc != "" {
+		mc = sam.Aux(append([]byte{mcTag[0], mcTag[1], 'Z'}, fields.mc...))
+	}
+	if fields.mq >= 0 {
+		mq = sam.Aux([]byte{mqTag[0], mqTag[1], 'C', byte(fields.mq)})
+	}
+	setAux(r, mcTag, mc)
+	setAux(r, mqTag, mq)
+	return nil
+}
+
+// runFixer opens the input, computes the corrections, and then calls write.
+func runFixer(srcPath string, opts Opts, write func(f *fixer) error) error {
+	provider := bamprovider.NewProvider(srcPath, opts.ProviderOpts)
+	f, err := newFixer(provider, opts)
+	if err == nil {
+		if err = f.find(); err == nil {
+			err = write(f)
+		}
+		if e := f.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if e := provider.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return errors.E(err, fmt.Sprintf("fixmate %s", srcPath))
+	}
+	return nil
+}
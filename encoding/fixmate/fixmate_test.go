@@ -0,0 +1,168 @@
+package fixmate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/internal/bamtest"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	chr1, _ = sam.NewReference("chr1", "", "", 1000, nil, nil)
+	chr2, _ = sam.NewReference("chr2", "", "", 1000, nil, nil)
+
+	r1F = sam.Paired | sam.Read1
+	r2F = sam.Paired | sam.Read2
+)
+
+// newRecord creates a record with the given mate fields. Each aux is
+// "tag:value". MQ is an integer.
+func newRecord(t *testing.T, name string, ref *sam.Reference, pos int, flags sam.Flags,
+	mateRef *sam.Reference, matePos, tempLen int, aux ...string) *sam.Record {
+	cigar := ""
+	if (flags & sam.Unmapped) == 0 {
+		cigar = "10M"
+	}
+	r := bamtest.NewRecord(t, name, ref, pos, flags, mateRef, matePos, cigar)
+	r.TempLen = tempLen
+	for _, a := range aux {
+		var v interface{} = a[3:]
+		if a[:2] == "MQ" {
+			var n uint8
+			_, err := fmt.Sscan(a[3:], &n)
+			require.NoError(t, err)
+			v = n
+		}
+		field, err := sam.NewAux(sam.NewTag(a[:2]), v)
+		require.NoError(t, err)
+		r.AuxFields = append(r.AuxFields, field)
+	}
+	return r
+}
+
+// expected is the expected mate information of a record.
+type expected struct {
+	name    string
+	flags   sam.Flags
+	mateRef *sam.Reference
+	matePos int
+	tempLen int
+	mc      string
+	mq      int
+}
+
+func testRecords(t *testing.T) ([]*sam.Record, []expected) {
+	recs := []*sam.Record{
+		// A's mate fields are stale.
+		newRecord(t, "A", chr1, 100, r1F|sam.ProperPair, chr1, 250, 0),
+		// B's mate is on a different reference.
+		newRecord(t, "B", chr1, 150, r1F, chr1, 400, 260),
+		newRecord(t, "A", chr1, 300, r2F|sam.Reverse|sam.ProperPair, chr1, 100, -210),
+		// C's mate has been filtered out.
+		newRecord(t, "C", chr1, 500, r1F|sam.ProperPair|sam.MateReverse, chr1, 700, 210, "MC:10M", "MQ:60"),
+		// D's mate is unmapped.
+		newRecord(t, "D", chr1, 600, r1F|sam.Reverse, chr1, 600, 10),
+		newRecord(t, "D", chr1, 600, r2F|sam.Unmapped, chr1, 600, 0),
+		// Unpaired and secondary records are not changed.
+		newRecord(t, "E", chr1, 650, 0, nil, -1, 0),
+		newRecord(t, "A", chr1, 700, r1F|sam.Secondary, chr1, 250, 0),
+		// F is already correct.
+		newRecord(t, "F", chr1, 800, r1F|sam.ProperPair|sam.MateReverse, chr1, 850, 60, "MC:10M", "MQ:60"),
+		newRecord(t, "F", chr1, 850, r2F|sam.ProperPair|sam.Reverse, chr1, 800, -60, "MC:10M", "MQ:60"),
+		newRecord(t, "B", chr2, 50, r2F|sam.Reverse, chr1, 150, 0),
+	}
+	return recs, []expected{
+		{"A", r1F | sam.ProperPair | sam.MateReverse, chr1, 300, 210, "10M", 60},
+		{"B", r1F | sam.MateReverse, chr2, 50, 0, "10M", 60},
+		{"A", r2F | sam.Reverse | sam.ProperPair, chr1, 100, -210, "10M", 60},
+		{"C", r1F | sam.MateUnmapped, nil, -1, 0, "", -1},
+		{"D", r1F | sam.Reverse | sam.MateUnmapped, chr1, 600, 0, "", -1},
+		{"D", r2F | sam.Unmapped | sam.MateReverse, chr1, 600, 0, "10M", 60},
+		{"E", 0, nil, -1, 0, "", -1},
+		{"A", r1F | sam.Secondary, chr1, 250, 0, "", -1},
+		{"F", r1F | sam.ProperPair | sam.MateReverse, chr1, 850, 60, "10M", 60},
+		{"F", r2F | sam.ProperPair | sam.Reverse, chr1, 800, -60, "10M", 60},
+		{"B", r2F | sam.Reverse, chr1, 150, 0, "10M", 60},
+	}
+}
+
+func checkRecords(t *testing.T, recs []*sam.Record, exp []expected) {
+	require.Equal(t, len(exp), len(recs))
+	for i, r := range recs {
+		e := exp[i]
+		assert.Equalf(t, e.name, r.Name, "i=%d", i)
+		assert.Equalf(t, e.flags, r.Flags, "rec=%v", r)
+		assert.Equalf(t, e.mateRef.ID(), r.MateRef.ID(), "rec=%v", r)
+		assert.Equalf(t, e.matePos, r.MatePos, "rec=%v", r)
+		assert.Equalf(t, e.tempLen, r.TempLen, "rec=%v", r)
+		mc := ""
+		if aux, ok := r.Tag([]byte("MC")); ok {
+			mc = fmt.Sprint(aux.Value())
+		}
+		assert.Equalf(t, e.mc, mc, "rec=%v", r)
+		mq := -1
+		if aux, ok := r.Tag([]byte("MQ")); ok {
+			mq, _ = gbam.AuxInt(aux)
+		}
+		assert.Equalf(t, e.mq, mq, "rec=%v", r)
+	}
+}
+
+func TestFixMate(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup)
+
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	require.NoError(t, err)
+	header.SortOrder = sam.Coordinate
+	recs, exp := testRecords(t)
+	srcPath := filepath.Join(tempDir, "src.pam")
+	bamtest.WritePAM(t, srcPath, header, recs)
+
+	scratchDir := filepath.Join(tempDir, "scratch")
+	require.NoError(t, os.Mkdir(scratchDir, 0700))
+	// Use small shards so that some pairs are split across shards. With few
+	// disk shards, each file of corrections covers many shards, and the files
+	// are evicted from memory as the output is written.
+	for _, opts := range []Opts{
+		{ShardSize: 100, Parallelism: 3, ScratchDir: scratchDir},
+		{ShardSize: 100, Parallelism: 1, DiskShards: 3, ScratchDir: scratchDir},
+	} {
+		bamPath := filepath.Join(tempDir, "dst.bam")
+		require.NoError(t, FixBAM(srcPath, bamPath, opts))
+		checkRecords(t, bamtest.ReadBAM(t, bamPath), exp)
+
+		pamPath := filepath.Join(tempDir, "dst.pam")
+		require.NoError(t, FixPAM(srcPath, pamPath, opts))
+		checkRecords(t, bamtest.ReadPAM(t, pamPath), exp)
+
+		// The temporary files are removed.
+		names, err := ioutil.ReadDir(scratchDir)
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(names))
+	}
+
+	// The input is left intact.
+	got := bamtest.ReadPAM(t, srcPath)
+	assert.Equal(t, 250, got[0].MatePos)
+}
+
+func TestFixedFieldsTempLen(t *testing.T) {
+	// Overlapping reads at the same position. Read1 gets the positive TLEN.
+	r1 := &readInfo{refID: 0, pos: 100, end: 120, flags: r1F}
+	r2 := &readInfo{refID: 0, pos: 100, end: 110, flags: r2F | sam.Reverse}
+	assert.Equal(t, 20, fixedFields(r1, r2).tempLen)
+	assert.Equal(t, -20, fixedFields(r2, r1).tempLen)
+	// The mate is contained in the read.
+	r2.pos, r2.end = 105, 110
+	assert.Equal(t, 20, fixedFields(r1, r2).tempLen)
+	assert.Equal(t, -20, fixedFields(r2, r1).tempLen)
+}
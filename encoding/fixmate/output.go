@@ -0,0 +1,77 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package fixmate
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/grailbio/base/vcontext"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/hts/sam"
+)
+
+// FixBAM fixes the mate information of the records in the coordinate-sorted
+// BAM or PAM file "srcPath", and writes all the records to a BAM file
+// "dstPath".
+func FixBAM(srcPath, dstPath string, opts Opts) error {
+	return runFixer(srcPath, opts, func(f *fixer) error {
+		return f.writeBAM(dstPath)
+	})
+}
+
+// writeBAM copies the input to a BAM file, applying the corrections. The
+// shards are processed in parallel and written in order.
+func (f *fixer) writeBAM(dstPath string) error {
+	return gbam.WriteShardedBAM(dstPath, f.header, len(f.shards), f.opts.Parallelism,
+		func(shardIdx int, add func(r *sam.Record) error) error {
+			iter := f.provider.NewIterator(f.shards[shardIdx])
+			var err error
+			for err == nil && iter.Scan() {
+				r := iter.Record()
+				if err = f.fix(r); err == nil {
+					err = add(r)
+				}
+				sam.PutInFreePool(r)
+			}
+			if e := iter.Close(); e != nil && err == nil {
+				err = e
+			}
+			return err
+		})
+}
+
+// FixPAM fixes the mate information of the records in the coordinate-sorted
+// PAM file "srcPath", and writes the result to a PAM file "dstPath". Only the
+// flags, materefid, matepos, templen and aux fields are rewritten. The files
+// for the other fields are hardlinked from srcPath when possible, and copied
+// otherwise. Existing contents of dstPath, if any, are destroyed.
+func FixPAM(srcPath, dstPath string, opts Opts) error {
+	if filepath.Clean(srcPath) == filepath.Clean(dstPath) {
+		return fmt.Errorf("fixmate %s: source and destination are the same", srcPath)
+	}
+	if bamprovider.GuessFileType(srcPath) != bamprovider.PAM {
+		return fmt.Errorf("fixmate %s: PAM output requires a PAM input", srcPath)
+	}
+	return runFixer(srcPath, opts, func(f *fixer) error {
+		ctx := vcontext.Background()
+		if err := pamutil.Remove(dstPath); err != nil {
+			return err
+		}
+		if err := pamutil.Concat(ctx, dstPath, []string{srcPath}); err != nil {
+			return err
+		}
+		return pam.RewriteFields(dstPath, pam.RewriteOpts{
+			Fields: []gbam.FieldType{gbam.FieldFlags, gbam.FieldMateRefID, gbam.FieldMatePos,
+				gbam.FieldTempLen, gbam.FieldAux},
+			DropFields:   []gbam.FieldType{gbam.FieldMapq, gbam.FieldCigar, gbam.FieldSeq, gbam.FieldQual},
+			MaxBufSize:   f.opts.MaxBufSize,
+			Transformers: f.opts.Transformers,
+		}, func(_ int, r *sam.Record) error { return f.fix(r) })
+	})
+}
@@ -0,0 +1,722 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package markdup marks duplicate reads in a coordinate-sorted BAM or PAM
+// file, in the same manner as Picard MarkDuplicates.
+//
+// Read pairs are grouped by the library, the unclipped 5' positions and the
+// orientations of both reads, and optionally by a UMI tag. In each group, the
+// pair with the largest sum of base qualities is kept, and the rest are marked
+// as duplicates. Reads whose mate is unmapped, and unpaired reads, are grouped
+// by their own unclipped 5' position and orientation. They are marked as
+// duplicates if a read pair has an end at the same position, or if another such
+// read in the group has a larger sum of base qualities.
+//
+// The file is processed in shards in parallel. Mates that fall in different
+// shards are resolved using bampair.GetDistantMates. To bound the memory usage,
+// the duplicates are stored in temporary files, in the same manner as package
+// fixmate. They are first spread over files by the hash of their names, so that
+// the secondary and supplementary records of the duplicates can be found. Then
+// the keys of the duplicate records are stored in files, one per group of
+// consecutive shards, and each file is loaded when its records are written.
+package markdup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"blainsmith.com/go/seahash"
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/traverse"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bampair"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/internal/diskfile"
+	"github.com/grailbio/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+const (
+	// DefaultShardSize is the default value of Opts.ShardSize.
+	DefaultShardSize = 5000000
+	// DefaultPadding is the default value of Opts.Padding.
+	DefaultPadding = 1000
+	// DefaultDiskShards is the default value of Opts.DiskShards.
+	DefaultDiskShards = 256
+
+	// UnknownLibrary is the library name used for reads without a read group,
+	// or whose read group has no LB tag. It is the same as Picard's.
+	UnknownLibrary = "Unknown Library"
+
+	// minScoreQual is the smallest base quality counted in a read's score.
+	minScoreQual = 15
+)
+
+// Opts controls the behavior of MarkBAM and MarkPAM.
+type Opts struct {
+	// ProviderOpts is passed to bamprovider.NewProvider when opening the input.
+	ProviderOpts bamprovider.ProviderOpts
+
+	// ShardSize is the width of the genomic range processed by one task. If <=
+	// 0, DefaultShardSize is used.
+	ShardSize int
+
+	// Padding is the max distance between the alignment position of a read and
+	// its unclipped 5' position, i.e., the max number of reference bases
+	// covered by a read, plus its clipped bases. Duplicates of reads that
+	// exceed this limit may be missed at shard boundaries. If <= 0,
+	// DefaultPadding is used.
+	Padding int
+
+	// Parallelism is the number of shards processed concurrently. If <= 0,
+	// runtime.NumCPU() is used.
+	Parallelism int
+
+	// DiskMateShards is passed to bampair.Opts. If it is 0, the distant mates
+	// are kept in memory.
+	DiskMateShards int
+
+	// DiskShards is the number of temporary files that store the duplicates
+	// by read name, and the number of files that store them by position. A
+	// file is loaded in memory only while it is used. If <= 0,
+	// DefaultDiskShards is used.
+	DiskShards int
+
+	// ScratchDir is the directory in which the temporary files, including the
+	// distant mates, are created. If empty, the default directory for
+	// temporary files is used.
+	ScratchDir string
+
+	// UMITag, if nonempty, is the aux tag that stores the unique molecular
+	// identifier, e.g., "RX". Reads with different UMIs are never duplicates of
+	// each other.
+	UMITag string
+
+	// MaxBufSize and Transformers are used by MarkPAM when writing the new
+	// flags field. They are the same as pam.WriteOpts.
+	MaxBufSize   int
+	Transformers []string
+}
+
+// readKey identifies one read of a template. Flags stores only the Read1 and
+// Read2 bits. The secondary and supplementary records of a read share the key
+// with its primary record.
+type readKey struct {
+	name  string
+	flags sam.Flags
+}
+
+func newReadKey(r *sam.Record) readKey {
+	return readKey{r.Name, r.Flags & (sam.Read1 | sam.Read2)}
+}
+
+// readEnd is the unclipped 5' end of a read.
+type readEnd struct {
+	refID   int
+	pos     int
+	reverse bool
+}
+
+func (e readEnd) less(o readEnd) bool {
+	if e.refID != o.refID {
+		return e.refID < o.refID
+	}
+	if e.pos != o.pos {
+		return e.pos < o.pos
+	}
+	return !e.reverse && o.reverse
+}
+
+// newReadEnd computes the unclipped 5' end of a mapped read.
+func newReadEnd(r *sam.Record) readEnd {
+	e := readEnd{refID: r.Ref.ID(), reverse: (r.Flags & sam.Reverse) != 0}
+	if !e.reverse {
+		e.pos = r.Pos
+		for _, op := range r.Cigar {
+			t := op.Type()
+			if t != sam.CigarSoftClipped && t != sam.CigarHardClipped {
+				break
+			}
+			e.pos -= op.Len()
+		}
+		return e
+	}
+	refLen, _ := r.Cigar.Lengths()
+	e.pos = r.Pos + refLen - 1
+	for i := len(r.Cigar) - 1; i >= 0; i-- {
+		t := r.Cigar[i].Type()
+		if t != sam.CigarSoftClipped && t != sam.CigarHardClipped {
+			break
+		}
+		e.pos += r.Cigar[i].Len()
+	}
+	return e
+}
+
+// fragmentKey groups reads by their own 5' end.
+type fragmentKey struct {
+	library, umi string
+	end          readEnd
+}
+
+// pairKey groups read pairs by the 5' ends of both reads. end0 is less than or
+// equal to end1.
+type pairKey struct {
+	library, umi string
+	end0, end1   readEnd
+}
+
+// candidateRead is a read of a candidate. shard is the index of the shard in
+// marker.shards that contains the read.
+type candidateRead struct {
+	key   readKey
+	shard int
+}
+
+// candidate is a read or a read pair in a duplicate group.
+type candidate struct {
+	reads  []candidateRead
+	score  int
+	paired bool // for fragments: true if the read belongs to a mapped pair.
+}
+
+// baseQualityScore computes the score of a read, the sum of its base qualities
+// >= 15. It is the same as Picard's SUM_OF_BASE_QUALITIES strategy.
+func baseQualityScore(r *sam.Record) int {
+	score := 0
+	for _, q := range r.Qual {
+		if q >= minScoreQual && q != 0xff {
+			score += int(q)
+		}
+	}
+	return score
+}
+
+// pickBest sorts the candidates so that the best one, i.e., the one with the
+// largest score, comes first. Ties are broken by the read name so that the
+// result does not depend on sharding.
+func pickBest(c []candidate) {
+	sort.Slice(c, func(i, j int) bool {
+		if c[i].score != c[j].score {
+			return c[i].score > c[j].score
+		}
+		return c[i].reads[0].key.name < c[j].reads[0].key.name
+	})
+}
+
+// marker stores the state of duplicate marking.
+type marker struct {
+	opts      Opts
+	provider  bamprovider.Provider
+	header    *sam.Header
+	libraries map[string]string // read group name -> library
+	// shards are the genomic ranges written by one task. The last one stores
+	// the unmapped reads.
+	shards []gbam.Shard
+
+	// scratchDir stores the temporary files.
+	scratchDir string
+	// reads[i] stores the duplicate reads found in the shards, and the
+	// secondary and supplementary records, whose name hashes to i.
+	reads []*diskfile.File
+	// duplicates[g] stores the keys of the duplicate records in the shards of
+	// group g (Cf. group).
+	duplicates []*diskfile.File
+	// Number of duplicate records.
+	nDuplicates int64
+
+	mu sync.Mutex
+	// loaded stores the contents of the recently used files in duplicates,
+	// keyed by group. lru lists the groups in loaded, least recently used
+	// first.
+	loaded map[int]map[readKey]struct{}
+	lru    []int
+}
+
+func newMarker(provider bamprovider.Provider, opts Opts) (*marker, error) {
+	if opts.ShardSize <= 0 {
+		opts.ShardSize = DefaultShardSize
+	}
+	if opts.Padding <= 0 {
+		opts.Padding = DefaultPadding
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = runtime.NumCPU()
+	}
+	if opts.DiskShards <= 0 {
+		opts.DiskShards = DefaultDiskShards
+	}
+	header, err := provider.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	if header.SortOrder != sam.Coordinate && header.SortOrder != sam.UnknownOrder {
+		return nil, fmt.Errorf("markdup: the input must be sorted by coordinate, but its sort order is %v", header.SortOrder)
+	}
+	shards, err := gbam.GetPositionBasedShards(header, opts.ShardSize, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	scratchDir, err := ioutil.TempDir(opts.ScratchDir, "markdup")
+	if err != nil {
+		return nil, err
+	}
+	m := &marker{
+		opts:       opts,
+		provider:   provider,
+		header:     header,
+		libraries:  map[string]string{},
+		shards:     shards,
+		scratchDir: scratchDir,
+		loaded:     map[int]map[readKey]struct{}{},
+	}
+	for _, rg := range header.RGs() {
+		if lib := rg.Library(); lib != "" {
+			m.libraries[rg.Name()] = lib
+		}
+	}
+	nGroups := opts.DiskShards
+	if nGroups > len(shards) {
+		nGroups = len(shards)
+	}
+	for i := 0; i < opts.DiskShards && err == nil; i++ {
+		var d *diskfile.File
+		if d, err = diskfile.New(filepath.Join(scratchDir, fmt.Sprintf("reads-%04d", i))); err == nil {
+			m.reads = append(m.reads, d)
+		}
+	}
+	for g := 0; g < nGroups && err == nil; g++ {
+		var d *diskfile.File
+		if d, err = diskfile.New(filepath.Join(scratchDir, fmt.Sprintf("duplicates-%04d", g))); err == nil {
+			m.duplicates = append(m.duplicates, d)
+		}
+	}
+	if err != nil {
+		m.close() // nolint: errcheck
+		return nil, err
+	}
+	return m, nil
+}
+
+// close removes the temporary files.
+func (m *marker) close() error {
+	for _, d := range append(m.reads, m.duplicates...) {
+		d.Close() // nolint: errcheck
+	}
+	return os.RemoveAll(m.scratchDir)
+}
+
+// group returns the index of the file in m.duplicates that stores the
+// duplicates in the given shard. Each group consists of consecutive shards.
+func (m *marker) group(shardIdx int) int {
+	return shardIdx * len(m.duplicates) / len(m.shards)
+}
+
+// shardIndex returns the index of the shard in m.shards that contains the
+// record.
+func (m *marker) shardIndex(r *sam.Record) int {
+	refID := r.Ref.ID()
+	if refID < 0 {
+		return len(m.shards) - 1
+	}
+	return sort.Search(len(m.shards)-1, func(i int) bool {
+		s := m.shards[i]
+		return s.EndRef.ID() > refID || (s.EndRef.ID() == refID && s.End > r.Pos)
+	})
+}
+
+// addRead stores a read in m.reads. Arg dup is true if the read is a
+// duplicate, and false if it is a secondary or supplementary record, which is
+// a duplicate if its primary record is.
+func (m *marker) addRead(e *diskfile.Encoder, key readKey, shard int, dup bool) error {
+	e.Reset()
+	e.PutString(key.name)
+	e.PutInt(int(key.flags))
+	e.PutInt(shard)
+	if dup {
+		e.PutInt(1)
+	} else {
+		e.PutInt(0)
+	}
+	return m.reads[seahash.Sum64([]byte(key.name))%uint64(len(m.reads))].Add(e)
+}
+
+// library returns the library of the read group of the record.
+func (m *marker) library(r *sam.Record) string {
+	if aux, ok := r.Tag([]byte("RG")); ok {
+		if lib, ok := m.libraries[fmt.Sprint(aux.Value())]; ok {
+			return lib
+		}
+	}
+	return UnknownLibrary
+}
+
+// umi returns the value of the UMI tag of the record, or "" if Opts.UMITag is
+// unset.
+func (m *marker) umi(r *sam.Record) string {
+	if m.opts.UMITag == "" {
+		return ""
+	}
+	if aux, ok := r.Tag([]byte(m.opts.UMITag)); ok {
+		return fmt.Sprint(aux.Value())
+	}
+	return ""
+}
+
+// groupDuplicates returns the keys of the duplicate records in the shards of
+// group g. It is thread safe after find returns.
+func (m *marker) groupDuplicates(g int) (map[readKey]struct{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, lg := range m.lru {
+		if lg == g {
+			m.lru = append(append(m.lru[:i], m.lru[i+1:]...), g)
+			return m.loaded[g], nil
+		}
+	}
+	dups := map[readKey]struct{}{}
+	err := m.duplicates[g].Read(func(d *diskfile.Decoder) error {
+		dups[readKey{name: d.String(), flags: sam.Flags(d.Int())}] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Each of the concurrent tasks uses at most two groups at a time, when it
+	// crosses a group boundary.
+	if len(m.lru) >= 2*m.opts.Parallelism {
+		delete(m.loaded, m.lru[0])
+		m.lru = m.lru[1:]
+	}
+	m.loaded[g] = dups
+	m.lru = append(m.lru, g)
+	return dups, nil
+}
+
+// isDuplicate returns true if the record was found to be a duplicate. It is
+// thread safe after find returns.
+func (m *marker) isDuplicate(r *sam.Record) (bool, error) {
+	if (r.Flags & sam.Unmapped) != 0 {
+		return false, nil
+	}
+	dups, err := m.groupDuplicates(m.group(m.shardIndex(r)))
+	if err != nil {
+		return false, err
+	}
+	_, ok := dups[newReadKey(r)]
+	return ok, nil
+}
+
+// find scans the input and finds the duplicates. It must be called before
+// isDuplicate.
+func (m *marker) find() error {
+	shards, err := gbam.GetPositionBasedShards(m.header, m.opts.ShardSize, m.opts.Padding, false)
+	if err != nil {
+		return err
+	}
+	distantMates, _, err := bampair.GetDistantMates(m.provider, shards, &bampair.Opts{
+		Parallelism: m.opts.Parallelism,
+		DiskShards:  m.opts.DiskMateShards,
+		ScratchDir:  m.opts.ScratchDir,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	err = traverse.Limit(m.opts.Parallelism).Each(len(shards), func(i int) error {
+		if err := distantMates.OpenShard(i); err != nil {
+			return err
+		}
+		err := m.findInShard(shards[i], distantMates)
+		distantMates.CloseShard(i)
+		return err
+	})
+	if e := distantMates.Close(); e != nil && err == nil {
+		err = e
+	}
+	for _, d := range m.reads {
+		if e := d.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err == nil {
+		err = traverse.Limit(m.opts.Parallelism).Each(len(m.reads), m.match)
+	}
+	for _, d := range m.duplicates {
+		if e := d.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	vlog.VI(1).Infof("markdup: found %d duplicate records in %d shards: %v", m.nDuplicates, len(shards), err)
+	return err
+}
+
+// match finds the duplicate records among the reads stored in m.reads[i], and
+// stores their keys in m.duplicates.
+func (m *marker) match(i int) error {
+	type entry struct {
+		key   readKey
+		shard int
+	}
+	var entries []entry
+	dups := map[readKey]struct{}{}
+	err := m.reads[i].Read(func(d *diskfile.Decoder) error {
+		e := entry{readKey{name: d.String(), flags: sam.Flags(d.Int())}, d.Int()}
+		if d.Int() != 0 {
+			dups[e.key] = struct{}{}
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	enc := diskfile.Encoder{}
+	for _, e := range entries {
+		if _, ok := dups[e.key]; !ok {
+			continue
+		}
+		atomic.AddInt64(&m.nDuplicates, 1)
+		enc.Reset()
+		enc.PutString(e.key.name)
+		enc.PutInt(int(e.key.flags))
+		if err := m.duplicates[m.group(e.shard)].Add(&enc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownsEnd returns true if the end is in the shard, excluding the padding.
+// Positions beyond the reference are clamped to the reference.
+func ownsEnd(shard gbam.Shard, e readEnd) bool {
+	if e.refID != shard.StartRef.ID() {
+		return false
+	}
+	pos := e.pos
+	if pos < 0 {
+		pos = 0
+	}
+	if n := shard.StartRef.Len(); pos >= n {
+		pos = n - 1
+	}
+	return pos >= shard.Start && pos < shard.End
+}
+
+// findInShard finds the duplicates among the pairs and fragments whose leftmost
+// 5' end is in the shard. The shard must be padded, so that it contains all the
+// reads whose 5' end is in the shard.
+func (m *marker) findInShard(shard gbam.Shard, distantMates *bampair.DistantMateTable) error {
+	var (
+		recs      []*sam.Record
+		byName    = map[string][]*sam.Record{}
+		pairs     = map[pairKey][]candidate{}
+		fragments = map[fragmentKey][]candidate{}
+	)
+	enc := diskfile.Encoder{}
+	iter := m.provider.NewIterator(shard)
+	for iter.Scan() {
+		r := iter.Record()
+		if (r.Flags & (sam.Secondary | sam.Supplementary | sam.Unmapped)) != 0 {
+			// A mapped secondary or supplementary record is a duplicate if its
+			// primary record is, which may be in another shard. Padding is
+			// excluded so that each record is stored once.
+			if (r.Flags&sam.Unmapped) == 0 && ownsEnd(shard, readEnd{refID: r.Ref.ID(), pos: r.Pos}) {
+				if err := m.addRead(&enc, newReadKey(r), m.shardIndex(r), false); err != nil {
+					iter.Close() // nolint: errcheck
+					return err
+				}
+			}
+			sam.PutInFreePool(r)
+			continue
+		}
+		recs = append(recs, r)
+		if !gbam.HasNoMappedMate(r) {
+			byName[r.Name] = append(byName[r.Name], r)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	for _, r := range recs {
+		end := newReadEnd(r)
+		paired := !gbam.HasNoMappedMate(r)
+		if ownsEnd(shard, end) {
+			key := fragmentKey{m.library(r), m.umi(r), end}
+			fragments[key] = append(fragments[key], candidate{
+				reads:  []candidateRead{{newReadKey(r), m.shardIndex(r)}},
+				score:  baseQualityScore(r),
+				paired: paired,
+			})
+		}
+		if !paired {
+			continue
+		}
+		var mate *sam.Record
+		switch group := byName[r.Name]; len(group) {
+		case 1:
+			if mate, _ = distantMates.GetMate(shard.ShardIdx, r); mate == nil {
+				return fmt.Errorf("markdup: mate of %v not found", r)
+			}
+		case 2:
+			if group[0] != r {
+				continue // processed with group[0].
+			}
+			mate = group[1]
+		default:
+			return fmt.Errorf("markdup: found %d primary records named %s", len(group), r.Name)
+		}
+		end0, end1 := end, newReadEnd(mate)
+		umiRec := r
+		if end1.less(end0) {
+			end0, end1 = end1, end0
+			umiRec = mate
+		}
+		if !ownsEnd(shard, end0) {
+			continue
+		}
+		key := pairKey{m.library(r), m.umi(umiRec), end0, end1}
+		pairs[key] = append(pairs[key], candidate{
+			reads: []candidateRead{{newReadKey(r), m.shardIndex(r)}, {newReadKey(mate), m.shardIndex(mate)}},
+			score: baseQualityScore(r) + baseQualityScore(mate),
+		})
+	}
+
+	var dups []candidateRead
+	for _, c := range pairs {
+		pickBest(c)
+		for _, p := range c[1:] {
+			dups = append(dups, p.reads...)
+		}
+	}
+	for _, c := range fragments {
+		hasPair := false
+		var unpaired []candidate
+		for _, f := range c {
+			if f.paired {
+				hasPair = true
+			} else {
+				unpaired = append(unpaired, f)
+			}
+		}
+		if !hasPair {
+			pickBest(unpaired)
+			unpaired = unpaired[1:]
+		}
+		for _, f := range unpaired {
+			dups = append(dups, f.reads...)
+		}
+	}
+	for _, r := range recs {
+		sam.PutInFreePool(r)
+	}
+	for _, d := range dups {
+		if err := m.addRead(&enc, d.key, d.shard, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mark sets or clears the duplicate flag of the record, and updates the
+// metrics. It is thread safe after find returns.
+func (m *marker) mark(r *sam.Record, metrics metricsMap) error {
+	r.Flags &^= sam.Duplicate
+	dup, err := m.isDuplicate(r)
+	if err != nil {
+		return err
+	}
+	if dup {
+		r.Flags |= sam.Duplicate
+	}
+	metrics.add(m.library(r), r, dup)
+	return nil
+}
+
+// metricsMap stores Metrics per library. Thread compatible.
+type metricsMap map[string]*Metrics
+
+func (mm metricsMap) add(library string, r *sam.Record, dup bool) {
+	mt, ok := mm[library]
+	if !ok {
+		mt = &Metrics{Library: library}
+		mm[library] = mt
+	}
+	switch {
+	case (r.Flags & (sam.Secondary | sam.Supplementary)) != 0:
+		mt.SecondaryOrSupplementaryReads++
+	case (r.Flags & sam.Unmapped) != 0:
+		mt.UnmappedReads++
+	case gbam.HasNoMappedMate(r):
+		mt.UnpairedReadsExamined++
+		if dup {
+			mt.UnpairedReadDuplicates++
+		}
+	default:
+		// Both reads of a pair are counted. list halves the counts, the same
+		// as Picard.
+		mt.ReadPairsExamined++
+		if dup {
+			mt.ReadPairDuplicates++
+		}
+	}
+}
+
+func (mm metricsMap) mergeFrom(src metricsMap) {
+	for lib, s := range src {
+		mt, ok := mm[lib]
+		if !ok {
+			mt = &Metrics{Library: lib}
+			mm[lib] = mt
+		}
+		mt.UnpairedReadsExamined += s.UnpairedReadsExamined
+		mt.ReadPairsExamined += s.ReadPairsExamined
+		mt.SecondaryOrSupplementaryReads += s.SecondaryOrSupplementaryReads
+		mt.UnmappedReads += s.UnmappedReads
+		mt.UnpairedReadDuplicates += s.UnpairedReadDuplicates
+		mt.ReadPairDuplicates += s.ReadPairDuplicates
+		mt.ReadPairOpticalDuplicates += s.ReadPairOpticalDuplicates
+	}
+}
+
+// list returns the metrics sorted by library.
+func (mm metricsMap) list() []Metrics {
+	var l []Metrics
+	for _, mt := range mm {
+		m := *mt
+		m.ReadPairsExamined /= 2
+		m.ReadPairDuplicates /= 2
+		l = append(l, m)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Library < l[j].Library })
+	return l
+}
+
+// runMarker opens the input, finds the duplicates, then calls write to write
+// the output.
+func runMarker(srcPath string, opts Opts, write func(m *marker) error) error {
+	provider := bamprovider.NewProvider(srcPath, opts.ProviderOpts)
+	m, err := newMarker(provider, opts)
+	if err == nil {
+		if err = m.find(); err == nil {
+			err = write(m)
+		}
+		if e := m.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if e := provider.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return errors.E(err, fmt.Sprintf("markdup %s", srcPath))
+	}
+	return nil
+}
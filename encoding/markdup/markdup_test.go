@@ -0,0 +1,197 @@
+package markdup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/bio/internal/bamtest"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	chr1, _ = sam.NewReference("chr1", "", "", 1000, nil, nil)
+
+	r1F = sam.Paired | sam.Read1
+	r2F = sam.Paired | sam.Read2
+)
+
+// newRecord creates a record whose quality scores are all "qual".
+func newRecord(t *testing.T, name string, ref *sam.Reference, pos int, flags sam.Flags, mateRef *sam.Reference, matePos int, cigar string, qual byte) *sam.Record {
+	r := bamtest.NewRecord(t, name, ref, pos, flags, mateRef, matePos, cigar)
+	for i := range r.Qual {
+		r.Qual[i] = qual
+	}
+	return r
+}
+
+// testRecords returns the records used by the tests, sorted by coordinate, and
+// the names of the records that must be marked as duplicates.
+func testRecords(t *testing.T) ([]*sam.Record, map[string]bool) {
+	unmapped := sam.Paired | sam.Unmapped | sam.MateUnmapped
+	recs := []*sam.Record{
+		// A, B and C are duplicates. A has the best quality.
+		newRecord(t, "A", chr1, 100, r1F|sam.MateReverse, chr1, 300, "10M", 30),
+		newRecord(t, "B", chr1, 100, r1F|sam.MateReverse, chr1, 300, "10M", 20),
+		// D is in a different orientation from A.
+		newRecord(t, "D", chr1, 100, r1F, chr1, 300, "10M", 30),
+		// E and E2 have the same ends; their mates are in a distant shard.
+		newRecord(t, "E", chr1, 100, r1F|sam.MateReverse, chr1, 800, "10M", 30),
+		newRecord(t, "E2", chr1, 100, r1F|sam.MateReverse, chr1, 800, "10M", 20),
+		// Unpaired read at one end of A.
+		newRecord(t, "F", chr1, 100, 0, nil, -1, "10M", 40),
+		// C's unclipped 5' position is the same as A's.
+		newRecord(t, "C", chr1, 102, r1F|sam.MateReverse, chr1, 300, "2S8M", 25),
+		newRecord(t, "A", chr1, 300, r2F|sam.Reverse, chr1, 100, "10M", 30),
+		newRecord(t, "B", chr1, 300, r2F|sam.Reverse, chr1, 100, "10M", 20),
+		newRecord(t, "C", chr1, 300, r2F|sam.Reverse, chr1, 102, "10M", 25),
+		newRecord(t, "D", chr1, 300, r2F, chr1, 100, "10M", 30),
+		// G and H are unpaired duplicates.
+		newRecord(t, "G", chr1, 500, sam.Reverse, nil, -1, "10M", 30),
+		newRecord(t, "H", chr1, 500, sam.Reverse, nil, -1, "10M", 20),
+		// I's mate is unmapped.
+		newRecord(t, "I", chr1, 600, r1F|sam.MateUnmapped, chr1, 600, "10M", 30),
+		newRecord(t, "I", chr1, 600, r2F|sam.Unmapped, chr1, 600, "", 30),
+		// Secondary alignment of B/1.
+		newRecord(t, "B", chr1, 700, r1F|sam.Secondary|sam.MateReverse, chr1, 300, "10M", 20),
+		newRecord(t, "E", chr1, 800, r2F|sam.Reverse, chr1, 100, "10M", 30),
+		newRecord(t, "E2", chr1, 800, r2F|sam.Reverse, chr1, 100, "10M", 20),
+		newRecord(t, "J", nil, -1, unmapped|sam.Read1, nil, -1, "", 30),
+		newRecord(t, "J", nil, -1, unmapped|sam.Read2, nil, -1, "", 30),
+	}
+	return recs, map[string]bool{"B": true, "C": true, "E2": true, "F": true, "H": true}
+}
+
+func checkDuplicates(t *testing.T, recs []*sam.Record, dups map[string]bool) {
+	for _, r := range recs {
+		expected := dups[r.Name] && (r.Flags&sam.Unmapped) == 0
+		assert.Equalf(t, expected, (r.Flags&sam.Duplicate) != 0, "rec=%v", r)
+	}
+}
+
+func TestMarkDuplicates(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup)
+
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	require.NoError(t, err)
+	header.SortOrder = sam.Coordinate
+	recs, dups := testRecords(t)
+	// Existing duplicate flags must be cleared.
+	recs[0].Flags |= sam.Duplicate
+	srcPath := filepath.Join(tempDir, "src.pam")
+	bamtest.WritePAM(t, srcPath, header, recs)
+
+	// Use small shards so that the pairs are split across shards.
+	opts := Opts{ShardSize: 100, Padding: 50, Parallelism: 3}
+	expected := []Metrics{{
+		Library:                       UnknownLibrary,
+		UnpairedReadsExamined:         4,
+		ReadPairsExamined:             6,
+		SecondaryOrSupplementaryReads: 1,
+		UnmappedReads:                 3,
+		UnpairedReadDuplicates:        2,
+		ReadPairDuplicates:            3,
+	}}
+
+	bamPath := filepath.Join(tempDir, "dst.bam")
+	metrics, err := MarkBAM(srcPath, bamPath, opts)
+	require.NoError(t, err)
+	assert.Equal(t, expected, metrics)
+	got := bamtest.ReadBAM(t, bamPath)
+	require.Equal(t, len(recs), len(got))
+	checkDuplicates(t, got, dups)
+
+	pamPath := filepath.Join(tempDir, "dst.pam")
+	metrics, err = MarkPAM(srcPath, pamPath, opts)
+	require.NoError(t, err)
+	assert.Equal(t, expected, metrics)
+	got = bamtest.ReadPAM(t, pamPath)
+	require.Equal(t, len(recs), len(got))
+	checkDuplicates(t, got, dups)
+	for i, r := range got {
+		assert.Equal(t, recs[i].Name, r.Name)
+		assert.Equal(t, recs[i].Pos, r.Pos)
+	}
+	// The source must be left intact.
+	got = bamtest.ReadPAM(t, srcPath)
+	assert.Equal(t, recs[0].Flags, got[0].Flags)
+
+	// With fewer temporary files than shards, each file stores the duplicates
+	// of several shards, and the files are loaded and evicted as the shards
+	// are written. The temporary files are removed at the end.
+	scratchDir := filepath.Join(tempDir, "scratch")
+	require.NoError(t, os.Mkdir(scratchDir, 0755))
+	for _, diskShards := range []int{1, 2, 3} {
+		dopts := opts
+		dopts.DiskShards = diskShards
+		dopts.Parallelism = 1
+		dopts.ScratchDir = scratchDir
+		metrics, err = MarkBAM(srcPath, bamPath, dopts)
+		require.NoError(t, err)
+		assert.Equal(t, expected, metrics, "diskShards=%d", diskShards)
+		checkDuplicates(t, bamtest.ReadBAM(t, bamPath), dups)
+		metrics, err = MarkPAM(srcPath, pamPath, dopts)
+		require.NoError(t, err)
+		assert.Equal(t, expected, metrics, "diskShards=%d", diskShards)
+		checkDuplicates(t, bamtest.ReadPAM(t, pamPath), dups)
+		files, err := ioutil.ReadDir(scratchDir)
+		require.NoError(t, err)
+		assert.Len(t, files, 0, "diskShards=%d", diskShards)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteMetrics(&buf, "markdup test", metrics))
+	assert.Contains(t, buf.String(), "## METRICS CLASS\tpicard.sam.DuplicationMetrics\n")
+	assert.Contains(t, buf.String(), "Unknown Library\t4\t6\t1\t3\t2\t3\t0\t0.5\t3\n")
+}
+
+func TestMarkDuplicatesUMI(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup)
+
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	require.NoError(t, err)
+	recs := []*sam.Record{
+		newRecord(t, "A", chr1, 100, r1F|sam.MateReverse, chr1, 300, "10M", 30),
+		newRecord(t, "B", chr1, 100, r1F|sam.MateReverse, chr1, 300, "10M", 20),
+		newRecord(t, "A", chr1, 300, r2F|sam.Reverse, chr1, 100, "10M", 30),
+		newRecord(t, "B", chr1, 300, r2F|sam.Reverse, chr1, 100, "10M", 20),
+	}
+	for i, umi := range []string{"AAA", "CCC", "AAA", "CCC"} {
+		aux, err := sam.NewAux(sam.NewTag("RX"), umi)
+		require.NoError(t, err)
+		recs[i].AuxFields = append(recs[i].AuxFields, aux)
+	}
+	srcPath := filepath.Join(tempDir, "src.pam")
+	bamtest.WritePAM(t, srcPath, header, recs)
+
+	bamPath := filepath.Join(tempDir, "dst.bam")
+	_, err = MarkBAM(srcPath, bamPath, Opts{})
+	require.NoError(t, err)
+	checkDuplicates(t, bamtest.ReadBAM(t, bamPath), map[string]bool{"B": true})
+
+	_, err = MarkBAM(srcPath, bamPath, Opts{UMITag: "RX"})
+	require.NoError(t, err)
+	checkDuplicates(t, bamtest.ReadBAM(t, bamPath), map[string]bool{})
+}
+
+func TestEstimateLibrarySize(t *testing.T) {
+	_, ok := estimateLibrarySize(100, 100)
+	assert.False(t, ok)
+	_, ok = estimateLibrarySize(0, 0)
+	assert.False(t, ok)
+	// With few duplicates, the library is much larger than the number of pairs.
+	n, ok := estimateLibrarySize(1000000, 999000)
+	assert.True(t, ok)
+	assert.True(t, n > 100000000, n)
+	// With many duplicates, the library is close to the number of unique pairs.
+	n, ok = estimateLibrarySize(1000000, 100000)
+	assert.True(t, ok)
+	assert.True(t, n >= 100000 && n < 101000, n)
+}
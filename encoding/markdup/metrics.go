@@ -0,0 +1,114 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package markdup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Metrics stores the duplication statistics of one library. The fields are the
+// same as Picard's DuplicationMetrics.
+type Metrics struct {
+	Library                       string
+	UnpairedReadsExamined         int64
+	ReadPairsExamined             int64
+	SecondaryOrSupplementaryReads int64
+	UnmappedReads                 int64
+	UnpairedReadDuplicates        int64
+	ReadPairDuplicates            int64
+	// ReadPairOpticalDuplicates is always zero, since optical duplicates are
+	// not detected.
+	ReadPairOpticalDuplicates int64
+}
+
+// PercentDuplication returns the fraction of mapped reads that are marked as
+// duplicates.
+func (m Metrics) PercentDuplication() float64 {
+	n := m.UnpairedReadsExamined + m.ReadPairsExamined*2
+	if n == 0 {
+		return 0
+	}
+	return float64(m.UnpairedReadDuplicates+m.ReadPairDuplicates*2) / float64(n)
+}
+
+// EstimatedLibrarySize estimates the number of unique molecules in the
+// library, using the Lander-Waterman equation in the same way as Picard. It
+// returns false if the size cannot be estimated, e.g., because there are no
+// duplicates.
+func (m Metrics) EstimatedLibrarySize() (int64, bool) {
+	readPairs := m.ReadPairsExamined - m.ReadPairOpticalDuplicates
+	uniquePairs := m.ReadPairsExamined - m.ReadPairDuplicates
+	return estimateLibrarySize(readPairs, uniquePairs)
+}
+
+// estimateLibrarySize solves c/x = 1 - exp(-n/x) for x, where n is the number
+// of read pairs, and c is the number of unique read pairs. It is a port of
+// Picard's DuplicationMetrics.estimateLibrarySize.
+func estimateLibrarySize(readPairs, uniquePairs int64) (int64, bool) {
+	if readPairs <= 0 || readPairs-uniquePairs <= 0 || uniquePairs <= 0 {
+		return 0, false
+	}
+	c, n := float64(uniquePairs), float64(readPairs)
+	f := func(x float64) float64 { return c/x - 1 + math.Exp(-n/x) }
+	lo, hi := 1.0, 100.0
+	if f(lo*c) < 0 {
+		return 0, false
+	}
+	for f(hi*c) > 0 {
+		hi *= 10
+	}
+	for i := 0; i < 40; i++ {
+		r := (lo + hi) / 2
+		u := f(r * c)
+		if u == 0 {
+			break
+		} else if u > 0 {
+			lo = r
+		} else {
+			hi = r
+		}
+	}
+	return int64(c * (lo + hi) / 2), true
+}
+
+// formatFloat formats v with at most six fractional digits, the same as
+// Picard's metrics files.
+func formatFloat(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 6, 64)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// WriteMetrics writes the metrics to w in the format of Picard's
+// MarkDuplicates metrics file, so that tools that parse the Picard output, such
+// as MultiQC, can read it. Arg comment, if nonempty, is written in the file
+// header, typically the command line.
+func WriteMetrics(w io.Writer, comment string, metrics []Metrics) error {
+	b := bufio.NewWriter(w)
+	if comment != "" {
+		fmt.Fprintf(b, "## htsjdk.samtools.metrics.StringHeader\n# %s\n", comment)
+	}
+	b.WriteString("\n## METRICS CLASS\tpicard.sam.DuplicationMetrics\n")
+	b.WriteString("LIBRARY\tUNPAIRED_READS_EXAMINED\tREAD_PAIRS_EXAMINED\tSECONDARY_OR_SUPPLEMENTARY_RDS\t" +
+		"UNMAPPED_READS\tUNPAIRED_READ_DUPLICATES\tREAD_PAIR_DUPLICATES\tREAD_PAIR_OPTICAL_DUPLICATES\t" +
+		"PERCENT_DUPLICATION\tESTIMATED_LIBRARY_SIZE\n")
+	for _, m := range metrics {
+		size := ""
+		if n, ok := m.EstimatedLibrarySize(); ok {
+			size = strconv.FormatInt(n, 10)
+		}
+		fmt.Fprintf(b, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			m.Library, m.UnpairedReadsExamined, m.ReadPairsExamined, m.SecondaryOrSupplementaryReads,
+			m.UnmappedReads, m.UnpairedReadDuplicates, m.ReadPairDuplicates, m.ReadPairOpticalDuplicates,
+			formatFloat(m.PercentDuplication()), size)
+	}
+	b.WriteString("\n")
+	return b.Flush()
+}
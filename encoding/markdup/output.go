@@ -0,0 +1,112 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package markdup
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/grailbio/base/vcontext"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/bamprovider"
+	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/hts/sam"
+)
+
+// MarkBAM marks the duplicates in the coordinate-sorted BAM or PAM file
+// "srcPath", and writes all the records to a BAM file "dstPath". The duplicate
+// flag (0x400) of every record is recomputed; existing flags are cleared. It
+// returns the metrics of each library, sorted by library name.
+func MarkBAM(srcPath, dstPath string, opts Opts) ([]Metrics, error) {
+	var metrics []Metrics
+	err := runMarker(srcPath, opts, func(m *marker) error {
+		var err error
+		metrics, err = m.writeBAM(dstPath)
+		return err
+	})
+	return metrics, err
+}
+
+// writeBAM copies the input to a BAM file, setting the duplicate flags. The
+// shards are processed in parallel and written in order.
+func (m *marker) writeBAM(dstPath string) ([]Metrics, error) {
+	var (
+		mu      sync.Mutex
+		metrics = metricsMap{}
+	)
+	err := gbam.WriteShardedBAM(dstPath, m.header, len(m.shards), m.opts.Parallelism,
+		func(shardIdx int, add func(r *sam.Record) error) error {
+			local := metricsMap{}
+			iter := m.provider.NewIterator(m.shards[shardIdx])
+			var err error
+			for err == nil && iter.Scan() {
+				r := iter.Record()
+				if err = m.mark(r, local); err == nil {
+					err = add(r)
+				}
+				sam.PutInFreePool(r)
+			}
+			if e := iter.Close(); e != nil && err == nil {
+				err = e
+			}
+			mu.Lock()
+			metrics.mergeFrom(local)
+			mu.Unlock()
+			return err
+		})
+	return metrics.list(), err
+}
+
+// MarkPAM marks the duplicates in the coordinate-sorted PAM file "srcPath",
+// and writes the result to a PAM file "dstPath". Only the flags field is
+// rewritten. The files for the other fields are hardlinked from srcPath when
+// possible, and copied otherwise. Existing contents of dstPath, if any, are
+// destroyed. It returns the metrics of each library, sorted by library name.
+func MarkPAM(srcPath, dstPath string, opts Opts) ([]Metrics, error) {
+	if filepath.Clean(srcPath) == filepath.Clean(dstPath) {
+		return nil, fmt.Errorf("markdup %s: source and destination are the same", srcPath)
+	}
+	if bamprovider.GuessFileType(srcPath) != bamprovider.PAM {
+		return nil, fmt.Errorf("markdup %s: PAM output requires a PAM input", srcPath)
+	}
+	var metrics []Metrics
+	err := runMarker(srcPath, opts, func(m *marker) error {
+		ctx := vcontext.Background()
+		if err := pamutil.Remove(dstPath); err != nil {
+			return err
+		}
+		if err := pamutil.Concat(ctx, dstPath, []string{srcPath}); err != nil {
+			return err
+		}
+		indexes, err := pamutil.ListIndexes(ctx, dstPath)
+		if err != nil {
+			return err
+		}
+		// shardMetrics[i] is used only by the task that rewrites shard i, so
+		// it needs no lock.
+		shardMetrics := make([]metricsMap, len(indexes))
+		for i := range shardMetrics {
+			shardMetrics[i] = metricsMap{}
+		}
+		err = pam.RewriteFields(dstPath, pam.RewriteOpts{
+			Fields: []gbam.FieldType{gbam.FieldFlags},
+			DropFields: []gbam.FieldType{gbam.FieldMapq, gbam.FieldCigar, gbam.FieldMateRefID,
+				gbam.FieldMatePos, gbam.FieldTempLen, gbam.FieldSeq, gbam.FieldQual},
+			MaxBufSize:   m.opts.MaxBufSize,
+			Transformers: m.opts.Transformers,
+		}, func(shard int, r *sam.Record) error {
+			return m.mark(r, shardMetrics[shard])
+		})
+		merged := metricsMap{}
+		for _, mm := range shardMetrics {
+			merged.mergeFrom(mm)
+		}
+		metrics = merged.list()
+		return err
+	})
+	return metrics, err
+}
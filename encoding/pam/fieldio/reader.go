@@ -80,6 +80,7 @@ type fieldReadBuf struct {
 	prevInt64Value1     int64
 	prevString          []byte // for decoding prefix-delta-encoded string.
 	tmpAuxMd            AuxMetadata
+	predictedSeq        []byte // scratch space for ReadRefSeqField.
 }
 
 func (rb *fieldReadBuf) reset(index biopb.PAMBlockIndexEntry, buf []byte, blob []byte) {
@@ -406,25 +407,30 @@ func (fr *Reader) ReadAuxMetadata() (AuxMetadata, bool) {
 		rb.tmpAuxMd.Tags = rb.tmpAuxMd.Tags[:nAux]
 	}
 	for i := 0; i < nAux; i++ {
-		t := &rb.tmpAuxMd.Tags[i]
-		copy(t.Name[:], rb.blobBuf.RawBytes(3))
-		switch t.Name[2] {
-		case 'A', 'c', 'C': // ascii, int8, uint8
-			t.Len = 1
-		case 's', 'S': // int16, uint16
-			t.Len = 2
-		case 'i', 'I', 'f': // int32, uint32, float32
-			t.Len = 4
-		case 'Z', 'H': // text, hex string
-			t.Len = int(rb.defaultBuf.Uvarint32())
-		default:
-			// TODO(saito) Handle unknown tags more gracefully.
-			log.Panicf("Unknown aux tag: %+v", t)
-		}
+		rb.readAuxTagHeader(&rb.tmpAuxMd.Tags[i])
 	}
 	return rb.tmpAuxMd, true
 }
 
+// readAuxTagHeader reads the name, the type, and the payload length of an aux
+// tag.
+func (rb *fieldReadBuf) readAuxTagHeader(t *AuxTagHeader) {
+	copy(t.Name[:], rb.blobBuf.RawBytes(3))
+	switch t.Name[2] {
+	case 'A', 'c', 'C': // ascii, int8, uint8
+		t.Len = 1
+	case 's', 'S': // int16, uint16
+		t.Len = 2
+	case 'i', 'I', 'f': // int32, uint32, float32
+		t.Len = 4
+	case 'Z', 'H': // text, hex string
+		t.Len = int(rb.defaultBuf.Uvarint32())
+	default:
+		// TODO(saito) Handle unknown tags more gracefully.
+		log.Panicf("Unknown aux tag: %+v", t)
+	}
+}
+
 // SkipAuxField skips the next aux field.
 // It panics on EOF or any error.
 func (fr *Reader) SkipAuxField() {
@@ -442,15 +448,12 @@ func (fr *Reader) SkipAuxField() {
 // SizeofSliceHeader is the internal size of a slice. Usually 2*(CPU word size).
 const SizeofSliceHeader = int(unsafe.Sizeof(reflect.SliceHeader{}))
 
-// ReadAuxField reads the next aux field. This function call must be preceded by
-// a call to ReadAuxMetadata.
-func (fr *Reader) ReadAuxField(md AuxMetadata, arena *UnsafeArena) []sam.Aux {
-	rb := &fr.fb
-	rb.remaining--
+// allocAuxSlice allocates a []sam.Aux of length n in the arena.
+func allocAuxSlice(n int, arena *UnsafeArena) []sam.Aux {
 	var aux []sam.Aux
 	// Allocate the backing space for aux.
 	arena.Align()
-	auxBuf := arena.Alloc(len(md.Tags) * SizeofSliceHeader)
+	auxBuf := arena.Alloc(n * SizeofSliceHeader)
 	// Clear the array before updating rec.AuxFields. GC will be
 	// confused otherwise.
 	for i := range auxBuf {
@@ -459,9 +462,17 @@ func (fr *Reader) ReadAuxField(md AuxMetadata, arena *UnsafeArena) []sam.Aux {
 	auxBufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&auxBuf))
 	auxHdr := (*reflect.SliceHeader)(unsafe.Pointer(&aux))
 	auxHdr.Data = auxBufHdr.Data
-	auxHdr.Len = len(md.Tags)
+	auxHdr.Len = n
 	auxHdr.Cap = auxHdr.Len
+	return aux
+}
 
+// ReadAuxField reads the next aux field. This function call must be preceded by
+// a call to ReadAuxMetadata.
+func (fr *Reader) ReadAuxField(md AuxMetadata, arena *UnsafeArena) []sam.Aux {
+	rb := &fr.fb
+	rb.remaining--
+	aux := allocAuxSlice(len(md.Tags), arena)
 	for i, tag := range md.Tags {
 		tagBuf := arena.Alloc(len(tag.Name) + tag.Len)
 		copy(tagBuf, tag.Name[:])
@@ -471,6 +482,114 @@ func (fr *Reader) ReadAuxField(md AuxMetadata, arena *UnsafeArena) []sam.Aux {
 	return aux
 }
 
+// AuxTagMetadata is the size and the position information of a field that
+// stores one aux tag. Cf. Writer.PutAuxTagField.
+type AuxTagMetadata struct {
+	// Present is true if the record has the tag. Other fields are unset if
+	// Present=false.
+	Present bool
+	// Index is the position of the tag in sam.Record.AuxFields.
+	Index int
+	// MainBefore is the number of tags in the common aux field that precede this
+	// tag in sam.Record.AuxFields.
+	MainBefore int
+	// Tag is the name and the payload length of the tag.
+	Tag AuxTagHeader
+}
+
+// ReadAuxTagMetadata reads the metadata of the next single-tag aux field.
+func (fr *Reader) ReadAuxTagMetadata() (AuxTagMetadata, bool) {
+	if fr.fb.remaining <= 0 && !fr.readNextBlock() {
+		return AuxTagMetadata{}, false
+	}
+	rb := &fr.fb
+	index := int(rb.defaultBuf.Uvarint32())
+	if index == 0 {
+		return AuxTagMetadata{}, true
+	}
+	md := AuxTagMetadata{
+		Present:    true,
+		Index:      index - 1,
+		MainBefore: int(rb.defaultBuf.Uvarint32()),
+	}
+	rb.readAuxTagHeader(&md.Tag)
+	return md, true
+}
+
+// SkipAuxTagField skips the next single-tag aux field.
+// It panics on EOF or any error.
+func (fr *Reader) SkipAuxTagField() {
+	rb := &fr.fb
+	rb.remaining--
+	md, ok := fr.ReadAuxTagMetadata()
+	if !ok {
+		panic(fr)
+	}
+	if md.Present {
+		rb.blobBuf.RawBytes(md.Tag.Len)
+	}
+}
+
+// ReadAuxTagField reads the next single-tag aux field. This function call must
+// be preceded by a call to ReadAuxTagMetadata. It returns nil if the record
+// does not have the tag.
+func (fr *Reader) ReadAuxTagField(md AuxTagMetadata, arena *UnsafeArena) sam.Aux {
+	rb := &fr.fb
+	rb.remaining--
+	if !md.Present {
+		return nil
+	}
+	tagBuf := arena.Alloc(len(md.Tag.Name) + md.Tag.Len)
+	copy(tagBuf, md.Tag.Name[:])
+	copy(tagBuf[3:], rb.blobBuf.RawBytes(md.Tag.Len))
+	return sam.Aux(tagBuf)
+}
+
+// MergeAuxFields combines the tags read from the common aux field (main) and
+// the tags read from single-tag aux fields (tags, with metadata mds) into one
+// list, in the order they appeared in the original sam.Record.AuxFields.
+// Elements of tags whose metadata has Present=false are ignored. If keep is
+// non-nil, tags in main for which keep returns false are dropped. The elements
+// of tags and mds may be reordered.
+//
+// The result is allocated in the arena. The caller must reserve
+// (len(main)+len(tags))*SizeofSliceHeader bytes plus a word for alignment.
+func MergeAuxFields(main []sam.Aux, tags []sam.Aux, mds []AuxTagMetadata, keep func(sam.Aux) bool, arena *UnsafeArena) []sam.Aux {
+	// Drop missing tags and sort the rest by the original position. The list is
+	// short, so use an insertion sort.
+	nTags := 0
+	for i := range tags {
+		if !mds[i].Present {
+			continue
+		}
+		j := nTags
+		for ; j > 0 && mds[j-1].Index > mds[i].Index; j-- {
+		}
+		md, tag := mds[i], tags[i]
+		copy(mds[j+1:nTags+1], mds[j:nTags])
+		copy(tags[j+1:nTags+1], tags[j:nTags])
+		mds[j], tags[j] = md, tag
+		nTags++
+	}
+	aux := allocAuxSlice(len(main)+nTags, arena)
+	n, ti := 0, 0
+	for mi, a := range main {
+		for ; ti < nTags && mds[ti].MainBefore <= mi; ti++ {
+			aux[n] = tags[ti]
+			n++
+		}
+		if keep == nil || keep(a) {
+			aux[n] = a
+			n++
+		}
+	}
+	for ; ti < nTags; ti++ {
+		aux[n] = tags[ti]
+		n++
+	}
+	return aux[:n]
+}
+
 // ReadCoordField reads the next coordinate value.  It returns false on EOF or
 // any error.
 func (fr *Reader) ReadCoordField() (biopb.Coord, bool) {
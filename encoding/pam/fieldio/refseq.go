@@ -0,0 +1,200 @@
+package fieldio
+
+import (
+	"github.com/grailbio/base/log"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// Modes of a seq field value written by PutRefSeqField.
+const (
+	// The bases are stored verbatim, in the same way as PutSeqField.
+	seqModeVerbatim = 0
+	// The bases are stored as the difference from the reference.
+	seqModeRefDiff = 1
+)
+
+// noBase is stored in the output of predictSeq for a base that is not aligned
+// to the reference.
+const noBase = 0xff
+
+// baseCode maps an IUPAC base character, in either case, to its 4-bit
+// encoding in sam.Seq. Other characters are mapped to 'N'.
+var baseCode [256]byte
+
+func init() {
+	for i := range baseCode {
+		baseCode[i] = 0xf
+	}
+	for i, c := range []byte("=ACMGRSVTWYHKDBN") {
+		baseCode[c] = byte(i)
+		if c >= 'A' && c <= 'Z' {
+			baseCode[c+'a'-'A'] = byte(i)
+		}
+	}
+}
+
+// predictSeq computes the bases of a read of length nBases, using the
+// reference bases that the read is aligned to. refBases is the reference
+// sequence starting at the alignment position of the read. It may be shorter
+// than the alignment, in which case the bases past its end are not predicted.
+// It returns the 4-bit codes of the bases, one per byte, in dst, with noBase for
+// the bases that are not aligned to the reference (e.g., soft clips and
+// insertions).
+func predictSeq(dst []byte, nBases int, cigar sam.Cigar, refBases []byte) []byte {
+	resizeBuf(&dst, nBases)
+	for i := range dst {
+		dst[i] = noBase
+	}
+	qpos, rpos := 0, 0
+	for _, op := range cigar {
+		n := op.Len()
+		con := op.Type().Consumes()
+		if con.Query != 0 && con.Reference != 0 {
+			for i := 0; i < n && qpos+i < nBases && rpos+i < len(refBases); i++ {
+				dst[qpos+i] = baseCode[refBases[rpos+i]]
+			}
+		}
+		qpos += n * con.Query
+		rpos += n * con.Reference
+		if qpos >= nBases {
+			break
+		}
+	}
+	return dst
+}
+
+// seqBase returns the 4-bit code of the i'th base in seq.
+func seqBase(seq sam.Seq, i int) byte {
+	d := byte(seq.Seq[i/2])
+	if i%2 == 0 {
+		return d >> 4
+	}
+	return d & 0xf
+}
+
+// PutRefSeqField adds the seq field, encoded as the difference from the
+// reference. cigar is the alignment of the read, and refBases are the
+// reference bases starting at the alignment position, in upper or lower case.
+// refBases may be truncated if the alignment extends past the end of the
+// reference. If cigar is empty, the bases are stored verbatim. Values written
+// by this function must be read by ReadRefSeqMetadata and ReadRefSeqField.
+//
+// The field is encoded as follows. The default subfield stores the sequence
+// length and the mode (seqModeVerbatim or seqModeRefDiff). For
+// seqModeVerbatim, the blob subfield stores the bases as in PutSeqField. For
+// seqModeRefDiff, the default subfield also stores the number of bases that
+// differ from the reference, and for each such base, the blob subfield stores
+// the distance from the previous one and its 4-bit code.
+func (fw *Writer) PutRefSeqField(addr biopb.Coord, seq sam.Seq, cigar sam.Cigar, refBases []byte) {
+	wb := fw.buf
+	wb.updateAddrBounds(addr)
+	wb.defaultBuf.PutUvarint64(uint64(seq.Length))
+	if len(cigar) == 0 || seq.Length == 0 {
+		wb.defaultBuf.PutUvarint64(seqModeVerbatim)
+		wb.blobBuf.PutBytes(gbam.UnsafeDoubletsToBytes(seq.Seq))
+		return
+	}
+	wb.defaultBuf.PutUvarint64(seqModeRefDiff)
+	wb.predictedSeq = predictSeq(wb.predictedSeq, seq.Length, cigar, refBases)
+	nDiffs, prev := 0, -1
+	for i, predicted := range wb.predictedSeq {
+		if base := seqBase(seq, i); base != predicted {
+			wb.blobBuf.PutUvarint64(uint64(i - prev - 1))
+			wb.blobBuf.PutUint8(base)
+			nDiffs++
+			prev = i
+		}
+	}
+	wb.defaultBuf.PutUvarint64(uint64(nDiffs))
+}
+
+// RefSeqMetadata is the length information of a seq field written by
+// PutRefSeqField.
+type RefSeqMetadata struct {
+	// NBases is the length of the sequence.
+	NBases int
+	// RefDiff is true if the sequence is stored as the difference from the
+	// reference. If false, ReadRefSeqField does not need the reference.
+	RefDiff bool
+}
+
+// ReadRefSeqMetadata reads the length of the next seq field written by
+// PutRefSeqField.
+func (fr *Reader) ReadRefSeqMetadata() (RefSeqMetadata, bool) {
+	if fr.fb.remaining <= 0 && !fr.readNextBlock() {
+		return RefSeqMetadata{}, false
+	}
+	return fr.readRefSeqMetadata(), true
+}
+
+func (fr *Reader) readRefSeqMetadata() RefSeqMetadata {
+	rb := &fr.fb
+	md := RefSeqMetadata{NBases: int(rb.defaultBuf.Uvarint32())}
+	switch mode := rb.defaultBuf.Uvarint32(); mode {
+	case seqModeVerbatim:
+	case seqModeRefDiff:
+		md.RefDiff = true
+	default:
+		log.Panicf("%v: corrupt seq mode %d", fr.label, mode)
+	}
+	return md
+}
+
+// ReadRefSeqField reads the seq field written by PutRefSeqField. md must be
+// obtained by calling ReadRefSeqMetadata. If md.RefDiff, cigar and refBases
+// must be the same as those passed to PutRefSeqField.
+func (fr *Reader) ReadRefSeqField(md RefSeqMetadata, cigar sam.Cigar, refBases []byte, arena *UnsafeArena) sam.Seq {
+	if !md.RefDiff {
+		return fr.ReadSeqField(md.NBases, arena)
+	}
+	rb := &fr.fb
+	rb.remaining--
+	rb.predictedSeq = predictSeq(rb.predictedSeq, md.NBases, cigar, refBases)
+	bases := rb.predictedSeq
+	nDiffs := int(rb.defaultBuf.Uvarint32())
+	pos := -1
+	for i := 0; i < nDiffs; i++ {
+		pos += int(rb.blobBuf.Uvarint32()) + 1
+		if pos >= len(bases) {
+			log.Panicf("%v: corrupt seq diff at %d, length %d", fr.label, pos, len(bases))
+		}
+		bases[pos] = rb.blobBuf.Uint8()
+	}
+	destBuf := arena.Alloc(SeqBytes(md.NBases))
+	for i := range destBuf {
+		destBuf[i] = 0
+	}
+	for i, base := range bases {
+		if base == noBase {
+			log.Panicf("%v: base %d not stored, cigar %v", fr.label, i, cigar)
+		}
+		if i%2 == 0 {
+			destBuf[i/2] = base << 4
+		} else {
+			destBuf[i/2] |= base
+		}
+	}
+	return sam.Seq{
+		Length: md.NBases,
+		Seq:    gbam.UnsafeBytesToDoublets(destBuf),
+	}
+}
+
+// SkipRefSeqField skips the next seq field written by PutRefSeqField.
+// It panics on EOF or any error.
+func (fr *Reader) SkipRefSeqField() {
+	rb := &fr.fb
+	rb.remaining--
+	md := fr.readRefSeqMetadata()
+	if !md.RefDiff {
+		rb.blobBuf.RawBytes(SeqBytes(md.NBases))
+		return
+	}
+	nDiffs := int(rb.defaultBuf.Uvarint32())
+	for i := 0; i < nDiffs; i++ {
+		rb.blobBuf.Uvarint32()
+		rb.blobBuf.Uint8()
+	}
+}
@@ -70,6 +70,8 @@ type fieldWriteBuf struct {
 	// For encoding deltas for fields RefID, Pos and MatePos.
 	prevInt64Value0 int64
 	prevInt64Value1 int64
+	// Scratch space for PutRefSeqField.
+	predictedSeq []byte
 }
 
 // totalLen computes the total # of bytes stored in the buffer.
@@ -214,27 +216,50 @@ func (fw *Writer) PutAuxField(addr biopb.Coord, aa []sam.Aux) {
 		wb.blobBuf.PutBytes(a[:3])
 	}
 	for _, a := range aa {
-		switch a[2] {
-		case 'A', 'c', 'C': // ascii, int8, uint8
-			if len(a) != 4 {
-				log.Panic(a)
-			}
-			wb.blobBuf.PutUint8(a[3])
-		case 's', 'S': // int16, uint16
-			if len(a) != 5 {
-				log.Panic(a)
-			}
-			wb.blobBuf.PutBytes(a[3:5])
-		case 'i', 'I', 'f': // int32, uint32, float32
-			if len(a) != 7 {
-				log.Panic(a)
-			}
-			wb.blobBuf.PutBytes(a[3:7])
-		case 'Z', 'H': // text, hexstr
-			wb.putLengthPrefixedBytes(a[3:])
-		default:
+		wb.putAuxPayload(a)
+	}
+}
+
+// PutAuxTagField adds a value of a field that stores one aux tag. index is
+// the position of the tag in sam.Record.AuxFields, and mainBefore is the number
+// of tags stored in the common aux field that precede this tag in
+// sam.Record.AuxFields. The reader uses them to restore the original tag
+// order. If index < 0, the record does not have the tag, and "a" is ignored.
+func (fw *Writer) PutAuxTagField(addr biopb.Coord, a sam.Aux, index, mainBefore int) {
+	wb := fw.buf
+	wb.updateAddrBounds(addr)
+	if index < 0 {
+		wb.defaultBuf.PutUvarint64(0)
+		return
+	}
+	wb.defaultBuf.PutUvarint64(uint64(index + 1))
+	wb.defaultBuf.PutUvarint64(uint64(mainBefore))
+	wb.blobBuf.PutBytes(a[:3])
+	wb.putAuxPayload(a)
+}
+
+// putAuxPayload adds the value part of the aux tag, i.e., a[3:].
+func (wb *fieldWriteBuf) putAuxPayload(a sam.Aux) {
+	switch a[2] {
+	case 'A', 'c', 'C': // ascii, int8, uint8
+		if len(a) != 4 {
+			log.Panic(a)
+		}
+		wb.blobBuf.PutUint8(a[3])
+	case 's', 'S': // int16, uint16
+		if len(a) != 5 {
+			log.Panic(a)
+		}
+		wb.blobBuf.PutBytes(a[3:5])
+	case 'i', 'I', 'f': // int32, uint32, float32
+		if len(a) != 7 {
 			log.Panic(a)
 		}
+		wb.blobBuf.PutBytes(a[3:7])
+	case 'Z', 'H': // text, hexstr
+		wb.putLengthPrefixedBytes(a[3:])
+	default:
+		log.Panic(a)
 	}
 }
 
@@ -25,8 +25,10 @@ import (
 	gbam "github.com/grailbio/bio/encoding/bam"
 	"github.com/grailbio/bio/encoding/bamprovider"
 	"github.com/grailbio/bio/encoding/converter"
+	"github.com/grailbio/bio/encoding/fasta"
 	"github.com/grailbio/bio/encoding/pam"
 	"github.com/grailbio/bio/encoding/pam/pamutil"
+	gsam "github.com/grailbio/bio/encoding/sam"
 	"github.com/grailbio/hts/bam"
 	"github.com/grailbio/hts/sam"
 	"github.com/grailbio/testutil"
@@ -235,6 +237,460 @@ func TestReadSubsetColumns(t *testing.T) {
 	assert.NoError(t, r.Close())
 }
 
+func TestSeparateAuxTags(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	header := mustOpenBAM(t, testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam")).Header()
+	ref := header.Refs()[0]
+
+	mustNewAux := func(tag string, value interface{}) sam.Aux {
+		a, err := sam.NewAux(sam.NewTag(tag), value)
+		assert.NoError(t, err)
+		return a
+	}
+	var recs []*sam.Record
+	for i := 0; i < 1000; i++ {
+		var aux []sam.Aux
+		switch i % 3 {
+		case 0:
+			aux = []sam.Aux{mustNewAux("NM", 1), mustNewAux("MD", fmt.Sprintf("%d", i)), mustNewAux("AS", 96)}
+		case 1:
+			aux = []sam.Aux{mustNewAux("MD", "10A5"), mustNewAux("XA", "foo")}
+		case 2:
+			aux = []sam.Aux{mustNewAux("AS", 50)}
+		}
+		rec, err := sam.NewRecord(fmt.Sprintf("seq%06d", i), ref, ref, i, i+100, 10, 60,
+			sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}, []byte("ACGT"), []byte{30, 30, 30, 30}, aux)
+		assert.NoError(t, err)
+		recs = append(recs, rec)
+	}
+	writePAM := func(path string, opts pam.WriteOpts) {
+		w := pam.NewWriter(opts, header, path)
+		for _, rec := range recs {
+			w.Write(rec)
+		}
+		assert.NoError(t, w.Close())
+	}
+	verify := func(path string, tags []string, expectedAuxFiles int) {
+		paths, err := filepath.Glob(path + "/*.aux*")
+		assert.NoError(t, err)
+		assert.EQ(t, len(paths), expectedAuxFiles, paths)
+
+		r := pam.NewReader(pam.ReadOpts{AuxTags: tags}, path)
+		n := 0
+		for r.Scan() {
+			rec := r.Record()
+			expected := *recs[n]
+			if len(tags) > 0 {
+				expected.AuxFields = nil
+				for _, a := range recs[n].AuxFields {
+					for _, tag := range tags {
+						if a.Tag() == sam.NewTag(tag) {
+							expected.AuxFields = append(expected.AuxFields, a)
+						}
+					}
+				}
+			}
+			assert.EQ(t, rec.String(), expected.String(), "n=%d, tags=%v", n, tags)
+			n++
+		}
+		assert.NoError(t, r.Close())
+		assert.EQ(t, n, len(recs))
+	}
+
+	separatePath := filepath.Join(tempDir, "separate")
+	writePAM(separatePath, pam.WriteOpts{MaxBufSize: 1000, SeparateAuxTags: []string{"MD", "AS", "ZZ"}})
+	verify(separatePath, nil, 4)
+	verify(separatePath, []string{"MD"}, 4)
+	verify(separatePath, []string{"AS", "MD"}, 4)
+	verify(separatePath, []string{"NM", "MD"}, 4)
+	verify(separatePath, []string{"XA"}, 4)
+	verify(separatePath, []string{"ZZ"}, 4)
+
+	// Files written without SeparateAuxTags can also be read with AuxTags.
+	plainPath := filepath.Join(tempDir, "plain")
+	writePAM(plainPath, pam.WriteOpts{MaxBufSize: 1000})
+	verify(plainPath, nil, 1)
+	verify(plainPath, []string{"NM", "MD"}, 1)
+
+	// Read a subrange, so that the per-tag files are seeked.
+	r := pam.NewReader(pam.ReadOpts{
+		AuxTags: []string{"MD"},
+		Range: biopb.CoordRange{
+			Start: biopb.Coord{RefId: int32(ref.ID()), Pos: 500},
+			Limit: biopb.Coord{RefId: int32(ref.ID()), Pos: 600}}}, separatePath)
+	n := 0
+	for r.Scan() {
+		rec := r.Record()
+		assert.EQ(t, rec.Name, recs[500+n].Name)
+		if (500+n)%3 == 2 {
+			assert.EQ(t, len(rec.AuxFields), 0)
+		} else {
+			assert.EQ(t, len(rec.AuxFields), 1)
+			assert.EQ(t, rec.AuxFields[0].Tag(), sam.NewTag("MD"))
+		}
+		n++
+	}
+	assert.NoError(t, r.Close())
+	assert.EQ(t, n, 100)
+}
+
+func TestRewriteFields(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam")
+	pamPath := newPAMPath(bamPath, tempDir)
+	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{}, pamPath, bamPath, "", math.MaxInt64))
+
+	readFiles := func(pattern string) map[string][]byte {
+		paths, err := filepath.Glob(filepath.Join(pamPath, pattern))
+		assert.NoError(t, err)
+		assert.True(t, len(paths) > 0, pattern)
+		data := map[string][]byte{}
+		for _, path := range paths {
+			data[path], err = ioutil.ReadFile(path)
+			assert.NoError(t, err)
+		}
+		return data
+	}
+	seqFiles := readFiles("*.seq")
+	flagFiles := readFiles("*.flags")
+
+	// A failed rewrite leaves the files intact.
+	err := pam.RewriteFields(pamPath, pam.RewriteOpts{Fields: []gbam.FieldType{gbam.FieldFlags}},
+		func(_ int, rec *sam.Record) error { return fmt.Errorf("test error") })
+	assert.Regexp(t, err, "test error")
+	assert.EQ(t, readFiles("*.flags"), flagFiles)
+
+	err = pam.RewriteFields(pamPath,
+		pam.RewriteOpts{
+			Fields:     []gbam.FieldType{gbam.FieldFlags, gbam.FieldMapq},
+			DropFields: []gbam.FieldType{gbam.FieldSeq, gbam.FieldQual},
+		},
+		func(_ int, rec *sam.Record) error {
+			rec.Flags |= sam.Duplicate
+			rec.MapQ = 1
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.EQ(t, readFiles("*.seq"), seqFiles)
+	tmpDirs, err := filepath.Glob(pamPath + ".rewrite*")
+	assert.NoError(t, err)
+	assert.EQ(t, len(tmpDirs), 0, tmpDirs)
+
+	rbam := mustOpenBAM(t, bamPath)
+	r := pam.NewReader(pam.ReadOpts{}, pamPath)
+	n := 0
+	for r.Scan() {
+		recPAM := r.Record()
+		recBAM, err := rbam.Read()
+		assert.NoError(t, err)
+		recBAM.Flags |= sam.Duplicate
+		recBAM.MapQ = 1
+		assert.EQ(t, recPAM.String(), recBAM.String())
+		n++
+	}
+	assert.NoError(t, r.Close())
+	_, err = rbam.Read()
+	assert.EQ(t, err, io.EOF, "n=%d", n)
+}
+
+func TestRewriteFieldsRollback(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	pamPath := filepath.Join(tempDir, "test.pam")
+	header, err := sam.NewHeader([]byte(refSeqTestHeader), nil)
+	assert.NoError(t, err)
+	p := gsam.NewParser(header)
+	w := pam.NewWriter(pam.WriteOpts{}, header, pamPath)
+	for _, line := range refSeqTestLines {
+		rec, err := p.Parse([]byte(line))
+		assert.NoError(t, err)
+		w.Write(rec)
+	}
+	assert.NoError(t, w.Close())
+	indexes, err := pamutil.ListIndexes(vcontext.Background(), pamPath)
+	assert.NoError(t, err)
+	flagsPath := pamutil.FieldDataPath(pamPath, indexes[0].Range, gbam.FieldFlags.String())
+	mapqPath := pamutil.FieldDataPath(pamPath, indexes[0].Range, gbam.FieldMapq.String())
+	flagsData, err := ioutil.ReadFile(flagsPath)
+	assert.NoError(t, err)
+	// An unrelated file at the old scratch path must be left alone.
+	otherPath := pamPath + ".rewrite"
+	assert.NoError(t, ioutil.WriteFile(otherPath, []byte("other"), 0644))
+
+	// The flags file is replaced first. Replacing the mapq file then fails,
+	// since the callback removes it, so the flags file is put back.
+	removed := false
+	err = pam.RewriteFields(pamPath, pam.RewriteOpts{Fields: []gbam.FieldType{gbam.FieldFlags, gbam.FieldMapq}},
+		func(_ int, rec *sam.Record) error {
+			if !removed {
+				assert.NoError(t, os.Remove(mapqPath))
+				removed = true
+			}
+			rec.Flags |= sam.Duplicate
+			rec.MapQ = 1
+			return nil
+		})
+	expect.Regexp(t, err, "rename")
+	data, err := ioutil.ReadFile(flagsPath)
+	assert.NoError(t, err)
+	expect.EQ(t, data, flagsData)
+	tmpDirs, err := filepath.Glob(pamPath + ".rewrite*")
+	assert.NoError(t, err)
+	expect.EQ(t, tmpDirs, []string{otherPath})
+	data, err = ioutil.ReadFile(otherPath)
+	assert.NoError(t, err)
+	expect.EQ(t, string(data), "other")
+}
+
+func TestParseQualBins(t *testing.T) {
+	bins, err := pam.ParseQualBins("")
+	assert.NoError(t, err)
+	assert.EQ(t, len(bins), 0)
+
+	bins, err = pam.ParseQualBins(pam.Illumina8QualBins)
+	assert.NoError(t, err)
+	assert.EQ(t, len(bins), 256)
+	for q, expected := range map[int]byte{0: 0, 1: 1, 2: 6, 9: 6, 10: 15, 24: 22, 25: 27, 34: 33, 39: 37, 41: 40, 0xff: 0xff} {
+		expect.EQ(t, bins[q], expected, "q=%d", q)
+	}
+	expect.EQ(t, pam.FormatQualBins(bins), "2-9:6,10-19:15,20-24:22,25-29:27,30-34:33,35-39:37,40-93:40")
+
+	bins, err = pam.ParseQualBins("0-19:10,30:31")
+	assert.NoError(t, err)
+	// 31 maps to itself, so it is merged with 30 in the output.
+	expect.EQ(t, pam.FormatQualBins(bins), "0-19:10,30-31:31")
+	expect.EQ(t, pam.FormatQualBins(nil), "")
+
+	for _, spec := range []string{"10", "10-5:1", "x:1", "1:256", "1:255", "1-2-3:4"} {
+		_, err := pam.ParseQualBins(spec)
+		expect.NotNil(t, err, "spec=%s", spec)
+	}
+}
+
+func TestQualBins(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam")
+	pamPath := newPAMPath(bamPath, tempDir)
+	bins, err := pam.ParseQualBins(pam.Illumina8QualBins)
+	assert.NoError(t, err)
+	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{QualBins: bins}, pamPath, bamPath, "", math.MaxInt64))
+
+	readBins, err := pam.ReadQualBins(vcontext.Background(), pamPath)
+	assert.NoError(t, err)
+	assert.EQ(t, readBins, bins)
+
+	rbam := mustOpenBAM(t, bamPath)
+	r := pam.NewReader(pam.ReadOpts{}, pamPath)
+	n := 0
+	for r.Scan() {
+		recPAM := r.Record()
+		recBAM, err := rbam.Read()
+		assert.NoError(t, err)
+		pam.BinQual(bins, recBAM.Qual)
+		assert.EQ(t, recPAM.String(), recBAM.String())
+		n++
+	}
+	assert.NoError(t, r.Close())
+	assert.True(t, n > 0)
+
+	// Files written without binning are lossless.
+	plainPath := filepath.Join(tempDir, "plain.pam")
+	assert.NoError(t, converter.ConvertToPAM(pam.WriteOpts{}, plainPath, bamPath, "", math.MaxInt64))
+	readBins, err = pam.ReadQualBins(vcontext.Background(), plainPath)
+	assert.NoError(t, err)
+	assert.EQ(t, len(readBins), 0)
+
+	// Invalid tables are rejected.
+	w := pam.NewWriter(pam.WriteOpts{QualBins: []byte{1, 2, 3}}, rbam.Header(), filepath.Join(tempDir, "bad.pam"))
+	expect.Regexp(t, w.Err(), "QualBins must have 256 entries")
+}
+
+const refSeqTestHeader = "@HD\tVN:1.3\tSO:coordinate\n" +
+	"@SQ\tSN:chr1\tLN:40\n" +
+	"@SQ\tSN:chr2\tLN:20\n"
+
+// refSeqTestLines are aligned to the reference returned by newRefSeqTestFasta.
+// The comments show the differences from the reference.
+var refSeqTestLines = []string{
+	"r0\t0\tchr1\t1\t60\t8M\t*\t0\t0\tACGTACGT\tIIIIIIII",           // exact match
+	"r1\t0\tchr1\t5\t60\t2S4M1I3M\t*\t0\t0\tTTACGTGATC\tIIIIIIIIII", // soft clip, insertion, mismatch
+	"r2\t16\tchr1\t11\t60\t3M2D3M\t*\t0\t0\tCCCGTA\tIIIIII",         // lowercase reference, deletion, mismatch
+	"r3\t0\tchr1\t37\t60\t6M\t*\t0\t0\tNNACGG\tIIIIII",              // extends past the reference end
+	"r4\t0\tchr2\t3\t60\t4M\t*\t0\t0\tGGNA\tIIII",                   // mismatch at N
+	"r5\t4\t*\t0\t0\t*\t*\t0\t0\tACGTN\tIIIII",                      // unmapped
+}
+
+func newRefSeqTestFasta(t *testing.T, chr1 string) fasta.Fasta {
+	ref, err := fasta.New(strings.NewReader(">chr1\n" + chr1 + "\n>chr2\nGGGGNNNNCCCCAAAATTTT\n"))
+	assert.NoError(t, err)
+	return ref
+}
+
+func TestReferenceSeq(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	pamPath := filepath.Join(tempDir, "test.pam")
+	ref := newRefSeqTestFasta(t, "ACGTACGTAAcccGGGTTTTacgtACGTTGCAACGTNNAC")
+
+	header, err := sam.NewHeader([]byte(refSeqTestHeader), nil)
+	assert.NoError(t, err)
+	p := gsam.NewParser(header)
+	var recs []*sam.Record
+	w := pam.NewWriter(pam.WriteOpts{Reference: ref}, header, pamPath)
+	for _, line := range refSeqTestLines {
+		rec, err := p.Parse([]byte(line))
+		assert.NoError(t, err)
+		recs = append(recs, rec)
+		w.Write(rec)
+	}
+	assert.NoError(t, w.Close())
+
+	indexes, err := pamutil.ListIndexes(vcontext.Background(), pamPath)
+	assert.NoError(t, err)
+	assert.EQ(t, len(indexes), 1)
+	index, err := pamutil.ReadShardIndex(vcontext.Background(), pamPath, indexes[0].Range)
+	assert.NoError(t, err)
+	assert.EQ(t, len(index.ReferenceChecksums), 2)
+	expect.EQ(t, len(index.ReferenceChecksums[0]), 32)
+	expect.EQ(t, len(index.ReferenceChecksums[1]), 32)
+
+	readAll := func(opts pam.ReadOpts) ([]*sam.Record, error) {
+		r := pam.NewReader(opts, pamPath)
+		var got []*sam.Record
+		for r.Scan() {
+			got = append(got, r.Record())
+		}
+		return got, r.Close()
+	}
+
+	got, err := readAll(pam.ReadOpts{Reference: ref})
+	assert.NoError(t, err)
+	assert.EQ(t, len(got), len(recs))
+	for i, rec := range got {
+		expect.EQ(t, rec.String(), recs[i].String())
+	}
+
+	// The cigar is needed to decode the seq field, but it is not returned if
+	// dropped.
+	got, err = readAll(pam.ReadOpts{Reference: ref, DropFields: []gbam.FieldType{gbam.FieldCigar}})
+	assert.NoError(t, err)
+	assert.EQ(t, len(got), len(recs))
+	for i, rec := range got {
+		expect.EQ(t, len(rec.Cigar), 0)
+		expect.EQ(t, string(rec.Seq.Expand()), string(recs[i].Seq.Expand()))
+	}
+
+	// Seeking into the middle of the shard skips the preceding records.
+	got, err = readAll(pam.ReadOpts{
+		Reference: ref,
+		Range: biopb.CoordRange{
+			Start: biopb.Coord{RefId: 0, Pos: 10},
+			Limit: biopb.Coord{RefId: 1, Pos: 0}}})
+	assert.NoError(t, err)
+	assert.EQ(t, len(got), 2)
+	for i, rec := range got {
+		expect.EQ(t, rec.String(), recs[i+2].String())
+	}
+
+	// The reference is not needed unless the seq field is read.
+	got, err = readAll(pam.ReadOpts{DropFields: []gbam.FieldType{gbam.FieldSeq}})
+	assert.NoError(t, err)
+	expect.EQ(t, len(got), len(recs))
+
+	_, err = readAll(pam.ReadOpts{})
+	expect.Regexp(t, err, "ReadOpts.Reference must be set")
+
+	wrongRef := newRefSeqTestFasta(t, "ACGTACGTAAcccGGGTTTTacgtACGTTGCAACGTNNAA")
+	_, err = readAll(pam.ReadOpts{Reference: wrongRef})
+	expect.Regexp(t, err, "reference checksum mismatch for chr1")
+
+	// A failure to read the reference is not remembered by the shared
+	// checksums.
+	flakyRef := &flakyFasta{Fasta: ref, failures: 1}
+	opts := pam.ReadOpts{Reference: flakyRef, ReferenceChecksums: pam.NewReferenceChecksums(flakyRef)}
+	_, err = readAll(opts)
+	expect.Regexp(t, err, "reference sequence chr1: transient error")
+	got, err = readAll(opts)
+	assert.NoError(t, err)
+	expect.EQ(t, len(got), len(recs))
+}
+
+// flakyFasta fails the first "failures" calls to Len.
+type flakyFasta struct {
+	fasta.Fasta
+	failures int
+}
+
+func (f *flakyFasta) Len(seqName string) (uint64, error) {
+	if f.failures > 0 {
+		f.failures--
+		return 0, fmt.Errorf("transient error")
+	}
+	return f.Fasta.Len(seqName)
+}
+
+func TestRewriteFieldsReferenceSeq(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	pamPath := filepath.Join(tempDir, "test.pam")
+	ref := newRefSeqTestFasta(t, "ACGTACGTAAcccGGGTTTTacgtACGTTGCAACGTNNAC")
+
+	header, err := sam.NewHeader([]byte(refSeqTestHeader), nil)
+	assert.NoError(t, err)
+	p := gsam.NewParser(header)
+	var recs []*sam.Record
+	w := pam.NewWriter(pam.WriteOpts{Reference: ref}, header, pamPath)
+	for _, line := range refSeqTestLines {
+		rec, err := p.Parse([]byte(line))
+		assert.NoError(t, err)
+		recs = append(recs, rec)
+		w.Write(rec)
+	}
+	assert.NoError(t, w.Close())
+
+	// Replace the indels with matches. The query lengths stay the same, so the
+	// seq must read back unchanged even though it is encoded relative to the
+	// cigar.
+	newCigar := map[string]string{"r1": "2S8M", "r2": "6M"}
+	rewriteCigar := func(_ int, rec *sam.Record) error {
+		if c, ok := newCigar[rec.Name]; ok {
+			cigar, err := sam.ParseCigar([]byte(c))
+			if err != nil {
+				return err
+			}
+			rec.Cigar = cigar
+		}
+		return nil
+	}
+	opts := pam.RewriteOpts{
+		Fields:     []gbam.FieldType{gbam.FieldCigar},
+		DropFields: []gbam.FieldType{gbam.FieldSeq, gbam.FieldQual},
+	}
+	expect.Regexp(t, pam.RewriteFields(pamPath, opts, rewriteCigar), "RewriteOpts.Reference must be set")
+	opts.Reference = ref
+	assert.NoError(t, pam.RewriteFields(pamPath, opts, rewriteCigar))
+
+	r := pam.NewReader(pam.ReadOpts{Reference: ref}, pamPath)
+	i := 0
+	for r.Scan() {
+		rec := r.Record()
+		assert.True(t, i < len(recs))
+		expect.EQ(t, rec.Name, recs[i].Name)
+		expect.EQ(t, string(rec.Seq.Expand()), string(recs[i].Seq.Expand()), rec.Name)
+		wantCigar := recs[i].Cigar.String()
+		if c, ok := newCigar[rec.Name]; ok {
+			wantCigar = c
+		}
+		expect.EQ(t, rec.Cigar.String(), wantCigar, rec.Name)
+		i++
+	}
+	assert.NoError(t, r.Close())
+	expect.EQ(t, i, len(recs))
+}
+
 func TestReadWriteUnmapped(t *testing.T) {
 	tempDir, cleanup := testutil.TempDir(t, "", "")
 	defer cleanup()
@@ -369,6 +825,112 @@ func TestConvert(t *testing.T) {
 	assert.EQ(t, 11, len(indexes), "Index:", indexes)
 }
 
+func TestValidate(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := vcontext.Background()
+
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
+	pamPath := newPAMPath(bamPath, tempDir)
+	shardRanges := []biopb.CoordRange{
+		biopb.CoordRange{biopb.Coord{0, 0, 0}, biopb.Coord{1, 0, 0}},
+		biopb.CoordRange{biopb.Coord{1, 0, 0}, biopb.Coord{3, 0, 0}},
+		biopb.CoordRange{biopb.Coord{3, 0, 0}, biopb.Coord{biopb.InfinityRefID, biopb.InfinityPos, 0}},
+	}
+	for _, shardRange := range shardRanges {
+		generatePAM(t, pam.WriteOpts{Range: shardRange, DropFields: []gbam.FieldType{gbam.FieldTempLen}}, pamPath, bamPath)
+	}
+	report, err := pamutil.Validate(ctx, pamPath)
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), "report: %+v", report)
+	assert.EQ(t, len(report.Shards), 3)
+	nRecs := int64(0)
+	for _, s := range report.Shards {
+		// The dropped field is not expected.
+		expect.EQ(t, len(s.Fields), gbam.NumFields-1)
+		nRecs += s.NumRecords
+	}
+	expect.EQ(t, report.NumRecords, int64(20042))
+	expect.EQ(t, nRecs, int64(20042))
+
+	// Truncate a field file in the middle shard, and add a file left by an
+	// unfinished writer.
+	mapqPath := pamutil.FieldDataPath(pamPath, shardRanges[1], "mapq")
+	data, err := ioutil.ReadFile(mapqPath)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(mapqPath, data[:len(data)/2], 0644))
+	orphanRange := biopb.CoordRange{biopb.Coord{3, 0, 0}, biopb.Coord{4, 0, 0}}
+	orphanPath := pamutil.FieldDataPath(pamPath, orphanRange, "coord")
+	assert.NoError(t, ioutil.WriteFile(orphanPath, []byte("junk"), 0644))
+
+	report, err = pamutil.Validate(ctx, pamPath)
+	assert.NoError(t, err)
+	expect.False(t, report.OK())
+	expect.EQ(t, len(report.Shards[0].Problems), 0)
+	assert.EQ(t, len(report.Shards[1].Problems), 1)
+	expect.Regexp(t, report.Shards[1].Problems[0], "^field mapq: ")
+	expect.EQ(t, len(report.Shards[2].Problems), 0)
+	expect.EQ(t, report.OrphanFiles, []string{orphanPath})
+	expect.EQ(t, len(report.Problems), 0)
+
+	removed, err := pamutil.RemoveInvalidShards(ctx, report)
+	assert.NoError(t, err)
+	expect.EQ(t, len(removed), gbam.NumFields+1) // index + fields + orphan
+	report, err = pamutil.Validate(ctx, pamPath)
+	assert.NoError(t, err)
+	assert.EQ(t, len(report.Shards), 2)
+	expect.EQ(t, len(report.OrphanFiles), 0)
+	expect.EQ(t, report.Problems, []string{"gap: no shard covers range 1:0,3:0"})
+
+	// The remaining shards are readable.
+	r := pam.NewReader(pam.ReadOpts{}, pamPath)
+	n := int64(0)
+	for r.Scan() {
+		n++
+	}
+	assert.NoError(t, r.Close())
+	expect.EQ(t, n, report.NumRecords)
+}
+
+func TestConcat(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := vcontext.Background()
+
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
+	var srcs []string
+	for i, shardRange := range []biopb.CoordRange{
+		biopb.CoordRange{biopb.Coord{0, 0, 0}, biopb.Coord{1, 0, 0}},
+		biopb.CoordRange{biopb.Coord{1, 0, 0}, biopb.Coord{3, 0, 0}},
+		biopb.CoordRange{biopb.Coord{3, 0, 0}, biopb.Coord{biopb.InfinityRefID, biopb.InfinityPos, 0}},
+	} {
+		src := filepath.Join(tempDir, fmt.Sprintf("src%d.pam", i))
+		generatePAM(t, pam.WriteOpts{Range: shardRange}, src, bamPath)
+		srcs = append(srcs, src)
+	}
+	dst := filepath.Join(tempDir, "dst.pam")
+	assert.NoError(t, pamutil.Concat(ctx, dst, srcs))
+	verifyPAM(t, pam.ReadOpts{}, dst, bamPath)
+	report, err := pamutil.Validate(ctx, dst)
+	assert.NoError(t, err)
+	expect.True(t, report.OK(), "report: %+v", report)
+	expect.EQ(t, len(report.Shards), 3)
+
+	// The destination must be empty.
+	expect.Regexp(t, pamutil.Concat(ctx, dst, srcs), "already contains PAM files")
+	// The sources must tile the coordinate space.
+	expect.Regexp(t, pamutil.Concat(ctx, filepath.Join(tempDir, "gap.pam"), []string{srcs[0], srcs[2]}),
+		"gap: no shard covers range 1:0,3:0")
+	expect.Regexp(t, pamutil.Concat(ctx, filepath.Join(tempDir, "overlap.pam"), []string{srcs[0], srcs[1], srcs[1], srcs[2]}),
+		"overlap")
+	// The headers must match.
+	otherPath := filepath.Join(tempDir, "other.pam")
+	generatePAM(t, pam.WriteOpts{Range: biopb.CoordRange{biopb.Coord{1, 0, 0}, biopb.Coord{3, 0, 0}}}, otherPath,
+		testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/test.bam"))
+	expect.Regexp(t, pamutil.Concat(ctx, filepath.Join(tempDir, "header.pam"), []string{srcs[0], otherPath, srcs[2]}),
+		"different header")
+}
+
 func TestSharder1(t *testing.T) {
 	tempDir, cleanup := testutil.TempDir(t, "", "")
 	defer cleanup()
@@ -397,6 +959,119 @@ func TestSharder1(t *testing.T) {
 	verifyPAMWithShardedReader(t, pam.ReadOpts{}, pamPath, bamPath, shards)
 }
 
+func TestReshard(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := vcontext.Background()
+
+	bamPath := testutil.GetFilePath("//go/src/grail.com/bio/encoding/bam/testdata/170614_WGS_LOD_Pre_Library_B3_27961B_05.merged.10000.bam")
+	srcPath := filepath.Join(tempDir, "src.pam")
+	for _, shardRange := range []biopb.CoordRange{
+		biopb.CoordRange{biopb.Coord{0, 0, 0}, biopb.Coord{1, 0, 0}},
+		biopb.CoordRange{biopb.Coord{1, 0, 0}, biopb.Coord{3, 0, 0}},
+		biopb.CoordRange{biopb.Coord{3, 0, 0}, biopb.Coord{biopb.InfinityRefID, biopb.InfinityPos, 0}},
+	} {
+		generatePAM(t, pam.WriteOpts{Range: shardRange, MaxBufSize: 16 << 10}, srcPath, bamPath)
+	}
+
+	// Merge the shards into one.
+	dstPath := filepath.Join(tempDir, "one.pam")
+	assert.NoError(t, pam.Reshard(srcPath, dstPath, pam.ReshardOpts{NumShards: 1}))
+	verifyPAM(t, pam.ReadOpts{}, dstPath, bamPath)
+	report, err := pamutil.Validate(ctx, dstPath)
+	assert.NoError(t, err)
+	expect.True(t, report.OK(), "report: %+v", report)
+	expect.EQ(t, len(report.Shards), 1)
+	expect.EQ(t, report.NumRecords, int64(20042))
+
+	// Split the shards further.
+	dstPath = filepath.Join(tempDir, "many.pam")
+	assert.NoError(t, pam.Reshard(srcPath, dstPath, pam.ReshardOpts{NumShards: 8}))
+	verifyPAM(t, pam.ReadOpts{}, dstPath, bamPath)
+	report, err = pamutil.Validate(ctx, dstPath)
+	assert.NoError(t, err)
+	expect.True(t, report.OK(), "report: %+v", report)
+	expect.True(t, len(report.Shards) > 3, "shards: %+v", report.Shards)
+	for _, s := range report.Shards {
+		// Shards are split only at position boundaries.
+		expect.EQ(t, s.Range.Start.Seq, int32(0), "shard: %+v", s.Range)
+	}
+
+	expect.Regexp(t, pam.Reshard(srcPath, srcPath, pam.ReshardOpts{NumShards: 2}), "source and destination .* overlap")
+}
+
+func TestReshardErrors(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	srcPath := filepath.Join(tempDir, "src.pam")
+	header, err := sam.NewHeader([]byte(refSeqTestHeader), nil)
+	assert.NoError(t, err)
+	p := gsam.NewParser(header)
+	writeShard := func(opts pam.WriteOpts) {
+		assert.NoError(t, pamutil.ValidateCoordRange(&opts.Range))
+		w := pam.NewWriter(opts, header, srcPath)
+		for _, line := range refSeqTestLines {
+			rec, err := p.Parse([]byte(line))
+			assert.NoError(t, err)
+			if opts.Range.Contains(gbam.CoordFromSAMRecord(rec, 0)) {
+				w.Write(rec)
+			}
+		}
+		assert.NoError(t, w.Close())
+	}
+	writeShard(pam.WriteOpts{Range: biopb.CoordRange{biopb.Coord{0, 0, 0}, biopb.Coord{1, 0, 0}}})
+	writeShard(pam.WriteOpts{Range: biopb.CoordRange{biopb.Coord{1, 0, 0}, biopb.Coord{biopb.InfinityRefID, biopb.InfinityPos, 0}}})
+	dstPath := filepath.Join(tempDir, "dst.pam")
+	assert.NoError(t, pam.Reshard(srcPath, dstPath, pam.ReshardOpts{}))
+
+	// The destination is removed before writing, so it must not overlap with
+	// the source.
+	expect.Regexp(t, pam.Reshard(srcPath, filepath.Join(srcPath, "sub"), pam.ReshardOpts{}), "source and destination .* overlap")
+	expect.Regexp(t, pam.Reshard(srcPath, tempDir, pam.ReshardOpts{}), "source and destination .* overlap")
+	expect.Regexp(t, pam.Reshard(srcPath, srcPath+"/", pam.ReshardOpts{}), "source and destination .* overlap")
+	_, err = os.Stat(srcPath)
+	assert.NoError(t, err)
+
+	// Shards written with different options cannot be merged.
+	assert.NoError(t, pamutil.Remove(srcPath))
+	writeShard(pam.WriteOpts{Range: biopb.CoordRange{biopb.Coord{0, 0, 0}, biopb.Coord{1, 0, 0}}})
+	writeShard(pam.WriteOpts{
+		Range:      biopb.CoordRange{biopb.Coord{1, 0, 0}, biopb.Coord{biopb.InfinityRefID, biopb.InfinityPos, 0}},
+		DropFields: []gbam.FieldType{gbam.FieldMapq},
+	})
+	expect.Regexp(t, pam.Reshard(srcPath, dstPath, pam.ReshardOpts{}), "shards .* have different fields")
+
+	// Each shard of a reference-encoded file stores the checksums of only the
+	// references that it uses.
+	ref := newRefSeqTestFasta(t, "ACGTACGTAAcccGGGTTTTacgtACGTTGCAACGTNNAC")
+	assert.NoError(t, pamutil.Remove(srcPath))
+	writeShard(pam.WriteOpts{Range: biopb.CoordRange{biopb.Coord{0, 0, 0}, biopb.Coord{1, 0, 0}}, Reference: ref})
+	writeShard(pam.WriteOpts{
+		Range:     biopb.CoordRange{biopb.Coord{1, 0, 0}, biopb.Coord{biopb.InfinityRefID, biopb.InfinityPos, 0}},
+		Reference: ref,
+	})
+	assert.NoError(t, pam.Reshard(srcPath, dstPath, pam.ReshardOpts{NumShards: 1, Reference: ref}))
+	r := pam.NewReader(pam.ReadOpts{Reference: ref}, dstPath)
+	n := 0
+	for r.Scan() {
+		rec, err := p.Parse([]byte(refSeqTestLines[n]))
+		assert.NoError(t, err)
+		expect.EQ(t, r.Record().String(), rec.String())
+		n++
+	}
+	assert.NoError(t, r.Close())
+	expect.EQ(t, n, len(refSeqTestLines))
+	expect.Regexp(t, pam.Reshard(srcPath, dstPath, pam.ReshardOpts{}), "ReshardOpts.Reference must be set")
+	wrongRef := newRefSeqTestFasta(t, "ACGTACGTAAcccGGGTTTTacgtACGTTGCAACGTNNAA")
+	expect.Regexp(t, pam.Reshard(srcPath, dstPath, pam.ReshardOpts{Reference: wrongRef}), "reference checksum mismatch for chr1")
+
+	// Reference-encoded and plain shards cannot be merged.
+	assert.NoError(t, pamutil.Remove(srcPath))
+	writeShard(pam.WriteOpts{Range: biopb.CoordRange{biopb.Coord{0, 0, 0}, biopb.Coord{1, 0, 0}}, Reference: ref})
+	writeShard(pam.WriteOpts{Range: biopb.CoordRange{biopb.Coord{1, 0, 0}, biopb.Coord{biopb.InfinityRefID, biopb.InfinityPos, 0}}})
+	expect.Regexp(t, pam.Reshard(srcPath, dstPath, pam.ReshardOpts{Reference: ref}), "shards .* have different reference encodings")
+}
+
 type syntheticTester struct {
 	t               *testing.T
 	tmpDir          string
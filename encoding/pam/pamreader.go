@@ -17,6 +17,7 @@ import (
 	"github.com/grailbio/base/vcontext"
 	"github.com/grailbio/bio/biopb"
 	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/fasta"
 	"github.com/grailbio/bio/encoding/pam/fieldio"
 	"github.com/grailbio/bio/encoding/pam/pamutil"
 	"github.com/grailbio/hts/sam"
@@ -28,6 +29,27 @@ type ReadOpts struct {
 	// DropFields causes the listed fields not to be filled in Read().
 	DropFields []gbam.FieldType
 
+	// AuxTags, if nonempty, causes Read() to fill only the listed aux tags,
+	// such as "NM" or "MD". Other tags are dropped from sam.Record.AuxFields.
+	// Reading is cheapest when all the listed tags were written to their own
+	// files via WriteOpts.SeparateAuxTags, since then the common aux file is
+	// not read at all. AuxTags is ignored if FieldAux is in DropFields.
+	AuxTags []string
+
+	// Reference must be set to read the seq field of a file written with
+	// WriteOpts.Reference. It must have the same sequences as the reference
+	// used by the writer; otherwise, the reader fails with a checksum
+	// mismatch error. Reference is ignored for other files, or if FieldSeq is
+	// in DropFields.
+	Reference fasta.Fasta
+
+	// ReferenceChecksums, if set, caches the checksums of the sequences in
+	// Reference, which are computed to verify the reference. It must have been
+	// created by NewReferenceChecksums(Reference). Readers that share one
+	// hash each sequence once; otherwise, every Reader hashes the sequences
+	// used by the files it reads.
+	ReferenceChecksums *ReferenceChecksums
+
 	// Optional row shard range. Only records in this range will be returned
 	// by Scan() and Read().
 	//
@@ -60,6 +82,25 @@ type ShardReader struct {
 	shardRange   biopb.CoordRange // row range parsed out of the filename.
 	nRecords     int              // # records read so far
 	err          *errors.Once     // Points to Reader.err
+
+	// Readers for the aux tags stored in their own files (Cf.
+	// WriteOpts.SeparateAuxTags). Only the tags needed by ReadOpts.AuxTags are
+	// opened. If fieldReaders[FieldAux] is nil, the common aux file is not
+	// needed for the requested tags.
+	auxTagReaders []*fieldio.Reader
+	// keepAuxTag, if non-nil, filters the tags read from the common aux file.
+	// It is set when ReadOpts.AuxTags is nonempty.
+	keepAuxTag func(sam.Aux) bool
+	// refSeq is true if the seq field is encoded relative to reference (Cf.
+	// WriteOpts.Reference).
+	refSeq    bool
+	reference fasta.Fasta
+	// dropCigar is true if the cigar field is read only for decoding the seq
+	// field. The cigar is not returned to the caller.
+	dropCigar bool
+	// Scratch space for reading auxTagReaders.
+	auxTagMds  []fieldio.AuxTagMetadata
+	auxTagVals []sam.Aux
 }
 
 var (
@@ -103,6 +144,14 @@ func GetDummySeq(length int) sam.Seq {
 	return sam.Seq{Length: length, Seq: newBuf[:n]}
 }
 
+const pointerSize = int(unsafe.Sizeof(uintptr(0)))
+
+// mergeAux returns true if the aux tags must be assembled from multiple files,
+// or filtered.
+func (r *ShardReader) mergeAux() bool {
+	return len(r.auxTagReaders) > 0 || r.keepAuxTag != nil
+}
+
 // Read one record from the buffer "rb". prevRec is used to delta-decode some
 // fields.
 func (r *ShardReader) readRecord() *sam.Record {
@@ -177,10 +226,17 @@ func (r *ShardReader) readRecord() *sam.Record {
 		arenaBytes += nameMd.PrefixLen + nameMd.DeltaLen
 	}
 	rec.Seq.Length = 0
+	seqMd := fieldio.RefSeqMetadata{}
 	if r.needField[gbam.FieldSeq] {
-		if rec.Seq.Length, ok = r.fieldReaders[gbam.FieldSeq].ReadSeqMetadata(); !ok {
+		if r.refSeq {
+			seqMd, ok = r.fieldReaders[gbam.FieldSeq].ReadRefSeqMetadata()
+		} else {
+			seqMd.NBases, ok = r.fieldReaders[gbam.FieldSeq].ReadSeqMetadata()
+		}
+		if !ok {
 			return nil
 		}
+		rec.Seq.Length = seqMd.NBases
 		arenaBytes += fieldio.SeqBytes(rec.Seq.Length)
 	}
 	qualLen := 0
@@ -198,12 +254,21 @@ func (r *ShardReader) readRecord() *sam.Record {
 		}
 		// Round up to the next CPU word boundary, since we will store
 		// pointers in the arena.
-		const pointerSize = int(unsafe.Sizeof(uintptr(0)))
 		arenaBytes += len(auxMd.Tags)*fieldio.SizeofSliceHeader + pointerSize
 		for _, tag := range auxMd.Tags {
 			arenaBytes += len(tag.Name) + tag.Len
 		}
 	}
+	if r.mergeAux() {
+		for i, fr := range r.auxTagReaders {
+			if r.auxTagMds[i], ok = fr.ReadAuxTagMetadata(); !ok {
+				return nil
+			}
+			arenaBytes += len(r.auxTagMds[i].Tag.Name) + r.auxTagMds[i].Tag.Len
+		}
+		// Space for the merged list.
+		arenaBytes += (len(auxMd.Tags)+len(r.auxTagReaders))*fieldio.SizeofSliceHeader + pointerSize
+	}
 	sam.ResizeScratch(&rec.Scratch, arenaBytes)
 	arena := fieldio.NewUnsafeArena(rec.Scratch)
 	if r.needField[gbam.FieldCigar] {
@@ -215,23 +280,42 @@ func (r *ShardReader) readRecord() *sam.Record {
 
 	// Qual and Seq must be of the same length, as per BAM file format spec.  So
 	// when one of them is not read, fill it with dummy data.
+	var err error
 	switch {
 	case r.needField[gbam.FieldSeq] && r.needField[gbam.FieldQual]:
 		// Common case
-		rec.Seq = r.fieldReaders[gbam.FieldSeq].ReadSeqField(rec.Seq.Length, &arena)
+		rec.Seq, err = r.readSeqField(rec, seqMd, &arena)
 		rec.Qual = r.fieldReaders[gbam.FieldQual].ReadBytesField(qualLen, &arena)
 	case r.needField[gbam.FieldSeq] && !r.needField[gbam.FieldQual]:
 		// Fill qual with garbage data w/ the same length as seq
-		rec.Seq = r.fieldReaders[gbam.FieldSeq].ReadSeqField(rec.Seq.Length, &arena)
+		rec.Seq, err = r.readSeqField(rec, seqMd, &arena)
 		rec.Qual = GetDummyQual(rec.Seq.Length)
 	case !r.needField[gbam.FieldSeq] && r.needField[gbam.FieldQual]:
 		// Fill seq with garbage data w/ the same length as qual
 		rec.Qual = r.fieldReaders[gbam.FieldQual].ReadBytesField(qualLen, &arena)
 		rec.Seq = GetDummySeq(len(rec.Qual))
 	}
+	if err != nil {
+		r.err.Set(errors.E(err, fmt.Sprintf("%s: read seq", r.label)))
+		return nil
+	}
+	if r.dropCigar {
+		rec.Cigar = nil
+	}
 
+	var mainAux []sam.Aux
 	if r.needField[gbam.FieldAux] {
-		rec.AuxFields = r.fieldReaders[gbam.FieldAux].ReadAuxField(auxMd, &arena)
+		mainAux = r.fieldReaders[gbam.FieldAux].ReadAuxField(auxMd, &arena)
+		rec.AuxFields = mainAux
+	}
+	if r.mergeAux() {
+		for i, fr := range r.auxTagReaders {
+			r.auxTagVals[i] = fr.ReadAuxTagField(r.auxTagMds[i], &arena)
+		}
+		rec.AuxFields = fieldio.MergeAuxFields(mainAux, r.auxTagVals, r.auxTagMds, r.keepAuxTag, &arena)
+		for i := range r.auxTagVals {
+			r.auxTagVals[i] = nil
+		}
 	}
 	r.nRecords++
 	if coord.LT(r.requestedRange.Start) {
@@ -245,6 +329,24 @@ func (r *ShardReader) readRecord() *sam.Record {
 	return rec
 }
 
+// readSeqField reads the seq field. rec.Ref, rec.Pos and rec.Cigar must have
+// been read already, since they are needed to decode a seq field that is
+// encoded relative to the reference.
+func (r *ShardReader) readSeqField(rec *sam.Record, md fieldio.RefSeqMetadata, arena *fieldio.UnsafeArena) (sam.Seq, error) {
+	fr := r.fieldReaders[gbam.FieldSeq]
+	if !r.refSeq {
+		return fr.ReadSeqField(md.NBases, arena), nil
+	}
+	var refBases []byte
+	if md.RefDiff {
+		var err error
+		if refBases, err = referenceBases(r.reference, rec); err != nil {
+			return sam.Seq{}, err
+		}
+	}
+	return fr.ReadRefSeqField(md, rec.Cigar, refBases, arena), nil
+}
+
 func validateReadOpts(o *ReadOpts) error {
 	for _, fi := range o.DropFields {
 		if int(fi) < 0 || int(fi) >= gbam.NumFields {
@@ -255,6 +357,11 @@ func validateReadOpts(o *ReadOpts) error {
 			return fmt.Errorf("dropping Coord field is not supported in %+v", *o)
 		}
 	}
+	for _, tag := range o.AuxTags {
+		if len(tag) != 2 {
+			return fmt.Errorf("invalid aux tag '%s' in %+v", tag, *o)
+		}
+	}
 	return pamutil.ValidateCoordRange(&o.Range)
 }
 
@@ -275,6 +382,10 @@ func (f *fieldSeeker) Skip() {
 // record at or after requestedRange.Start.
 func (r *ShardReader) seek(requestedRange biopb.CoordRange) {
 	var readers []fieldio.ColumnSeeker
+	skipSeq := (*fieldio.Reader).SkipSeqField
+	if r.refSeq {
+		skipSeq = (*fieldio.Reader).SkipRefSeqField
+	}
 	fields := []struct {
 		field gbam.FieldType
 		skip  func(*fieldio.Reader)
@@ -286,7 +397,7 @@ func (r *ShardReader) seek(requestedRange biopb.CoordRange) {
 		{gbam.FieldTempLen, func(fr *fieldio.Reader) { fr.ReadVarintField() }},
 		{gbam.FieldCigar, (*fieldio.Reader).SkipCigarField},
 		{gbam.FieldName, (*fieldio.Reader).SkipStringDeltaField},
-		{gbam.FieldSeq, (*fieldio.Reader).SkipSeqField},
+		{gbam.FieldSeq, skipSeq},
 		{gbam.FieldQual, (*fieldio.Reader).SkipBytesField},
 		{gbam.FieldAux, (*fieldio.Reader).SkipAuxField},
 	}
@@ -295,12 +406,15 @@ func (r *ShardReader) seek(requestedRange biopb.CoordRange) {
 			readers = append(readers, &fieldSeeker{fr, d.skip})
 		}
 	}
+	for _, fr := range r.auxTagReaders {
+		readers = append(readers, &fieldSeeker{fr, (*fieldio.Reader).SkipAuxTagField})
+	}
 	r.err.Set(fieldio.SeekReaders(requestedRange, r.fieldReaders[gbam.FieldCoord], readers))
 }
 
-// NewShardReader creates a reader for a rowshard.  requestedRange and
-// dropFields are fields from ReadOpts.  pamIndex is the index file information,
-// gleaned from its pathname. muPtr and errPtr are for reporting errors to the
+// NewShardReader creates a reader for a rowshard.  requestedRange, dropFields,
+// auxTags and reference are fields from ReadOpts.  pamIndex is the index file
+// information, gleaned from its pathname. muPtr and errPtr are for reporting errors to the
 // parent.
 //
 // REQUIRES: requestedRange ∩ pamIndex.Range != ∅
@@ -308,6 +422,26 @@ func NewShardReader(
 	ctx context.Context,
 	requestedRange biopb.CoordRange,
 	dropFields []gbam.FieldType,
+	auxTags []string,
+	reference fasta.Fasta,
+	pamIndex pamutil.FileInfo,
+	errp *errors.Once) *ShardReader {
+	var refSums *ReferenceChecksums
+	if reference != nil {
+		refSums = NewReferenceChecksums(reference)
+	}
+	return newShardReader(ctx, requestedRange, dropFields, auxTags, reference, refSums, pamIndex, errp)
+}
+
+// newShardReader is NewShardReader with the checksums of reference cached in
+// refSums.
+func newShardReader(
+	ctx context.Context,
+	requestedRange biopb.CoordRange,
+	dropFields []gbam.FieldType,
+	auxTags []string,
+	reference fasta.Fasta,
+	refSums *ReferenceChecksums,
 	pamIndex pamutil.FileInfo,
 	errp *errors.Once) *ShardReader {
 	r := &ShardReader{
@@ -339,7 +473,27 @@ func NewShardReader(
 	if !r.requestedRange.Intersects(r.shardRange) {
 		vlog.Panicf("%v: Range doesn't intersect", r.label)
 	}
+	if r.needField[gbam.FieldSeq] && len(r.index.ReferenceChecksums) > 0 {
+		if reference == nil {
+			r.err.Set(fmt.Errorf("newshardreader %s: the seq field is encoded relative to a reference; ReadOpts.Reference must be set", r.path))
+			return r
+		}
+		if err := verifyReferenceChecksums(refSums, r.header, r.index.ReferenceChecksums); err != nil {
+			r.err.Set(errors.E(err, fmt.Sprintf("newshardreader %s", r.path)))
+			return r
+		}
+		r.refSeq = true
+		r.reference = reference
+		if !r.needField[gbam.FieldCigar] {
+			r.needField[gbam.FieldCigar] = true
+			r.dropCigar = true
+		}
+	}
 
+	var separateAuxTags []string
+	if r.needField[gbam.FieldAux] {
+		separateAuxTags = r.setupAuxTags(auxTags)
+	}
 	for f := range r.needField {
 		if r.needField[f] {
 			path := pamutil.FieldDataPath(pamIndex.Dir, pamIndex.Range, gbam.FieldType(f).String())
@@ -358,10 +512,58 @@ func NewShardReader(
 			}
 		}
 	}
+	for _, tag := range separateAuxTags {
+		field := pamutil.AuxTagFieldName(tag)
+		path := pamutil.FieldDataPath(pamIndex.Dir, pamIndex.Range, field)
+		label := fmt.Sprintf("%s:s%s:u%s(%s)",
+			file.Base(pamIndex.Dir),
+			pamutil.CoordRangePathString(pamIndex.Range),
+			pamutil.CoordRangePathString(r.requestedRange),
+			field)
+		fr, err := fieldio.NewReader(ctx, path, label, false, errp)
+		if err != nil {
+			r.err.Set(err)
+			return r
+		} else if fr == nil {
+			r.err.Set(fmt.Errorf("missing file for %s: %s", label, path))
+			return r
+		}
+		r.auxTagReaders = append(r.auxTagReaders, fr)
+	}
+	r.auxTagMds = make([]fieldio.AuxTagMetadata, len(r.auxTagReaders))
+	r.auxTagVals = make([]sam.Aux, len(r.auxTagReaders))
 	r.seek(r.requestedRange)
 	return r
 }
 
+// setupAuxTags decides which aux files to read, given ReadOpts.AuxTags and the
+// list of tags stored in their own files in this shard. It returns the
+// separately stored tags to be read. It clears needField[FieldAux] if the
+// common aux file need not be read.
+func (r *ShardReader) setupAuxTags(auxTags []string) []string {
+	if len(auxTags) == 0 {
+		return r.index.AuxTags
+	}
+	want := map[string]bool{}
+	wantTag := map[sam.Tag]bool{}
+	for _, tag := range auxTags {
+		want[tag] = true
+		wantTag[sam.NewTag(tag)] = true
+	}
+	r.keepAuxTag = func(a sam.Aux) bool { return wantTag[a.Tag()] }
+
+	var separateAuxTags []string
+	for _, tag := range r.index.AuxTags {
+		if want[tag] {
+			separateAuxTags = append(separateAuxTags, tag)
+			delete(want, tag)
+		}
+	}
+	// Tags remaining in "want" can only be found in the common aux file.
+	r.needField[gbam.FieldAux] = len(want) > 0
+	return separateAuxTags
+}
+
 // Close must be called exactly once. After close, no method may be called.
 func (r *ShardReader) Close(ctx context.Context) {
 	for f := range r.fieldReaders {
@@ -369,6 +571,9 @@ func (r *ShardReader) Close(ctx context.Context) {
 			fr.Close(ctx)
 		}
 	}
+	for _, fr := range r.auxTagReaders {
+		fr.Close(ctx)
+	}
 }
 
 // Reader is the main PAM reader class. It can read across multiple rowshard
@@ -402,6 +607,9 @@ func NewReader(opts ReadOpts, dir string) *Reader {
 	if r.err.Err() != nil {
 		return r
 	}
+	if r.opts.Reference != nil && r.opts.ReferenceChecksums == nil {
+		r.opts.ReferenceChecksums = NewReferenceChecksums(r.opts.Reference)
+	}
 	r.label = fmt.Sprintf("%s:u%s", file.Base(dir), pamutil.CoordRangePathString(r.opts.Range))
 	var err error
 	if r.indexFiles, err = pamutil.FindIndexFilesInRange(r.ctx, dir, r.opts.Range); err != nil {
@@ -413,7 +621,7 @@ func NewReader(opts ReadOpts, dir string) *Reader {
 		return r
 	}
 	vlog.VI(1).Infof("Found index files in range %+v: %+v", r.opts.Range, r.indexFiles)
-	r.r = NewShardReader(r.ctx, r.opts.Range, r.opts.DropFields, r.indexFiles[0], &r.err)
+	r.r = newShardReader(r.ctx, r.opts.Range, r.opts.DropFields, r.opts.AuxTags, r.opts.Reference, r.opts.ReferenceChecksums, r.indexFiles[0], &r.err)
 	r.indexFiles = r.indexFiles[1:]
 	return r
 }
@@ -458,7 +666,7 @@ func (r *Reader) Scan() bool {
 			return false
 		}
 		r.r.Close(r.ctx)
-		r.r = NewShardReader(r.ctx, r.opts.Range, r.opts.DropFields, r.indexFiles[0], &r.err)
+		r.r = newShardReader(r.ctx, r.opts.Range, r.opts.DropFields, r.opts.AuxTags, r.opts.Reference, r.opts.ReferenceChecksums, r.indexFiles[0], &r.err)
 		r.indexFiles = r.indexFiles[1:]
 	}
 }
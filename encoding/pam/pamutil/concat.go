@@ -0,0 +1,160 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pamutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/traverse"
+	"github.com/grailbio/bio/biopb"
+)
+
+// concatShard is a shard to be copied by Concat.
+type concatShard struct {
+	dir    string   // source PAM directory
+	info   FileInfo // shard index file
+	index  biopb.PAMShardIndex
+	fields []string // field files in the shard
+}
+
+// Concat combines the PAM files in "srcs" into one PAM file in "dst". Each
+// source is typically written by pam.NewWriter with a distinct WriteOpts.Range.
+// The shard ranges of the sources must together cover the UniversalRange
+// without a gap or an overlap, all the shards must have the same sam.Header,
+// and they must store the same set of fields.
+//
+// The field files are hardlinked into dst when possible, and copied otherwise;
+// the records are never decoded. The shard index files are written after all
+// the field files are in place, so if Concat fails midway, Validate reports the
+// partially copied files as orphans. Concat fails if dst already contains a
+// shard index.
+func Concat(ctx context.Context, dst string, srcs []string) error {
+	if len(srcs) == 0 {
+		return fmt.Errorf("concat %s: no source", dst)
+	}
+	var (
+		shards []concatShard
+		infos  []FileInfo
+	)
+	for _, src := range srcs {
+		indexes, fieldFiles, err := listShardFiles(ctx, src)
+		if err != nil {
+			return err
+		}
+		if len(indexes) == 0 {
+			return fmt.Errorf("concat %s: no shard index files found in %s", dst, src)
+		}
+		for _, fi := range indexes {
+			index, err := ReadShardIndex(ctx, src, fi.Range)
+			if err != nil {
+				return err
+			}
+			fields := append([]string{}, fieldFiles[fi.Range]...)
+			sort.Strings(fields)
+			shards = append(shards, concatShard{dir: src, info: fi, index: index, fields: fields})
+			infos = append(infos, fi)
+		}
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Range.Start.LT(infos[j].Range.Start)
+	})
+	if problems := validateShardRanges(infos); len(problems) > 0 {
+		return fmt.Errorf("concat %s: the source shards do not tile the coordinate space: %s", dst, strings.Join(problems, "; "))
+	}
+	first := shards[0]
+	for _, s := range shards[1:] {
+		if !bytes.Equal(s.index.EncodedBamHeader, first.index.EncodedBamHeader) {
+			return fmt.Errorf("concat %s: shard %s in %s has a different header from shard %s in %s",
+				dst, CoordRangePathString(s.info.Range), s.dir, CoordRangePathString(first.info.Range), first.dir)
+		}
+		// Separately stored aux tags are listed in each shard index, so they
+		// need not be the same across shards.
+		if a, b := nonAuxTagFields(s.fields), nonAuxTagFields(first.fields); a != b {
+			return fmt.Errorf("concat %s: shard %s in %s has fields [%s], but shard %s in %s has [%s]",
+				dst, CoordRangePathString(s.info.Range), s.dir, a, CoordRangePathString(first.info.Range), first.dir, b)
+		}
+	}
+	dstIndexes, _, err := listShardFiles(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if len(dstIndexes) > 0 {
+		return fmt.Errorf("concat %s: the destination already contains PAM files", dst)
+	}
+
+	type copyRequest struct{ src, dst string }
+	var reqs []copyRequest
+	for _, s := range shards {
+		for _, field := range s.fields {
+			reqs = append(reqs, copyRequest{
+				src: FieldDataPath(s.dir, s.info.Range, field),
+				dst: FieldDataPath(dst, s.info.Range, field),
+			})
+		}
+	}
+	if err := traverse.Each(len(reqs), func(i int) error {
+		return linkOrCopyFile(ctx, reqs[i].src, reqs[i].dst)
+	}); err != nil {
+		return err
+	}
+	for i := range shards {
+		if err := WriteShardIndex(ctx, dst, shards[i].info.Range, &shards[i].index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nonAuxTagFields returns the fields, excluding separately stored aux tags, as
+// a comma-separated string. Arg fields must be sorted.
+func nonAuxTagFields(fields []string) string {
+	var r []string
+	for _, f := range fields {
+		if !strings.HasPrefix(f, AuxTagFieldName("")) {
+			r = append(r, f)
+		}
+	}
+	return strings.Join(r, ",")
+}
+
+// isLocalPath returns true if the path is on the local file system.
+func isLocalPath(path string) bool {
+	scheme, _, err := file.ParsePath(path)
+	return err == nil && scheme == ""
+}
+
+// linkOrCopyFile creates a hardlink "dst" to "src" if both are on the local
+// file system. Otherwise, or if the hardlink fails (e.g., because the files are
+// on different devices), it copies the contents.
+func linkOrCopyFile(ctx context.Context, src, dst string) (err error) {
+	if isLocalPath(src) && isLocalPath(dst) {
+		if os.MkdirAll(filepath.Dir(dst), 0777) == nil && os.Link(src, dst) == nil {
+			return nil
+		}
+	}
+	in, err := file.Open(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer file.CloseAndReport(ctx, in, &err)
+	out, err := file.Create(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out.Writer(ctx), in.Reader(ctx)); err != nil {
+		out.Discard(ctx) // nolint: errcheck
+		return errors.E(err, fmt.Sprintf("copy %s to %s", src, dst))
+	}
+	return out.Close(ctx)
+}
@@ -47,6 +47,13 @@ func FieldDataPath(dir string, recRange biopb.CoordRange, field string) string {
 	return fmt.Sprintf("%s/%s.%s", dir, CoordRangePathString(recRange), field)
 }
 
+// AuxTagFieldName returns the field name of the file that stores the given aux
+// tag separately from the rest of the aux field. For example,
+// AuxTagFieldName("MD") returns "aux.MD". Cf. pam.WriteOpts.SeparateAuxTags.
+func AuxTagFieldName(tag string) string {
+	return "aux." + tag
+}
+
 // ShardIndexPath returns the path of shard index file.
 func ShardIndexPath(dir string, recRange biopb.CoordRange) string {
 	return fmt.Sprintf("%s/%s.index", dir, CoordRangePathString(recRange))
@@ -65,6 +65,73 @@ func readFieldIndex(ctx context.Context, dir string, recRange biopb.CoordRange,
 	return index, err
 }
 
+// sampleField picks the largest of the given fields in the file shard. It
+// returns the name and the size of the field file, as well as the total size of
+// all the field files.
+func sampleField(ctx context.Context, indexFile FileInfo, fields []string) (sampledField string, sampledFieldSize, totalFileBytes int64) {
+	sampledFieldSize = -1
+	for _, field := range fields {
+		size := fieldFileSize(ctx, indexFile.Dir, indexFile.Range, field)
+		if size > sampledFieldSize {
+			sampledField = field
+			sampledFieldSize = size
+		}
+		totalFileBytes += size
+	}
+	return
+}
+
+// ApproxBytesInRanges estimates, for each of the given coordinate ranges, the
+// number of bytes that store the records in the range. The estimate is the sum
+// across the given fields. The field indexes of each file shard are read only
+// once, so this function is efficient even when there are many ranges.
+func ApproxBytesInRanges(ctx context.Context, dir string, ranges []biopb.CoordRange, fields []string) ([]int64, error) {
+	files, err := ListIndexes(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]float64, len(ranges))
+	for _, indexFile := range files {
+		var hits []int
+		for i, r := range ranges {
+			if r.Intersects(indexFile.Range) {
+				hits = append(hits, i)
+			}
+		}
+		if len(hits) == 0 {
+			continue
+		}
+		sampledField, sampledFieldSize, totalFileBytes := sampleField(ctx, indexFile, fields)
+		if sampledFieldSize <= 0 {
+			return nil, fmt.Errorf("approxbytesinranges %+v: field files are empty", indexFile)
+		}
+		index, err := readFieldIndex(ctx, indexFile.Dir, indexFile.Range, sampledField)
+		if err != nil {
+			return nil, err
+		}
+		scale := float64(totalFileBytes) / float64(sampledFieldSize)
+		for _, i := range hits {
+			for j, block := range index.Blocks {
+				if !BlockIntersectsRange(block.StartAddr, block.EndAddr, ranges[i]) {
+					continue
+				}
+				limitOffset := uint64(sampledFieldSize)
+				if j+1 < len(index.Blocks) {
+					limitOffset = index.Blocks[j+1].FileOffset
+				}
+				if limitOffset > block.FileOffset {
+					sizes[i] += float64(limitOffset-block.FileOffset) * scale
+				}
+			}
+		}
+	}
+	result := make([]int64, len(ranges))
+	for i, size := range sizes {
+		result[i] = int64(size)
+	}
+	return result, nil
+}
+
 // Read *.index files listed in "files", then narrow their ShardIndex.Blocks so
 // that they only contains blocks that intersect recRange.
 
@@ -90,19 +157,7 @@ func readAndSubsetIndexes(ctx context.Context, files []FileInfo, recRange biopb.
 		// Below, we pick an arbitrary field obtain a sample of record coordinates
 		// and corresponding file offsets. We pick the largeest field, which will
 		// have the largest # of coordinates and offsets to sample from.
-		fieldFileSizes := map[string]int64{}
-		sampledFieldSize := int64(-1)
-		totalFileBytes := int64(0)
-		var sampledField string
-		for _, field := range fields {
-			size := fieldFileSize(ctx, indexFile.Dir, indexFile.Range, field)
-			fieldFileSizes[field] = size
-			if size > sampledFieldSize {
-				sampledField = field
-				sampledFieldSize = size
-			}
-			totalFileBytes += size
-		}
+		sampledField, sampledFieldSize, totalFileBytes := sampleField(ctx, indexFile, fields)
 		index, err := readFieldIndex(ctx, indexFile.Dir, indexFile.Range, sampledField)
 		if err != nil {
 			log.Panicf("%+v: failed to read index: %v", indexFile, err)
@@ -165,6 +220,13 @@ type GenerateReadShardsOpts struct {
 	// at the start of unmapped reads.
 	AlwaysSplitMappedAndUnmappedCoords bool
 
+	// CrossFileShards allows creating a shard that spans multiple file shards
+	// (rowshards). If this flag is false, shards are always split at file shard
+	// boundaries, since a read shard that crosses a boundary opens more files.
+	// Setting this flag is useful for merging small file shards, e.g., when
+	// resharding.
+	CrossFileShards bool
+
 	// BytesPerShard is the target shard size, in bytes across all fields.  If
 	// this field is set, NumShards is ignored.
 	BytesPerShard int64
@@ -229,6 +291,9 @@ func GenerateReadShards(
 	} else if opts.NumShards > 0 {
 		nShards = opts.NumShards
 	}
+	if nShards <= 0 {
+		nShards = 1
+	}
 	log.Debug.Printf("GenerateReadShads %s: creating %d shards; totalblocks=%d, totalbytes=%d, opts %+v", path, nShards, totalBlocks, totalBytes, opts)
 	targetBlocksPerReadShard := float64(totalBlocks) / float64(nShards)
 
@@ -259,10 +324,17 @@ func GenerateReadShards(
 	}
 
 	nBlocks := 0
+	var prevBlock *biopb.PAMBlockIndexEntry
 	for ii, index := range indexes {
 		log.Debug.Printf("Index %d: range %+v bytes %+v ", ii, index.shardRange, index.approxBytes)
-		for blockIndex, block := range index.blocks {
-			if blockIndex > 0 && nBlocks > int(float64(len(bounds)+1)*targetBlocksPerReadShard) {
+		if !opts.CrossFileShards {
+			prevBlock = nil
+		}
+		for blockIndex := range index.blocks {
+			block := &index.blocks[blockIndex]
+			prev := prevBlock
+			prevBlock = block
+			if prev != nil && nBlocks > int(float64(len(bounds)+1)*targetBlocksPerReadShard) {
 				// Add a shard boundary at block.StartAddr.
 				limitAddr := block.StartAddr
 
@@ -270,7 +342,7 @@ func GenerateReadShards(
 				// coordinate. This means the boundary is in the middle of a sequence of
 				// reads at the coordinate. We can't split shards at such place, unless
 				// opts.Split*Coords flags are set.
-				prevBlock := index.blocks[blockIndex-1].EndAddr
+				prevBlock := prev.EndAddr
 				if prevBlock.RefId == limitAddr.RefId && prevBlock.Pos == limitAddr.Pos {
 					if prevBlock.RefId != biopb.UnmappedRefID && !opts.SplitMappedCoords {
 						log.Debug.Printf("prev (%d): %+v %+v, new: %+v", len(bounds), prevLimit, prevBlock, block.StartAddr)
@@ -285,10 +357,15 @@ func GenerateReadShards(
 			}
 			nBlocks++
 		}
-		// For performance, we don't want a readshard that crosses a rowshard
-		// boundary, so close the shard here.
-		log.Debug.Printf("Add (%d): %v", len(bounds), index.shardRange.Limit.Min(opts.Range.Limit))
-		appendShard(index.shardRange.Limit.Min(opts.Range.Limit))
+		if !opts.CrossFileShards {
+			// For performance, we don't want a readshard that crosses a rowshard
+			// boundary, so close the shard here.
+			log.Debug.Printf("Add (%d): %v", len(bounds), index.shardRange.Limit.Min(opts.Range.Limit))
+			appendShard(index.shardRange.Limit.Min(opts.Range.Limit))
+		}
+	}
+	if opts.CrossFileShards {
+		appendShard(opts.Range.Limit)
 	}
 	return bounds, nil
 }
@@ -0,0 +1,311 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pamutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/traverse"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+)
+
+// ShardReport is the result of validating one shard of a PAM file.
+type ShardReport struct {
+	// Range is the coordinate range of the shard, as encoded in the pathname of
+	// the shard index.
+	Range biopb.CoordRange `json:"-"`
+	// Shard is Range in the pathname format, e.g., "0:0,3:12345".
+	Shard string `json:"shard"`
+	// NumRecords is the number of records in the shard, as recorded in the
+	// index of the coord field file.
+	NumRecords int64 `json:"num_records"`
+	// Fields lists the field files found for the shard, e.g., "coord", "mapq",
+	// "aux.MD".
+	Fields []string `json:"fields"`
+	// Problems lists the problems found in the shard. It is empty iff the shard
+	// is valid.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// ValidateReport is the result of Validate.
+type ValidateReport struct {
+	// Dir is the PAM directory.
+	Dir string `json:"dir"`
+	// NumRecords is the total number of records in the valid shards.
+	NumRecords int64 `json:"num_records"`
+	// Shards lists the shards, sorted by range.
+	Shards []ShardReport `json:"shards"`
+	// Problems lists the problems that are not specific to one shard, such as
+	// gaps or overlaps between the shard ranges.
+	Problems []string `json:"problems,omitempty"`
+	// OrphanFiles lists the field files that have no shard index. They are
+	// usually left by a writer that did not finish, since the shard index is
+	// written last.
+	OrphanFiles []string `json:"orphan_files,omitempty"`
+}
+
+// OK returns true if no problem is found.
+func (r *ValidateReport) OK() bool {
+	if len(r.Problems) > 0 || len(r.OrphanFiles) > 0 {
+		return false
+	}
+	for _, s := range r.Shards {
+		if len(s.Problems) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the integrity of the PAM files in "dir". It checks that:
+//
+// - The shard ranges cover the UniversalRange without a gap or an overlap.
+//
+// - Each shard has a file for every field found in other shards, plus one for
+// every aux tag listed in its index (Cf. pam.WriteOpts.SeparateAuxTags).
+//
+// - Each field file has an index, and it stores the same number of records as
+// the coord field.
+//
+// - The block index entries in each field file are monotonic, and the
+// coordinates of the blocks are in the shard range. Since the entry of a block
+// records the smallest and largest coordinates in the block, this ensures that
+// every record is in the shard range.
+//
+// Validate reads only the index of each file, so it runs much faster than
+// reading the records. The returned error is non-nil only if the directory
+// cannot be listed. Problems found in the files are reported in
+// ValidateReport.
+func Validate(ctx context.Context, dir string) (ValidateReport, error) {
+	report := ValidateReport{Dir: dir}
+	indexes, fieldFiles, err := listShardFiles(ctx, dir)
+	if err != nil {
+		return report, err
+	}
+	report.Problems = validateShardRanges(indexes)
+
+	// Fields found in any shard are expected in all shards. Separately stored
+	// aux tags are listed in each shard index, so they are checked in
+	// validateShard.
+	fieldSet := map[string]bool{}
+	for _, fi := range indexes {
+		for _, field := range fieldFiles[fi.Range] {
+			if !strings.HasPrefix(field, AuxTagFieldName("")) {
+				fieldSet[field] = true
+			}
+		}
+	}
+	fieldSet[gbam.FieldCoord.String()] = true
+	var fields []string
+	for f := range gbam.FieldNames {
+		if name := gbam.FieldType(f).String(); fieldSet[name] {
+			fields = append(fields, name)
+		}
+	}
+
+	report.Shards = make([]ShardReport, len(indexes))
+	traverse.Each(len(indexes), func(i int) error { // nolint: errcheck
+		report.Shards[i] = validateShard(ctx, dir, indexes[i].Range, fields, fieldFiles[indexes[i].Range])
+		return nil
+	})
+	shardRanges := map[biopb.CoordRange]bool{}
+	for _, s := range report.Shards {
+		shardRanges[s.Range] = true
+		if len(s.Problems) == 0 {
+			report.NumRecords += s.NumRecords
+		}
+	}
+	for r, fields := range fieldFiles {
+		if shardRanges[r] {
+			continue
+		}
+		for _, field := range fields {
+			report.OrphanFiles = append(report.OrphanFiles, FieldDataPath(dir, r, field))
+		}
+	}
+	sort.Strings(report.OrphanFiles)
+	if len(indexes) == 0 {
+		report.Problems = append(report.Problems, "no shard index files found")
+	}
+	return report, nil
+}
+
+// listShardFiles lists the files in "dir". It returns the shard index files,
+// sorted by range, and the names of the field files for each range. Unlike
+// ListIndexes, it does not fail when no shard index is found.
+func listShardFiles(ctx context.Context, dir string) ([]FileInfo, map[biopb.CoordRange][]string, error) {
+	var indexes []FileInfo
+	fieldFiles := map[biopb.CoordRange][]string{}
+	lister := file.List(ctx, dir, true)
+	for lister.Scan() {
+		fi, err := ParsePath(lister.Path())
+		if err != nil {
+			continue
+		}
+		switch fi.Type {
+		case FileTypeShardIndex:
+			indexes = append(indexes, fi)
+		case FileTypeFieldData:
+			fieldFiles[fi.Range] = append(fieldFiles[fi.Range], fi.Field)
+		}
+	}
+	if err := lister.Err(); err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return indexes[i].Range.Start.LT(indexes[j].Range.Start)
+	})
+	return indexes, fieldFiles, nil
+}
+
+// validateShardRanges checks that the ranges of the shards cover the
+// UniversalRange exactly. Arg indexes must be sorted by range.
+func validateShardRanges(indexes []FileInfo) []string {
+	if len(indexes) == 0 {
+		return nil
+	}
+	var problems []string
+	prevLimit := gbam.UniversalRange.Start
+	for i, fi := range indexes {
+		switch c := fi.Range.Start.Compare(prevLimit); {
+		case c > 0:
+			problems = append(problems, fmt.Sprintf("gap: no shard covers range %s",
+				CoordRangePathString(biopb.CoordRange{Start: prevLimit, Limit: fi.Range.Start})))
+		case c < 0:
+			problems = append(problems, fmt.Sprintf("overlap: shards %s and %s overlap",
+				CoordRangePathString(indexes[i-1].Range), CoordRangePathString(fi.Range)))
+		}
+		if prevLimit.LT(fi.Range.Limit) {
+			prevLimit = fi.Range.Limit
+		}
+	}
+	if prevLimit.LT(gbam.UniversalRange.Limit) {
+		problems = append(problems, fmt.Sprintf("gap: no shard covers range %s",
+			CoordRangePathString(biopb.CoordRange{Start: prevLimit, Limit: gbam.UniversalRange.Limit})))
+	}
+	return problems
+}
+
+// validateShard checks the files of the shard "shardRange". Arg fields lists
+// the fields expected in the shard, and files lists the fields actually found.
+func validateShard(ctx context.Context, dir string, shardRange biopb.CoordRange, fields []string, files []string) ShardReport {
+	s := ShardReport{Range: shardRange, Shard: CoordRangePathString(shardRange)}
+	s.Fields = append(s.Fields, files...)
+	sort.Strings(s.Fields)
+	problemf := func(format string, args ...interface{}) {
+		s.Problems = append(s.Problems, fmt.Sprintf(format, args...))
+	}
+	index, err := ReadShardIndex(ctx, dir, shardRange)
+	if err != nil {
+		problemf("shard index: %v", err)
+		return s
+	}
+	if !index.Range.EQ(shardRange) {
+		problemf("shard index: range %s differs from the pathname", CoordRangePathString(index.Range))
+	}
+	fields = append([]string{}, fields...)
+	for _, tag := range index.AuxTags {
+		fields = append(fields, AuxTagFieldName(tag))
+	}
+	found := map[string]bool{}
+	for _, field := range files {
+		found[field] = true
+	}
+	coordField := gbam.FieldCoord.String()
+	nRecords := map[string]int64{}
+	for _, field := range fields {
+		if !found[field] {
+			problemf("field %s: file not found", field)
+			continue
+		}
+		n, err := validateFieldFile(ctx, dir, shardRange, field)
+		if err != nil {
+			problemf("field %s: %v", field, err)
+			continue
+		}
+		nRecords[field] = n
+	}
+	nCoords, ok := nRecords[coordField]
+	if !ok {
+		return s
+	}
+	s.NumRecords = nCoords
+	for _, field := range fields {
+		if n, ok := nRecords[field]; ok && n != nCoords {
+			problemf("field %s: found %d records, but %s has %d records", field, n, coordField, nCoords)
+		}
+	}
+	return s
+}
+
+// validateFieldFile checks the index of the field file of the given shard. It
+// returns the number of records in the file.
+func validateFieldFile(ctx context.Context, dir string, shardRange biopb.CoordRange, field string) (int64, error) {
+	index, err := readFieldIndex(ctx, dir, shardRange, field)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for i, b := range index.Blocks {
+		if b.EndAddr.LT(b.StartAddr) {
+			return 0, fmt.Errorf("block %d: start %+v is after end %+v", i, b.StartAddr, b.EndAddr)
+		}
+		if !shardRange.Contains(b.StartAddr) || !shardRange.Contains(b.EndAddr) {
+			return 0, fmt.Errorf("block %d: range [%+v, %+v] is outside the shard range", i, b.StartAddr, b.EndAddr)
+		}
+		if i > 0 {
+			prev := index.Blocks[i-1]
+			if b.FileOffset <= prev.FileOffset {
+				return 0, fmt.Errorf("block %d: file offset %d is not after the previous block's %d", i, b.FileOffset, prev.FileOffset)
+			}
+			if b.StartAddr.LE(prev.EndAddr) {
+				return 0, fmt.Errorf("block %d: start %+v is not after the previous block's end %+v", i, b.StartAddr, prev.EndAddr)
+			}
+		}
+		n += int64(b.NumRecords)
+	}
+	return n, nil
+}
+
+// RemoveInvalidShards deletes the files of the shards that have problems in the
+// report, as well as the orphan field files. It returns the list of deleted
+// files. The remaining shards can be read, but the ranges of the deleted shards
+// become gaps, so the records in them are lost.
+func RemoveInvalidShards(ctx context.Context, report ValidateReport) ([]string, error) {
+	var removed []string
+	remove := func(path string) error {
+		if err := file.Remove(ctx, path); err != nil {
+			return err
+		}
+		removed = append(removed, path)
+		return nil
+	}
+	for _, s := range report.Shards {
+		if len(s.Problems) == 0 {
+			continue
+		}
+		// Remove the index first, so that the shard is never seen with a
+		// partial set of field files.
+		if err := remove(ShardIndexPath(report.Dir, s.Range)); err != nil {
+			return removed, err
+		}
+		for _, field := range s.Fields {
+			if err := remove(FieldDataPath(report.Dir, s.Range, field)); err != nil {
+				return removed, err
+			}
+		}
+	}
+	for _, path := range report.OrphanFiles {
+		if err := remove(path); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
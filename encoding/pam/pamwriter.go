@@ -14,6 +14,7 @@ import (
 	"github.com/grailbio/base/vcontext"
 	"github.com/grailbio/bio/biopb"
 	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/fasta"
 	"github.com/grailbio/bio/encoding/pam/fieldio"
 	"github.com/grailbio/bio/encoding/pam/pamutil"
 	"github.com/grailbio/hts/sam"
@@ -47,6 +48,28 @@ type WriteOpts struct {
 	// CPU overheads, pass "zstd 1".
 	Transformers []string
 
+	// SeparateAuxTags lists aux tags, such as "MD" or "BQ", to be stored in
+	// their own files (named "*.aux.<tag>") instead of the common aux file. A
+	// reader that needs only some tags can then skip the rest (see
+	// ReadOpts.AuxTags). The tags are ignored if FieldAux is in DropFields.
+	SeparateAuxTags []string
+
+	// QualBins, if nonempty, causes the quality scores to be binned before
+	// being written: each score q is replaced by QualBins[q]. This is lossy,
+	// but it makes the qual field much more compressible. The table must have
+	// 256 entries and map 0xff to itself; use ParseQualBins to create one. The
+	// table is recorded in the shard index, so that readers can tell that the
+	// quality scores are lossy (Cf. ReadQualBins).
+	QualBins []byte
+
+	// Reference, if non-nil, causes the sequences of mapped reads to be stored
+	// as the difference from the reference bases they are aligned to. This
+	// makes the seq field much smaller. Reading the seq field of such a file
+	// requires the same reference (Cf. ReadOpts.Reference). The MD5 checksums
+	// of the reference sequences used by the records are recorded in the
+	// shard index, so that a reader can detect a wrong reference.
+	Reference fasta.Fasta
+
 	// Range defines the range of records that can be stored in the PAM
 	// file.  The range will be encoded in the path name. Also, Write() will
 	// cause an error if it sees a record outside the range. An empty range
@@ -84,6 +107,19 @@ func validateWriteOpts(o *WriteOpts) error {
 	if len(o.Transformers) == 0 {
 		o.Transformers = []string{"zstd"}
 	}
+	seen := map[string]bool{}
+	for _, tag := range o.SeparateAuxTags {
+		if len(tag) != 2 {
+			return fmt.Errorf("invalid aux tag '%s' in SeparateAuxTags", tag)
+		}
+		if seen[tag] {
+			return fmt.Errorf("duplicate aux tag '%s' in SeparateAuxTags", tag)
+		}
+		seen[tag] = true
+	}
+	if err := validateQualBins(o.QualBins); err != nil {
+		return err
+	}
 	return pamutil.ValidateCoordRange(&o.Range)
 }
 
@@ -99,6 +135,17 @@ type Writer struct {
 	bufPool      *fieldio.WriteBufPool
 	fieldWriters [gbam.NumFields]*fieldio.Writer // Writer for each field
 
+	// Writer for each tag in opts.SeparateAuxTags. Empty if FieldAux is dropped.
+	auxTagWriters []*fieldio.Writer
+	// auxTags[i] is the tag stored by auxTagWriters[i].
+	auxTags []sam.Tag
+	// Scratch space for the tags stored in the common aux field.
+	auxBuf []sam.Aux
+	// Scratch space for binning the quality scores.
+	qualBuf []byte
+	// refSeq is true if the seq field is encoded relative to opts.Reference.
+	refSeq bool
+
 	// Value to be assigned to the "seq" field of a new recBlockWriteBuf.
 	nextBlockSeq int
 	err          errors.Once
@@ -144,13 +191,27 @@ func (w *Writer) Write(r *sam.Record) {
 		w.fieldWriters[gbam.FieldName].PutStringDeltaField(addr, r.Name)
 	}
 	if w.fieldWriters[gbam.FieldSeq] != nil {
-		w.fieldWriters[gbam.FieldSeq].PutSeqField(addr, r.Seq)
+		if w.refSeq {
+			w.putRefSeqField(addr, r)
+		} else {
+			w.fieldWriters[gbam.FieldSeq].PutSeqField(addr, r.Seq)
+		}
 	}
 	if w.fieldWriters[gbam.FieldQual] != nil {
-		w.fieldWriters[gbam.FieldQual].PutBytesField(addr, r.Qual)
+		qual := r.Qual
+		if len(w.opts.QualBins) > 0 {
+			w.qualBuf = append(w.qualBuf[:0], qual...)
+			BinQual(w.opts.QualBins, w.qualBuf)
+			qual = w.qualBuf
+		}
+		w.fieldWriters[gbam.FieldQual].PutBytesField(addr, qual)
 	}
 	if w.fieldWriters[gbam.FieldAux] != nil {
-		w.fieldWriters[gbam.FieldAux].PutAuxField(addr, r.AuxFields)
+		aux := r.AuxFields
+		if len(w.auxTagWriters) > 0 {
+			aux = w.putAuxTagFields(addr, r.AuxFields)
+		}
+		w.fieldWriters[gbam.FieldAux].PutAuxField(addr, aux)
 	}
 	for _, fw := range w.fieldWriters {
 		if fw != nil && fw.BufLen() >= w.opts.MaxBufSize {
@@ -158,16 +219,91 @@ func (w *Writer) Write(r *sam.Record) {
 			fw.NewBuf()
 		}
 	}
+	for _, fw := range w.auxTagWriters {
+		if fw.BufLen() >= w.opts.MaxBufSize {
+			fw.FlushBuf()
+			fw.NewBuf()
+		}
+	}
+}
+
+// putRefSeqField writes the seq field as the difference from opts.Reference.
+func (w *Writer) putRefSeqField(addr biopb.Coord, r *sam.Record) {
+	fw := w.fieldWriters[gbam.FieldSeq]
+	if r.Ref == nil || r.Flags&sam.Unmapped != 0 || len(r.Cigar) == 0 {
+		fw.PutRefSeqField(addr, r.Seq, nil, nil)
+		return
+	}
+	refID := r.Ref.ID()
+	if w.index.ReferenceChecksums[refID] == "" {
+		// First record on this reference. The checksum is computed once per
+		// Writer and kept in the index.
+		sum, err := referenceChecksum(w.opts.Reference, r.Ref.Name())
+		if err != nil {
+			w.err.Set(fmt.Errorf("reference sequence %s: %v", r.Ref.Name(), err))
+			return
+		}
+		w.index.ReferenceChecksums[refID] = sum
+	}
+	refBases, err := referenceBases(w.opts.Reference, r)
+	if err != nil {
+		w.err.Set(fmt.Errorf("reference bases for %v: %v", r, err))
+		return
+	}
+	fw.PutRefSeqField(addr, r.Seq, r.Cigar, refBases)
+}
+
+// putAuxTagFields writes the tags listed in opts.SeparateAuxTags to their own
+// files. It returns the rest of the tags, which should be stored in the common
+// aux file. The returned slice is valid until the next call.
+func (w *Writer) putAuxTagFields(addr biopb.Coord, aa []sam.Aux) []sam.Aux {
+	for i, fw := range w.auxTagWriters {
+		index, mainBefore := -1, 0
+		for j, a := range aa {
+			if a.Tag() == w.auxTags[i] {
+				index = j
+				break
+			}
+			if !w.isSeparateAuxTag(a.Tag()) {
+				mainBefore++
+			}
+		}
+		var tag sam.Aux
+		if index >= 0 {
+			tag = aa[index]
+		}
+		fw.PutAuxTagField(addr, tag, index, mainBefore)
+	}
+	w.auxBuf = w.auxBuf[:0]
+	for _, a := range aa {
+		if !w.isSeparateAuxTag(a.Tag()) {
+			w.auxBuf = append(w.auxBuf, a)
+		}
+	}
+	return w.auxBuf
+}
+
+func (w *Writer) isSeparateAuxTag(tag sam.Tag) bool {
+	for _, t := range w.auxTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // Close must be called exactly once. After close, no operation other than Err()
 // may be called.
 func (w *Writer) Close() error {
-	traverse.Each(len(w.fieldWriters), func(i int) error { // nolint: errcheck
-		fw := w.fieldWriters[i]
+	var writers []*fieldio.Writer
+	for _, fw := range w.fieldWriters {
 		if fw != nil {
-			fw.Close()
+			writers = append(writers, fw)
 		}
+	}
+	writers = append(writers, w.auxTagWriters...)
+	traverse.Each(len(writers), func(i int) error { // nolint: errcheck
+		writers[i].Close()
 		return nil
 	})
 	w.bufPool.Finish()
@@ -201,6 +337,9 @@ func NewWriter(wo WriteOpts, samHeader *sam.Header, dir string) *Writer {
 			nWrittenFields++
 		}
 	}
+	if !dropField[gbam.FieldAux] {
+		nWrittenFields += len(w.opts.SeparateAuxTags)
+	}
 
 	w.label = fmt.Sprintf("%s:%s", dir, pamutil.CoordRangePathString(w.opts.Range))
 	w.bufPool = fieldio.NewBufPool(w.opts.WriteParallelism * nWrittenFields)
@@ -215,6 +354,26 @@ func NewWriter(wo WriteOpts, samHeader *sam.Header, dir string) *Writer {
 		fw := fieldio.NewWriter(path, label, w.opts.Transformers, w.bufPool, &w.err)
 		w.fieldWriters[f] = fw
 	}
+	if !dropField[gbam.FieldAux] {
+		for _, tag := range w.opts.SeparateAuxTags {
+			field := pamutil.AuxTagFieldName(tag)
+			path := pamutil.FieldDataPath(dir, w.opts.Range, field)
+			label := fmt.Sprintf("%s:%s:%s", file.Base(dir), pamutil.CoordRangePathString(w.opts.Range), field)
+			w.auxTagWriters = append(w.auxTagWriters, fieldio.NewWriter(path, label, w.opts.Transformers, w.bufPool, &w.err))
+			w.auxTags = append(w.auxTags, sam.NewTag(tag))
+		}
+		w.index.AuxTags = w.opts.SeparateAuxTags
+	}
+	if !dropField[gbam.FieldQual] {
+		w.index.QualBins = w.opts.QualBins
+	}
+	if w.opts.Reference != nil && !dropField[gbam.FieldSeq] && len(samHeader.Refs()) > 0 {
+		// A nonempty ReferenceChecksums tells the reader that the seq field is
+		// encoded relative to the reference. Checksums are filled as the
+		// references are used.
+		w.refSeq = true
+		w.index.ReferenceChecksums = make([]string, len(samHeader.Refs()))
+	}
 	return w
 }
 
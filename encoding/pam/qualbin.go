@@ -0,0 +1,169 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pam
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+)
+
+// Illumina8QualBins is the spec of the 8-level quality binning used by
+// Illumina HiSeq X and later instruments. It can be passed to ParseQualBins.
+const Illumina8QualBins = "illumina8"
+
+// illumina8Spec is the table form of Illumina8QualBins.
+const illumina8Spec = "2-9:6,10-19:15,20-24:22,25-29:27,30-34:33,35-39:37,40-93:40"
+
+// ParseQualBins parses a quality binning spec into a table that can be set in
+// WriteOpts.QualBins. The spec is either Illumina8QualBins, or a
+// comma-separated list of "lo-hi:value" or "q:value" entries. Each entry maps
+// the quality scores in the closed range [lo,hi] to the value. Scores not
+// covered by any entry are unchanged. For example, "0-19:10,20-93:30" bins the
+// quality scores into two levels. An empty spec yields a nil table, which means
+// no binning.
+func ParseQualBins(spec string) ([]byte, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if spec == Illumina8QualBins {
+		spec = illumina8Spec
+	}
+	bins := identityQualBins()
+	for _, entry := range strings.Split(spec, ",") {
+		colon := strings.IndexByte(entry, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("qualbins %s: entry '%s' must be of form 'lo-hi:value'", spec, entry)
+		}
+		loStr, hiStr := entry[:colon], entry[:colon]
+		if dash := strings.IndexByte(loStr, '-'); dash >= 0 {
+			loStr, hiStr = loStr[:dash], loStr[dash+1:]
+		}
+		lo, err := parseQual(loStr)
+		if err != nil {
+			return nil, fmt.Errorf("qualbins %s: %v", spec, err)
+		}
+		hi, err := parseQual(hiStr)
+		if err != nil {
+			return nil, fmt.Errorf("qualbins %s: %v", spec, err)
+		}
+		value, err := parseQual(entry[colon+1:])
+		if err != nil {
+			return nil, fmt.Errorf("qualbins %s: %v", spec, err)
+		}
+		if lo > hi {
+			return nil, fmt.Errorf("qualbins %s: empty range in '%s'", spec, entry)
+		}
+		for q := lo; q <= hi; q++ {
+			bins[q] = value
+		}
+	}
+	return bins, nil
+}
+
+// parseQual parses a quality score. The value must be in range [0,0xfe]; 0xff
+// is reserved for missing qualities.
+func parseQual(s string) (byte, error) {
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || v == 0xff {
+		return 0, fmt.Errorf("invalid quality score '%s'", s)
+	}
+	return byte(v), nil
+}
+
+// identityQualBins returns a table that maps every quality score to itself.
+func identityQualBins() []byte {
+	bins := make([]byte, 256)
+	for i := range bins {
+		bins[i] = byte(i)
+	}
+	return bins
+}
+
+// FormatQualBins is the inverse of ParseQualBins. It lists the ranges of
+// quality scores that are changed by the table. It returns "" if the table is
+// empty or is an identity mapping.
+func FormatQualBins(bins []byte) string {
+	var entries []string
+	for lo := 0; lo < len(bins); {
+		hi := lo
+		for hi+1 < len(bins) && bins[hi+1] == bins[lo] {
+			hi++
+		}
+		changed := false
+		for q := lo; q <= hi; q++ {
+			if bins[q] != byte(q) {
+				changed = true
+				break
+			}
+		}
+		if changed {
+			if lo == hi {
+				entries = append(entries, fmt.Sprintf("%d:%d", lo, bins[lo]))
+			} else {
+				entries = append(entries, fmt.Sprintf("%d-%d:%d", lo, hi, bins[lo]))
+			}
+		}
+		lo = hi + 1
+	}
+	return strings.Join(entries, ",")
+}
+
+// validateQualBins checks that a table set in WriteOpts.QualBins can be
+// applied to all quality scores.
+func validateQualBins(bins []byte) error {
+	if len(bins) == 0 {
+		return nil
+	}
+	if len(bins) != 256 {
+		return fmt.Errorf("QualBins must have 256 entries, but found %d", len(bins))
+	}
+	if bins[0xff] != 0xff {
+		return fmt.Errorf("QualBins must map 0xff (missing quality) to itself, but found %d", bins[0xff])
+	}
+	return nil
+}
+
+// BinQual replaces each quality score in "qual" with bins[score], in place.
+// It is a noop if bins is empty. Arg bins must be a table returned by
+// ParseQualBins, or one stored in a PAM shard index.
+func BinQual(bins, qual []byte) {
+	if len(bins) == 0 {
+		return
+	}
+	for i, q := range qual {
+		qual[i] = bins[q]
+	}
+}
+
+// ReadQualBins returns the quality binning table that was used to write the
+// PAM files in "dir", or nil if the quality scores are stored losslessly. It
+// returns an error if the shards use different tables.
+func ReadQualBins(ctx context.Context, dir string) ([]byte, error) {
+	indexes, err := pamutil.ListIndexes(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	var bins []byte
+	for i, fi := range indexes {
+		index, err := pamutil.ReadShardIndex(ctx, dir, fi.Range)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && !bytes.Equal(bins, index.QualBins) {
+			return nil, fmt.Errorf("readqualbins %s: shards %+v and %+v use different quality binnings",
+				dir, indexes[0].Range, fi.Range)
+		}
+		bins = index.QualBins
+	}
+	if len(bins) == 0 {
+		return nil, nil
+	}
+	return bins, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pam
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/grailbio/base/unsafe"
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/hts/sam"
+)
+
+// ReferenceChecksums computes and remembers the MD5 checksums of the sequences
+// in a reference. Computing a checksum requires reading the whole sequence, so
+// readers of the same files should share one ReferenceChecksums (Cf.
+// ReadOpts.ReferenceChecksums). Failures are not remembered; a later Get for
+// the same sequence retries. Thread safe.
+type ReferenceChecksums struct {
+	reference fasta.Fasta
+	mu        sync.Mutex
+	sums      map[string]*refChecksum
+}
+
+// refChecksum is the value of ReferenceChecksums.sums.
+type refChecksum struct {
+	mu  sync.Mutex // serializes the computation of sum.
+	sum string     // "" until computed.
+}
+
+// NewReferenceChecksums creates an empty ReferenceChecksums for the reference.
+func NewReferenceChecksums(reference fasta.Fasta) *ReferenceChecksums {
+	return &ReferenceChecksums{reference: reference, sums: map[string]*refChecksum{}}
+}
+
+// Get returns the checksum of the given sequence, as computed by
+// referenceChecksum.
+func (c *ReferenceChecksums) Get(seqName string) (string, error) {
+	c.mu.Lock()
+	e := c.sums[seqName]
+	if e == nil {
+		e = &refChecksum{}
+		c.sums[seqName] = e
+	}
+	c.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.sum == "" {
+		sum, err := referenceChecksum(c.reference, seqName)
+		if err != nil {
+			return "", err
+		}
+		e.sum = sum
+	}
+	return e.sum, nil
+}
+
+// referenceChecksum computes the MD5 checksum of the given sequence in the
+// reference, as a hex string. The checksum is computed over the uppercase
+// bases, so it is the same as the "M5" tag in a SAM header.
+func referenceChecksum(reference fasta.Fasta, seqName string) (string, error) {
+	const chunkSize = 1 << 20
+	length, err := reference.Len(seqName)
+	if err != nil {
+		return "", err
+	}
+	h := md5.New()
+	var buf []byte
+	for start := uint64(0); start < length; start += chunkSize {
+		end := start + chunkSize
+		if end > length {
+			end = length
+		}
+		bases, err := reference.Get(seqName, start, end)
+		if err != nil {
+			return "", err
+		}
+		buf = append(buf[:0], bases...)
+		for i, c := range buf {
+			if c >= 'a' && c <= 'z' {
+				buf[i] = c - 'a' + 'A'
+			}
+		}
+		h.Write(buf) // nolint: errcheck
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// referenceBases returns the reference bases that rec is aligned to, starting
+// at rec.Pos. The result is truncated at the end of the reference sequence.
+// The result must not be modified.
+func referenceBases(reference fasta.Fasta, rec *sam.Record) ([]byte, error) {
+	name := rec.Ref.Name()
+	length, err := reference.Len(name)
+	if err != nil {
+		return nil, err
+	}
+	refLen, _ := rec.Cigar.Lengths()
+	start, end := uint64(rec.Pos), uint64(rec.Pos+refLen)
+	if end > length {
+		end = length
+	}
+	if rec.Pos < 0 || start >= end {
+		return nil, nil
+	}
+	bases, err := reference.Get(name, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return unsafe.StringToBytes(bases), nil
+}
+
+// verifyReferenceChecksums checks that the reference of "sums" has the same
+// sequences as the reference that a PAM shard was written with. checksums is
+// PAMShardIndex.ReferenceChecksums.
+func verifyReferenceChecksums(sums *ReferenceChecksums, header *sam.Header, checksums []string) error {
+	refs := header.Refs()
+	if len(checksums) != len(refs) {
+		return fmt.Errorf("%d reference checksums found for %d references in the header", len(checksums), len(refs))
+	}
+	for i, expected := range checksums {
+		if expected == "" {
+			continue
+		}
+		name := refs[i].Name()
+		actual, err := sums.Get(name)
+		if err != nil {
+			return fmt.Errorf("reference sequence %s: %v", name, err)
+		}
+		if actual != expected {
+			return fmt.Errorf("reference checksum mismatch for %s: the file was written with MD5 %s, but the given reference has MD5 %s; wrong reference FASTA?",
+				name, expected, actual)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pam
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/file"
+	"github.com/grailbio/base/traverse"
+	"github.com/grailbio/base/vcontext"
+	"github.com/grailbio/bio/biopb"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+// ReshardOpts defines options for Reshard.
+type ReshardOpts struct {
+	// BytesPerShard is the target size of each new file shard, in bytes across
+	// all fields. If this field is set, NumShards is ignored.
+	BytesPerShard int64
+
+	// NumShards is the target number of new file shards. It is ignored if
+	// BytesPerShard > 0. If neither BytesPerShard nor NumShards is set, one
+	// shard is created.
+	NumShards int
+
+	// MaxBufSize and Transformers are passed to WriteOpts when writing the new
+	// shards.
+	MaxBufSize   int
+	Transformers []string
+
+	// Reference must be set if the seq field of the source is encoded relative
+	// to a reference (Cf. WriteOpts.Reference). The new files are encoded
+	// relative to the same reference.
+	Reference fasta.Fasta
+}
+
+// Reshard copies the PAM files in "src" to "dst", changing the layout of the
+// file shards. The new shards are split only at position boundaries, i.e., all
+// the records at the same (refid, position) are stored in one shard. All the
+// unmapped reads are also stored in one shard. So the resulting number of
+// shards may be smaller than requested. Shards are written in parallel.
+//
+// The aux tags stored in separate files, the quality binning table, and the
+// reference encoding of the seq field are carried over from the source. The
+// fields dropped in the source are also dropped in the destination. These
+// settings must be the same in all the source shards, except that each shard
+// records the reference checksums of only the sequences it uses; those must
+// agree wherever two shards both record one. Existing contents of
+// "dst" are deleted, so "dst" must neither contain "src" nor be inside it.
+func Reshard(src, dst string, opts ReshardOpts) error {
+	ctx := vcontext.Background()
+	// dst is removed recursively below, so it must not contain src, and vice
+	// versa.
+	if isSubdir(src, dst) || isSubdir(dst, src) {
+		return fmt.Errorf("reshard %s: source and destination %s overlap", src, dst)
+	}
+	indexes, err := pamutil.ListIndexes(ctx, src)
+	if err != nil {
+		return err
+	}
+	first := indexes[0]
+	index, err := pamutil.ReadShardIndex(ctx, src, first.Range)
+	if err != nil {
+		return err
+	}
+	// The write options are derived from the first shard, so the other shards
+	// must have been written with the same ones.
+	firstFields, err := shardFields(src, first.Range)
+	if err != nil {
+		return err
+	}
+	// Each shard stores the checksums of only the references that it uses,
+	// so they are merged across the shards.
+	checksums := append([]string(nil), index.ReferenceChecksums...)
+	for _, fi := range indexes[1:] {
+		other, err := pamutil.ReadShardIndex(ctx, src, fi.Range)
+		if err != nil {
+			return err
+		}
+		otherFields, err := shardFields(src, fi.Range)
+		if err != nil {
+			return err
+		}
+		var diff string
+		switch {
+		case !reflect.DeepEqual(index.AuxTags, other.AuxTags):
+			diff = "separate aux tags"
+		case !bytes.Equal(index.QualBins, other.QualBins):
+			diff = "quality bins"
+		case (len(checksums) > 0) != (len(other.ReferenceChecksums) > 0):
+			diff = "reference encodings"
+		case !mergeReferenceChecksums(checksums, other.ReferenceChecksums):
+			diff = "reference checksums"
+		case !reflect.DeepEqual(firstFields, otherFields):
+			diff = "fields"
+		}
+		if diff != "" {
+			return fmt.Errorf("reshard %s: shards %s and %s have different %s",
+				src, pamutil.CoordRangePathString(first.Range), pamutil.CoordRangePathString(fi.Range), diff)
+		}
+	}
+	header, err := gbam.UnmarshalHeader(index.EncodedBamHeader)
+	if err != nil {
+		return errors.E(err, fmt.Sprintf("reshard %s: decode sam.Header in index", src))
+	}
+	wopts := WriteOpts{
+		MaxBufSize:      opts.MaxBufSize,
+		Transformers:    opts.Transformers,
+		SeparateAuxTags: index.AuxTags,
+		QualBins:        index.QualBins,
+	}
+	// refSums is shared by all the readers, so that each reference sequence is
+	// hashed once.
+	var refSums *ReferenceChecksums
+	if len(checksums) > 0 {
+		if opts.Reference == nil {
+			return fmt.Errorf("reshard %s: the seq field is encoded relative to a reference; ReshardOpts.Reference must be set", src)
+		}
+		refSums = NewReferenceChecksums(opts.Reference)
+		if err := verifyReferenceChecksums(refSums, header, checksums); err != nil {
+			return fmt.Errorf("reshard %s: %v", src, err)
+		}
+		wopts.Reference = opts.Reference
+	}
+	var fields []string
+	for f := range gbam.FieldNames {
+		field := gbam.FieldType(f)
+		if !firstFields[f] {
+			wopts.DropFields = append(wopts.DropFields, field)
+			continue
+		}
+		fields = append(fields, field.String())
+	}
+
+	nShards := opts.NumShards
+	if opts.BytesPerShard <= 0 && nShards <= 0 {
+		nShards = 1
+	}
+	bounds, err := pamutil.GenerateReadShards(ctx, pamutil.GenerateReadShardsOpts{
+		BytesPerShard:   opts.BytesPerShard,
+		NumShards:       nShards,
+		CrossFileShards: true,
+	}, src, fields)
+	if err != nil {
+		return err
+	}
+	if len(bounds) == 0 {
+		// The source has no records.
+		bounds = append(bounds, gbam.UniversalRange)
+	}
+	vlog.Infof("%v: resharding %d shards into %d shards in %v", src, len(indexes), len(bounds), dst)
+	if err := pamutil.Remove(dst); err != nil {
+		return err
+	}
+	var totalRecs int64
+	err = traverse.Each(len(bounds), func(i int) error {
+		r := NewReader(ReadOpts{Range: bounds[i], DropFields: wopts.DropFields, Reference: opts.Reference, ReferenceChecksums: refSums}, src)
+		shardOpts := wopts
+		shardOpts.Range = bounds[i]
+		w := NewWriter(shardOpts, header, dst)
+		nRecs := int64(0)
+		for r.Scan() {
+			rec := r.Record()
+			w.Write(rec)
+			sam.PutInFreePool(rec)
+			if w.Err() != nil {
+				break
+			}
+			nRecs++
+		}
+		w.err.Set(r.Close())
+		err := w.Close()
+		atomic.AddInt64(&totalRecs, nRecs)
+		vlog.VI(1).Infof("%v: wrote %d records in shard %+v: %v", dst, nRecs, bounds[i], err)
+		return err
+	})
+	vlog.Infof("%v: finished resharding, written %d records, error %v", dst, totalRecs, err)
+	return err
+}
+
+// mergeReferenceChecksums copies the nonempty entries of src to dst. It
+// returns false if the two have different lengths, or if a reference has
+// different nonempty checksums in them.
+func mergeReferenceChecksums(dst, src []string) bool {
+	if len(dst) != len(src) {
+		return false
+	}
+	for i, sum := range src {
+		switch {
+		case sum == "":
+		case dst[i] == "":
+			dst[i] = sum
+		case dst[i] != sum:
+			return false
+		}
+	}
+	return true
+}
+
+// shardFields reports which of the fields have a file in the shard of the PAM
+// directory "dir".
+func shardFields(dir string, r biopb.CoordRange) (found [gbam.NumFields]bool, err error) {
+	ctx := vcontext.Background()
+	for f := range found {
+		_, err = file.Stat(ctx, pamutil.FieldDataPath(dir, r, gbam.FieldType(f).String()))
+		if err == nil {
+			found[f] = true
+		} else if !errors.Is(errors.NotExist, err) {
+			return found, err
+		}
+	}
+	return found, nil
+}
+
+// isSubdir checks if path "child" is the same as "dir" or is under it.
+func isSubdir(dir, child string) bool {
+	dir, child = filepath.Clean(dir), filepath.Clean(child)
+	return child == dir || strings.HasPrefix(child, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pam
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/grailbio/base/errors"
+	"github.com/grailbio/base/traverse"
+	"github.com/grailbio/base/vcontext"
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/bio/encoding/fasta"
+	"github.com/grailbio/bio/encoding/pam/pamutil"
+	"github.com/grailbio/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+// RewriteOpts defines options for RewriteFields.
+type RewriteOpts struct {
+	// Fields lists the fields to be rewritten. Files for other fields are left
+	// intact. FieldCoord cannot be rewritten, since it would change the sort
+	// order. If FieldAux is listed, the aux tags stored in their own files (Cf.
+	// WriteOpts.SeparateAuxTags) are also rewritten.
+	Fields []gbam.FieldType
+
+	// DropFields lists the fields that the callback doesn't need to see. They
+	// are not read. It must not overlap with Fields.
+	DropFields []gbam.FieldType
+
+	// MaxBufSize and Transformers are passed to WriteOpts when writing new
+	// field files.
+	MaxBufSize   int
+	Transformers []string
+
+	// Reference must be set when rewriting the seq or cigar field of a file
+	// written with WriteOpts.Reference. The new seq field is encoded relative
+	// to the same reference. Since such a seq field is encoded relative to the
+	// cigar, it is also rewritten whenever the cigar is.
+	Reference fasta.Fasta
+}
+
+// RewriteFields updates the values of some fields of all the records in the
+// PAM directory "dir", without touching the files for other fields. It reads
+// each record, calls callback, and writes the fields listed in opts.Fields back
+// to new files. Arg shard of callback is the index of the file shard that
+// stores the record, in the order listed by pamutil.ListIndexes. File shards
+// are processed in parallel, so callback must be thread safe, but the records
+// of one shard are passed sequentially, so state kept per shard needs no lock.
+// Callback may modify the record in place, but it must not change the
+// coordinate (Ref and Pos). If callback returns an error, the rewrite is
+// abandoned and the error is returned.
+//
+// The new files are written to a new temporary directory next to "dir", named
+// "dir.rewrite*", and they are renamed into "dir" only after all the shards are
+// processed successfully. If renaming fails midway, the files renamed so far
+// are put back. Thus, on error, "dir" is left unchanged, unless the process
+// crashes or the file system fails while the files are being renamed. The
+// temporary directory is removed in any case. Renaming requires "dir" to be on
+// a local file system.
+//
+// The shard index files, "dir/*.index", are left intact, since they don't
+// depend on field contents.
+func RewriteFields(dir string, opts RewriteOpts, callback func(shard int, rec *sam.Record) error) error {
+	ctx := vcontext.Background()
+	if len(opts.Fields) == 0 {
+		return fmt.Errorf("rewritefields %s: no field to rewrite", dir)
+	}
+	rewrite := [gbam.NumFields]bool{}
+	for _, f := range opts.Fields {
+		if int(f) < 0 || int(f) >= gbam.NumFields {
+			return fmt.Errorf("rewritefields %s: invalid field %v", dir, f)
+		}
+		if f == gbam.FieldCoord {
+			return fmt.Errorf("rewritefields %s: coord field cannot be rewritten", dir)
+		}
+		rewrite[f] = true
+	}
+	for _, f := range opts.DropFields {
+		if int(f) >= 0 && int(f) < gbam.NumFields && rewrite[f] {
+			return fmt.Errorf("rewritefields %s: field %v is both rewritten and dropped", dir, f)
+		}
+	}
+	var dropFields []gbam.FieldType
+	for f := range rewrite {
+		if !rewrite[f] {
+			dropFields = append(dropFields, gbam.FieldType(f))
+		}
+	}
+
+	indexes, err := pamutil.ListIndexes(ctx, dir)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+".rewrite")
+	if err != nil {
+		return err
+	}
+	// refSums is shared by all the readers, so that each reference sequence is
+	// hashed once.
+	var refSums *ReferenceChecksums
+	if opts.Reference != nil {
+		refSums = NewReferenceChecksums(opts.Reference)
+	}
+	// fieldNames[i] lists the field files written for indexes[i].
+	fieldNames := make([][]string, len(indexes))
+	err = traverse.Each(len(indexes), func(i int) error {
+		fi := indexes[i]
+		index, err := pamutil.ReadShardIndex(ctx, dir, fi.Range)
+		if err != nil {
+			return err
+		}
+		header, err := gbam.UnmarshalHeader(index.EncodedBamHeader)
+		if err != nil {
+			return errors.E(err, fmt.Sprintf("rewritefields %s: decode sam.Header in index", dir))
+		}
+		wopts := WriteOpts{
+			MaxBufSize:   opts.MaxBufSize,
+			DropFields:   dropFields,
+			Transformers: opts.Transformers,
+			Range:        fi.Range,
+		}
+		ropts := ReadOpts{Range: fi.Range, DropFields: opts.DropFields, Reference: opts.Reference, ReferenceChecksums: refSums}
+		for _, f := range opts.Fields {
+			fieldNames[i] = append(fieldNames[i], f.String())
+		}
+		if rewrite[gbam.FieldQual] {
+			// Keep the quality scores consistent with the binning recorded in
+			// the index.
+			wopts.QualBins = index.QualBins
+		}
+		if (rewrite[gbam.FieldSeq] || rewrite[gbam.FieldCigar]) && len(index.ReferenceChecksums) > 0 {
+			if opts.Reference == nil {
+				return fmt.Errorf("rewritefields %s: the seq field is encoded relative to a reference; RewriteOpts.Reference must be set", dir)
+			}
+			wopts.Reference = opts.Reference
+			if !rewrite[gbam.FieldSeq] {
+				// The seq field is encoded relative to the cigar, so it must
+				// be re-encoded with the new one.
+				fieldNames[i] = append(fieldNames[i], gbam.FieldSeq.String())
+				wopts.DropFields = removeField(dropFields, gbam.FieldSeq)
+			}
+			// Encoding the seq field needs both the seq and the cigar.
+			ropts.DropFields = removeField(removeField(opts.DropFields, gbam.FieldSeq), gbam.FieldCigar)
+		}
+		if rewrite[gbam.FieldAux] {
+			wopts.SeparateAuxTags = index.AuxTags
+			for _, tag := range index.AuxTags {
+				fieldNames[i] = append(fieldNames[i], pamutil.AuxTagFieldName(tag))
+			}
+		}
+		r := NewReader(ropts, dir)
+		w := NewWriter(wopts, header, tmpDir)
+		nRecs := 0
+		for r.Scan() {
+			rec := r.Record()
+			refID, pos := rec.Ref.ID(), rec.Pos
+			if err := callback(i, rec); err != nil {
+				w.err.Set(err)
+				break
+			}
+			if rec.Ref.ID() != refID || rec.Pos != pos {
+				w.err.Set(fmt.Errorf("rewritefields %s: callback changed the coordinate of %v from (%d,%d)", dir, rec, refID, pos))
+				break
+			}
+			w.Write(rec)
+			sam.PutInFreePool(rec)
+			nRecs++
+		}
+		w.err.Set(r.Close())
+		err = w.Close()
+		vlog.VI(1).Infof("%v: rewrote %d records in shard %+v: %v", dir, nRecs, fi.Range, err)
+		return err
+	})
+	if err == nil {
+		err = replaceFiles(dir, tmpDir, indexes, fieldNames)
+	}
+	if err != nil {
+		pamutil.Remove(tmpDir) // nolint: errcheck
+		return err
+	}
+	return pamutil.Remove(tmpDir)
+}
+
+// removeField returns a copy of fields without field f.
+func removeField(fields []gbam.FieldType, f gbam.FieldType) []gbam.FieldType {
+	var r []gbam.FieldType
+	for _, field := range fields {
+		if field != f {
+			r = append(r, field)
+		}
+	}
+	return r
+}
+
+// replaceFiles renames the field files written in tmpDir into dir. The files
+// they replace are first moved to tmpDir, so that they can be restored if a
+// rename fails.
+func replaceFiles(dir, tmpDir string, indexes []pamutil.FileInfo, fieldNames [][]string) error {
+	type renamed struct{ src, dst, backup string }
+	var done []renamed
+	rename := func(src, dst, backup string) error {
+		if err := os.Rename(dst, backup); err != nil {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			os.Rename(backup, dst) // nolint: errcheck
+			return err
+		}
+		done = append(done, renamed{src, dst, backup})
+		return nil
+	}
+	for i, fi := range indexes {
+		for _, field := range fieldNames[i] {
+			src := pamutil.FieldDataPath(tmpDir, fi.Range, field)
+			dst := pamutil.FieldDataPath(dir, fi.Range, field)
+			if err := rename(src, dst, src+".orig"); err != nil {
+				// Put back the files replaced so far.
+				for j := len(done) - 1; j >= 0; j-- {
+					if rerr := os.Rename(done[j].backup, done[j].dst); rerr != nil {
+						vlog.Errorf("rewritefields %s: restore %s: %v", dir, done[j].dst, rerr)
+					}
+				}
+				return errors.E(err, fmt.Sprintf("rewritefields %s: rename %s", dir, src))
+			}
+		}
+	}
+	return nil
+}
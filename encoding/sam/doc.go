@@ -0,0 +1,20 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package sam reads and writes SAM text files as sam.Records of
+// github.com/grailbio/hts/sam.
+//
+// Parser converts one SAM line into a sam.Record. The record is taken from
+// sam.GetFromFreePool, and all its variable-length fields are stored in the
+// record's scratch buffer, so a record recycled through sam.PutInFreePool is
+// parsed without allocation. Reader splits the input into chunks of lines and
+// parses the chunks in parallel, while returning records in the input order.
+//
+// AppendRecord formats a record in SAM. It is thread safe, so callers may
+// format records in parallel. Writer is a simple sequential SAM writer built
+// on top of it.
+//
+// The text representation is compatible with sam.Record.UnmarshalSAM and
+// sam.Record.MarshalText.
+package sam
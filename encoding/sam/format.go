@@ -0,0 +1,166 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sam
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strconv"
+
+	"github.com/grailbio/hts/sam"
+)
+
+var seqChars = []byte("=ACMGRSVTWYHKDBN")
+
+// AppendRecord appends the SAM representation of "rec" to dst, without a
+// trailing newline, and returns the extended buffer. The output is the same as
+// rec.MarshalText(). AppendRecord is thread safe.
+func AppendRecord(dst []byte, rec *sam.Record) ([]byte, error) {
+	if rec.Qual != nil && len(rec.Qual) != rec.Seq.Length {
+		return dst, errSeqQualLength
+	}
+	dst = append(dst, rec.Name...)
+	dst = append(dst, '\t')
+	dst = strconv.AppendUint(dst, uint64(rec.Flags), 10)
+	dst = append(dst, '\t')
+	dst = appendRefName(dst, rec.Ref)
+	dst = append(dst, '\t')
+	dst = strconv.AppendInt(dst, int64(rec.Pos+1), 10)
+	dst = append(dst, '\t')
+	dst = strconv.AppendUint(dst, uint64(rec.MapQ), 10)
+	dst = append(dst, '\t')
+	if len(rec.Cigar) == 0 {
+		dst = append(dst, '*')
+	}
+	for _, op := range rec.Cigar {
+		dst = strconv.AppendInt(dst, int64(op.Len()), 10)
+		dst = append(dst, op.Type().String()...)
+	}
+	dst = append(dst, '\t')
+	if rec.MateRef != nil && rec.MateRef == rec.Ref {
+		dst = append(dst, '=')
+	} else {
+		dst = appendRefName(dst, rec.MateRef)
+	}
+	dst = append(dst, '\t')
+	dst = strconv.AppendInt(dst, int64(rec.MatePos+1), 10)
+	dst = append(dst, '\t')
+	dst = strconv.AppendInt(dst, int64(rec.TempLen), 10)
+	dst = append(dst, '\t')
+	if rec.Seq.Length == 0 {
+		dst = append(dst, '*')
+	}
+	for i := 0; i < rec.Seq.Length; i++ {
+		d := rec.Seq.Seq[i/2]
+		if i%2 == 0 {
+			d >>= 4
+		}
+		dst = append(dst, seqChars[d&0xf])
+	}
+	dst = append(dst, '\t')
+	dst = appendQual(dst, rec.Qual)
+	for _, aux := range rec.AuxFields {
+		dst = append(dst, '\t')
+		dst = appendAux(dst, aux)
+	}
+	return dst, nil
+}
+
+func appendRefName(dst []byte, ref *sam.Reference) []byte {
+	if ref == nil {
+		return append(dst, '*')
+	}
+	return append(dst, ref.Name()...)
+}
+
+// appendQual appends the quality scores in phred+33. Scores that are all 0xff
+// are printed as "*".
+func appendQual(dst []byte, qual []byte) []byte {
+	missing := true
+	for _, q := range qual {
+		if q != 0xff {
+			missing = false
+			break
+		}
+	}
+	if missing {
+		return append(dst, '*')
+	}
+	for _, q := range qual {
+		dst = append(dst, q+33)
+	}
+	return dst
+}
+
+// appendAux appends an aux field in the "TG:T:value" form.
+func appendAux(dst []byte, aux sam.Aux) []byte {
+	dst = append(dst, aux[0], aux[1], ':')
+	switch typ := aux.Type(); typ {
+	case 'A':
+		return append(dst, 'A', ':', aux[3])
+	case 'c':
+		dst = append(dst, 'i', ':')
+		return strconv.AppendInt(dst, int64(int8(aux[3])), 10)
+	case 'C':
+		dst = append(dst, 'i', ':')
+		return strconv.AppendUint(dst, uint64(aux[3]), 10)
+	case 's':
+		dst = append(dst, 'i', ':')
+		return strconv.AppendInt(dst, int64(int16(binary.LittleEndian.Uint16(aux[3:]))), 10)
+	case 'S':
+		dst = append(dst, 'i', ':')
+		return strconv.AppendUint(dst, uint64(binary.LittleEndian.Uint16(aux[3:])), 10)
+	case 'i':
+		dst = append(dst, 'i', ':')
+		return strconv.AppendInt(dst, int64(int32(binary.LittleEndian.Uint32(aux[3:]))), 10)
+	case 'I':
+		dst = append(dst, 'i', ':')
+		return strconv.AppendUint(dst, uint64(binary.LittleEndian.Uint32(aux[3:])), 10)
+	case 'f':
+		dst = append(dst, 'f', ':')
+		return appendFloat(dst, binary.LittleEndian.Uint32(aux[3:]))
+	case 'Z':
+		dst = append(dst, 'Z', ':')
+		return append(dst, aux[3:]...)
+	case 'H':
+		dst = append(dst, 'H', ':')
+		n := len(dst)
+		dst = append(dst, make([]byte, hex.EncodedLen(len(aux)-3))...)
+		hex.Encode(dst[n:], aux[3:])
+		return dst
+	case 'B':
+		elemType := aux[3]
+		dst = append(dst, 'B', ':', elemType)
+		n := int(binary.LittleEndian.Uint32(aux[4:]))
+		data := aux[8:]
+		for i := 0; i < n; i++ {
+			dst = append(dst, ',')
+			switch elemType {
+			case 'c':
+				dst = strconv.AppendInt(dst, int64(int8(data[i])), 10)
+			case 'C':
+				dst = strconv.AppendUint(dst, uint64(data[i]), 10)
+			case 's':
+				dst = strconv.AppendInt(dst, int64(int16(binary.LittleEndian.Uint16(data[2*i:]))), 10)
+			case 'S':
+				dst = strconv.AppendUint(dst, uint64(binary.LittleEndian.Uint16(data[2*i:])), 10)
+			case 'i':
+				dst = strconv.AppendInt(dst, int64(int32(binary.LittleEndian.Uint32(data[4*i:]))), 10)
+			case 'I':
+				dst = strconv.AppendUint(dst, uint64(binary.LittleEndian.Uint32(data[4*i:])), 10)
+			case 'f':
+				dst = appendFloat(dst, binary.LittleEndian.Uint32(data[4*i:]))
+			}
+		}
+		return dst
+	}
+	// Unknown type. Print it the same way as sam.Aux.String.
+	return append(dst, aux.String()[3:]...)
+}
+
+func appendFloat(dst []byte, bits uint32) []byte {
+	return strconv.AppendFloat(dst, float64(math.Float32frombits(bits)), 'g', -1, 32)
+}
@@ -0,0 +1,467 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"unsafe"
+
+	gbam "github.com/grailbio/bio/encoding/bam"
+	"github.com/grailbio/hts/sam"
+)
+
+// nMandatoryFields is the number of mandatory fields in a SAM line.
+const nMandatoryFields = 11
+
+const sizeofSliceHeader = int(unsafe.Sizeof(reflect.SliceHeader{}))
+
+// seqTable maps an IUPAC base to its 4-bit encoding.
+var seqTable [256]sam.Doublet
+
+// cigarTable maps a cigar op character to its type plus 1. Zero means an
+// invalid character.
+var cigarTable [256]byte
+
+func init() {
+	for i := range seqTable {
+		seqTable[i] = 0xf
+	}
+	for i, c := range []byte("=ACMGRSVTWYHKDBN") {
+		seqTable[c] = sam.Doublet(i)
+		if c >= 'A' && c <= 'Z' {
+			seqTable[c+'a'-'A'] = sam.Doublet(i)
+		}
+	}
+	for i, c := range []byte("MIDNSHP=X") {
+		cigarTable[c] = byte(i + 1)
+	}
+}
+
+var (
+	errMissingFields  = errors.New("sam: missing SAM fields")
+	errSeqCigarLength = errors.New("sam: sequence/CIGAR length mismatch")
+	errSeqQualLength  = errors.New("sam: sequence/quality length mismatch")
+)
+
+// Parser parses SAM record lines. It is thread safe.
+type Parser struct {
+	header *sam.Header
+	refs   map[string]*sam.Reference
+}
+
+// NewParser creates a parser for records that refer to the references in the
+// given header.
+func NewParser(header *sam.Header) *Parser {
+	p := &Parser{header: header, refs: map[string]*sam.Reference{}}
+	for _, ref := range header.Refs() {
+		p.refs[ref.Name()] = ref
+	}
+	return p
+}
+
+// Header returns the header passed to NewParser.
+func (p *Parser) Header() *sam.Header {
+	return p.header
+}
+
+func (p *Parser) ref(name []byte) (*sam.Reference, error) {
+	if len(name) == 1 && name[0] == '*' {
+		return nil, nil
+	}
+	ref, ok := p.refs[string(name)]
+	if !ok {
+		return nil, fmt.Errorf("no reference with name %q", name)
+	}
+	return ref, nil
+}
+
+// Parse parses one SAM line, without the trailing newline. The record is
+// obtained from sam.GetFromFreePool. The caller may pass the record to
+// sam.PutInFreePool once it is no longer used.
+func (p *Parser) Parse(line []byte) (*sam.Record, error) {
+	rec := sam.GetFromFreePool()
+	if err := p.ParseInto(line, rec); err != nil {
+		sam.PutInFreePool(rec)
+		return nil, err
+	}
+	return rec, nil
+}
+
+// ParseInto parses one SAM line into "rec". All the fields of "rec" are
+// overwritten. The name, cigar, sequence, qualities and aux fields of the
+// result are stored in rec.Scratch, so they become invalid when "rec" is
+// reused.
+func (p *Parser) ParseInto(line []byte, rec *sam.Record) error {
+	var f [nMandatoryFields][]byte
+	rest := line
+	for i := range f {
+		j := bytes.IndexByte(rest, '\t')
+		if j < 0 {
+			if i != nMandatoryFields-1 {
+				return errMissingFields
+			}
+			f[i], rest = rest, nil
+			break
+		}
+		f[i], rest = rest[:j], rest[j+1:]
+	}
+
+	var err error
+	if rec.Ref, err = p.ref(f[2]); err != nil {
+		return fmt.Errorf("sam: failed to assign reference: %v", err)
+	}
+	if bytes.Equal(f[6], []byte{'='}) || bytes.Equal(f[2], f[6]) {
+		rec.MateRef = rec.Ref
+	} else if rec.MateRef, err = p.ref(f[6]); err != nil {
+		return fmt.Errorf("sam: failed to assign mate reference: %v", err)
+	}
+	flags, err := parseUint(f[1], math.MaxUint16)
+	if err != nil {
+		return fmt.Errorf("sam: failed to parse flags: %v", err)
+	}
+	rec.Flags = sam.Flags(flags)
+	if rec.Pos, err = parseInt(f[3]); err != nil {
+		return fmt.Errorf("sam: failed to parse position: %v", err)
+	}
+	rec.Pos--
+	mapQ, err := parseUint(f[4], math.MaxUint8)
+	if err != nil {
+		return fmt.Errorf("sam: failed to parse map quality: %v", err)
+	}
+	rec.MapQ = byte(mapQ)
+	if rec.MatePos, err = parseInt(f[7]); err != nil {
+		return fmt.Errorf("sam: failed to parse mate position: %v", err)
+	}
+	rec.MatePos--
+	if rec.TempLen, err = parseInt(f[8]); err != nil {
+		return fmt.Errorf("sam: failed to parse template length: %v", err)
+	}
+
+	// Compute the layout of rec.Scratch.
+	name := f[0]
+	cigarText := f[5]
+	if len(cigarText) == 1 && cigarText[0] == '*' {
+		cigarText = nil
+	}
+	nCigar := 0
+	for _, c := range cigarText {
+		if c < '0' || c > '9' {
+			nCigar++
+		}
+	}
+	seqText := f[9]
+	if len(seqText) == 1 && seqText[0] == '*' {
+		seqText = nil
+	}
+	qualText := f[10]
+	if len(qualText) == 1 && qualText[0] == '*' {
+		qualText = nil
+	}
+	if len(qualText) != 0 && len(qualText) != len(seqText) {
+		return errSeqQualLength
+	}
+	nAux := 0
+	if len(rest) > 0 {
+		nAux = bytes.Count(rest, []byte{'\t'}) + 1
+	}
+
+	cigarOff := alignOffset(len(name))
+	seqOff := cigarOff + nCigar*gbam.CigarOpSize
+	qualOff := seqOff + (len(seqText)+1)/2
+	auxOff := qualOff + len(seqText)
+	// Binary aux fields are at most 8 + 2*(length of the text) bytes long.
+	auxHdrOff := alignOffset(auxOff + 8*nAux + 2*len(rest))
+	sam.ResizeScratch(&rec.Scratch, auxHdrOff+nAux*sizeofSliceHeader)
+	buf := rec.Scratch
+
+	rec.Name = ""
+	if len(name) > 0 {
+		copy(buf, name)
+		nameHdr := (*reflect.StringHeader)(unsafe.Pointer(&rec.Name))
+		nameHdr.Data = uintptr(unsafe.Pointer(&buf[0]))
+		nameHdr.Len = len(name)
+	}
+
+	rec.Cigar = nil
+	if nCigar > 0 {
+		rec.Cigar = gbam.UnsafeBytesToCigar(buf[cigarOff:seqOff:seqOff])
+		if err := parseCigar(cigarText, rec.Cigar); err != nil {
+			return err
+		}
+	}
+
+	rec.Seq = sam.Seq{Length: len(seqText)}
+	rec.Qual = nil
+	if len(seqText) > 0 {
+		doublets := buf[seqOff:qualOff:qualOff]
+		for i := 0; i < len(seqText); i += 2 {
+			d := seqTable[seqText[i]] << 4
+			if i+1 < len(seqText) {
+				d |= seqTable[seqText[i+1]]
+			}
+			doublets[i/2] = byte(d)
+		}
+		rec.Seq.Seq = gbam.UnsafeBytesToDoublets(doublets)
+		if len(rec.Cigar) > 0 && !rec.Cigar.IsValid(rec.Seq.Length) {
+			return errSeqCigarLength
+		}
+		rec.Qual = buf[qualOff:auxOff:auxOff]
+		if qualText == nil {
+			for i := range rec.Qual {
+				rec.Qual[i] = 0xff
+			}
+		} else {
+			for i, q := range qualText {
+				rec.Qual[i] = q - 33
+			}
+		}
+	} else if len(qualText) > 0 {
+		return errSeqQualLength
+	}
+
+	rec.AuxFields = nil
+	if nAux > 0 {
+		for i := auxHdrOff; i < len(buf); i++ {
+			buf[i] = 0 // Clear the memory that will store pointers.
+		}
+		auxHdr := (*reflect.SliceHeader)(unsafe.Pointer(&rec.AuxFields))
+		auxHdr.Data = uintptr(unsafe.Pointer(&buf[auxHdrOff]))
+		auxHdr.Len = nAux
+		auxHdr.Cap = nAux
+		off := auxOff
+		for i := 0; i < nAux; i++ {
+			text := rest
+			if j := bytes.IndexByte(rest, '\t'); j >= 0 {
+				text, rest = rest[:j], rest[j+1:]
+			}
+			n, err := parseAux(text, buf[off:auxHdrOff])
+			if err != nil {
+				rec.AuxFields = nil
+				return err
+			}
+			rec.AuxFields[i] = sam.Aux(buf[off : off+n : off+n])
+			off += n
+		}
+	}
+	return nil
+}
+
+// alignOffset rounds "off" up to a multiple of 8, so that a pointer or an
+// integer can be stored at the offset.
+func alignOffset(off int) int {
+	const align = 8
+	return (off + align - 1) / align * align
+}
+
+// parseInt parses a decimal integer without allocating memory.
+func parseInt(b []byte) (int, error) {
+	neg := false
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		neg = b[0] == '-'
+		b = b[1:]
+	}
+	v, err := parseUint(b, math.MaxInt64)
+	if err != nil {
+		return 0, err
+	}
+	if neg {
+		return -int(v), nil
+	}
+	return int(v), nil
+}
+
+// parseUint parses an unsigned integer that is at most max. It is fast for
+// decimal numbers, but it also accepts the prefixes recognized by
+// strconv.ParseUint with base 0.
+func parseUint(b []byte, max uint64) (uint64, error) {
+	if len(b) == 0 {
+		return 0, errors.New("empty number")
+	}
+	if len(b) > 2 && b[0] == '0' && (b[1] == 'x' || b[1] == 'X') {
+		v, err := strconv.ParseUint(string(b), 0, 64)
+		if err == nil && v > max {
+			err = fmt.Errorf("number %q out of range", b)
+		}
+		return v, err
+	}
+	var v uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid number %q", b)
+		}
+		d := uint64(c - '0')
+		if v > (max-d)/10 {
+			return 0, fmt.Errorf("number %q out of range", b)
+		}
+		v = v*10 + d
+	}
+	return v, nil
+}
+
+// parseCigar parses text into cigar, which must have exactly as many ops as
+// the text.
+func parseCigar(text []byte, cigar sam.Cigar) error {
+	n, nDigits, op := 0, 0, 0
+	for _, c := range text {
+		if c >= '0' && c <= '9' {
+			n = n*10 + int(c-'0')
+			nDigits++
+			if n > math.MaxInt32>>4 {
+				return fmt.Errorf("sam: cigar op too long in %q", text)
+			}
+			continue
+		}
+		t := cigarTable[c]
+		if t == 0 || nDigits == 0 {
+			return fmt.Errorf("sam: failed to parse cigar string %q", text)
+		}
+		cigar[op] = sam.NewCigarOp(sam.CigarOpType(t-1), n)
+		op++
+		n, nDigits = 0, 0
+	}
+	if nDigits != 0 {
+		return fmt.Errorf("sam: failed to parse cigar string %q", text)
+	}
+	return nil
+}
+
+// parseAux encodes an aux field in text form, "TG:T:value", into its binary
+// form in dst. It returns the length of the binary form.
+func parseAux(text []byte, dst []byte) (int, error) {
+	if len(text) < 5 || text[2] != ':' || text[4] != ':' {
+		return 0, fmt.Errorf("sam: invalid aux tag field: %q", text)
+	}
+	dst[0], dst[1] = text[0], text[1]
+	val := text[5:]
+	switch typ := text[3]; typ {
+	case 'A':
+		if len(val) != 1 {
+			return 0, fmt.Errorf("sam: invalid aux tag field: %q", text)
+		}
+		dst[2], dst[3] = 'A', val[0]
+		return 4, nil
+	case 'i':
+		v, err := parseInt(val)
+		if err != nil {
+			return 0, fmt.Errorf("sam: invalid aux tag field: %v", err)
+		}
+		return putAuxInt(dst, v, text)
+	case 'f':
+		v, err := strconv.ParseFloat(string(val), 32)
+		if err != nil {
+			return 0, fmt.Errorf("sam: invalid aux tag field: %v", err)
+		}
+		dst[2] = 'f'
+		binary.LittleEndian.PutUint32(dst[3:], math.Float32bits(float32(v)))
+		return 7, nil
+	case 'Z':
+		dst[2] = 'Z'
+		return 3 + copy(dst[3:], val), nil
+	case 'H':
+		dst[2] = 'H'
+		n, err := hex.Decode(dst[3:], val)
+		if err != nil {
+			return 0, fmt.Errorf("sam: invalid aux tag field: %v", err)
+		}
+		return 3 + n, nil
+	case 'B':
+		return parseAuxArray(text, dst)
+	}
+	return 0, fmt.Errorf("sam: invalid aux tag field: %q", text)
+}
+
+// putAuxInt stores an 'i' aux value using the smallest integer type, like
+// sam.NewAux does.
+func putAuxInt(dst []byte, v int, text []byte) (int, error) {
+	switch {
+	case v < math.MinInt32 || v > math.MaxUint32:
+		return 0, fmt.Errorf("sam: invalid aux tag field: %q: out of range", text)
+	case v < 0 && v >= math.MinInt8:
+		dst[2], dst[3] = 'c', byte(v)
+		return 4, nil
+	case v < 0 && v >= math.MinInt16:
+		dst[2] = 's'
+		binary.LittleEndian.PutUint16(dst[3:], uint16(v))
+		return 5, nil
+	case v < 0:
+		dst[2] = 'i'
+		binary.LittleEndian.PutUint32(dst[3:], uint32(v))
+		return 7, nil
+	case v <= math.MaxUint8:
+		dst[2], dst[3] = 'C', byte(v)
+		return 4, nil
+	case v <= math.MaxUint16:
+		dst[2] = 'S'
+		binary.LittleEndian.PutUint16(dst[3:], uint16(v))
+		return 5, nil
+	default:
+		dst[2] = 'I'
+		binary.LittleEndian.PutUint32(dst[3:], uint32(v))
+		return 7, nil
+	}
+}
+
+// auxElemSize is the size of an element of a 'B' aux array, keyed by the
+// element type.
+var auxElemSize = [256]int{'c': 1, 'C': 1, 's': 2, 'S': 2, 'i': 4, 'I': 4, 'f': 4}
+
+func parseAuxArray(text []byte, dst []byte) (int, error) {
+	val := text[5:]
+	if len(val) < 2 || val[1] != ',' || auxElemSize[val[0]] == 0 {
+		return 0, fmt.Errorf("sam: invalid aux tag field: %q", text)
+	}
+	elemType := val[0]
+	size := auxElemSize[elemType]
+	dst[2], dst[3] = 'B', elemType
+	n := 0
+	off := 8
+	for elems := val[2:]; elems != nil; n++ {
+		elem := elems
+		if j := bytes.IndexByte(elems, ','); j >= 0 {
+			elem, elems = elems[:j], elems[j+1:]
+		} else {
+			elems = nil
+		}
+		var bits uint64
+		switch elemType {
+		case 'f':
+			v, err := strconv.ParseFloat(string(elem), 32)
+			if err != nil {
+				return 0, fmt.Errorf("sam: invalid aux tag field: %v", err)
+			}
+			bits = uint64(math.Float32bits(float32(v)))
+		case 'c', 's', 'i':
+			v, err := parseInt(elem)
+			if err != nil || v < -1<<uint(8*size-1) || v >= 1<<uint(8*size-1) {
+				return 0, fmt.Errorf("sam: invalid aux tag field: %q", text)
+			}
+			bits = uint64(v)
+		default:
+			v, err := parseUint(elem, 1<<uint(8*size)-1)
+			if err != nil {
+				return 0, fmt.Errorf("sam: invalid aux tag field: %q", text)
+			}
+			bits = v
+		}
+		switch size {
+		case 1:
+			dst[off] = byte(bits)
+		case 2:
+			binary.LittleEndian.PutUint16(dst[off:], uint16(bits))
+		default:
+			binary.LittleEndian.PutUint32(dst[off:], uint32(bits))
+		}
+		off += size
+	}
+	binary.LittleEndian.PutUint32(dst[4:], uint32(n))
+	return off, nil
+}
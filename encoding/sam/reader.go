@@ -0,0 +1,269 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sam
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/grailbio/base/syncqueue"
+	"github.com/grailbio/hts/sam"
+)
+
+// DefaultChunkBytes is the default value of ReaderOpts.ChunkBytes.
+const DefaultChunkBytes = 1 << 20
+
+// ReaderOpts defines the options for NewReader.
+type ReaderOpts struct {
+	// Parallelism is the number of goroutines that parse records. If <= 0,
+	// runtime.NumCPU() is used.
+	Parallelism int
+	// ChunkBytes is the approximate number of bytes of SAM text that are parsed
+	// as a unit. If <= 0, DefaultChunkBytes is used.
+	ChunkBytes int
+}
+
+var errReaderClosed = errors.New("sam: reader closed")
+
+// chunk is a sequence of complete SAM lines.
+type chunk struct {
+	seq  int
+	data []byte
+	// err is the error that occurred while reading past the end of the chunk.
+	err error
+}
+
+// batch is the result of parsing a chunk.
+type batch struct {
+	recs []*sam.Record
+	// nLines is the number of lines in the chunk, including those after an
+	// error.
+	nLines int
+	// err is the parse error, if any. errLine is the index of the failed line
+	// within the chunk.
+	err     error
+	errLine int
+}
+
+// Reader reads SAM records in parallel. Read returns records in the input
+// order. Reader is thread compatible.
+type Reader struct {
+	parser *Parser
+	in     *bufio.Reader
+	opts   ReaderOpts
+	// nHeaderLines is the number of header lines.
+	nHeaderLines int
+
+	queue     *syncqueue.OrderedQueue
+	chunkPool sync.Pool
+	done      chan struct{}
+
+	cur    *batch
+	curIdx int
+	// line is the number of lines before the current batch.
+	line int
+	err  error
+}
+
+// NewReader creates a reader that reads from "in". It reads the header
+// immediately.
+func NewReader(in io.Reader, optList ...ReaderOpts) (*Reader, error) {
+	var opts ReaderOpts
+	for _, o := range optList {
+		if o.Parallelism > 0 {
+			opts.Parallelism = o.Parallelism
+		}
+		if o.ChunkBytes > 0 {
+			opts.ChunkBytes = o.ChunkBytes
+		}
+	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = runtime.NumCPU()
+	}
+	if opts.ChunkBytes <= 0 {
+		opts.ChunkBytes = DefaultChunkBytes
+	}
+	r := &Reader{
+		in:    bufio.NewReaderSize(in, 1<<16),
+		opts:  opts,
+		queue: syncqueue.NewOrderedQueue(opts.Parallelism * 2),
+		done:  make(chan struct{}),
+	}
+	r.chunkPool.New = func() interface{} { return make([]byte, 0, opts.ChunkBytes+4096) }
+
+	var text []byte
+	for {
+		c, err := r.in.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c[0] != '@' {
+			break
+		}
+		line, err := r.in.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		text = append(text, line...)
+		r.nHeaderLines++
+	}
+	header, err := sam.NewHeader(text, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.parser = NewParser(header)
+
+	chunkCh := make(chan chunk, opts.Parallelism)
+	go r.readChunks(chunkCh)
+	wg := sync.WaitGroup{}
+	for i := 0; i < opts.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunkCh {
+				b := r.parseChunk(c.data)
+				if b.err == nil && c.err != nil {
+					b.err, b.errLine = c.err, b.nLines
+				}
+				r.chunkPool.Put(c.data[:0])
+				if err := r.queue.Insert(c.seq, b); err != nil {
+					// The reader is closed. Keep draining chunkCh so that readChunks
+					// finishes.
+					continue
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		r.queue.Close(nil) // nolint: errcheck
+	}()
+	return r, nil
+}
+
+// readChunks splits the input into chunks at line boundaries, and sends them
+// to chunkCh.
+func (r *Reader) readChunks(chunkCh chan<- chunk) {
+	defer close(chunkCh)
+	for seq := 0; ; seq++ {
+		data := r.chunkPool.Get().([]byte)
+		data = data[:cap(data)][:r.opts.ChunkBytes]
+		n, err := io.ReadFull(r.in, data)
+		data = data[:n]
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err == nil && data[n-1] != '\n' {
+			// Extend the chunk to the end of the line.
+			for {
+				var line []byte
+				line, err = r.in.ReadSlice('\n')
+				data = append(data, line...)
+				if err != bufio.ErrBufferFull {
+					break
+				}
+			}
+		}
+		c := chunk{seq: seq, data: data}
+		if err != nil && err != io.EOF {
+			c.err = err
+		}
+		if len(c.data) > 0 || c.err != nil {
+			select {
+			case chunkCh <- c:
+			case <-r.done:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// parseChunk parses the lines in "data".
+func (r *Reader) parseChunk(data []byte) *batch {
+	b := &batch{}
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		b.nLines++
+		if b.err != nil {
+			continue
+		}
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		if len(line) == 0 {
+			continue
+		}
+		rec, err := r.parser.Parse(line)
+		if err != nil {
+			b.err, b.errLine = err, b.nLines-1
+			continue
+		}
+		b.recs = append(b.recs, rec)
+	}
+	return b
+}
+
+// Header returns the SAM header.
+func (r *Reader) Header() *sam.Header {
+	return r.parser.Header()
+}
+
+// Read returns the next record. It returns io.EOF after the last record. The
+// record is obtained from sam.GetFromFreePool, and the caller owns it.
+func (r *Reader) Read() (*sam.Record, error) {
+	for r.err == nil && (r.cur == nil || r.curIdx >= len(r.cur.recs)) {
+		if r.cur != nil {
+			if r.cur.err != nil {
+				r.err = fmt.Errorf("sam: line %d: %v", r.nHeaderLines+r.line+r.cur.errLine+1, r.cur.err)
+				break
+			}
+			r.line += r.cur.nLines
+		}
+		v, ok, err := r.queue.Next()
+		if err != nil {
+			r.err = err
+			break
+		}
+		if !ok {
+			r.err = io.EOF
+			break
+		}
+		r.cur, r.curIdx = v.(*batch), 0
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	rec := r.cur.recs[r.curIdx]
+	r.cur.recs[r.curIdx] = nil
+	r.curIdx++
+	return rec, nil
+}
+
+// Close releases the resources used by the reader. It does not close the
+// underlying io.Reader. It returns the error encountered by Read, if any.
+func (r *Reader) Close() error {
+	close(r.done)
+	r.queue.Close(errReaderClosed) // nolint: errcheck
+	if r.err == io.EOF || r.err == errReaderClosed {
+		return nil
+	}
+	return r.err
+}
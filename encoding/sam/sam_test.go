@@ -0,0 +1,200 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sam_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	gsam "github.com/grailbio/bio/encoding/sam"
+	"github.com/grailbio/hts/sam"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+const testHeader = "@HD\tVN:1.3\tSO:coordinate\n" +
+	"@SQ\tSN:chr1\tLN:10000\n" +
+	"@SQ\tSN:chr2\tLN:20000\n"
+
+var testLines = []string{
+	"r0\t99\tchr1\t100\t60\t4M\t=\t200\t104\tACGT\tABCD",
+	"r1\t147\tchr1\t200\t30\t2S3M1I2D2M\tchr2\t100\t-5\tACGTNNAC\t#####:::",
+	"r3\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*",
+	"r4\t0\tchr2\t1\t255\t3M\t*\t0\t0\tacg\t!!!\tXA:A:x\tXB:i:-1\tXC:i:200\tXD:i:-200\tXE:i:70000\tXF:i:-70000\tXG:i:4000000000",
+	"r5\t16\tchr2\t10\t0\t2M\t*\t0\t0\tGG\tII\tXH:f:1.5\tXI:Z:hello world\tXJ:H:1AE301\tXK:B:c,-1,2\tXL:B:S,1,65535\tXM:B:f,0.5,-2",
+	"r6\t1024\tchr2\t19999\t10\t1M1N1M\t=\t19999\t0\tTT\t*\tRG:Z:foo",
+}
+
+func newTestHeader(t *testing.T) *sam.Header {
+	header, err := sam.NewHeader([]byte(testHeader), nil)
+	assert.NoError(t, err)
+	return header
+}
+
+func TestParseAndFormat(t *testing.T) {
+	header := newTestHeader(t)
+	p := gsam.NewParser(header)
+	for _, line := range testLines {
+		expected := &sam.Record{}
+		assert.NoError(t, expected.UnmarshalSAM(header, []byte(line)), "line: %s", line)
+		expectedText, err := expected.MarshalText()
+		assert.NoError(t, err)
+
+		rec, err := p.Parse([]byte(line))
+		assert.NoError(t, err, "line: %s", line)
+		text, err := gsam.AppendRecord(nil, rec)
+		assert.NoError(t, err)
+		expect.EQ(t, string(text), string(expectedText))
+		expect.EQ(t, rec.String(), expected.String())
+
+		text, err = gsam.AppendRecord(nil, expected)
+		assert.NoError(t, err)
+		expect.EQ(t, string(text), string(expectedText))
+		sam.PutInFreePool(rec)
+	}
+}
+
+func TestParseUnmappedWithSeq(t *testing.T) {
+	// sam.Record.UnmarshalSAM rejects a sequence without a cigar, but aligners
+	// emit such lines for unmapped reads.
+	p := gsam.NewParser(newTestHeader(t))
+	line := "r2\t4\t*\t0\t0\t*\t*\t0\t0\tACGTRYKM\t*"
+	rec, err := p.Parse([]byte(line))
+	assert.NoError(t, err)
+	expect.EQ(t, rec.Seq.Expand(), []byte("ACGTRYKM"))
+	expect.EQ(t, rec.Ref, (*sam.Reference)(nil))
+	text, err := gsam.AppendRecord(nil, rec)
+	assert.NoError(t, err)
+	expect.EQ(t, string(text), line)
+}
+
+func TestParseReuse(t *testing.T) {
+	header := newTestHeader(t)
+	p := gsam.NewParser(header)
+	rec := &sam.Record{}
+	for i := 0; i < 3; i++ {
+		for _, line := range testLines {
+			expected := &sam.Record{}
+			assert.NoError(t, expected.UnmarshalSAM(header, []byte(line)))
+			assert.NoError(t, p.ParseInto([]byte(line), rec))
+			expect.EQ(t, rec.String(), expected.String())
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	p := gsam.NewParser(newTestHeader(t))
+	for _, test := range []struct {
+		line string
+		re   string
+	}{
+		{"r0\t0\tchr1\t1\t0\t1M", "missing SAM fields"},
+		{"r0\t0\tchr3\t1\t0\t1M\t*\t0\t0\tA\t*", "failed to assign reference"},
+		{"r0\tx\tchr1\t1\t0\t1M\t*\t0\t0\tA\t*", "failed to parse flags"},
+		{"r0\t0\tchr1\t1\t300\t1M\t*\t0\t0\tA\t*", "failed to parse map quality"},
+		{"r0\t0\tchr1\t1\t0\t1Q\t*\t0\t0\tA\t*", "failed to parse cigar"},
+		{"r0\t0\tchr1\t1\t0\t2M\t*\t0\t0\tA\t*", "sequence/CIGAR length mismatch"},
+		{"r0\t0\tchr1\t1\t0\t1M\t*\t0\t0\tA\tII", "sequence/quality length mismatch"},
+		{"r0\t0\tchr1\t1\t0\t1M\t*\t0\t0\tA\t*\tXA:Q:1", "invalid aux tag field"},
+		{"r0\t0\tchr1\t1\t0\t1M\t*\t0\t0\tA\t*\tXA:i:x", "invalid aux tag field"},
+		{"r0\t0\tchr1\t1\t0\t1M\t*\t0\t0\tA\t*\tXA:B:c,128", "invalid aux tag field"},
+	} {
+		_, err := p.Parse([]byte(test.line))
+		expect.Regexp(t, err, test.re, "line: %s", test.line)
+	}
+}
+
+// generateSAM generates a SAM file with n records.
+func generateSAM(n int) string {
+	buf := bytes.Buffer{}
+	buf.WriteString(testHeader)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "read%d\t0\tchr1\t%d\t60\t4M\t*\t0\t0\tACGT\tABCD\tNM:i:%d\n", i, i+1, i)
+	}
+	return buf.String()
+}
+
+func TestReader(t *testing.T) {
+	const n = 1000
+	for _, opts := range []gsam.ReaderOpts{
+		{},
+		{Parallelism: 1, ChunkBytes: 1},
+		{Parallelism: 4, ChunkBytes: 100},
+		{Parallelism: 16, ChunkBytes: 1000},
+	} {
+		r, err := gsam.NewReader(strings.NewReader(generateSAM(n)), opts)
+		assert.NoError(t, err)
+		assert.EQ(t, len(r.Header().Refs()), 2)
+		for i := 0; i < n; i++ {
+			rec, err := r.Read()
+			assert.NoError(t, err, "opts: %+v", opts)
+			assert.EQ(t, rec.Name, fmt.Sprintf("read%d", i), "opts: %+v", opts)
+			assert.EQ(t, rec.Pos, i)
+			sam.PutInFreePool(rec)
+		}
+		_, err = r.Read()
+		assert.EQ(t, err, io.EOF)
+		assert.NoError(t, r.Close())
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	text := generateSAM(100)
+	// Break the 51st record, which is on line 54 of the file.
+	text = strings.Replace(text, "read50\t0\tchr1", "read50\t0\tchr9", 1)
+	r, err := gsam.NewReader(strings.NewReader(text), gsam.ReaderOpts{Parallelism: 3, ChunkBytes: 200})
+	assert.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		_, err := r.Read()
+		assert.NoError(t, err)
+	}
+	_, err = r.Read()
+	expect.Regexp(t, err, "^sam: line 54: ")
+	expect.Regexp(t, r.Close(), "^sam: line 54: ")
+}
+
+func TestReaderEarlyClose(t *testing.T) {
+	r, err := gsam.NewReader(strings.NewReader(generateSAM(10000)), gsam.ReaderOpts{Parallelism: 2, ChunkBytes: 100})
+	assert.NoError(t, err)
+	_, err = r.Read()
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+}
+
+func TestWriter(t *testing.T) {
+	header := newTestHeader(t)
+	r, err := gsam.NewReader(strings.NewReader(testHeader + strings.Join(testLines, "\n") + "\n"))
+	assert.NoError(t, err)
+	out := bytes.Buffer{}
+	w, err := gsam.NewWriter(&out, header)
+	assert.NoError(t, err)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		assert.NoError(t, w.Write(rec))
+	}
+	assert.NoError(t, r.Close())
+	assert.NoError(t, w.Close())
+
+	expected := bytes.Buffer{}
+	headerText, err := header.MarshalText()
+	assert.NoError(t, err)
+	expected.Write(headerText)
+	for _, line := range testLines {
+		rec := &sam.Record{}
+		assert.NoError(t, rec.UnmarshalSAM(header, []byte(line)))
+		text, err := rec.MarshalText()
+		assert.NoError(t, err)
+		expected.Write(text)
+		expected.WriteByte('\n')
+	}
+	expect.EQ(t, out.String(), expected.String())
+}
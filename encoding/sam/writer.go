@@ -0,0 +1,55 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package sam
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/grailbio/hts/sam"
+)
+
+// Writer writes SAM records. Writer is thread compatible.
+type Writer struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+// NewWriter creates a writer that writes to "w". It writes the header
+// immediately. The caller must call Flush (or Close) after writing the last
+// record.
+func NewWriter(w io.Writer, header *sam.Header) (*Writer, error) {
+	sw := &Writer{w: bufio.NewWriterSize(w, 1<<16)}
+	text, err := header.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sw.w.Write(text); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// Write writes one record.
+func (w *Writer) Write(rec *sam.Record) error {
+	var err error
+	if w.buf, err = AppendRecord(w.buf[:0], rec); err != nil {
+		return err
+	}
+	w.buf = append(w.buf, '\n')
+	_, err = w.w.Write(w.buf)
+	return err
+}
+
+// Flush writes any buffered data to the underlying io.Writer.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Close flushes the buffered data. It does not close the underlying
+// io.Writer.
+func (w *Writer) Close() error {
+	return w.w.Flush()
+}
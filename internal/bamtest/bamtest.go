@@ -0,0 +1,82 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package bamtest provides helpers for the tests that write records to BAM and
+// PAM files and read them back.
+package bamtest
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/grailbio/bio/encoding/pam"
+	"github.com/grailbio/hts/bam"
+	"github.com/grailbio/hts/sam"
+	"github.com/stretchr/testify/require"
+)
+
+// NewRecord creates a record with the given fields. The sequence consists of
+// 'A's, as many as the query length of the cigar, or 10 if the cigar is
+// empty. The quality scores are all zeros. The template length is zero.
+func NewRecord(t testing.TB, name string, ref *sam.Reference, pos int, flags sam.Flags,
+	mateRef *sam.Reference, matePos int, cigar string) *sam.Record {
+	var (
+		c   sam.Cigar
+		err error
+	)
+	if cigar != "" {
+		c, err = sam.ParseCigar([]byte(cigar))
+		require.NoError(t, err)
+	}
+	_, n := c.Lengths()
+	if n == 0 {
+		n = 10
+	}
+	seq := bytes.Repeat([]byte{'A'}, n)
+	r, err := sam.NewRecord(name, ref, mateRef, pos, matePos, 0, 60, c, seq, make([]byte, n), nil)
+	require.NoError(t, err)
+	r.Flags = flags
+	return r
+}
+
+// WritePAM writes the records to a PAM file.
+func WritePAM(t testing.TB, path string, header *sam.Header, recs []*sam.Record) {
+	w := pam.NewWriter(pam.WriteOpts{}, header, path)
+	for _, r := range recs {
+		w.Write(r)
+	}
+	require.NoError(t, w.Close())
+}
+
+// ReadBAM reads all the records in a BAM file.
+func ReadBAM(t testing.TB, path string) []*sam.Record {
+	in, err := os.Open(path)
+	require.NoError(t, err)
+	defer in.Close() // nolint: errcheck
+	r, err := bam.NewReader(in, 1)
+	require.NoError(t, err)
+	var recs []*sam.Record
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// ReadPAM reads all the records in a PAM file.
+func ReadPAM(t testing.TB, path string) []*sam.Record {
+	r := pam.NewReader(pam.ReadOpts{}, path)
+	var recs []*sam.Record
+	for r.Scan() {
+		recs = append(recs, r.Record())
+	}
+	require.NoError(t, r.Close())
+	return recs
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package diskfile provides temporary files that store sequences of
+// variable-length entries. They are used to bound the memory usage of
+// algorithms that match records by read name across a whole file.
+package diskfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// File is a temporary file that stores a sequence of variable-length entries,
+// compressed with snappy. Entries can be added concurrently. They are read back
+// after Close.
+type File struct {
+	path   string
+	mu     sync.Mutex
+	f      *os.File
+	w      *snappy.Writer
+	lenBuf [binary.MaxVarintLen64]byte
+}
+
+// New creates a file at the given path.
+func New(path string) (*File, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: path, f: f, w: snappy.NewBufferedWriter(f)}, nil
+}
+
+// Add appends an entry to the file. It is thread safe.
+func (d *File) Add(e *Encoder) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := binary.PutUvarint(d.lenBuf[:], uint64(len(e.buf)))
+	if _, err := d.w.Write(d.lenBuf[:n]); err != nil {
+		return fmt.Errorf("write %s: %v", d.path, err)
+	}
+	if _, err := d.w.Write(e.buf); err != nil {
+		return fmt.Errorf("write %s: %v", d.path, err)
+	}
+	return nil
+}
+
+// Close finishes writing the file. It can be called multiple times.
+func (d *File) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	err := d.w.Close()
+	if e := d.f.Close(); e != nil && err == nil {
+		err = e
+	}
+	d.f, d.w = nil, nil
+	return err
+}
+
+// Read calls cb for every entry in the file, in the order they were added. It
+// must be called after Close.
+func (d *File) Read(cb func(dec *Decoder) error) error {
+	f, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	r := bufio.NewReader(snappy.NewReader(f))
+	var buf []byte
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %v", d.path, err)
+		}
+		if cap(buf) < int(n) {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("read %s: %v", d.path, err)
+		}
+		dec := Decoder{buf: buf}
+		if err := cb(&dec); err != nil {
+			return err
+		}
+		if dec.err != nil {
+			return fmt.Errorf("read %s: %v", d.path, dec.err)
+		}
+	}
+}
+
+// Encoder builds an entry of a File.
+type Encoder struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+// Reset clears the entry.
+func (e *Encoder) Reset() { e.buf = e.buf[:0] }
+
+// PutInt appends an int to the entry.
+func (e *Encoder) PutInt(v int) {
+	n := binary.PutVarint(e.tmp[:], int64(v))
+	e.buf = append(e.buf, e.tmp[:n]...)
+}
+
+// PutString appends a string to the entry.
+func (e *Encoder) PutString(s string) {
+	e.PutInt(len(s))
+	e.buf = append(e.buf, s...)
+}
+
+// Decoder reads the values stored by an Encoder, in the same order. On error, it
+// sets err and returns zero values.
+type Decoder struct {
+	buf []byte
+	err error
+}
+
+// Int reads an int.
+func (d *Decoder) Int() int {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		if d.err == nil {
+			d.err = fmt.Errorf("corrupt entry")
+		}
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return int(v)
+}
+
+// String reads a string.
+func (d *Decoder) String() string {
+	n := d.Int()
+	if n < 0 || n > len(d.buf) {
+		if d.err == nil {
+			d.err = fmt.Errorf("corrupt entry")
+		}
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
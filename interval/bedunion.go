@@ -358,6 +358,13 @@ func (u *BEDUnion) RefByID(refID int) []PosType {
 	return u.idMap[refID]
 }
 
+// RefByName is the same as RefByID, but the reference is specified by name.
+// It returns nil if the reference is not mentioned in the BEDUnion.  Unlike
+// RefByID, it works even when the BEDUnion was created without a SAMHeader.
+func (u *BEDUnion) RefByName(refName string) []PosType {
+	return u.nameMap[refName]
+}
+
 func initBEDUnion() (bedUnion BEDUnion) {
 	bedUnion.nameMap = make(map[string]([]PosType))
 	bedUnion.lastRefName = ""